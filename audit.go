@@ -0,0 +1,156 @@
+package msgbus
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Audit actions
+const (
+	AuditPublish     = "publish"
+	AuditPull        = "pull"
+	AuditSubscribe   = "subscribe"
+	AuditUnsubscribe = "unsubscribe"
+	AuditDelete      = "delete"
+	AuditAuth        = "auth"
+	AuditAdmin       = "admin"
+)
+
+// Audit results
+const (
+	AuditOK       = "ok"
+	AuditEmpty    = "empty"
+	AuditRejected = "rejected"
+	AuditDenied   = "denied"
+	AuditError    = "error"
+)
+
+// AuditEvent records who did what and when on the bus. Payloads are only
+// recorded if the audit log was created with payloads included.
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Result    string    `json:"result"`
+	Identity  string    `json:"identity,omitempty"`
+	Remote    string    `json:"remote,omitempty"`
+	Topic     string    `json:"topic,omitempty"`
+	MessageID *uint64   `json:"message_id,omitempty"`
+	Size      int       `json:"size,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	Payload   []byte    `json:"payload,omitempty"`
+}
+
+// WithMessage returns a copy of the event describing message
+func (e AuditEvent) WithMessage(message Message) AuditEvent {
+	id := message.ID
+	e.Topic = message.Topic.Name
+	e.MessageID = &id
+	e.Size = len(message.Payload)
+	e.Payload = message.Payload
+	return e
+}
+
+// Auditor records audit events
+type Auditor interface {
+	Audit(event AuditEvent)
+}
+
+// AuditLog is an Auditor writing events as JSON lines
+type AuditLog struct {
+	sync.Mutex
+
+	w              io.Writer
+	includePayload bool
+}
+
+// NewAuditLog returns an AuditLog writing to w. Payloads are omitted
+// unless includePayload is true.
+func NewAuditLog(w io.Writer, includePayload bool) *AuditLog {
+	return &AuditLog{w: w, includePayload: includePayload}
+}
+
+// SetOutput replaces the writer events are written to, e.g: to reopen a
+// rotated log file.
+func (l *AuditLog) SetOutput(w io.Writer) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.w = w
+}
+
+// Audit writes event as a single line of JSON
+func (l *AuditLog) Audit(event AuditEvent) {
+	if !l.includePayload {
+		event.Payload = nil
+	}
+
+	out, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("error serializing audit event: %s", err)
+		return
+	}
+	out = append(out, '\n')
+
+	l.Lock()
+	defer l.Unlock()
+
+	if _, err := l.w.Write(out); err != nil {
+		log.Errorf("error writing audit event: %s", err)
+	}
+}
+
+type contextKey int
+
+const (
+	identityKey contextKey = iota
+	remoteAddrKey
+)
+
+// WithIdentity returns a copy of ctx carrying the authenticated identity
+// of the caller.
+func WithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey, identity)
+}
+
+// IdentityFromContext returns the identity carried by ctx, if any
+func IdentityFromContext(ctx context.Context) string {
+	identity, _ := ctx.Value(identityKey).(string)
+	return identity
+}
+
+// WithRemoteAddr returns a copy of ctx carrying the remote address of the
+// caller.
+func WithRemoteAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, remoteAddrKey, addr)
+}
+
+// RemoteAddrFromContext returns the remote address carried by ctx, if any
+func RemoteAddrFromContext(ctx context.Context) string {
+	addr, _ := ctx.Value(remoteAddrKey).(string)
+	return addr
+}
+
+// Audit records event with the auditor of the bus, if any. The time,
+// identity and remote address are filled in from ctx when not set.
+func (mb *MessageBus) Audit(ctx context.Context, event AuditEvent) {
+	if mb.auditor == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Identity == "" {
+		event.Identity = IdentityFromContext(ctx)
+	}
+	if event.Remote == "" {
+		event.Remote = RemoteAddrFromContext(ctx)
+	}
+
+	mb.auditor.Audit(event)
+}
@@ -0,0 +1,94 @@
+package msgbus
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readAuditEvents(t *testing.T, buf *bytes.Buffer) []AuditEvent {
+	var events []AuditEvent
+
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var event AuditEvent
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+
+	return events
+}
+
+func TestAuditLog(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := &bytes.Buffer{}
+	mb := New(&Options{
+		MaxPayloadSize: 16,
+		Auditor:        NewAuditLog(buf, false),
+	})
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("PUT", "/hello", bytes.NewBufferString("hello world"))
+	r.RemoteAddr = "10.0.0.1:1234"
+	r = r.WithContext(WithIdentity(r.Context(), "alice"))
+	mb.ServeHTTP(w, r)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("PUT", "/hello", bytes.NewBufferString("way too large payload"))
+	mb.ServeHTTP(w, r)
+
+	for i := 0; i < 2; i++ {
+		w = httptest.NewRecorder()
+		r, _ = http.NewRequest("GET", "/hello", nil)
+		mb.ServeHTTP(w, r)
+	}
+
+	assert.NotContains(buf.String(), "hello world")
+	assert.NotContains(buf.String(), `"payload"`)
+
+	events := readAuditEvents(t, buf)
+	require.Len(t, events, 4)
+
+	assert.Equal(AuditPublish, events[0].Action)
+	assert.Equal(AuditOK, events[0].Result)
+	assert.Equal("alice", events[0].Identity)
+	assert.Equal("10.0.0.1:1234", events[0].Remote)
+	assert.Equal("hello", events[0].Topic)
+	assert.Equal(uint64(0), *events[0].MessageID)
+	assert.Equal(11, events[0].Size)
+	assert.False(events[0].Time.IsZero())
+
+	assert.Equal(AuditPublish, events[1].Action)
+	assert.Equal(AuditRejected, events[1].Result)
+
+	assert.Equal(AuditPull, events[2].Action)
+	assert.Equal(AuditOK, events[2].Result)
+	assert.Equal(uint64(0), *events[2].MessageID)
+
+	assert.Equal(AuditPull, events[3].Action)
+	assert.Equal(AuditEmpty, events[3].Result)
+	assert.Nil(events[3].MessageID)
+}
+
+func TestAuditLogIncludePayload(t *testing.T) {
+	buf := &bytes.Buffer{}
+	mb := New(&Options{
+		MaxPayloadSize: 16,
+		Auditor:        NewAuditLog(buf, true),
+	})
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("PUT", "/hello", bytes.NewBufferString("hello world"))
+	mb.ServeHTTP(w, r)
+
+	events := readAuditEvents(t, buf)
+	require.Len(t, events, 1)
+	assert.Equal(t, []byte("hello world"), events[0].Payload)
+}
@@ -0,0 +1,230 @@
+package msgbus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const (
+	// BatchPath is the path of batch publishes to several topics, whose
+	// messages each name their topic
+	BatchPath = "/_batch"
+
+	// DefaultMaxBatchLength is the default maximum number of messages of a
+	// batch publish
+	DefaultMaxBatchLength = 1000
+
+	// DefaultMaxBatchSize is the default maximum size of the body of a
+	// batch publish
+	DefaultMaxBatchSize = 4 << 20 // 4MB
+)
+
+// ErrBatchTooLarge is returned when reading a batch with more messages or
+// larger than allowed by MaxBatchLength and MaxBatchSize
+var ErrBatchTooLarge = errors.New("batch too large")
+
+// BatchResult is the result of publishing a message of a batch, Error is
+// the reason the message was rejected if it was not published
+type BatchResult struct {
+	PublishResult
+
+	Error string `json:"error,omitempty"`
+}
+
+// IsBatch returns true if r publishes a batch of messages: to BatchPath,
+// with ?batch=true or with a body of newline delimited JSON
+func IsBatch(r *http.Request) bool {
+	if r.URL.Path == BatchPath {
+		return true
+	}
+
+	if batch, _ := strconv.ParseBool(r.URL.Query().Get("batch")); batch {
+		return true
+	}
+
+	mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediatype == "application/x-ndjson"
+}
+
+// ReadBatch reads a batch of messages to topic, or to the topics named by
+// the messages if topic is empty, from r as a JSON array or as newline
+// delimited JSON. ErrBatchTooLarge is returned if the batch has more
+// messages or is larger than allowed.
+func (mb *MessageBus) ReadBatch(r io.Reader, topic string) ([]Publishing, error) {
+	mb.RLock()
+	maxLength, maxSize := mb.maxBatchLength, mb.maxBatchSize
+	mb.RUnlock()
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading batch: %w", err)
+	}
+	if len(data) > maxSize {
+		return nil, fmt.Errorf("%w: exceeds max-batch-size", ErrBatchTooLarge)
+	}
+
+	var messages []Publishing
+
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("[")) {
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return nil, fmt.Errorf("invalid batch: %w", err)
+		}
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		for len(messages) <= maxLength {
+			var m Publishing
+			if err := dec.Decode(&m); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("invalid batch message %d: %w", len(messages), err)
+			}
+			messages = append(messages, m)
+		}
+	}
+
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("empty batch")
+	}
+	if len(messages) > maxLength {
+		return nil, fmt.Errorf("%w: exceeds max-batch-length of %d messages", ErrBatchTooLarge, maxLength)
+	}
+
+	if topic != "" {
+		for i := range messages {
+			if messages[i].Topic == "" {
+				messages[i].Topic = topic
+			} else if messages[i].Topic != topic {
+				return nil, fmt.Errorf("batch message %d is to topic %s not %s", i, messages[i].Topic, topic)
+			}
+		}
+	}
+
+	return messages, nil
+}
+
+// PutBatch puts a batch of messages on the bus holding the bus lock, so the
+// messages of each topic are assigned contiguous sequences and published
+// in order without messages of other publishes in between. Messages that
+// cannot be published are rejected with the reason in their result, those
+// whose idempotency key was already published are not put again. Trace
+// contexts are propagated as by PutContext.
+func (mb *MessageBus) PutBatch(ctx context.Context, messages []Publishing) []BatchResult {
+	mb.Lock()
+	defer mb.Unlock()
+
+	results := make([]BatchResult, len(messages))
+	for i, m := range messages {
+		if err := mb.validate(m); err != nil {
+			results[i] = BatchResult{PublishResult: PublishResult{Topic: m.Topic}, Error: err.Error()}
+			continue
+		}
+		results[i] = mb.putBatchMessage(ctx, m)
+	}
+	return results
+}
+
+// putBatchMessage puts a valid message of a batch, the caller must hold the
+// bus lock
+func (mb *MessageBus) putBatchMessage(ctx context.Context, m Publishing) BatchResult {
+	_, result, _ := mb.putMessage(ctx, m)
+	return BatchResult{PublishResult: result}
+}
+
+// validate returns the reason m cannot be published, if any, the caller
+// must hold the bus lock
+func (mb *MessageBus) validate(m Publishing) error {
+	limits := mb.limits(m.Topic)
+
+	switch {
+	case m.Topic == "":
+		return fmt.Errorf("topic required")
+	case IsPattern(m.Topic):
+		return fmt.Errorf("cannot publish to pattern %q", m.Topic)
+	case limits.Compacted && m.Key == "":
+		return ErrKeyRequired
+	case len(m.Payload) > limits.MaxPayloadSize:
+		return fmt.Errorf("payload exceeds max-payload-size")
+	}
+
+	return nil
+}
+
+// AuditBatch records the publish of each message of a batch with its result
+func (mb *MessageBus) AuditBatch(ctx context.Context, messages []Publishing, results []BatchResult) {
+	if mb.auditor == nil {
+		return
+	}
+
+	for i, result := range results {
+		event := AuditEvent{
+			Action: AuditPublish, Result: AuditOK, Topic: result.Topic,
+			Size: len(messages[i].Payload),
+		}
+		if result.Error != "" {
+			event.Result = AuditRejected
+			event.Detail = result.Error
+		} else {
+			id := result.ID
+			event.MessageID = &id
+			event.Payload = messages[i].Payload
+			if result.Duplicate {
+				event.Detail = "duplicate"
+			}
+		}
+		mb.Audit(ctx, event)
+	}
+}
+
+// BatchStatus returns the status of the response to a batch that could not
+// be published because of err
+func BatchStatus(err error) int {
+	if errors.Is(err, ErrBatchTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// WriteBatchResults writes results as the JSON response of a batch publish
+// with status 202 Accepted
+func WriteBatchResults(w http.ResponseWriter, results []BatchResult) {
+	out, err := json.Marshal(results)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error serializing results: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(out)
+}
+
+// serveBatch publishes a batch of messages to topic, or to the topics named
+// by the messages if topic is empty
+func (mb *MessageBus) serveBatch(w http.ResponseWriter, r *http.Request, topic string) {
+	ctx := WithRemoteAddr(r.Context(), r.RemoteAddr)
+
+	messages, err := mb.ReadBatch(r.Body, topic)
+	if err != nil {
+		mb.Audit(ctx, AuditEvent{
+			Action: AuditPublish, Result: AuditRejected, Topic: topic, Detail: err.Error(),
+		})
+		http.Error(w, err.Error(), BatchStatus(err))
+		return
+	}
+
+	results := mb.PutBatch(propagator.Extract(ctx, propagation.HeaderCarrier(r.Header)), messages)
+	mb.AuditBatch(ctx, messages, results)
+
+	WriteBatchResults(w, results)
+}
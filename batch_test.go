@@ -0,0 +1,146 @@
+package msgbus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := New(&Options{
+		BufferLength:   DefaultBufferLength,
+		MaxQueueSize:   DefaultMaxQueueSize,
+		MaxPayloadSize: DefaultMaxPayloadSize,
+		MaxBatchLength: 2,
+		MaxBatchSize:   128,
+	})
+
+	messages, err := mb.ReadBatch(strings.NewReader(`[{"payload": "YQ=="}, {"topic": "foo", "payload": "Yg=="}]`), "foo")
+	require.NoError(t, err)
+	assert.Equal([]Publishing{
+		{Topic: "foo", Payload: []byte("a")},
+		{Topic: "foo", Payload: []byte("b")},
+	}, messages)
+
+	messages, err = mb.ReadBatch(strings.NewReader("{\"topic\": \"foo\", \"payload\": \"YQ==\"}\n{\"topic\": \"bar\", \"key\": \"k\"}\n"), "")
+	require.NoError(t, err)
+	assert.Equal([]Publishing{
+		{Topic: "foo", Payload: []byte("a")},
+		{Topic: "bar", Key: "k"},
+	}, messages)
+
+	_, err = mb.ReadBatch(strings.NewReader(`{"topic": "bar"}`), "foo")
+	assert.Error(err)
+
+	_, err = mb.ReadBatch(strings.NewReader(" "), "foo")
+	assert.Error(err)
+
+	_, err = mb.ReadBatch(strings.NewReader("{}\n{}\n{}\n"), "foo")
+	assert.ErrorIs(err, ErrBatchTooLarge)
+
+	_, err = mb.ReadBatch(strings.NewReader(`[{"payload": "`+strings.Repeat("A", 128)+`"}]`), "foo")
+	assert.ErrorIs(err, ErrBatchTooLarge)
+}
+
+func TestPutBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := New(&Options{
+		BufferLength:   DefaultBufferLength,
+		MaxQueueSize:   DefaultMaxQueueSize,
+		MaxPayloadSize: 4,
+		Topics:         map[string]TopicOptions{"state": {Compacted: true}},
+	})
+	mb.Put(mb.NewMessage(mb.NewTopic("foo"), []byte("0")))
+
+	results := mb.PutBatch(context.Background(), []Publishing{
+		{Topic: "foo", Payload: []byte("a"), IdempotencyKey: "x"},
+		{Topic: "bar", Payload: []byte("b")},
+		{Topic: "foo", Payload: []byte("toolarge")},
+		{Topic: "foo/#", Payload: []byte("c")},
+		{Topic: "state", Payload: []byte("d")},
+		{Topic: "foo", Payload: []byte("e")},
+		{Topic: "foo", Payload: []byte("a"), IdempotencyKey: "x"},
+	})
+	require.Len(t, results, 7)
+
+	assert.Equal(uint64(1), results[0].ID)
+	assert.Equal("foo", results[0].Topic)
+	assert.Empty(results[0].Error)
+	assert.Equal(uint64(0), results[1].ID)
+	assert.Equal("bar", results[1].Topic)
+	assert.Equal("payload exceeds max-payload-size", results[2].Error)
+	assert.NotEmpty(results[3].Error)
+	assert.Equal("compacted topics require a key", results[4].Error)
+	assert.Equal(uint64(2), results[5].ID)
+	assert.True(results[6].Duplicate)
+	assert.Equal(uint64(1), results[6].ID)
+
+	topic := mb.NewTopic("foo")
+	for _, expected := range []string{"0", "a", "e"} {
+		message, ok := mb.Get(topic)
+		assert.True(ok)
+		assert.Equal(expected, string(message.Payload))
+	}
+	_, ok := mb.Get(topic)
+	assert.False(ok)
+}
+
+func TestServeHTTPBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := New(nil)
+	ch := mb.Subscribe("a", "bar")
+	defer mb.Unsubscribe("a", "bar")
+
+	batch := func(path, contentType, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		r.Header.Set("Content-Type", contentType)
+		mb.ServeHTTP(w, r)
+		return w
+	}
+
+	w := batch("/foo?batch=true", "application/json", `[{"payload": "YQ=="}, {"payload": "Yg=="}]`)
+	assert.Equal(http.StatusAccepted, w.Code)
+
+	var results []BatchResult
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &results))
+	if assert.Len(results, 2) {
+		assert.Equal(uint64(0), results[0].ID)
+		assert.Equal(uint64(1), results[1].ID)
+	}
+
+	w = batch(BatchPath, "application/x-ndjson", "{\"topic\": \"foo\", \"payload\": \"Yw==\"}\n{\"topic\": \"bar\", \"payload\": \"ZA==\"}\n")
+	assert.Equal(http.StatusAccepted, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &results))
+	if assert.Len(results, 2) {
+		assert.Equal("foo", results[0].Topic)
+		assert.Equal(uint64(2), results[0].ID)
+		assert.Equal("bar", results[1].Topic)
+		assert.Equal(1, results[1].Delivered)
+	}
+	assert.Equal("d", string((<-ch).Payload))
+
+	// A JSON array without ?batch=true is the payload of a single message
+	w = batch("/foo", "application/json", `[1, 2]`)
+	assert.Equal(http.StatusAccepted, w.Code)
+	assert.Equal("3", w.Header().Get(IDHeader))
+
+	assert.Equal(http.StatusBadRequest, batch(BatchPath, "application/json", `[{"topic": "foo"`).Code)
+	assert.Equal(http.StatusRequestEntityTooLarge, batch(BatchPath, "application/json", strings.Repeat(`{"topic": "foo"}`, DefaultMaxBatchLength+1)).Code)
+
+	w = httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", BatchPath, nil)
+	mb.ServeHTTP(w, r)
+	assert.Equal(http.StatusMethodNotAllowed, w.Code)
+}
@@ -0,0 +1,430 @@
+// Package bridge federates a msgbus.MessageBus with remote msgbus servers.
+//
+// Messages of remote topics matching the import patterns of a Remote are
+// republished locally, and local messages of topics matching its export
+// patterns are published to the remote. Imports reconnect with backoff and
+// resume after the last message received of each topic, or partition, from
+// the remote's history, which must be enabled on the remote to not lose
+// the messages published while disconnected. Keys are preserved.
+//
+// Loops are prevented with two message headers: "msgbus-origin" names the
+// node a message was first bridged from and "msgbus-hops" counts the
+// bridges it crossed. Messages are never bridged back to their origin nor
+// beyond MaxHops bridges. The name of a Remote must therefore be the ID of
+// the bridge of the remote server, if it has one.
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jpillora/backoff"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prologic/msgbus"
+	"github.com/prologic/msgbus/client"
+)
+
+const (
+	// DefaultMaxHops is the default number of bridges a message may cross
+	DefaultMaxHops = 8
+
+	// DefaultMinBackoff is the default delay before retrying to export a
+	// message
+	DefaultMinBackoff = time.Second
+
+	// DefaultMaxBackoff is the default maximum delay between retries
+	DefaultMaxBackoff = time.Minute
+
+	// subscriberPrefix prefixes the bus subscriber id of an export
+	subscriberPrefix = "bridge:"
+)
+
+// Message headers
+const (
+	HeaderOrigin = "msgbus-origin"
+	HeaderHops   = "msgbus-hops"
+)
+
+// Directions and results of bridged messages, as reported by metrics
+const (
+	DirectionImport = "import"
+	DirectionExport = "export"
+
+	ResultForwarded = "forwarded"
+	ResultLoop      = "loop"
+	ResultTooLarge  = "too_large"
+	ResultRejected  = "rejected"
+	ResultError     = "error"
+)
+
+var (
+	// ErrClosed is returned when adding remotes to a closed Bridge
+	ErrClosed = errors.New("bridge: closed")
+
+	// ErrExists is returned when adding a remote with the name of another
+	ErrExists = errors.New("bridge: remote already exists")
+)
+
+// Remote is a remote msgbus server
+type Remote struct {
+	// Name identifies the remote, it must be the ID of its bridge
+	Name string
+
+	// URL is the url of the remote's HTTP API
+	URL string
+
+	// Header is sent with every request to the remote, e.g: an
+	// Authorization header
+	Header http.Header
+
+	// Import are the patterns of remote topics republished locally
+	Import []string
+
+	// Export are the patterns of local topics published to the remote
+	Export []string
+}
+
+// Validate returns an error if the remote is invalid
+func (r Remote) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("remote without name")
+	}
+
+	u, err := url.Parse(r.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q of remote %s", r.URL, r.Name)
+	}
+
+	if len(r.Import) == 0 && len(r.Export) == 0 {
+		return fmt.Errorf("remote %s imports and exports nothing", r.Name)
+	}
+	for _, p := range append(append([]string{}, r.Import...), r.Export...) {
+		if p == "" || !msgbus.ValidPattern(p) {
+			return fmt.Errorf("invalid pattern %q of remote %s", p, r.Name)
+		}
+	}
+
+	return nil
+}
+
+// Options ...
+type Options struct {
+	// ID identifies the local node, it is the name remotes must use for it
+	ID string
+
+	// MaxHops is the number of bridges a message may cross
+	MaxHops int
+
+	// MinBackoff and MaxBackoff bound the exponential delay between
+	// attempts to export a message
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// remote is the state of a connected remote
+type remote struct {
+	Remote
+
+	client      *client.Client
+	subscribers []*client.Subscriber
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Bridge bridges a bus with remotes
+type Bridge struct {
+	sync.Mutex
+
+	bus *msgbus.MessageBus
+
+	id         string
+	maxHops    int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	remotes map[string]*remote
+	closed  bool
+}
+
+// New ...
+func New(bus *msgbus.MessageBus, options *Options) *Bridge {
+	b := &Bridge{
+		bus:        bus,
+		maxHops:    DefaultMaxHops,
+		minBackoff: DefaultMinBackoff,
+		maxBackoff: DefaultMaxBackoff,
+		remotes:    make(map[string]*remote),
+	}
+
+	if options != nil {
+		b.id = options.ID
+		if options.MaxHops > 0 {
+			b.maxHops = options.MaxHops
+		}
+		if options.MinBackoff > 0 {
+			b.minBackoff = options.MinBackoff
+		}
+		if options.MaxBackoff > 0 {
+			b.maxBackoff = options.MaxBackoff
+		}
+	}
+
+	if metrics := bus.Metrics(); metrics != nil {
+		metrics.NewCounterVec(
+			"bridge", "messages",
+			"Number of messages bridged by remote, direction and result",
+			[]string{"remote", "direction", "result"},
+		)
+		metrics.NewGaugeFunc(
+			"bridge", "remotes",
+			"Number of bridged remotes",
+			func() float64 {
+				b.Lock()
+				defer b.Unlock()
+				return float64(len(b.remotes))
+			},
+		)
+	}
+
+	return b
+}
+
+// Add connects to a remote and starts bridging its imports and exports
+func (b *Bridge) Add(r Remote) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+	if _, ok := b.remotes[r.Name]; ok {
+		return ErrExists
+	}
+
+	rs := &remote{
+		Remote: r,
+		client: client.NewClient(r.URL, &client.Options{Header: r.Header}),
+		done:   make(chan struct{}),
+	}
+
+	for _, pattern := range r.Import {
+		s := rs.client.Subscribe(pattern, func(ctx context.Context, msg *msgbus.Message) error {
+			b.importMessage(ctx, rs, msg)
+			return nil
+		})
+		s.OnState = func(state client.State) {
+			if state == client.StateConnected && s.HistoryLength() == 0 {
+				log.Warnf(
+					"[bridge] %s keeps no history, messages of %s published while disconnected are lost: set history_length on %s",
+					r.Name, pattern, r.Name,
+				)
+			}
+		}
+		s.Start()
+		rs.subscribers = append(rs.subscribers, s)
+	}
+
+	for _, pattern := range r.Export {
+		ch := b.bus.SubscribePattern(subscriberPrefix+r.Name, pattern)
+		rs.wg.Add(1)
+		go b.export(rs, ch)
+	}
+
+	b.remotes[r.Name] = rs
+	log.Infof("[bridge] bridging %s (%s) import=%v export=%v", r.Name, r.URL, r.Import, r.Export)
+
+	return nil
+}
+
+// Remotes returns the remotes bridged
+func (b *Bridge) Remotes() []Remote {
+	b.Lock()
+	defer b.Unlock()
+
+	remotes := make([]Remote, 0, len(b.remotes))
+	for _, rs := range b.remotes {
+		remotes = append(remotes, rs.Remote)
+	}
+	return remotes
+}
+
+// Close disconnects from all remotes, messages being exported are dropped
+func (b *Bridge) Close() error {
+	b.Lock()
+	defer b.Unlock()
+
+	b.closed = true
+	for name, rs := range b.remotes {
+		b.stop(rs)
+		delete(b.remotes, name)
+	}
+
+	return nil
+}
+
+// stop disconnects from a remote, the caller must hold the lock
+func (b *Bridge) stop(rs *remote) {
+	for _, s := range rs.subscribers {
+		s.Stop()
+	}
+	for _, pattern := range rs.Export {
+		b.bus.UnsubscribePattern(subscriberPrefix+rs.Name, pattern)
+	}
+	close(rs.done)
+	rs.wg.Wait()
+}
+
+// hops returns the number of bridges msg crossed
+func hops(msg *msgbus.Message) int {
+	n, _ := strconv.Atoi(msg.Headers[HeaderHops])
+	return n
+}
+
+// forward returns the headers of msg bridged from origin, or false if msg
+// must not be bridged to the node named to
+func (b *Bridge) forward(msg *msgbus.Message, origin, to string) (map[string]string, bool) {
+	if to != "" && msg.Headers[HeaderOrigin] == to {
+		return nil, false
+	}
+
+	n := hops(msg)
+	if n >= b.maxHops {
+		return nil, false
+	}
+
+	headers := make(map[string]string, len(msg.Headers)+2)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	if headers[HeaderOrigin] == "" {
+		headers[HeaderOrigin] = origin
+	}
+	headers[HeaderHops] = strconv.Itoa(n + 1)
+
+	return headers, true
+}
+
+// importMessage republishes a message of a remote locally
+func (b *Bridge) importMessage(ctx context.Context, rs *remote, msg *msgbus.Message) {
+	if msg.Topic == nil {
+		return
+	}
+	topic := msg.Topic.Name
+
+	headers, ok := b.forward(msg, rs.Name, b.id)
+	if !ok {
+		log.Debugf("[bridge] dropped message %d of %s from %s", msg.ID, topic, rs.Name)
+		b.observe(rs.Name, DirectionImport, ResultLoop)
+		return
+	}
+
+	ctx = msgbus.WithIdentity(ctx, subscriberPrefix+rs.Name)
+
+	if len(msg.Payload) > b.bus.TopicOptions(topic).MaxPayloadSize {
+		b.bus.Audit(ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditPublish, Result: msgbus.AuditRejected, Topic: topic,
+			Size: len(msg.Payload), Detail: "payload exceeds max-payload-size",
+		})
+		b.observe(rs.Name, DirectionImport, ResultTooLarge)
+		return
+	}
+
+	message, _, err := b.bus.PutMessage(ctx, msgbus.Publishing{
+		Topic: topic, Key: msg.Key, Payload: msg.Payload, Headers: headers,
+	})
+	if err != nil {
+		log.Warnf("[bridge] rejected message %d of %s from %s: %s", msg.ID, topic, rs.Name, err)
+		b.bus.Audit(ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditPublish, Result: msgbus.AuditRejected, Topic: topic,
+			Size: len(msg.Payload), Detail: err.Error(),
+		})
+		b.observe(rs.Name, DirectionImport, ResultRejected)
+		return
+	}
+	b.bus.Audit(ctx, msgbus.AuditEvent{
+		Action: msgbus.AuditPublish, Result: msgbus.AuditOK,
+	}.WithMessage(message))
+
+	b.observe(rs.Name, DirectionImport, ResultForwarded)
+}
+
+// export publishes local messages to a remote until it is stopped
+func (b *Bridge) export(rs *remote, ch chan msgbus.Message) {
+	defer rs.wg.Done()
+
+	for {
+		select {
+		case <-rs.done:
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			b.exportMessage(rs, &msg)
+		}
+	}
+}
+
+// exportMessage publishes a local message to a remote, retrying with
+// backoff until it succeeds or the remote is stopped. Every attempt has the
+// same idempotency key, so the remote publishes the message once.
+func (b *Bridge) exportMessage(rs *remote, msg *msgbus.Message) {
+	headers, ok := b.forward(msg, b.id, rs.Name)
+	if !ok {
+		b.observe(rs.Name, DirectionExport, ResultLoop)
+		return
+	}
+
+	opts := []client.PublishOption{
+		client.WithKey(msg.Key),
+		client.WithHeaders(headers),
+		client.WithIdempotencyKey(b.idempotencyKey(msg)),
+	}
+
+	bo := &backoff.Backoff{Min: b.minBackoff, Max: b.maxBackoff, Factor: 2, Jitter: true}
+	for {
+		_, err := rs.client.PublishContext(context.Background(), msg.Topic.Name, msg.Payload, opts...)
+		if err == nil {
+			b.observe(rs.Name, DirectionExport, ResultForwarded)
+			return
+		}
+
+		b.observe(rs.Name, DirectionExport, ResultError)
+		d := bo.Duration()
+		log.Warnf(
+			"[bridge] error exporting message %d of %s to %s, retrying in %s: %s",
+			msg.ID, msg.Topic.Name, rs.Name, d, err,
+		)
+
+		select {
+		case <-rs.done:
+			return
+		case <-time.After(d):
+		}
+	}
+}
+
+// idempotencyKey returns the idempotency key of the export of msg, which
+// identifies it by the bridge exporting it, its topic and partition and
+// its id
+func (b *Bridge) idempotencyKey(msg *msgbus.Message) string {
+	return fmt.Sprintf("%s%s:%s:%d:%d", subscriberPrefix, b.id, msg.Topic.Name, msg.Partition, msg.ID)
+}
+
+func (b *Bridge) observe(name, direction, result string) {
+	if metrics := b.bus.Metrics(); metrics != nil {
+		metrics.CounterVec("bridge", "messages").WithLabelValues(name, direction, result).Inc()
+	}
+}
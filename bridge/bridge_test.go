@@ -0,0 +1,201 @@
+package bridge
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/prologic/msgbus"
+	"github.com/prologic/msgbus/client"
+)
+
+func publish(mb *msgbus.MessageBus, topic, payload string) {
+	mb.Put(mb.NewMessage(mb.NewTopic(topic), []byte(payload)))
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for condition")
+}
+
+func TestBridge(t *testing.T) {
+	assert := assert.New(t)
+
+	local := msgbus.New(nil)
+	remote := msgbus.New(nil)
+
+	ts := httptest.NewServer(remote)
+	defer ts.Close()
+
+	b := New(local, &Options{ID: "a", MinBackoff: time.Millisecond})
+	defer b.Close()
+
+	require.NoError(t, b.Add(Remote{
+		Name:   "b",
+		URL:    ts.URL,
+		Import: []string{"t/#"},
+		Export: []string{"t/#"},
+	}))
+	assert.Equal(ErrExists, b.Add(Remote{Name: "b", URL: ts.URL, Import: []string{"x"}}))
+
+	// Wait for the import to subscribe
+	waitFor(t, func() bool {
+		publish(remote, "t/ready", "")
+		return len(local.Topics()) > 0
+	})
+
+	// Remote messages are imported once and not exported back
+	publish(remote, "t/1", "one")
+	waitFor(t, func() bool { _, ok := local.Get(local.NewTopic("t/1")); return ok })
+	time.Sleep(50 * time.Millisecond)
+	_, ok := remote.Get(remote.NewTopic("t/1"))
+	assert.True(ok)
+	_, ok = remote.Get(remote.NewTopic("t/1"))
+	assert.False(ok)
+
+	// Local messages are exported once and not imported back
+	publish(local, "t/2", "two")
+	var msg msgbus.Message
+	waitFor(t, func() bool { msg, ok = remote.Get(remote.NewTopic("t/2")); return ok })
+	assert.Equal("two", string(msg.Payload))
+	assert.Equal("a", msg.Headers[HeaderOrigin])
+	assert.Equal("1", msg.Headers[HeaderHops])
+
+	time.Sleep(50 * time.Millisecond)
+	_, ok = local.Get(local.NewTopic("t/2"))
+	assert.True(ok)
+	_, ok = local.Get(local.NewTopic("t/2"))
+	assert.False(ok)
+
+	assert.Len(b.Remotes(), 1)
+	assert.NoError(b.Close())
+	assert.Empty(b.Remotes())
+	assert.Equal(ErrClosed, b.Add(Remote{Name: "c", URL: ts.URL, Import: []string{"x"}}))
+}
+
+func TestBridgeKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	// Compacted topics reject messages without a key
+	compacted := map[string]msgbus.TopicOptions{
+		"in":  {Compacted: true},
+		"out": {Compacted: true},
+	}
+	newBus := func() *msgbus.MessageBus {
+		return msgbus.New(&msgbus.Options{
+			BufferLength:   msgbus.DefaultBufferLength,
+			MaxQueueSize:   msgbus.DefaultMaxQueueSize,
+			MaxPayloadSize: msgbus.DefaultMaxPayloadSize,
+			Topics:         compacted,
+		})
+	}
+	local, remote := newBus(), newBus()
+
+	ts := httptest.NewServer(remote)
+	defer ts.Close()
+
+	b := New(local, &Options{ID: "a", MinBackoff: time.Millisecond})
+	defer b.Close()
+
+	require.NoError(t, b.Add(Remote{Name: "b", URL: ts.URL, Import: []string{"in"}, Export: []string{"out"}}))
+
+	put := func(mb *msgbus.MessageBus, topic, key string) {
+		_, _, err := mb.PutMessage(context.Background(), msgbus.Publishing{
+			Topic: topic, Key: key, Payload: []byte("on"),
+		})
+		require.NoError(t, err)
+	}
+
+	waitFor(t, func() bool {
+		put(remote, "in", "ready")
+		return len(local.Compacted("in")) > 0
+	})
+	put(remote, "in", "lamp")
+	waitFor(t, func() bool { return len(local.Compacted("in")) == 2 })
+
+	put(local, "out", "fan")
+	waitFor(t, func() bool { return len(remote.Compacted("out")) == 1 })
+	assert.Equal("fan", remote.Compacted("out")[0].Key)
+}
+
+func TestExportRetries(t *testing.T) {
+	local := msgbus.New(nil)
+	remote := msgbus.New(&msgbus.Options{
+		BufferLength:   msgbus.DefaultBufferLength,
+		MaxQueueSize:   msgbus.DefaultMaxQueueSize,
+		MaxPayloadSize: msgbus.DefaultMaxPayloadSize,
+		DedupWindow:    time.Minute,
+	})
+
+	// The responses to the publishes of the first attempt of the bridge,
+	// retried by its client, are lost
+	var attempts, accepted int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) <= client.DefaultMaxRetries+1 {
+			remote.ServeHTTP(httptest.NewRecorder(), r)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		remote.ServeHTTP(w, r)
+		atomic.AddInt32(&accepted, 1)
+	}))
+	defer ts.Close()
+
+	b := New(local, &Options{ID: "a", MinBackoff: time.Millisecond})
+	defer b.Close()
+
+	require.NoError(t, b.Add(Remote{Name: "b", URL: ts.URL, Export: []string{"t"}}))
+
+	publish(local, "t", "one")
+	waitFor(t, func() bool { return atomic.LoadInt32(&accepted) > 0 })
+
+	// The message is published once
+	_, ok := remote.Get(remote.NewTopic("t"))
+	assert.True(t, ok)
+	_, ok = remote.Get(remote.NewTopic("t"))
+	assert.False(t, ok)
+}
+
+func TestForward(t *testing.T) {
+	assert := assert.New(t)
+
+	b := New(msgbus.New(nil), &Options{ID: "a", MaxHops: 2})
+
+	msg := &msgbus.Message{Headers: map[string]string{"foo": "bar"}}
+	headers, ok := b.forward(msg, "a", "b")
+	assert.True(ok)
+	assert.Equal(map[string]string{"foo": "bar", HeaderOrigin: "a", HeaderHops: "1"}, headers)
+
+	// Messages are not bridged back to their origin
+	_, ok = b.forward(&msgbus.Message{Headers: headers}, "c", "a")
+	assert.False(ok)
+
+	// Nor beyond MaxHops
+	headers, ok = b.forward(&msgbus.Message{Headers: headers}, "b", "c")
+	assert.True(ok)
+	assert.Equal("a", headers[HeaderOrigin])
+	assert.Equal("2", headers[HeaderHops])
+	_, ok = b.forward(&msgbus.Message{Headers: headers}, "c", "d")
+	assert.False(ok)
+}
+
+func TestRemoteValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(Remote{Name: "b", URL: "http://localhost:8000", Import: []string{"a/+"}}.Validate())
+	assert.Error(Remote{URL: "http://localhost:8000", Import: []string{"a"}}.Validate())
+	assert.Error(Remote{Name: "b", URL: "ftp://localhost", Import: []string{"a"}}.Validate())
+	assert.Error(Remote{Name: "b", URL: "http://localhost:8000"}.Validate())
+	assert.Error(Remote{Name: "b", URL: "http://localhost:8000", Export: []string{"a/#/b"}}.Validate())
+}
@@ -2,11 +2,16 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
-	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,6 +20,7 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/jpillora/backoff"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/propagation"
 
 	"github.com/prologic/msgbus"
 )
@@ -26,6 +32,24 @@ const (
 	// DefaultMaxReconnectInterval ...
 	DefaultMaxReconnectInterval = 64
 
+	// DefaultTimeout is the timeout of requests of the default HTTP client
+	DefaultTimeout = 30 * time.Second
+
+	// DefaultMaxRetries is the default number of times a failed request is
+	// retried
+	DefaultMaxRetries = 3
+
+	// DefaultRetryInterval is the default delay before retrying a request,
+	// doubled after every retry up to DefaultMaxRetryInterval
+	DefaultRetryInterval = 100 * time.Millisecond
+
+	// DefaultMaxRetryInterval is the default maximum delay between retries
+	DefaultMaxRetryInterval = 5 * time.Second
+
+	// maxIdleConnsPerHost is the number of idle connections the default
+	// HTTP client keeps to the server
+	maxIdleConnsPerHost = 64
+
 	// Time allowed to write a message to the peer.
 	writeWait = 10 * time.Second
 
@@ -36,18 +60,49 @@ const (
 	pingPeriod = (pongWait * 9) / 10
 )
 
+// propagator propagates the trace context of requests to the server
+var propagator = propagation.TraceContext{}
+
 // Client ...
 type Client struct {
 	url string
 
+	// tcpAddr is the address of the TCP listener for tcp:// urls
+	tcpAddr string
+	tcpMu   sync.Mutex
+	tcp     *TCPClient
+
 	reconnectInterval    time.Duration
 	maxReconnectInterval time.Duration
+
+	httpClient       *http.Client
+	maxRetries       int
+	retryInterval    time.Duration
+	maxRetryInterval time.Duration
+
+	header http.Header
 }
 
 // Options ...
 type Options struct {
 	ReconnectInterval    int
 	MaxReconnectInterval int
+
+	// Header is sent with every request, e.g: an Authorization header
+	Header http.Header
+
+	// HTTPClient sends all requests, it should be shared so connections are
+	// reused. The default client keeps idle connections to the server and
+	// times out requests after DefaultTimeout.
+	HTTPClient *http.Client
+
+	// MaxRetries is the number of times a failed request is retried with
+	// exponential backoff from RetryInterval up to MaxRetryInterval, a
+	// negative number disables retries. Publishes are retried with an
+	// idempotency key, pulls only if they were not sent.
+	MaxRetries       int
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
 }
 
 // NewClient ...
@@ -59,7 +114,17 @@ func NewClient(url string, options *Options) *Client {
 
 	url = strings.TrimSuffix(url, "/")
 
-	client := &Client{url: url}
+	client := &Client{
+		url: url,
+
+		maxRetries:       DefaultMaxRetries,
+		retryInterval:    DefaultRetryInterval,
+		maxRetryInterval: DefaultMaxRetryInterval,
+	}
+
+	if strings.HasPrefix(url, "tcp://") {
+		client.tcpAddr = strings.TrimPrefix(url, "tcp://")
+	}
 
 	if options != nil {
 		if options.ReconnectInterval != 0 {
@@ -69,6 +134,25 @@ func NewClient(url string, options *Options) *Client {
 		if options.MaxReconnectInterval != 0 {
 			maxReconnectInterval = options.MaxReconnectInterval
 		}
+
+		if options.MaxRetries != 0 {
+			client.maxRetries = options.MaxRetries
+		}
+
+		if options.RetryInterval != 0 {
+			client.retryInterval = options.RetryInterval
+		}
+
+		if options.MaxRetryInterval != 0 {
+			client.maxRetryInterval = options.MaxRetryInterval
+		}
+
+		client.header = options.Header
+		client.httpClient = options.HTTPClient
+	}
+
+	if client.httpClient == nil {
+		client.httpClient = newHTTPClient()
 	}
 
 	client.reconnectInterval = time.Duration(reconnectInterval) * time.Second
@@ -77,86 +161,467 @@ func NewClient(url string, options *Options) *Client {
 	return client
 }
 
-// Handle ...
-func (c *Client) Handle(msg *msgbus.Message) error {
-	out, err := json.Marshal(msg)
+// newHTTPClient returns the default HTTP client, which keeps idle
+// connections to the server for reuse
+func newHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+
+	return &http.Client{Transport: transport, Timeout: DefaultTimeout}
+}
+
+// tcpClient returns the connection to the TCP listener, dialing it on
+// first use or if the previous connection was closed
+func (c *Client) tcpClient() (*TCPClient, error) {
+	c.tcpMu.Lock()
+	defer c.tcpMu.Unlock()
+
+	if c.tcp != nil && c.tcp.Err() == nil {
+		return c.tcp, nil
+	}
+
+	tcp, err := DialTCP(c.tcpAddr)
 	if err != nil {
-		log.Errorf("error marshalling message: %s", err)
-		return err
+		return nil, err
 	}
+	c.tcp = tcp
 
-	os.Stdout.Write(out)
-	os.Stdout.Write([]byte{'\r', '\n'})
-	return nil
+	return tcp, nil
+}
+
+// request is a request to the HTTP API, which may be sent more than once
+type request struct {
+	method string
+	topic  string
+	query  url.Values
+	header http.Header
+	body   []byte
+
+	// idempotent requests are retried after any failure, others only if
+	// they could not be sent
+	idempotent bool
+}
+
+// do sends req, retrying failed attempts with backoff, and returns the
+// response, which the caller must close. Error responses are returned as a
+// *StatusError.
+func (c *Client) do(ctx context.Context, req request) (*http.Response, error) {
+	b := &backoff.Backoff{
+		Min:    c.retryInterval,
+		Max:    c.maxRetryInterval,
+		Factor: 2,
+		Jitter: true,
+	}
+
+	for {
+		res, err := c.send(ctx, req)
+		if err == nil {
+			return res, nil
+		}
+
+		if int(b.Attempt()) >= c.maxRetries || ctx.Err() != nil || !retryable(err, req.idempotent) {
+			return nil, err
+		}
+
+		d := b.Duration()
+		log.Debugf("retrying %s %s in %s: %s", req.method, req.topic, d, err)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(d):
+		}
+	}
 }
 
-// Pull ...
-func (c *Client) Pull(topic string) (msg *msgbus.Message, err error) {
-	url := fmt.Sprintf("%s/%s", c.url, topic)
-	client := &http.Client{}
+// send makes a single attempt at req
+func (c *Client) send(ctx context.Context, req request) (*http.Response, error) {
+	u := fmt.Sprintf("%s/%s", c.url, req.topic)
+	if len(req.query) > 0 {
+		u += "?" + req.query.Encode()
+	}
 
-	req, err := http.NewRequest("GET", url, nil)
+	r, err := http.NewRequestWithContext(ctx, req.method, u, bytes.NewReader(req.body))
 	if err != nil {
-		log.Errorf("error constructing request to %s: %s", url, err)
-		return
+		return nil, fmt.Errorf("error constructing request: %w", err)
 	}
+	c.setHeader(r.Header)
+	for k, vs := range req.header {
+		r.Header[k] = vs
+	}
+	propagator.Inject(ctx, propagation.HeaderCarrier(r.Header))
 
-	res, err := client.Do(req)
+	res, err := c.httpClient.Do(r)
 	if err != nil {
-		log.Errorf("error sending request to %s: %s", url, err)
-		return
+		return nil, err
 	}
 
-	if res.StatusCode == http.StatusNotFound {
-		// Empty queue
-		return
+	if res.StatusCode >= http.StatusBadRequest {
+		defer res.Body.Close()
+		return nil, newStatusError(res)
+	}
+
+	return res, nil
+}
+
+// retryable returns true if a request that failed with err should be
+// retried. Requests that could not be sent are always retried, others only
+// if they are idempotent and the failure may be temporary.
+func retryable(err error, idempotent bool) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	if !idempotent {
+		return false
+	}
+
+	var se *StatusError
+	if errors.As(err, &se) {
+		return temporaryStatus(se.StatusCode)
+	}
+
+	return true
+}
+
+// PullOption configures a pull
+type PullOption func(*pullOptions)
+
+type pullOptions struct {
+	partition int
+}
+
+// WithPartition pulls from the partition of a partitioned topic only
+func WithPartition(partition int) PullOption {
+	return func(o *pullOptions) {
+		o.partition = partition
+	}
+}
+
+// Pull pulls the next message of topic, returning ErrEmpty if the topic
+// has no messages
+func (c *Client) Pull(topic string) (*msgbus.Message, error) {
+	return c.PullContext(context.Background(), topic)
+}
+
+// PullPartition pulls the next message of the partition of a partitioned
+// topic, partitions are not supported by the TCP transport
+func (c *Client) PullPartition(topic string, partition int) (*msgbus.Message, error) {
+	return c.PullContext(context.Background(), topic, WithPartition(partition))
+}
+
+// PullContext pulls the next message of topic, returning ErrEmpty if the
+// topic has no messages. Pulls are not retried once sent since the message
+// may have been removed from the queue.
+func (c *Client) PullContext(ctx context.Context, topic string, opts ...PullOption) (*msgbus.Message, error) {
+	o := pullOptions{partition: -1}
+	for _, opt := range opts {
+		opt(&o)
 	}
 
+	if c.tcpAddr != "" {
+		if o.partition >= 0 {
+			return nil, fmt.Errorf("partitions are not supported by the tcp transport")
+		}
+		return c.pullTCP(topic)
+	}
+
+	req := request{method: "GET", topic: topic}
+	if o.partition >= 0 {
+		req.query = url.Values{"partition": {strconv.Itoa(o.partition)}}
+	}
+
+	res, err := c.do(ctx, req)
+	if isStatus(err, http.StatusNotFound) {
+		return nil, ErrEmpty
+	}
+	if err != nil {
+		return nil, err
+	}
 	defer res.Body.Close()
-	err = json.NewDecoder(res.Body).Decode(&msg)
+
+	var msg *msgbus.Message
+	if err := json.NewDecoder(res.Body).Decode(&msg); err != nil {
+		return nil, fmt.Errorf("error decoding message: %w", err)
+	}
+
+	return msg, nil
+}
+
+func (c *Client) pullTCP(topic string) (*msgbus.Message, error) {
+	tcp, err := c.tcpClient()
 	if err != nil {
-		log.Errorf(
-			"error decoding response from %s for %s: %s",
-			url, topic, err,
-		)
-		return
+		return nil, fmt.Errorf("error connecting to %s: %w", c.tcpAddr, err)
 	}
-	err = c.Handle(msg)
+
+	msg, err := tcp.Pull(topic)
 	if err != nil {
-		log.Errorf(
-			"error handling message from %s for %s: %s",
-			url, topic, err,
-		)
-		return
+		return nil, err
+	}
+	if msg == nil {
+		return nil, ErrEmpty
+	}
+
+	return msg, nil
+}
+
+// newIdempotencyKey returns a random idempotency key
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// setHeader adds the headers of the client's options to h
+func (c *Client) setHeader(h http.Header) {
+	for k, vs := range c.header {
+		for _, v := range vs {
+			h.Add(k, v)
+		}
 	}
+}
+
+// PublishOption configures a publish
+type PublishOption func(*publishOptions)
 
-	return
+type publishOptions struct {
+	key            string
+	headers        map[string]string
+	retain         bool
+	idempotencyKey string
+}
+
+// WithKey publishes the message with key, messages of a partitioned topic
+// with the same key are published to the same partition and so kept in
+// order. Keys are not supported by the TCP transport.
+func WithKey(key string) PublishOption {
+	return func(o *publishOptions) {
+		o.key = key
+	}
+}
+
+// WithHeaders publishes the message with headers, of which only those
+// prefixed with msgbus.HeaderPrefix, e.g: "msgbus-origin", are stored in
+// the message. Headers are not supported by the TCP transport.
+func WithHeaders(headers map[string]string) PublishOption {
+	return func(o *publishOptions) {
+		o.headers = headers
+	}
+}
+
+// WithRetain stores the message as the retained message of its topic,
+// which new subscribers receive first. An empty payload clears the
+// retained message. Retaining is not supported by the TCP transport.
+func WithRetain() PublishOption {
+	return func(o *publishOptions) {
+		o.retain = true
+	}
+}
+
+// WithIdempotencyKey identifies the message with key in the
+// Idempotency-Key header, publishes of the same key to a topic are
+// deduplicated by the server. Idempotency keys are not supported by the TCP
+// transport and ignored.
+func WithIdempotencyKey(key string) PublishOption {
+	return func(o *publishOptions) {
+		o.idempotencyKey = key
+	}
 }
 
 // Publish ...
-func (c *Client) Publish(topic, message string) error {
-	var payload bytes.Buffer
+func (c *Client) Publish(topic, message string) (*msgbus.PublishResult, error) {
+	return c.PublishContext(context.Background(), topic, []byte(message))
+}
+
+// PublishWithHeaders publishes payload to topic with headers, see
+// WithHeaders
+func (c *Client) PublishWithHeaders(topic string, payload []byte, headers map[string]string) (*msgbus.PublishResult, error) {
+	return c.PublishContext(context.Background(), topic, payload, WithHeaders(headers))
+}
+
+// PublishWithKey publishes payload to topic with key and headers, see
+// WithKey
+func (c *Client) PublishWithKey(topic, key string, payload []byte, headers map[string]string) (*msgbus.PublishResult, error) {
+	return c.PublishContext(context.Background(), topic, payload, WithKey(key), WithHeaders(headers))
+}
 
-	payload.Write([]byte(message))
+// PublishRetained publishes payload to topic as its retained message, see
+// WithRetain
+func (c *Client) PublishRetained(topic string, payload []byte) (*msgbus.PublishResult, error) {
+	return c.PublishContext(context.Background(), topic, payload, WithRetain())
+}
 
-	url := fmt.Sprintf("%s/%s", c.url, topic)
+// PublishContext publishes payload to topic with the trace context of ctx
+// and returns the result of the publish, of which only the id and topic
+// are known over the TCP transport. Publishes are retried with an
+// idempotency key, generated unless given with WithIdempotencyKey, so the
+// server does not publish a message twice.
+func (c *Client) PublishContext(ctx context.Context, topic string, payload []byte, opts ...PublishOption) (*msgbus.PublishResult, error) {
+	var o publishOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
 
-	client := &http.Client{}
+	if c.tcpAddr != "" {
+		if o.key != "" {
+			return nil, fmt.Errorf("keys are not supported by the tcp transport")
+		}
+		if o.retain {
+			return nil, fmt.Errorf("retained messages are not supported by the tcp transport")
+		}
 
-	req, err := http.NewRequest("PUT", url, &payload)
+		tcp, err := c.tcpClient()
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to %s: %w", c.tcpAddr, err)
+		}
+		id, err := tcp.Publish(topic, payload)
+		if err != nil {
+			return nil, fmt.Errorf("error publishing message: %w", err)
+		}
+		return &msgbus.PublishResult{ID: id, Topic: topic}, nil
+	}
+
+	req := request{method: "PUT", topic: topic, body: payload, header: make(http.Header)}
+	for k, v := range o.headers {
+		if strings.HasPrefix(strings.ToLower(k), strings.ToLower(msgbus.HeaderPrefix)) {
+			req.header.Set(k, v)
+		}
+	}
+	if o.key != "" || o.retain {
+		req.query = make(url.Values)
+	}
+	if o.key != "" {
+		req.query.Set("key", o.key)
+	}
+	if o.retain {
+		req.query.Set("retain", "true")
+	}
+	// Publishes with an idempotency key are deduplicated by the server, so
+	// they can be retried like idempotent requests. A key is generated if
+	// none was given and the publish may be retried.
+	if o.idempotencyKey == "" && c.maxRetries > 0 {
+		o.idempotencyKey = newIdempotencyKey()
+	}
+	if o.idempotencyKey != "" {
+		req.header.Set(msgbus.IdempotencyKeyHeader, o.idempotencyKey)
+		req.idempotent = true
+	}
+
+	res, err := c.do(ctx, req)
 	if err != nil {
-		return fmt.Errorf("error constructing request: %s", err)
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var result *msgbus.PublishResult
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error decoding publish result: %w", err)
+	}
+
+	return result, nil
+}
+
+// PublishBatch publishes messages in a single request, to topic or to the
+// topics named by the messages if topic is empty, and returns the result
+// of each message. Messages rejected by the server are not published and
+// have the reason in the Error of their result. Like PublishContext
+// messages are given idempotency keys if the batch may be retried.
+func (c *Client) PublishBatch(ctx context.Context, topic string, messages []msgbus.Publishing) ([]msgbus.BatchResult, error) {
+	req := request{method: "POST", topic: topic}
+	if topic == "" {
+		req.topic = strings.TrimPrefix(msgbus.BatchPath, "/")
+	} else {
+		req.query = url.Values{"batch": []string{"true"}}
 	}
 
-	res, err := client.Do(req)
+	return c.publishBatch(ctx, req, messages)
+}
+
+// PublishTransaction publishes messages to the topics named by the
+// messages atomically: either all messages are published or, if the server
+// rejects any message, none are and a *StatusError with the reason is
+// returned. Like PublishBatch messages are given idempotency keys if the
+// transaction may be retried, so it is not published twice.
+func (c *Client) PublishTransaction(ctx context.Context, messages []msgbus.Publishing) ([]msgbus.BatchResult, error) {
+	req := request{method: "POST", topic: strings.TrimPrefix(msgbus.TransactionPath, "/")}
+
+	return c.publishBatch(ctx, req, messages)
+}
+
+// publishBatch sends req with messages as its body and returns the result
+// of each message
+func (c *Client) publishBatch(ctx context.Context, req request, messages []msgbus.Publishing) ([]msgbus.BatchResult, error) {
+	if c.tcpAddr != "" {
+		return nil, fmt.Errorf("batches are not supported by the tcp transport")
+	}
+	if len(messages) == 0 {
+		return nil, nil
+	}
+
+	req.header = make(http.Header)
+	req.header.Set("Content-Type", "application/json")
+
+	// Batches whose messages all have an idempotency key are deduplicated
+	// by the server, so they can be retried like idempotent requests
+	keyed := make([]msgbus.Publishing, len(messages))
+	copy(keyed, messages)
+	req.idempotent = true
+	for i := range keyed {
+		if keyed[i].IdempotencyKey == "" && c.maxRetries > 0 {
+			keyed[i].IdempotencyKey = newIdempotencyKey()
+		}
+		if keyed[i].IdempotencyKey == "" {
+			req.idempotent = false
+		}
+	}
+
+	body, err := json.Marshal(keyed)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding batch: %w", err)
+	}
+	req.body = body
+
+	res, err := c.do(ctx, req)
 	if err != nil {
-		return fmt.Errorf("error publishing message: %s", err)
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var results []msgbus.BatchResult
+	if err := json.NewDecoder(res.Body).Decode(&results); err != nil {
+		return nil, fmt.Errorf("error decoding batch results: %w", err)
+	}
+
+	return results, nil
+}
+
+// ClearRetained clears the retained message of topic
+func (c *Client) ClearRetained(topic string) error {
+	return c.ClearRetainedContext(context.Background(), topic)
+}
+
+// ClearRetainedContext clears the retained message of topic, it is not an
+// error if topic has none
+func (c *Client) ClearRetainedContext(ctx context.Context, topic string) error {
+	if c.tcpAddr != "" {
+		return fmt.Errorf("retained messages are not supported by the tcp transport")
 	}
 
-	if res.StatusCode != http.StatusAccepted {
-		return fmt.Errorf("unexpected response: %s", res.Status)
+	req := request{
+		method: "DELETE", topic: topic, idempotent: true,
+		query: url.Values{"retained": {""}},
 	}
 
+	res, err := c.do(ctx, req)
+	if isStatus(err, http.StatusNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
 	return nil
 }
 
@@ -165,6 +630,59 @@ func (c *Client) Subscribe(topic string, handler msgbus.HandlerFunc) *Subscriber
 	return NewSubscriber(c, topic, handler)
 }
 
+// SubscribeGroup subscribes to topic as a member of the consumer group,
+// each message is handled by a single member of the group, the member its
+// partition is currently assigned to
+func (c *Client) SubscribeGroup(topic, group string, handler msgbus.HandlerFunc) *Subscriber {
+	s := NewSubscriber(c, topic, handler)
+	s.group = group
+	return s
+}
+
+// SubscribePartition subscribes to the messages of a single partition of
+// a partitioned topic
+func (c *Client) SubscribePartition(topic string, partition int, handler msgbus.HandlerFunc) *Subscriber {
+	s := NewSubscriber(c, topic, handler)
+	s.partition = partition
+	return s
+}
+
+// State is the state of the connection of a Subscriber
+type State int
+
+const (
+	// StateStopped is the state of a subscriber that is not running
+	StateStopped State = iota
+
+	// StateConnecting is the state while connecting to the server
+	StateConnecting
+
+	// StateConnected is the state while connected to the server
+	StateConnected
+
+	// StateDisconnected is the state after the connection to the server was
+	// lost, until reconnecting
+	StateDisconnected
+)
+
+func (s State) String() string {
+	switch s {
+	case StateStopped:
+		return "stopped"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+// ErrRunning is returned by Run if the subscriber is already running
+var ErrRunning = errors.New("client: subscriber already running")
+
 // Subscriber ...
 type Subscriber struct {
 	sync.RWMutex
@@ -180,18 +698,87 @@ type Subscriber struct {
 	reconnectInterval    time.Duration
 	maxReconnectInterval time.Duration
 
-	closeWriteChan chan bool
+	// err is the error of an invalid url, returned by Run
+	err error
+
+	// OnState is called with the new state whenever the state of the
+	// subscriber changes
+	OnState func(State)
+
+	// OnError is called with the errors of connecting, reading and handling
+	// messages, including handler panics, which are logged if it is nil
+	OnError func(error)
+
+	// Concurrency is the number of messages handled concurrently, by default
+	// messages are handled one at a time as they are read
+	Concurrency int
+
+	// BufferSize is the number of messages read but not handled yet, reading
+	// blocks while the buffer is full. It defaults to Concurrency.
+	BufferSize int
+
+	// Ordered handles the messages of a key in order when handling messages
+	// concurrently
+	Ordered bool
+
+	// group is the consumer group subscribed as, if any, and partition
+	// the only partition subscribed to, if not negative
+	group     string
+	partition int
+
+	// last is the creation time of the last message handled and positions
+	// the id of the last message handled of each topic or partition, used
+	// to resume from the server's history when reconnecting
+	last      time.Time
+	positions map[position]uint64
+
+	// historyLength is the number of messages the server keeps per topic,
+	// -1 until it is known
+	historyLength int
+
+	state   State
+	running bool
+
+	// cancel stops the subscriber started by Start, which closes done once
+	// it has stopped
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// position identifies a topic, or a partition of a partitioned topic
+type position struct {
+	topic     string
+	partition int
+}
+
+// discard is the handler of subscribers without one
+func discard(ctx context.Context, msg *msgbus.Message) error {
+	return nil
 }
 
 // NewSubscriber ...
 func NewSubscriber(client *Client, topic string, handler msgbus.HandlerFunc) *Subscriber {
 	if handler == nil {
-		handler = client.Handle
+		handler = discard
+	}
+
+	s := &Subscriber{
+		client:  client,
+		topic:   topic,
+		handler: handler,
+
+		reconnectInterval:    client.reconnectInterval,
+		maxReconnectInterval: client.maxReconnectInterval,
+
+		partition:     -1,
+		positions:     make(map[position]uint64),
+		historyLength: -1,
 	}
 
 	u, err := url.Parse(client.url)
 	if err != nil {
-		log.Fatalf("invalid url: %s", client.url)
+		s.err = fmt.Errorf("invalid url %s: %w", client.url, err)
+		return s
 	}
 
 	if strings.HasPrefix(client.url, "https") {
@@ -202,28 +789,118 @@ func NewSubscriber(client *Client, topic string, handler msgbus.HandlerFunc) *Su
 
 	u.Path += fmt.Sprintf("/%s", topic)
 
-	url := u.String()
+	s.url = u.String()
 
-	return &Subscriber{
-		client:  client,
-		topic:   topic,
-		handler: handler,
+	return s
+}
 
-		url:                  url,
-		reconnectInterval:    client.reconnectInterval,
-		maxReconnectInterval: client.maxReconnectInterval,
+// dialURL returns the url to connect to, resuming after the last message
+// handled if any. The server resumes after the last message of each topic
+// or partition handled, and after the time of the last message handled for
+// topics none was handled of.
+func (s *Subscriber) dialURL() string {
+	s.RLock()
+	defer s.RUnlock()
+
+	query := make(url.Values)
+	if !s.last.IsZero() {
+		query.Set("since", s.last.Format(time.RFC3339Nano))
+	}
+	for p, id := range s.positions {
+		query.Add("after", msgbus.Position{Topic: p.topic, Partition: p.partition, ID: id}.String())
+	}
+	sort.Strings(query["after"])
+	if s.group != "" {
+		query.Set("group", s.group)
+	}
+	if s.partition >= 0 {
+		query.Set("partition", strconv.Itoa(s.partition))
+	}
+
+	if len(query) == 0 {
+		return s.url
+	}
+	return s.url + "?" + query.Encode()
+}
+
+// HistoryLength returns the number of messages the server keeps per topic
+// to resume the subscription when reconnecting, messages published while
+// disconnected are lost if it is 0. It is -1 until connected to a server
+// that reports it.
+func (s *Subscriber) HistoryLength() int {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.historyLength
+}
 
-		closeWriteChan: make(chan bool, 1),
+// State returns the current state of the subscriber
+func (s *Subscriber) State() State {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.state
+}
+
+func (s *Subscriber) setState(state State) {
+	s.Lock()
+	changed := s.state != state
+	s.state = state
+	s.Unlock()
+
+	if !changed {
+		return
+	}
+
+	log.Debugf("subscriber of %s %s", s.url, state)
+	if s.OnState != nil {
+		s.OnState(state)
 	}
 }
 
-func (s *Subscriber) closeAndReconnect() {
-	s.closeWriteChan <- true
-	s.conn.Close()
-	go s.connect()
+func (s *Subscriber) error(err error) {
+	if s.OnError != nil {
+		s.OnError(err)
+		return
+	}
+	log.Warn(err)
 }
 
-func (s *Subscriber) connect() {
+// Run connects to the server and handles the messages of the topic until
+// ctx is done, reconnecting with backoff whenever the connection is lost.
+// Once Run returns the connection is closed, the messages read have been
+// handled and the subscriber does not reconnect. It returns
+// nil once ctx is done, or an error if the subscriber cannot run.
+func (s *Subscriber) Run(ctx context.Context) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	s.Lock()
+	if s.running {
+		s.Unlock()
+		return ErrRunning
+	}
+	s.running = true
+	s.Unlock()
+
+	defer func() {
+		s.Lock()
+		s.running = false
+		s.Unlock()
+		s.setState(StateStopped)
+	}()
+
+	// Messages are handled inline unless they are handled concurrently or
+	// buffered, the pool outlives connections so messages buffered when a
+	// connection is lost are still handled
+	handle := s.handle
+	if s.Concurrency > 1 || s.BufferSize > 0 {
+		p := newPool(s.Concurrency, s.BufferSize, s.Ordered, s.handle)
+		defer p.close()
+		handle = p.dispatch
+	}
+
 	b := &backoff.Backoff{
 		Min:    s.reconnectInterval,
 		Max:    s.maxReconnectInterval,
@@ -232,37 +909,84 @@ func (s *Subscriber) connect() {
 	}
 
 	for {
-		d := b.Duration()
+		s.setState(StateConnecting)
 
-		conn, _, err := websocket.DefaultDialer.Dial(s.url, nil)
+		conn, err := s.dial(ctx)
+		if err == nil {
+			b.Reset()
+			s.setState(StateConnected)
+			err = s.serve(ctx, conn, handle)
+		}
 
-		if err != nil {
-			log.Warnf("error connecting to %s: %s", s.url, err)
-			log.Infof("reconnecting in %s", d)
-			time.Sleep(d)
-			continue
+		if ctx.Err() != nil {
+			return nil
 		}
 
-		log.Infof("successfully connected to %s", s.url)
+		s.error(err)
+		s.setState(StateDisconnected)
 
-		s.Lock()
-		s.conn = conn
-		s.closeWriteChan = make(chan bool, 1)
-		s.Unlock()
+		d := b.Duration()
+		log.Infof("reconnecting to %s in %s", s.url, d)
 
-		go s.readLoop()
-		go s.writeLoop()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(d):
+		}
+	}
+}
 
-		break
+// dial connects to the server, error responses are returned as a
+// *StatusError
+func (s *Subscriber) dial(ctx context.Context) (*websocket.Conn, error) {
+	header := make(http.Header)
+	s.client.setHeader(header)
+
+	conn, res, err := websocket.DefaultDialer.DialContext(ctx, s.dialURL(), header)
+	if err == websocket.ErrBadHandshake && res != nil {
+		err = newStatusError(res)
 	}
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %w", s.url, err)
+	}
+
+	if n, err := strconv.Atoi(res.Header.Get(msgbus.HistoryLengthHeader)); err == nil {
+		s.Lock()
+		s.historyLength = n
+		s.Unlock()
+	}
+
+	return conn, nil
 }
 
-func (s *Subscriber) readLoop() {
-	var msg *msgbus.Message
+// serve handles the messages read from conn until reading fails, which it
+// does once ctx is done and conn is closed by keepalive
+func (s *Subscriber) serve(ctx context.Context, conn *websocket.Conn, handle func(*msgbus.Message)) error {
+	s.Lock()
+	s.conn = conn
+	s.Unlock()
 
-	s.conn.SetReadDeadline(time.Now().Add(pongWait))
+	var wg sync.WaitGroup
+	done := make(chan struct{})
 
-	s.conn.SetPongHandler(func(message string) error {
+	defer func() {
+		close(done)
+		wg.Wait()
+
+		s.Lock()
+		s.conn = nil
+		s.Unlock()
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.keepalive(ctx, conn, done)
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+
+	conn.SetPongHandler(func(message string) error {
 		log.Debugf("recieved pong from %s: %s", s.url, message)
 		t, err := strconv.ParseInt(message, 10, 64)
 		d := time.Duration(time.Now().UnixNano() - t)
@@ -271,70 +995,104 @@ func (s *Subscriber) readLoop() {
 		} else {
 			log.Debugf("pong latency of %s: %s", s.url, d)
 		}
-		s.conn.SetReadDeadline(time.Now().Add(pongWait))
+		conn.SetReadDeadline(time.Now().Add(pongWait))
 
 		return nil
 	})
 
 	for {
-		err := s.conn.ReadJSON(&msg)
-		if err != nil {
-			log.Errorf("error reading from %s: %s", s.url, err)
-			s.closeAndReconnect()
-			return
+		var msg *msgbus.Message
+
+		if err := conn.ReadJSON(&msg); err != nil {
+			conn.Close()
+			return fmt.Errorf("error reading from %s: %w", s.url, err)
 		}
 
-		err = s.handler(msg)
-		if err != nil {
-			log.Warnf("error handling message: %s", err)
+		handle(msg)
+
+		s.Lock()
+		s.last = msg.Created
+		if msg.Topic != nil {
+			s.positions[position{msg.Topic.Name, msg.Partition}] = msg.ID
 		}
+		s.Unlock()
 	}
 }
 
-func (s *Subscriber) writeLoop() {
-	ticker := time.NewTicker(pingPeriod)
+// handle calls the handler with msg, reporting its error or panic
+func (s *Subscriber) handle(msg *msgbus.Message) {
 	defer func() {
-		ticker.Stop()
-		if s.conn != nil {
-			s.conn.Close()
+		if r := recover(); r != nil {
+			s.error(fmt.Errorf("panic handling message %d of %s: %v", msg.ID, s.topic, r))
 		}
 	}()
 
+	ctx := msgbus.ExtractContext(context.Background(), msg)
+	if err := s.handler(ctx, msg); err != nil {
+		s.error(fmt.Errorf("error handling message %d of %s: %w", msg.ID, s.topic, err))
+	}
+}
+
+// keepalive pings the server over conn until done is closed, closing conn
+// if a ping fails or once ctx is done
+func (s *Subscriber) keepalive(ctx context.Context, conn *websocket.Conn, done chan struct{}) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <-ticker.C:
-			s.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			t := time.Now()
-			message := []byte(fmt.Sprintf("%d", t.UnixNano()))
-			if err := s.conn.WriteMessage(websocket.PingMessage, message); err != nil {
-				log.Errorf("error sending ping to %s: %s", s.url, err)
-				s.closeAndReconnect()
+			message := []byte(fmt.Sprintf("%d", time.Now().UnixNano()))
+			if err := conn.WriteControl(websocket.PingMessage, message, time.Now().Add(writeWait)); err != nil {
+				log.Debugf("error sending ping to %s: %s", s.url, err)
+				conn.Close()
 				return
 			}
-		case <-s.closeWriteChan:
+		case <-ctx.Done():
+			message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+			if err := conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait)); err != nil {
+				log.Debugf("error sending close message to %s: %s", s.url, err)
+			}
+			conn.Close()
+			return
+		case <-done:
 			return
 		}
 	}
 }
 
-// Start ...
+// Start runs the subscriber in the background until Stop is called
 func (s *Subscriber) Start() {
-	go s.connect()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	s.Lock()
+	s.cancel = cancel
+	s.done = done
+	s.Unlock()
+
+	go func() {
+		defer close(done)
+		if err := s.Run(ctx); err != nil {
+			s.error(err)
+		}
+	}()
 }
 
-// Stop ...
+// Stop stops the subscriber started by Start, waiting for the handler of
+// the last message to return
 func (s *Subscriber) Stop() {
 	log.Infof("shutting down ...")
 
-	err := s.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-	if err != nil {
-		log.Warnf("error sending close message: %s", err)
-	}
+	s.Lock()
+	cancel, done := s.cancel, s.done
+	s.cancel, s.done = nil, nil
+	s.Unlock()
 
-	err = s.conn.Close()
-	if err != nil {
-		log.Warnf("error closing connection: %s", err)
+	if cancel == nil {
+		return
 	}
 
-	s.conn = nil
+	cancel()
+	<-done
 }
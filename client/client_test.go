@@ -1,10 +1,17 @@
 package client
 
 import (
+	"context"
+	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/prologic/msgbus"
 )
@@ -19,8 +26,14 @@ func TestClientPublish(t *testing.T) {
 
 	client := NewClient(server.URL, nil)
 
-	err := client.Publish("hello", "hello world")
+	result, err := client.Publish("hello", "hello world")
 	assert.NoError(err)
+	if assert.NotNil(result) {
+		assert.Equal(uint64(0), result.ID)
+		assert.Equal("hello", result.Topic)
+		assert.False(result.Created.IsZero())
+		assert.Equal(0, result.Delivered)
+	}
 
 	topic := mb.NewTopic("hello")
 	expected := msgbus.Message{Topic: topic, Payload: []byte("hello world")}
@@ -31,3 +44,557 @@ func TestClientPublish(t *testing.T) {
 	assert.Equal(actual.Topic, expected.Topic)
 	assert.Equal(actual.Payload, expected.Payload)
 }
+
+func TestClientPublishWithHeaders(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := msgbus.New(nil)
+
+	server := httptest.NewServer(mb)
+	defer server.Close()
+
+	client := NewClient(server.URL, nil)
+
+	_, err := client.PublishWithHeaders("hello", []byte("hello world"), map[string]string{
+		"msgbus-origin": "a",
+		"other":         "b",
+	})
+	assert.NoError(err)
+
+	actual, ok := mb.Get(mb.NewTopic("hello"))
+	assert.True(ok)
+	assert.Equal(map[string]string{"msgbus-origin": "a"}, actual.Headers)
+}
+
+func TestClientPublishWithKey(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := msgbus.New(&msgbus.Options{
+		BufferLength:   msgbus.DefaultBufferLength,
+		MaxQueueSize:   msgbus.DefaultMaxQueueSize,
+		MaxPayloadSize: msgbus.DefaultMaxPayloadSize,
+		Topics:         map[string]msgbus.TopicOptions{"orders": {Partitions: 4}},
+	})
+
+	server := httptest.NewServer(mb)
+	defer server.Close()
+
+	client := NewClient(server.URL, nil)
+
+	for _, payload := range []string{"a", "b"} {
+		_, err := client.PublishWithKey("orders", "order/1", []byte(payload), nil)
+		assert.NoError(err)
+	}
+
+	p := msgbus.PartitionFor("order/1", 4)
+	for _, expected := range []string{"a", "b"} {
+		msg, err := client.PullPartition("orders", p)
+		assert.NoError(err)
+		if assert.NotNil(msg) {
+			assert.Equal("order/1", msg.Key)
+			assert.Equal(p, msg.Partition)
+			assert.Equal(expected, string(msg.Payload))
+		}
+	}
+
+	_, err := client.PullPartition("orders", p)
+	assert.ErrorIs(err, ErrEmpty)
+
+	_, err = client.PullPartition("orders", 4)
+	assert.Error(err)
+}
+
+func TestClientPublishBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := msgbus.New(&msgbus.Options{
+		BufferLength:   msgbus.DefaultBufferLength,
+		MaxQueueSize:   msgbus.DefaultMaxQueueSize,
+		MaxPayloadSize: 4,
+	})
+
+	server := httptest.NewServer(mb)
+	defer server.Close()
+
+	client := NewClient(server.URL, nil)
+	ctx := context.Background()
+
+	results, err := client.PublishBatch(ctx, "hello", []msgbus.Publishing{
+		{Payload: []byte("a")},
+		{Payload: []byte("too large")},
+		{Payload: []byte("b"), Key: "k"},
+	})
+	require.NoError(t, err)
+	if assert.Len(results, 3) {
+		assert.Equal(uint64(0), results[0].ID)
+		assert.NotEmpty(results[1].Error)
+		assert.Equal(uint64(1), results[2].ID)
+	}
+
+	results, err = client.PublishBatch(ctx, "", []msgbus.Publishing{
+		{Topic: "hello", Payload: []byte("c")},
+		{Topic: "world", Payload: []byte("d")},
+	})
+	require.NoError(t, err)
+	if assert.Len(results, 2) {
+		assert.Equal("hello", results[0].Topic)
+		assert.Equal(uint64(2), results[0].ID)
+		assert.Equal("world", results[1].Topic)
+		assert.Equal(uint64(0), results[1].ID)
+	}
+
+	for _, expected := range []string{"a", "b", "c"} {
+		msg, err := client.Pull("hello")
+		require.NoError(t, err)
+		assert.Equal(expected, string(msg.Payload))
+	}
+
+	results, err = client.PublishBatch(ctx, "", []msgbus.Publishing{{Payload: []byte("a")}})
+	require.NoError(t, err)
+	if assert.Len(results, 1) {
+		assert.Equal("topic required", results[0].Error)
+	}
+
+	_, err = client.PublishBatch(ctx, "hello", []msgbus.Publishing{{Topic: "world"}})
+	assert.Error(err)
+}
+
+func TestClientPublishTransaction(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := msgbus.New(nil)
+
+	server := httptest.NewServer(mb)
+	defer server.Close()
+
+	client := NewClient(server.URL, nil)
+	ctx := context.Background()
+
+	tx := []msgbus.Publishing{
+		{Topic: "orders.created", Payload: []byte("a")},
+		{Topic: "audit.orders", Payload: []byte("b")},
+	}
+	results, err := client.PublishTransaction(ctx, tx)
+	require.NoError(t, err)
+	if assert.Len(results, 2) {
+		assert.Equal("orders.created", results[0].Topic)
+		assert.Equal("audit.orders", results[1].Topic)
+	}
+
+	_, err = client.Pull("orders.created")
+	require.NoError(t, err)
+	_, err = client.Pull("orders.created")
+	assert.ErrorIs(err, ErrEmpty)
+
+	// A transaction with a message rejected by the server publishes none
+	_, err = client.PublishTransaction(ctx, append(tx, msgbus.Publishing{Payload: []byte("c")}))
+	var se *StatusError
+	if assert.ErrorAs(err, &se) {
+		assert.Equal(http.StatusBadRequest, se.StatusCode)
+	}
+	_, err = client.Pull("audit.orders")
+	require.NoError(t, err)
+	_, err = client.Pull("audit.orders")
+	assert.ErrorIs(err, ErrEmpty)
+}
+
+func TestClientPublishRetained(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := msgbus.New(nil)
+
+	server := httptest.NewServer(mb)
+	defer server.Close()
+
+	client := NewClient(server.URL, nil)
+
+	_, err := client.PublishRetained("status", []byte("online"))
+	assert.NoError(err)
+	retained := mb.Retained("status")
+	if assert.Len(retained, 1) {
+		assert.Equal("online", string(retained[0].Payload))
+	}
+
+	assert.NoError(client.ClearRetained("status"))
+	assert.Empty(mb.Retained("status"))
+	assert.NoError(client.ClearRetained("status"))
+}
+
+func TestClientErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := msgbus.New(&msgbus.Options{
+		BufferLength:   msgbus.DefaultBufferLength,
+		MaxQueueSize:   msgbus.DefaultMaxQueueSize,
+		MaxPayloadSize: 4,
+	})
+
+	server := httptest.NewServer(mb)
+	defer server.Close()
+
+	client := NewClient(server.URL, nil)
+
+	_, err := client.PublishContext(context.Background(), "hello", []byte("hello world"))
+	assert.ErrorIs(err, ErrTooLarge)
+
+	_, err = client.PullContext(context.Background(), "hello")
+	assert.ErrorIs(err, ErrEmpty)
+
+	unauthorized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	}))
+	defer unauthorized.Close()
+
+	_, err = NewClient(unauthorized.URL, nil).Publish("hello", "hi")
+	assert.ErrorIs(err, ErrUnauthorized)
+	var se *StatusError
+	if assert.ErrorAs(err, &se) {
+		assert.Equal(http.StatusUnauthorized, se.StatusCode)
+		assert.Equal("Unauthorized", se.Message)
+	}
+}
+
+func TestPuller(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := msgbus.New(nil)
+
+	server := httptest.NewServer(mb)
+	defer server.Close()
+
+	client := NewClient(server.URL, nil)
+
+	for _, payload := range []string{"a", "b", "c"} {
+		_, err := client.Publish("hello", payload)
+		assert.NoError(err)
+	}
+
+	var payloads []string
+	p := client.Puller("hello")
+	for p.Next(context.Background()) {
+		payloads = append(payloads, string(p.Message().Payload))
+	}
+	assert.NoError(p.Err())
+	assert.Equal([]string{"a", "b", "c"}, payloads)
+
+	// With a poll interval new messages are pulled until ctx is done
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p = client.Puller("hello")
+	p.PollInterval = 10 * time.Millisecond
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		client.Publish("hello", "d")
+	}()
+	assert.True(p.Next(ctx))
+	assert.Equal("d", string(p.Message().Payload))
+
+	cancel()
+	assert.False(p.Next(ctx))
+	assert.ErrorIs(p.Err(), context.Canceled)
+}
+
+func TestClientRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	var (
+		requests int32
+		failures int32 = 2
+		keys           = make(chan string, 20)
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys <- r.Header.Get(msgbus.IdempotencyKeyHeader)
+		if atomic.AddInt32(&requests, 1) <= atomic.LoadInt32(&failures) {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Method == "PUT" {
+			msgbus.WritePublishResult(w, msgbus.PublishResult{Topic: "hello"})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, &Options{RetryInterval: time.Millisecond})
+
+	// Idempotent requests are retried
+	assert.NoError(client.ClearRetained("status"))
+	assert.Equal(int32(3), atomic.LoadInt32(&requests))
+
+	for i := 0; i < 3; i++ {
+		<-keys
+	}
+
+	// Publishes are retried with the same idempotency key
+	atomic.StoreInt32(&requests, 0)
+	_, err := client.Publish("hello", "hi")
+	assert.NoError(err)
+	assert.Equal(int32(3), atomic.LoadInt32(&requests))
+	key := <-keys
+	assert.NotEmpty(key)
+	assert.Equal(key, <-keys)
+	assert.Equal(key, <-keys)
+
+	// and without retries have no key
+	atomic.StoreInt32(&requests, 0)
+	client = NewClient(server.URL, &Options{MaxRetries: -1})
+	_, err = client.Publish("hello", "hi")
+	assert.Error(err)
+	assert.Equal(int32(1), atomic.LoadInt32(&requests))
+	assert.Empty(<-keys)
+
+	// Retries give up after MaxRetries
+	atomic.StoreInt32(&requests, 0)
+	atomic.StoreInt32(&failures, 10)
+	client = NewClient(server.URL, &Options{MaxRetries: 1, RetryInterval: time.Millisecond})
+	assert.Error(client.ClearRetained("status"))
+	assert.Equal(int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestClientContext(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := msgbus.New(nil)
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		mb.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, nil)
+
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{1},
+		TraceFlags: trace.FlagsSampled,
+	}))
+	_, err := client.PublishContext(ctx, "hello", []byte("hello world"))
+	assert.NoError(err)
+	assert.Contains(traceparent, trace.TraceID{1}.String())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = client.PullContext(ctx, "hello")
+	assert.ErrorIs(err, context.Canceled)
+}
+
+func TestSubscriberResume(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := msgbus.New(&msgbus.Options{HistoryLength: 10})
+
+	server := httptest.NewServer(mb)
+	defer server.Close()
+
+	msgs := make(chan string, 10)
+	client := NewClient(server.URL, &Options{ReconnectInterval: 1})
+	s := client.Subscribe("hello", func(ctx context.Context, msg *msgbus.Message) error {
+		msgs <- string(msg.Payload)
+		return nil
+	})
+	s.Start()
+	defer s.Stop()
+
+	publish := func(payload string) {
+		mb.Put(mb.NewMessage(mb.NewTopic("hello"), []byte(payload)))
+	}
+	receive := func() string {
+		select {
+		case payload := <-msgs:
+			return payload
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for message")
+			return ""
+		}
+	}
+	connected := func() *websocket.Conn {
+		for i := 0; i < 500; i++ {
+			s.RLock()
+			conn := s.conn
+			s.RUnlock()
+			if conn != nil {
+				return conn
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("timed out waiting for connection")
+		return nil
+	}
+
+	conn := connected()
+	// The server subscribes after the upgrade
+	for i := 0; i < 100 && len(mb.Topics()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	publish("a")
+	assert.Equal("a", receive())
+
+	// Messages published while disconnected are received on reconnect
+	conn.Close()
+	publish("b")
+	publish("c")
+
+	assert.Equal("b", receive())
+	assert.Equal("c", receive())
+	assert.Equal(10, s.HistoryLength())
+
+	// Messages created at the time of the last message received are not
+	// skipped, subscriptions resume after its id
+	s.RLock()
+	last := s.last
+	s.RUnlock()
+	connected().Close()
+	msg := mb.NewMessage(mb.NewTopic("hello"), []byte("d"))
+	msg.Created = last
+	mb.Put(msg)
+
+	assert.Equal("d", receive())
+
+	select {
+	case payload := <-msgs:
+		t.Fatalf("unexpected message %q", payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSubscriberRun(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := msgbus.New(nil)
+
+	var connections int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&connections, 1)
+		mb.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	var (
+		handling = make(chan struct{})
+		release  = make(chan struct{})
+		handled  int32
+	)
+	client := NewClient(server.URL, &Options{ReconnectInterval: 1})
+	s := client.Subscribe("hello", func(ctx context.Context, msg *msgbus.Message) error {
+		close(handling)
+		<-release
+		atomic.StoreInt32(&handled, 1)
+		return nil
+	})
+
+	states := make(chan State, 10)
+	s.OnState = func(state State) { states <- state }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := make(chan error, 1)
+	go func() { ran <- s.Run(ctx) }()
+
+	assert.Equal(StateConnecting, <-states)
+	assert.Equal(StateConnected, <-states)
+	assert.ErrorIs(s.Run(ctx), ErrRunning)
+
+	// The server subscribes after the upgrade
+	for i := 0; i < 100 && len(mb.Topics()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	mb.Put(mb.NewMessage(mb.NewTopic("hello"), []byte("hi")))
+	<-handling
+
+	// Run waits for the handler of the last message
+	cancel()
+	select {
+	case <-ran:
+		t.Fatal("Run returned before the handler")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+
+	select {
+	case err := <-ran:
+		assert.NoError(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Run to return")
+	}
+	assert.Equal(int32(1), atomic.LoadInt32(&handled))
+	assert.Equal(StateStopped, <-states)
+	assert.Equal(StateStopped, s.State())
+
+	// and does not reconnect once stopped
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(int32(1), atomic.LoadInt32(&connections))
+}
+
+func TestSubscriberErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	errs := make(chan error, 10)
+	s := NewClient(server.URL, &Options{ReconnectInterval: 1}).Subscribe("hello", nil)
+	s.OnError = func(err error) { errs <- err }
+	s.Start()
+
+	select {
+	case err := <-errs:
+		assert.ErrorIs(err, ErrUnauthorized)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for error")
+	}
+	s.Stop()
+	assert.Equal(StateStopped, s.State())
+
+	s = NewClient("http://[::1", nil).Subscribe("hello", nil)
+	assert.Error(s.Run(context.Background()))
+}
+
+func TestSubscriberPanic(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := msgbus.New(nil)
+
+	server := httptest.NewServer(mb)
+	defer server.Close()
+
+	msgs := make(chan string, 10)
+	s := NewClient(server.URL, nil).Subscribe("hello", func(ctx context.Context, msg *msgbus.Message) error {
+		if string(msg.Payload) == "boom" {
+			panic("boom")
+		}
+		msgs <- string(msg.Payload)
+		return nil
+	})
+	s.Concurrency = 2
+
+	errs := make(chan error, 10)
+	s.OnError = func(err error) { errs <- err }
+	s.Start()
+	defer s.Stop()
+
+	for i := 0; i < 100 && len(mb.Topics()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	mb.Put(mb.NewMessage(mb.NewTopic("hello"), []byte("boom")))
+
+	select {
+	case err := <-errs:
+		assert.Contains(err.Error(), "panic handling message")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for error")
+	}
+
+	// The worker survives the panic
+	mb.Put(mb.NewMessage(mb.NewTopic("hello"), []byte("hi")))
+	select {
+	case payload := <-msgs:
+		assert.Equal("hi", payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+}
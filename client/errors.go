@@ -0,0 +1,83 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxErrorBody is the maximum length of the body of an error response kept
+// in a StatusError
+const maxErrorBody = 512
+
+var (
+	// ErrEmpty is returned when pulling from a topic without messages
+	ErrEmpty = errors.New("client: no messages")
+
+	// ErrTooLarge is returned when a payload exceeds the max payload size of
+	// its topic
+	ErrTooLarge = errors.New("client: payload too large")
+
+	// ErrUnauthorized is returned when the credentials of a request are
+	// missing, invalid or not allowed to make it
+	ErrUnauthorized = errors.New("client: unauthorized")
+)
+
+// StatusError is the error of a request that failed with an HTTP status,
+// it matches ErrEmpty, ErrTooLarge or ErrUnauthorized with errors.Is if the
+// status has that meaning
+type StatusError struct {
+	StatusCode int
+	Status     string
+
+	// Message is the start of the body of the response
+	Message string
+}
+
+func newStatusError(res *http.Response) *StatusError {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, maxErrorBody))
+	return &StatusError{
+		StatusCode: res.StatusCode,
+		Status:     res.Status,
+		Message:    strings.TrimSpace(string(body)),
+	}
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("client: unexpected response: %s", e.Status)
+	}
+	return fmt.Sprintf("client: unexpected response: %s: %s", e.Status, e.Message)
+}
+
+// Unwrap returns the error the status stands for, if any
+func (e *StatusError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusRequestEntityTooLarge:
+		return ErrTooLarge
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrUnauthorized
+	default:
+		return nil
+	}
+}
+
+// isStatus returns true if err is a StatusError with code
+func isStatus(err error, code int) bool {
+	var se *StatusError
+	return errors.As(err, &se) && se.StatusCode == code
+}
+
+// temporaryStatus returns true if a request that failed with the status
+// code may succeed later
+func temporaryStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
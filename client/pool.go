@@ -0,0 +1,80 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/prologic/msgbus"
+)
+
+// pool handles the messages of a subscriber with a number of workers
+// reading from bounded queues. With ordering each worker has its own queue
+// and the messages of a key are always queued to the same worker, so they
+// are handled in order.
+type pool struct {
+	queues []chan *msgbus.Message
+
+	// next is the queue the next message without a key is queued to
+	next int
+
+	wg sync.WaitGroup
+}
+
+// newPool starts workers handling messages with handle, up to size
+// messages are queued before dispatch blocks
+func newPool(workers, size int, ordered bool, handle func(*msgbus.Message)) *pool {
+	if workers < 1 {
+		workers = 1
+	}
+	if size < workers {
+		size = workers
+	}
+
+	p := &pool{}
+	if ordered {
+		for i := 0; i < workers; i++ {
+			p.queues = append(p.queues, make(chan *msgbus.Message, size/workers))
+		}
+	} else {
+		p.queues = []chan *msgbus.Message{make(chan *msgbus.Message, size)}
+	}
+
+	for i := 0; i < workers; i++ {
+		queue := p.queues[i%len(p.queues)]
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for msg := range queue {
+				handle(msg)
+			}
+		}()
+	}
+
+	return p
+}
+
+// dispatch queues msg to a worker, blocking while its queue is full. It
+// must not be called concurrently.
+func (p *pool) dispatch(msg *msgbus.Message) {
+	n := len(p.queues)
+	if n == 1 {
+		p.queues[0] <- msg
+		return
+	}
+
+	if msg.Key != "" {
+		p.queues[msgbus.PartitionFor(msg.Key, n)] <- msg
+		return
+	}
+
+	p.queues[p.next] <- msg
+	p.next = (p.next + 1) % n
+}
+
+// close stops the workers once they have handled the queued messages and
+// waits for them
+func (p *pool) close() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
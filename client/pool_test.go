@@ -0,0 +1,71 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/prologic/msgbus"
+)
+
+func TestPoolConcurrency(t *testing.T) {
+	assert := assert.New(t)
+
+	var (
+		running, peak int32
+		release       = make(chan struct{})
+	)
+	p := newPool(4, 8, false, func(msg *msgbus.Message) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&peak)
+			if n <= m || atomic.CompareAndSwapInt32(&peak, m, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&running, -1)
+	})
+
+	for i := 0; i < 8; i++ {
+		p.dispatch(&msgbus.Message{ID: uint64(i)})
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&peak) < 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(int32(4), atomic.LoadInt32(&peak))
+
+	close(release)
+	p.close()
+	assert.Equal(int32(0), atomic.LoadInt32(&running))
+}
+
+func TestPoolOrdered(t *testing.T) {
+	assert := assert.New(t)
+
+	var (
+		mu      sync.Mutex
+		handled = make(map[string][]uint64)
+	)
+	p := newPool(4, 16, true, func(msg *msgbus.Message) {
+		time.Sleep(time.Duration(msg.ID%3) * time.Millisecond)
+		mu.Lock()
+		handled[msg.Key] = append(handled[msg.Key], msg.ID)
+		mu.Unlock()
+	})
+
+	for i := 0; i < 100; i++ {
+		p.dispatch(&msgbus.Message{ID: uint64(i), Key: fmt.Sprintf("%d", i%5)})
+	}
+	p.close()
+
+	assert.Len(handled, 5)
+	for key, ids := range handled {
+		assert.Len(ids, 20)
+		assert.IsIncreasing(ids, key)
+	}
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/prologic/msgbus"
+)
+
+// Puller consumes the messages of a topic by pulling them one at a time,
+// until the topic is empty or, with a poll interval, continuously:
+//
+//	p := c.Puller("foo")
+//	for p.Next(ctx) {
+//		msg := p.Message()
+//		...
+//	}
+//	if err := p.Err(); err != nil {
+//		...
+//	}
+type Puller struct {
+	client *Client
+	topic  string
+	opts   []PullOption
+
+	// PollInterval is how long to wait before pulling again when the topic
+	// is empty, if zero Next returns false once the topic is empty
+	PollInterval time.Duration
+
+	msg *msgbus.Message
+	err error
+}
+
+// Puller returns a Puller consuming the messages of topic
+func (c *Client) Puller(topic string, opts ...PullOption) *Puller {
+	return &Puller{client: c, topic: topic, opts: opts}
+}
+
+// Next pulls the next message, which is then returned by Message. It
+// returns false once the topic is empty, unless PollInterval is set, or
+// when an error occurs or ctx is done, which are returned by Err.
+func (p *Puller) Next(ctx context.Context) bool {
+	p.msg = nil
+	if p.err != nil {
+		return false
+	}
+
+	for {
+		msg, err := p.client.PullContext(ctx, p.topic, p.opts...)
+		if err == nil {
+			p.msg = msg
+			return true
+		}
+		if err != ErrEmpty {
+			p.err = err
+			return false
+		}
+		if p.PollInterval <= 0 {
+			return false
+		}
+
+		select {
+		case <-ctx.Done():
+			p.err = ctx.Err()
+			return false
+		case <-time.After(p.PollInterval):
+		}
+	}
+}
+
+// Message returns the message pulled by the last call to Next
+func (p *Puller) Message() *msgbus.Message {
+	return p.msg
+}
+
+// Err returns the error that stopped Next, if any, it is nil if the topic
+// was emptied
+func (p *Puller) Err() error {
+	return p.err
+}
@@ -0,0 +1,391 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultSpoolMaxMessages is the default maximum number of messages
+	// spooled
+	DefaultSpoolMaxMessages = 10000
+
+	// DefaultSpoolMaxBytes is the default maximum size of the spool
+	DefaultSpoolMaxBytes = 64 << 20
+
+	// DefaultSpoolReplayInterval is the default interval at which spooled
+	// messages are replayed
+	DefaultSpoolReplayInterval = 5 * time.Second
+
+	// spoolExt is the extension of the files of spooled messages, which are
+	// named by their sequence so they sort in order
+	spoolExt = ".msg"
+)
+
+// ErrSpoolFull is returned when a message cannot be spooled because the
+// spool is full
+var ErrSpoolFull = errors.New("client: spool full")
+
+// SpoolOptions ...
+type SpoolOptions struct {
+	// MaxMessages and MaxBytes bound the number of messages spooled and the
+	// size of the spool
+	MaxMessages int
+	MaxBytes    int64
+
+	// ReplayInterval is the interval at which spooled messages are replayed
+	ReplayInterval time.Duration
+
+	// OnError is called with the errors of replaying messages, which are
+	// logged if it is nil. Messages rejected by the server are dropped from
+	// the spool.
+	OnError func(error)
+}
+
+// spooled is a message in the spool
+type spooled struct {
+	Topic          string            `json:"topic"`
+	Payload        []byte            `json:"payload"`
+	Key            string            `json:"key,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	Retain         bool              `json:"retain,omitempty"`
+	IdempotencyKey string            `json:"idempotency_key"`
+}
+
+func (m spooled) options() []PublishOption {
+	opts := []PublishOption{WithIdempotencyKey(m.IdempotencyKey)}
+	if m.Key != "" {
+		opts = append(opts, WithKey(m.Key))
+	}
+	if m.Headers != nil {
+		opts = append(opts, WithHeaders(m.Headers))
+	}
+	if m.Retain {
+		opts = append(opts, WithRetain())
+	}
+	return opts
+}
+
+// SpoolingPublisher publishes messages with a client, spooling them to a
+// directory while the server is unavailable and replaying them in order
+// once it is available again. Every message is published with an
+// idempotency key so messages published before the server failed to
+// respond are not published twice.
+type SpoolingPublisher struct {
+	client *Client
+	dir    string
+
+	maxMessages    int
+	maxBytes       int64
+	replayInterval time.Duration
+	onError        func(error)
+
+	// mu guards the state of the spool, replayMu is held while replaying
+	mu       sync.Mutex
+	replayMu sync.Mutex
+	seq      uint64
+	depth    int
+	bytes    int64
+
+	kick chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewSpoolingPublisher returns a publisher spooling messages to dir, which
+// is created if it does not exist. Messages already in the spool are
+// replayed in the background.
+func NewSpoolingPublisher(client *Client, dir string, options *SpoolOptions) (*SpoolingPublisher, error) {
+	p := &SpoolingPublisher{
+		client: client,
+		dir:    dir,
+
+		maxMessages:    DefaultSpoolMaxMessages,
+		maxBytes:       DefaultSpoolMaxBytes,
+		replayInterval: DefaultSpoolReplayInterval,
+
+		kick: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	if options != nil {
+		if options.MaxMessages != 0 {
+			p.maxMessages = options.MaxMessages
+		}
+
+		if options.MaxBytes != 0 {
+			p.maxBytes = options.MaxBytes
+		}
+
+		if options.ReplayInterval != 0 {
+			p.replayInterval = options.ReplayInterval
+		}
+
+		p.onError = options.OnError
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating spool %s: %w", dir, err)
+	}
+
+	names, err := p.list()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("error reading spool %s: %w", dir, err)
+		}
+		p.depth++
+		p.bytes += fi.Size()
+	}
+	if len(names) > 0 {
+		p.seq, _ = strconv.ParseUint(strings.TrimSuffix(names[len(names)-1], spoolExt), 10, 64)
+		p.kick <- struct{}{}
+	}
+
+	go p.run()
+
+	return p, nil
+}
+
+// list returns the names of the files of the spooled messages in order
+func (p *SpoolingPublisher) list() ([]string, error) {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading spool %s: %w", p.dir, err)
+	}
+
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), spoolExt) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Depth returns the number of messages spooled
+func (p *SpoolingPublisher) Depth() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.depth
+}
+
+// Publish publishes payload to topic, or spools it if the server is
+// unavailable or messages are already spooled so messages are published in
+// order. Errors of messages rejected by the server are returned, as is
+// ErrSpoolFull if the message cannot be spooled.
+func (p *SpoolingPublisher) Publish(ctx context.Context, topic string, payload []byte, opts ...PublishOption) error {
+	var o publishOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	m := spooled{
+		Topic:          topic,
+		Payload:        payload,
+		Key:            o.key,
+		Headers:        o.headers,
+		Retain:         o.retain,
+		IdempotencyKey: o.idempotencyKey,
+	}
+	if m.IdempotencyKey == "" {
+		m.IdempotencyKey = newIdempotencyKey()
+	}
+
+	if p.Depth() == 0 {
+		_, err := p.client.PublishContext(ctx, topic, payload, m.options()...)
+		if err == nil || !unavailable(err) || ctx.Err() != nil {
+			return err
+		}
+		log.Debugf("spooling message to %s: %s", topic, err)
+	}
+
+	if err := p.append(m); err != nil {
+		return err
+	}
+
+	select {
+	case p.kick <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// append writes m to the spool, the file is written under a temporary name
+// and renamed so a partially written message is never replayed
+func (p *SpoolingPublisher) append(m spooled) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("error encoding message: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.depth >= p.maxMessages || p.bytes+int64(len(data)) > p.maxBytes {
+		return ErrSpoolFull
+	}
+
+	p.seq++
+	name := filepath.Join(p.dir, fmt.Sprintf("%020d%s", p.seq, spoolExt))
+
+	f, err := os.CreateTemp(p.dir, ".spool-*")
+	if err != nil {
+		return fmt.Errorf("error spooling message: %w", err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("error spooling message: %w", err)
+	}
+
+	p.depth++
+	p.bytes += int64(len(data))
+
+	return nil
+}
+
+// Flush replays the spooled messages in order until the spool is empty,
+// ctx is done or the server is unavailable, whose error is returned
+func (p *SpoolingPublisher) Flush(ctx context.Context) error {
+	p.replayMu.Lock()
+	defer p.replayMu.Unlock()
+
+	names, err := p.list()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		path := filepath.Join(p.dir, name)
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading spooled message: %w", err)
+		}
+
+		var m spooled
+		if err := json.Unmarshal(data, &m); err != nil {
+			p.error(fmt.Errorf("dropping invalid spooled message %s: %w", name, err))
+		} else if _, err := p.client.PublishContext(ctx, m.Topic, m.Payload, m.options()...); err != nil {
+			if unavailable(err) || ctx.Err() != nil {
+				return err
+			}
+			p.error(fmt.Errorf("dropping spooled message to %s: %w", m.Topic, err))
+		}
+
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("error removing spooled message: %w", err)
+		}
+
+		p.mu.Lock()
+		p.depth--
+		p.bytes -= int64(len(data))
+		p.mu.Unlock()
+	}
+
+	return nil
+}
+
+func (p *SpoolingPublisher) error(err error) {
+	if p.onError != nil {
+		p.onError(err)
+		return
+	}
+	log.Warn(err)
+}
+
+// run replays spooled messages every replay interval and whenever a message
+// is spooled until the publisher is closed
+func (p *SpoolingPublisher) run() {
+	defer close(p.done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-p.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(p.replayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.kick:
+		case <-p.stop:
+			return
+		}
+
+		if p.Depth() == 0 {
+			continue
+		}
+		if err := p.Flush(ctx); err != nil && ctx.Err() == nil {
+			log.Debugf("error replaying spool %s: %s", p.dir, err)
+		}
+	}
+}
+
+// Close stops replaying spooled messages, which remain in the spool
+func (p *SpoolingPublisher) Close() error {
+	close(p.stop)
+	<-p.done
+	return nil
+}
+
+// unavailable returns true if a publish failed with err because the server
+// is unavailable, as opposed to rejecting the message
+func unavailable(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return temporaryStatus(se.StatusCode)
+	}
+
+	var ue *url.Error
+	if errors.As(err, &ue) && ue.Op == "parse" {
+		return false
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return true
+	}
+
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ErrClosed)
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/prologic/msgbus"
+)
+
+func TestSpoolingPublisher(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := msgbus.New(&msgbus.Options{
+		BufferLength:   msgbus.DefaultBufferLength,
+		MaxQueueSize:   msgbus.DefaultMaxQueueSize,
+		MaxPayloadSize: 8,
+	})
+
+	var (
+		mu   sync.Mutex
+		keys []string
+	)
+	// Requests of replays cancelled by Close may still be handled after
+	// Close returns, so messages are spooled while a separate server is down
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		mu.Unlock()
+		mb.ServeHTTP(w, r)
+	}))
+	defer up.Close()
+
+	dir := t.TempDir()
+	options := &SpoolOptions{MaxMessages: 3, ReplayInterval: time.Hour}
+	ctx := context.Background()
+
+	p, err := NewSpoolingPublisher(NewClient(down.URL, nil), dir, options)
+	require.NoError(t, err)
+
+	for _, payload := range []string{"a", "b", "c"} {
+		assert.NoError(p.Publish(ctx, "hello", []byte(payload)))
+	}
+	assert.Equal(3, p.Depth())
+	assert.ErrorIs(p.Publish(ctx, "hello", []byte("d")), ErrSpoolFull)
+	assert.Error(p.Flush(ctx))
+	assert.NoError(p.Close())
+
+	// Spooled messages survive restarts and are replayed in order in the
+	// background once restarted
+	p, err = NewSpoolingPublisher(NewClient(up.URL, nil), dir, options)
+	require.NoError(t, err)
+	defer p.Close()
+
+	assert.Eventually(func() bool { return p.Depth() == 0 }, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(p.Flush(ctx))
+
+	topic := mb.NewTopic("hello")
+	for _, expected := range []string{"a", "b", "c"} {
+		msg, ok := mb.Get(topic)
+		if assert.True(ok) {
+			assert.Equal(expected, string(msg.Payload))
+		}
+	}
+
+	mu.Lock()
+	assert.Len(keys, 3)
+	for _, key := range keys {
+		assert.NotEmpty(key)
+	}
+	mu.Unlock()
+
+	// Messages rejected by the server are not spooled
+	err = p.Publish(ctx, "hello", []byte("too large"))
+	assert.ErrorIs(err, ErrTooLarge)
+	assert.Equal(0, p.Depth())
+}
@@ -0,0 +1,367 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prologic/msgbus"
+)
+
+// maxLineLength is the maximum length of a line read from the server
+const maxLineLength = 4096
+
+// ErrClosed is returned by requests of a closed TCPClient
+var ErrClosed = errors.New("client: connection closed")
+
+// Call is a pending request of a TCPClient, Done is closed once the reply
+// has been received
+type Call struct {
+	// ID is the id of the published message
+	ID uint64
+
+	// Message is the pulled message, nil if the topic was empty
+	Message *msgbus.Message
+
+	// Err is the error of the request, if any
+	Err error
+
+	// Done is closed when the request completed
+	Done chan struct{}
+}
+
+// Wait waits for the call to complete and returns its error
+func (call *Call) Wait() error {
+	<-call.Done
+	return call.Err
+}
+
+func (call *Call) done(err error) {
+	call.Err = err
+	close(call.Done)
+}
+
+// TCPClient is a client of the line protocol served by msgbusd over TCP
+// (see package github.com/prologic/msgbus/tcp). It is safe for concurrent
+// use and requests are pipelined on a single connection, replies are
+// matched to requests in order.
+type TCPClient struct {
+	conn net.Conn
+
+	// wmu serializes writing requests and queueing their calls
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	sync.Mutex
+	pending  []*Call
+	handlers map[string]msgbus.HandlerFunc
+	err      error
+
+	messages chan *msgbus.Message
+	done     chan struct{}
+}
+
+// DialTCP connects to the TCP listener of msgbusd at addr, e.g:
+// localhost:8001
+func DialTCP(addr string) (*TCPClient, error) {
+	conn, err := net.DialTimeout("tcp", addr, writeWait)
+	if err != nil {
+		return nil, err
+	}
+	return NewTCPClient(conn), nil
+}
+
+// NewTCPClient returns a client using the established connection conn
+func NewTCPClient(conn net.Conn) *TCPClient {
+	c := &TCPClient{
+		conn: conn,
+		w:    bufio.NewWriter(conn),
+
+		handlers: make(map[string]msgbus.HandlerFunc),
+		messages: make(chan *msgbus.Message, msgbus.DefaultBufferLength),
+		done:     make(chan struct{}),
+	}
+
+	go c.readLoop()
+	go c.dispatch()
+
+	return c
+}
+
+// Close closes the connection, pending requests fail with ErrClosed
+func (c *TCPClient) Close() error {
+	return c.conn.Close()
+}
+
+// Done returns a channel closed when the connection is closed
+func (c *TCPClient) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the error the connection was closed with, if any
+func (c *TCPClient) Err() error {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.err
+}
+
+// send writes a request and queues call for its reply
+func (c *TCPClient) send(call *Call, command string, payload []byte) *Call {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.Lock()
+	if c.err != nil {
+		c.Unlock()
+		call.done(c.err)
+		return call
+	}
+	c.pending = append(c.pending, call)
+	c.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	c.w.WriteString(command)
+	c.w.WriteString("\r\n")
+	if payload != nil {
+		c.w.Write(payload)
+		c.w.WriteString("\r\n")
+	}
+	if err := c.w.Flush(); err != nil {
+		// Fails all pending calls including this one
+		c.conn.Close()
+	}
+
+	return call
+}
+
+func (c *TCPClient) call(command string, payload []byte) *Call {
+	return c.send(&Call{Done: make(chan struct{})}, command, payload)
+}
+
+// Auth authenticates with a username and password or, if username is
+// empty, with a token
+func (c *TCPClient) Auth(username, password string) error {
+	if username == "" {
+		return c.call("AUTH "+password, nil).Wait()
+	}
+	return c.call(fmt.Sprintf("AUTH %s %s", username, password), nil).Wait()
+}
+
+// PublishAsync publishes payload to topic without waiting for the reply,
+// the id of the message is set on the returned call once it is done
+func (c *TCPClient) PublishAsync(topic string, payload []byte) *Call {
+	if payload == nil {
+		payload = []byte{}
+	}
+	return c.call(fmt.Sprintf("PUB %s %d", topic, len(payload)), payload)
+}
+
+// Publish publishes payload to topic and returns the id of the message
+func (c *TCPClient) Publish(topic string, payload []byte) (uint64, error) {
+	call := c.PublishAsync(topic, payload)
+	if err := call.Wait(); err != nil {
+		return 0, err
+	}
+	return call.ID, nil
+}
+
+// Pull pulls the next message of topic, if the topic is empty the message
+// is nil
+func (c *TCPClient) Pull(topic string) (*msgbus.Message, error) {
+	call := c.call("PULL "+topic, nil)
+	if err := call.Wait(); err != nil {
+		return nil, err
+	}
+	return call.Message, nil
+}
+
+// Subscribe calls handler for every message published to topic, which may
+// be a pattern, from now on. Handlers are called one message at a time.
+func (c *TCPClient) Subscribe(topic string, handler msgbus.HandlerFunc) error {
+	c.Lock()
+	c.handlers[topic] = handler
+	c.Unlock()
+
+	if err := c.call("SUB "+topic, nil).Wait(); err != nil {
+		c.Lock()
+		delete(c.handlers, topic)
+		c.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Unsubscribe ends the subscription to topic
+func (c *TCPClient) Unsubscribe(topic string) error {
+	err := c.call("UNSUB "+topic, nil).Wait()
+
+	c.Lock()
+	delete(c.handlers, topic)
+	c.Unlock()
+
+	return err
+}
+
+// Ping checks the connection is alive
+func (c *TCPClient) Ping() error {
+	return c.call("PING", nil).Wait()
+}
+
+func (c *TCPClient) readLoop() {
+	r := bufio.NewReader(c.conn)
+
+	err := c.read(r)
+	if err == io.EOF || errors.Is(err, net.ErrClosed) {
+		err = ErrClosed
+	} else {
+		log.Errorf("error reading from %s: %s", c.conn.RemoteAddr(), err)
+	}
+
+	c.Lock()
+	c.err = err
+	pending := c.pending
+	c.pending = nil
+	c.Unlock()
+
+	for _, call := range pending {
+		call.done(err)
+	}
+
+	close(c.messages)
+	close(c.done)
+}
+
+func (c *TCPClient) read(r *bufio.Reader) error {
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "MSG ") {
+			msg, err := readMessage(r, line)
+			if err != nil {
+				return err
+			}
+			c.messages <- msg
+			continue
+		}
+
+		c.Lock()
+		if len(c.pending) == 0 {
+			c.Unlock()
+			return fmt.Errorf("unexpected reply %q", line)
+		}
+		call := c.pending[0]
+		c.pending = c.pending[1:]
+		c.Unlock()
+
+		switch {
+		case strings.HasPrefix(line, "-ERR "):
+			call.done(fmt.Errorf("error from server: %s", strings.TrimPrefix(line, "-ERR ")))
+		case strings.HasPrefix(line, "+MSG "):
+			msg, err := readMessage(r, line)
+			if err != nil {
+				call.done(err)
+				return err
+			}
+			call.Message = msg
+			call.done(nil)
+		case strings.HasPrefix(line, "+OK "):
+			id, err := strconv.ParseUint(strings.TrimPrefix(line, "+OK "), 10, 64)
+			if err != nil {
+				call.done(fmt.Errorf("invalid reply %q", line))
+				continue
+			}
+			call.ID = id
+			call.done(nil)
+		case strings.HasPrefix(line, "+"):
+			call.done(nil)
+		default:
+			call.done(fmt.Errorf("invalid reply %q", line))
+			return fmt.Errorf("invalid reply %q", line)
+		}
+	}
+}
+
+// dispatch calls the handlers of subscriptions matching pushed messages
+func (c *TCPClient) dispatch() {
+	for msg := range c.messages {
+		c.Lock()
+		var handlers []msgbus.HandlerFunc
+		for topic, handler := range c.handlers {
+			if msgbus.MatchTopic(topic, msg.Topic.Name) {
+				handlers = append(handlers, handler)
+			}
+		}
+		c.Unlock()
+
+		for _, handler := range handlers {
+			if err := handler(context.Background(), msg); err != nil {
+				log.Warnf("error handling message: %s", err)
+			}
+		}
+	}
+}
+
+// readMessage reads the payload of the message announced by line, e.g:
+// "MSG <topic> <id> <length>"
+func readMessage(r *bufio.Reader, line string) (*msgbus.Message, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("invalid message %q", line)
+	}
+
+	id, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message %q", line)
+	}
+
+	length, err := strconv.Atoi(fields[3])
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("invalid message %q", line)
+	}
+
+	payload := make([]byte, length+2)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	return &msgbus.Message{
+		ID:      id,
+		Topic:   &msgbus.Topic{Name: fields[1]},
+		Payload: payload[:length],
+	}, nil
+}
+
+// readLine reads a line terminated by LF or CRLF
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxLineLength {
+			return "", fmt.Errorf("line too long")
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/prologic/msgbus"
+	"github.com/prologic/msgbus/tcp"
+)
+
+func newTCPServer(t *testing.T) (*msgbus.MessageBus, string) {
+	mb := msgbus.New(nil)
+	s := tcp.NewServer(mb, nil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	return mb, l.Addr().String()
+}
+
+func TestTCPClientPipelined(t *testing.T) {
+	assert := assert.New(t)
+
+	mb, addr := newTCPServer(t)
+
+	c, err := DialTCP(addr)
+	require.NoError(t, err)
+	defer c.Close()
+
+	var calls []*Call
+	for i := 0; i < 10; i++ {
+		calls = append(calls, c.PublishAsync("foo", []byte(fmt.Sprintf("message %d", i))))
+	}
+	for i, call := range calls {
+		require.NoError(t, call.Wait())
+		assert.Equal(uint64(i), call.ID)
+	}
+
+	msg, err := c.Pull("foo")
+	require.NoError(t, err)
+	assert.Equal("foo", msg.Topic.Name)
+	assert.Equal([]byte("message 0"), msg.Payload)
+
+	actual, ok := mb.Get(mb.NewTopic("foo"))
+	assert.True(ok)
+	assert.Equal([]byte("message 1"), actual.Payload)
+
+	msg, err = c.Pull("bar")
+	assert.NoError(err)
+	assert.Nil(msg)
+
+	_, err = c.Publish("foo/#", []byte("invalid"))
+	assert.Error(err)
+}
+
+func TestTCPClientSubscribe(t *testing.T) {
+	assert := assert.New(t)
+
+	_, addr := newTCPServer(t)
+
+	c, err := DialTCP(addr)
+	require.NoError(t, err)
+	defer c.Close()
+
+	msgs := make(chan *msgbus.Message, 1)
+	require.NoError(t, c.Subscribe("sensors/#", func(ctx context.Context, msg *msgbus.Message) error {
+		msgs <- msg
+		return nil
+	}))
+
+	_, err = c.Publish("sensors/kitchen/temp", []byte("21"))
+	require.NoError(t, err)
+
+	select {
+	case msg := <-msgs:
+		assert.Equal("sensors/kitchen/temp", msg.Topic.Name)
+		assert.Equal([]byte("21"), msg.Payload)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+
+	c.Close()
+	<-c.Done()
+	assert.Equal(ErrClosed, c.Err())
+
+	_, err = c.Publish("foo", []byte("bar"))
+	assert.Equal(ErrClosed, err)
+}
+
+func TestClientPublishTCP(t *testing.T) {
+	assert := assert.New(t)
+
+	mb, addr := newTCPServer(t)
+
+	client := NewClient("tcp://"+addr, nil)
+	result, err := client.Publish("hello", "hello world")
+	assert.NoError(err)
+	if assert.NotNil(result) {
+		assert.Equal(uint64(0), result.ID)
+		assert.Equal("hello", result.Topic)
+	}
+
+	actual, ok := mb.Get(mb.NewTopic("hello"))
+	assert.True(ok)
+	assert.Equal([]byte("hello world"), actual.Payload)
+}
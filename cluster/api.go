@@ -0,0 +1,143 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/prologic/msgbus"
+)
+
+// Status is the state of a node as seen by itself
+type Status struct {
+	ID     string `json:"id"`
+	State  string `json:"state"`
+	Leader string `json:"leader,omitempty"`
+	Nodes  []Peer `json:"nodes"`
+}
+
+// Status returns the state of the node
+func (n *Node) Status() (Status, error) {
+	nodes, err := n.Nodes()
+	if err != nil {
+		return Status{}, err
+	}
+
+	status := Status{ID: n.self.ID, State: n.raft.State().String(), Nodes: nodes}
+	if leader, ok := n.Leader(); ok {
+		status.Leader = leader.ID
+	}
+	return status, nil
+}
+
+// Admin returns the handler of the API managing the cluster, paths are
+// relative to where it is mounted:
+//
+//	GET    /      returns the status of the node
+//	POST   /      adds the node in the JSON body to the cluster
+//	DELETE /<id>  removes a node from the cluster
+//
+// Changes are forwarded to the leader.
+func (n *Node) Admin() http.Handler {
+	return http.HandlerFunc(n.serveAdmin)
+}
+
+func (n *Node) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	ctx := msgbus.WithRemoteAddr(r.Context(), r.RemoteAddr)
+	path := strings.Trim(r.URL.Path, "/")
+
+	switch {
+	case path == "" && r.Method == "GET":
+		status, err := n.Status()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	case path == "" && r.Method == "POST":
+		if !n.IsLeader() {
+			n.forward(w, r)
+			return
+		}
+
+		var p Peer
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, "invalid node: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := n.Join(p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n.audit(ctx, "join node "+p.ID+" at "+p.Address)
+
+		w.WriteHeader(http.StatusNoContent)
+	case path != "" && !strings.Contains(path, "/") && r.Method == "DELETE":
+		if !n.IsLeader() {
+			n.forward(w, r)
+			return
+		}
+
+		if err := n.Remove(path); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n.audit(ctx, "remove node "+path)
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Not Found", http.StatusNotFound)
+	}
+}
+
+func (n *Node) audit(ctx context.Context, detail string) {
+	n.bus.Audit(ctx, msgbus.AuditEvent{
+		Action: msgbus.AuditAdmin, Result: msgbus.AuditOK, Detail: "cluster: " + detail,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+// JoinCluster asks the cluster with the admin API at url, on any of its
+// nodes, to add this node
+func (n *Node) JoinCluster(ctx context.Context, url string) error {
+	body, err := json.Marshal(n.self)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, vs := range n.header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("cluster: error joining %s: %s", url, res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,784 @@
+// Package cluster replicates a msgbus.MessageBus across several nodes with
+// the Raft consensus algorithm.
+//
+// Publishes and pulls of the HTTP API are appended to the replicated raft
+// log and applied to the bus of every node in the same order, so topics
+// have the same sequence numbers and queues on all nodes. A publish is
+// only acknowledged once it was committed by a majority of the nodes, so
+// it survives the failure of a minority. Clients may connect to any node:
+// followers forward publishes and pulls to the leader, and websocket
+// subscribers of any node receive every message as it is applied.
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/propagation"
+
+	"github.com/prologic/msgbus"
+)
+
+const (
+	// DefaultApplyTimeout is the default time to wait for a command to be
+	// committed
+	DefaultApplyTimeout = 10 * time.Second
+
+	// DefaultRetainSnapshots is the default number of snapshots kept on disk
+	DefaultRetainSnapshots = 2
+
+	// HeaderForwarded is set on requests forwarded to the leader, which
+	// are never forwarded again
+	HeaderForwarded = "X-Msgbus-Forwarded"
+
+	// maxTransportPool is the number of connections kept per peer
+	maxTransportPool = 3
+
+	// transportTimeout is the timeout of transport I/O
+	transportTimeout = 10 * time.Second
+)
+
+// propagator propagates W3C trace context, as the bus does
+var propagator = propagation.TraceContext{}
+
+var (
+	// ErrNoLeader is returned when the cluster has no leader, e.g: during
+	// an election or without a quorum
+	ErrNoLeader = errors.New("cluster: no leader")
+
+	// ErrNotLeader is returned by operations only the leader may perform
+	ErrNotLeader = errors.New("cluster: not the leader")
+)
+
+// Peer is a node of the cluster
+type Peer struct {
+	// ID uniquely identifies the node
+	ID string `json:"id"`
+
+	// Address is the address of the raft transport of the node
+	Address string `json:"address"`
+
+	// API is the url of the HTTP API of the node, where requests are
+	// forwarded when it is the leader
+	API string `json:"api"`
+}
+
+// Options ...
+type Options struct {
+	// ID uniquely identifies the node
+	ID string
+
+	// Bind is the address the raft transport listens on
+	Bind string
+
+	// Advertise is the address of the raft transport advertised to other
+	// nodes, defaults to Bind
+	Advertise string
+
+	// API is the url of the HTTP API of the node
+	API string
+
+	// Dir is the directory the raft log and snapshots are stored in, if
+	// empty they are kept in memory and lost when the node stops
+	Dir string
+
+	// Bootstrap bootstraps a new cluster of Peers, which must include this
+	// node. It is ignored if the node already has state in Dir.
+	Bootstrap bool
+	Peers     []Peer
+
+	// Transport overrides the TCP transport listening on Bind, e.g: with a
+	// raft.InmemTransport to run several nodes in a single process
+	Transport raft.Transport
+
+	// Config overrides the default raft configuration, its LocalID is set
+	// to ID
+	Config *raft.Config
+
+	// ApplyTimeout is the time to wait for a command to be committed
+	ApplyTimeout time.Duration
+
+	// Client is used to forward requests to the leader
+	Client *http.Client
+
+	// Header is sent with requests forwarded by Publish and Pull, e.g: an
+	// Authorization header
+	Header http.Header
+}
+
+// Node is a node of a cluster replicating a bus
+type Node struct {
+	bus  *msgbus.MessageBus
+	self Peer
+
+	raft      *raft.Raft
+	fsm       *fsm
+	transport raft.Transport
+	closers   []io.Closer
+
+	applyTimeout time.Duration
+	client       *http.Client
+	header       http.Header
+}
+
+// NewNode starts a node replicating bus, which must not be modified other
+// than through the node
+func NewNode(bus *msgbus.MessageBus, options *Options) (*Node, error) {
+	if options == nil || options.ID == "" {
+		return nil, fmt.Errorf("cluster: node id must be set")
+	}
+
+	n := &Node{
+		bus:          bus,
+		applyTimeout: DefaultApplyTimeout,
+		client:       http.DefaultClient,
+		header:       options.Header,
+	}
+	if options.ApplyTimeout > 0 {
+		n.applyTimeout = options.ApplyTimeout
+	}
+	if options.Client != nil {
+		n.client = options.Client
+	}
+
+	config := raft.DefaultConfig()
+	if options.Config != nil {
+		c := *options.Config
+		config = &c
+	}
+	config.LocalID = raft.ServerID(options.ID)
+	if config.Logger == nil && config.LogOutput == nil {
+		config.LogOutput = log.StandardLogger().Writer()
+		config.LogLevel = "WARN"
+	}
+
+	transport := options.Transport
+	if transport == nil {
+		t, err := newTCPTransport(options.Bind, options.Advertise)
+		if err != nil {
+			return nil, err
+		}
+		transport = t
+		n.closers = append(n.closers, t)
+	}
+	n.transport = transport
+
+	n.self = Peer{ID: options.ID, Address: string(transport.LocalAddr()), API: options.API}
+	n.fsm = newFSM(bus, append(options.Peers, n.self))
+
+	logs, stable, snaps, err := n.newStores(options.Dir)
+	if err != nil {
+		n.close()
+		return nil, err
+	}
+
+	r, err := raft.NewRaft(config, n.fsm, logs, stable, snaps, transport)
+	if err != nil {
+		n.close()
+		return nil, fmt.Errorf("cluster: error starting raft: %s", err)
+	}
+	n.raft = r
+
+	if options.Bootstrap {
+		peers := options.Peers
+		if len(peers) == 0 {
+			peers = []Peer{n.self}
+		}
+
+		var servers []raft.Server
+		for _, p := range peers {
+			if p.ID == n.self.ID && p.Address == "" {
+				p = n.self
+			}
+			servers = append(servers, raft.Server{
+				ID:      raft.ServerID(p.ID),
+				Address: raft.ServerAddress(p.Address),
+			})
+		}
+
+		err := r.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+		if err != nil && err != raft.ErrCantBootstrap {
+			n.Shutdown()
+			return nil, fmt.Errorf("cluster: error bootstrapping: %s", err)
+		}
+	}
+
+	if metrics := bus.Metrics(); metrics != nil {
+		metrics.NewGaugeFunc(
+			"cluster", "leader",
+			"Whether the node is the leader of the cluster",
+			func() float64 {
+				if n.IsLeader() {
+					return 1
+				}
+				return 0
+			},
+		)
+		metrics.NewCounterVec(
+			"cluster", "forwarded",
+			"Number of requests forwarded to the leader by result",
+			[]string{"result"},
+		)
+	}
+
+	return n, nil
+}
+
+func newTCPTransport(bind, advertise string) (*raft.NetworkTransport, error) {
+	if advertise == "" {
+		advertise = bind
+	}
+	addr, err := net.ResolveTCPAddr("tcp", advertise)
+	if err != nil {
+		return nil, fmt.Errorf("cluster: invalid advertise address %q: %s", advertise, err)
+	}
+
+	t, err := raft.NewTCPTransport(bind, addr, maxTransportPool, transportTimeout, log.StandardLogger().Writer())
+	if err != nil {
+		return nil, fmt.Errorf("cluster: error listening on %s: %s", bind, err)
+	}
+	return t, nil
+}
+
+// newStores returns the raft log, stable and snapshot stores in dir, or in
+// memory if dir is empty
+func (n *Node) newStores(dir string) (raft.LogStore, raft.StableStore, raft.SnapshotStore, error) {
+	if dir == "" {
+		store := raft.NewInmemStore()
+		return store, store, raft.NewInmemSnapshotStore(), nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, nil, fmt.Errorf("cluster: error creating %s: %s", dir, err)
+	}
+
+	store, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cluster: error opening raft log: %s", err)
+	}
+	n.closers = append(n.closers, store)
+
+	snaps, err := raft.NewFileSnapshotStore(dir, DefaultRetainSnapshots, log.StandardLogger().Writer())
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cluster: error opening snapshots: %s", err)
+	}
+
+	return store, store, snaps, nil
+}
+
+// ID returns the id of the node
+func (n *Node) ID() string {
+	return n.self.ID
+}
+
+// IsLeader returns true if the node is the leader
+func (n *Node) IsLeader() bool {
+	return n.raft.State() == raft.Leader
+}
+
+// Leader returns the leader of the cluster, if any
+func (n *Node) Leader() (Peer, bool) {
+	_, id := n.raft.LeaderWithID()
+	if id == "" {
+		return Peer{}, false
+	}
+	return n.fsm.node(string(id))
+}
+
+// Nodes returns the nodes of the cluster
+func (n *Node) Nodes() ([]Peer, error) {
+	future := n.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+
+	var peers []Peer
+	for _, s := range future.Configuration().Servers {
+		p, ok := n.fsm.node(string(s.ID))
+		if !ok {
+			p = Peer{ID: string(s.ID)}
+		}
+		p.Address = string(s.Address)
+		peers = append(peers, p)
+	}
+	return peers, nil
+}
+
+// Join adds a node to the cluster, only the leader can add nodes
+func (n *Node) Join(p Peer) error {
+	if !n.IsLeader() {
+		return ErrNotLeader
+	}
+	if p.ID == "" || p.Address == "" {
+		return fmt.Errorf("cluster: node id and address must be set")
+	}
+
+	err := n.raft.AddVoter(raft.ServerID(p.ID), raft.ServerAddress(p.Address), 0, n.applyTimeout).Error()
+	if err != nil {
+		return fmt.Errorf("cluster: error adding node %s: %s", p.ID, err)
+	}
+
+	_, err = n.apply(command{Op: opJoin, Node: &p, Nodes: n.fsm.peers()})
+	return err
+}
+
+// Remove removes a node from the cluster, only the leader can remove nodes
+func (n *Node) Remove(id string) error {
+	if !n.IsLeader() {
+		return ErrNotLeader
+	}
+
+	err := n.raft.RemoveServer(raft.ServerID(id), 0, n.applyTimeout).Error()
+	if err != nil {
+		return fmt.Errorf("cluster: error removing node %s: %s", id, err)
+	}
+
+	_, err = n.apply(command{Op: opRemove, Node: &Peer{ID: id}})
+	return err
+}
+
+// apply proposes a command and returns the result of applying it
+func (n *Node) apply(cmd command) (interface{}, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	future := n.raft.Apply(data, n.applyTimeout)
+	if err := future.Error(); err != nil {
+		if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+			return nil, ErrNotLeader
+		}
+		return nil, err
+	}
+
+	if err, ok := future.Response().(error); ok {
+		return nil, err
+	}
+	return future.Response(), nil
+}
+
+// Publish publishes payload to topic once committed by the cluster,
+// forwarding it to the leader if necessary
+func (n *Node) Publish(ctx context.Context, topic string, payload []byte, headers map[string]string) error {
+	if n.IsLeader() {
+		_, err := n.apply(command{
+			Op: opPut, Topic: topic, Payload: payload, Headers: headers, Created: time.Now(),
+		})
+		return err
+	}
+
+	req, err := n.newForwardRequest(ctx, "PUT", topic, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cluster: error forwarding publish: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("cluster: error forwarding publish: %s", res.Status)
+	}
+	return nil
+}
+
+// Pull removes and returns the next message of the queue of topic on all
+// nodes, forwarding it to the leader if necessary
+func (n *Node) Pull(ctx context.Context, topic string) (msgbus.Message, bool, error) {
+	if n.IsLeader() {
+		result, err := n.apply(command{Op: opGet, Topic: topic})
+		if err != nil {
+			return msgbus.Message{}, false, err
+		}
+		r := result.(getResult)
+		return r.Message, r.OK, nil
+	}
+
+	req, err := n.newForwardRequest(ctx, "GET", topic, nil)
+	if err != nil {
+		return msgbus.Message{}, false, err
+	}
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return msgbus.Message{}, false, fmt.Errorf("cluster: error forwarding pull: %s", err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		var message msgbus.Message
+		if err := json.NewDecoder(res.Body).Decode(&message); err != nil {
+			return msgbus.Message{}, false, fmt.Errorf("cluster: error decoding message: %s", err)
+		}
+		return message, true, nil
+	case http.StatusNotFound:
+		return msgbus.Message{}, false, nil
+	default:
+		return msgbus.Message{}, false, fmt.Errorf("cluster: error forwarding pull: %s", res.Status)
+	}
+}
+
+// newForwardRequest returns a request to the API of the leader
+func (n *Node) newForwardRequest(ctx context.Context, method, topic string, body io.Reader) (*http.Request, error) {
+	leader, ok := n.Leader()
+	if !ok || leader.API == "" {
+		return nil, ErrNoLeader
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(leader.API, "/")+"/"+topic, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range n.header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	req.Header.Set(HeaderForwarded, n.self.ID)
+
+	return req, nil
+}
+
+// forward proxies a request to the API of the leader
+func (n *Node) forward(w http.ResponseWriter, r *http.Request) {
+	leader, ok := n.Leader()
+	if !ok || leader.API == "" || r.Header.Get(HeaderForwarded) != "" {
+		n.observe("no_leader")
+		http.Error(w, ErrNoLeader.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	target, err := url.Parse(leader.API)
+	if err != nil {
+		n.observe("error")
+		http.Error(w, fmt.Sprintf("invalid leader api %q", leader.API), http.StatusBadGateway)
+		return
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			// The original request uri is forwarded, so requests to handlers
+			// mounted with a prefix are forwarded to the same handler
+			u, _ := url.Parse(req.RequestURI)
+			if u == nil {
+				u = req.URL
+			}
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.URL.Path = strings.TrimSuffix(target.Path, "/") + u.Path
+			req.URL.RawPath = ""
+			req.URL.RawQuery = u.RawQuery
+			req.Host = target.Host
+			req.Header.Set(HeaderForwarded, n.self.ID)
+		},
+		Transport: n.client.Transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			n.observe("error")
+			log.Warnf("[cluster] error forwarding %s %s to %s: %s", r.Method, r.URL.Path, leader.ID, err)
+			http.Error(w, "error forwarding to leader", http.StatusBadGateway)
+		},
+	}
+
+	n.observe("ok")
+	proxy.ServeHTTP(w, r)
+}
+
+func (n *Node) observe(result string) {
+	if metrics := n.bus.Metrics(); metrics != nil {
+		metrics.CounterVec("cluster", "forwarded").WithLabelValues(result).Inc()
+	}
+}
+
+// ServeHTTP serves the HTTP API of the bus, replicating publishes and
+// pulls. Requests other than those are served by the local bus.
+func (n *Node) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	topic := strings.Trim(r.URL.Path, "/")
+
+	_, retained := r.URL.Query()["retained"]
+
+	switch {
+	case r.Method == "DELETE" && retained && topic != "":
+		if !n.IsLeader() {
+			n.forward(w, r)
+			return
+		}
+		n.serveClear(w, r, topic)
+	case topic == "" || r.Method == "DELETE":
+		n.bus.ServeHTTP(w, r)
+	case (r.URL.Path == msgbus.BatchPath || r.URL.Path == msgbus.TransactionPath) && r.Method != "POST" && r.Method != "PUT":
+		n.bus.ServeHTTP(w, r)
+	case r.Method == "GET" && strings.EqualFold(r.Header.Get("Upgrade"), "websocket"):
+		n.bus.ServeHTTP(w, r)
+	case r.Method == "POST" || r.Method == "PUT":
+		if !n.IsLeader() {
+			n.forward(w, r)
+			return
+		}
+		n.servePublish(w, r, topic)
+	case r.Method == "GET":
+		if !n.IsLeader() {
+			n.forward(w, r)
+			return
+		}
+		n.servePull(w, r, topic)
+	default:
+		n.bus.ServeHTTP(w, r)
+	}
+}
+
+func (n *Node) servePublish(w http.ResponseWriter, r *http.Request, topic string) {
+	if r.URL.Path == msgbus.TransactionPath {
+		n.serveBatch(w, r, "", opTransaction)
+		return
+	}
+	if msgbus.IsBatch(r) {
+		if r.URL.Path == msgbus.BatchPath {
+			topic = ""
+		}
+		n.serveBatch(w, r, topic, opBatch)
+		return
+	}
+
+	ctx := msgbus.WithRemoteAddr(r.Context(), r.RemoteAddr)
+
+	if msgbus.IsPattern(topic) {
+		http.Error(w, fmt.Sprintf("cannot publish to pattern %q", topic), http.StatusBadRequest)
+		return
+	}
+
+	// Messages without a key to compacted topics would be rejected as they
+	// are applied, they are rejected before being replicated
+	key := r.URL.Query().Get("key")
+	if key == "" && n.bus.TopicOptions(topic).Compacted {
+		msg := msgbus.ErrKeyRequired.Error()
+		n.bus.Audit(ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditPublish, Result: msgbus.AuditRejected, Topic: topic, Detail: msg,
+		})
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	retain, err := msgbus.ParseRetain(r.URL.Query().Get("retain"), r.Header.Get(msgbus.RetainHeader))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid retain: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	maxPayloadSize := n.bus.TopicOptions(topic).MaxPayloadSize
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(maxPayloadSize)+1))
+	if err != nil {
+		msg := fmt.Sprintf("error reading payload: %s", err)
+		n.bus.Audit(ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditPublish, Result: msgbus.AuditError, Topic: topic, Detail: msg,
+		})
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxPayloadSize {
+		msg := "payload exceeds max-payload-size"
+		n.bus.Audit(ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditPublish, Result: msgbus.AuditRejected, Topic: topic,
+			Size: len(body), Detail: msg,
+		})
+		http.Error(w, msg, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// The trace context and headers prefixed with msgbus.HeaderPrefix are
+	// replicated with the message
+	headers := make(map[string]string)
+	for k, vs := range r.Header {
+		if strings.HasPrefix(k, msgbus.HeaderPrefix) && len(vs) > 0 {
+			headers[strings.ToLower(k)] = vs[0]
+		}
+	}
+	propagator.Inject(
+		propagator.Extract(ctx, propagation.HeaderCarrier(r.Header)),
+		propagation.MapCarrier(headers),
+	)
+
+	result, err := n.apply(command{
+		Op: opPut, Topic: topic, Key: key, Payload: body, Headers: headers,
+		Created: time.Now(), Retain: retain,
+		IdempotencyKey: r.Header.Get(msgbus.IdempotencyKeyHeader),
+	})
+	if errors.Is(err, msgbus.ErrKeyRequired) {
+		n.bus.Audit(ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditPublish, Result: msgbus.AuditRejected, Topic: topic, Detail: err.Error(),
+		})
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		n.bus.Audit(ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditPublish, Result: msgbus.AuditError, Topic: topic, Detail: err.Error(),
+		})
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	put := result.(putResult)
+	event := msgbus.AuditEvent{Action: msgbus.AuditPublish, Result: msgbus.AuditOK}
+	if put.Duplicate {
+		event.Detail = "duplicate"
+	}
+	n.bus.Audit(ctx, event.WithMessage(put.Message))
+
+	res := msgbus.NewPublishResult(put.Message, put.Delivered)
+	res.Duplicate = put.Duplicate
+	msgbus.WritePublishResult(w, res)
+}
+
+// serveBatch publishes a batch of messages to topic, or to the topics named
+// by the messages if topic is empty, as a single command of op: opBatch, or
+// opTransaction to publish all messages or none
+func (n *Node) serveBatch(w http.ResponseWriter, r *http.Request, topic, op string) {
+	ctx := msgbus.WithRemoteAddr(r.Context(), r.RemoteAddr)
+
+	messages, err := n.bus.ReadBatch(r.Body, topic)
+	if err != nil {
+		n.bus.Audit(ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditPublish, Result: msgbus.AuditRejected, Topic: topic, Detail: err.Error(),
+		})
+		http.Error(w, err.Error(), msgbus.BatchStatus(err))
+		return
+	}
+
+	// The trace context of the request is replicated with every message
+	tctx := propagator.Extract(ctx, propagation.HeaderCarrier(r.Header))
+	for i, m := range messages {
+		headers := make(map[string]string, len(m.Headers))
+		for k, v := range m.Headers {
+			headers[k] = v
+		}
+		propagator.Inject(tctx, propagation.MapCarrier(headers))
+		messages[i].Headers = headers
+	}
+
+	result, err := n.apply(command{Op: op, Messages: messages, Created: time.Now()})
+	var txErr *msgbus.TransactionError
+	if errors.As(err, &txErr) {
+		n.bus.Audit(ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditPublish, Result: msgbus.AuditRejected, Detail: err.Error(),
+		})
+		http.Error(w, err.Error(), msgbus.BatchStatus(err))
+		return
+	}
+	if err != nil {
+		n.bus.Audit(ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditPublish, Result: msgbus.AuditError, Topic: topic, Detail: err.Error(),
+		})
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	results := result.([]msgbus.BatchResult)
+	n.bus.AuditBatch(ctx, messages, results)
+
+	msgbus.WriteBatchResults(w, results)
+}
+
+func (n *Node) servePull(w http.ResponseWriter, r *http.Request, topic string) {
+	ctx := msgbus.WithRemoteAddr(r.Context(), r.RemoteAddr)
+
+	cmd := command{Op: opGet, Topic: topic}
+	if v := r.URL.Query().Get("partition"); v != "" {
+		partition, err := msgbus.ParsePartition(n.bus.NewTopic(topic), v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cmd.Partition = &partition
+	}
+
+	result, err := n.apply(cmd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	get := result.(getResult)
+	message, ok := get.Message, get.OK
+	if !ok {
+		n.bus.Audit(ctx, msgbus.AuditEvent{Action: msgbus.AuditPull, Result: msgbus.AuditEmpty, Topic: topic})
+		http.Error(w, fmt.Sprintf("no messages enqueued for topic: %s", topic), http.StatusNotFound)
+		return
+	}
+
+	n.bus.Audit(ctx, msgbus.AuditEvent{Action: msgbus.AuditPull, Result: msgbus.AuditOK}.WithMessage(message))
+
+	message.Topic = message.Topic.Copy()
+	out, err := json.Marshal(message)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error serializing message: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+// serveClear clears the retained message of topic on all nodes
+func (n *Node) serveClear(w http.ResponseWriter, r *http.Request, topic string) {
+	ctx := msgbus.WithRemoteAddr(r.Context(), r.RemoteAddr)
+
+	result, err := n.apply(command{Op: opClear, Topic: topic})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if !result.(bool) {
+		n.bus.Audit(ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditDelete, Result: msgbus.AuditEmpty, Topic: topic, Detail: "retained",
+		})
+		http.Error(w, fmt.Sprintf("no retained message for topic: %s", topic), http.StatusNotFound)
+		return
+	}
+
+	n.bus.Audit(ctx, msgbus.AuditEvent{
+		Action: msgbus.AuditDelete, Result: msgbus.AuditOK, Topic: topic, Detail: "retained",
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Shutdown stops the node, which leaves the cluster only if it was
+// removed first
+func (n *Node) Shutdown() error {
+	var err error
+	if n.raft != nil {
+		err = n.raft.Shutdown().Error()
+	}
+	n.close()
+	return err
+}
+
+func (n *Node) close() {
+	for _, c := range n.closers {
+		c.Close()
+	}
+	n.closers = nil
+}
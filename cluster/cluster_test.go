@@ -0,0 +1,436 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/prologic/msgbus"
+)
+
+// testNode is a node of an in-process test cluster with its HTTP API
+type testNode struct {
+	sync.RWMutex
+
+	*Node
+	bus       *msgbus.MessageBus
+	server    *httptest.Server
+	transport *raft.InmemTransport
+	mux       *http.ServeMux
+}
+
+func (tn *testNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tn.RLock()
+	mux := tn.mux
+	tn.RUnlock()
+
+	if mux == nil {
+		http.Error(w, "starting", http.StatusServiceUnavailable)
+		return
+	}
+	mux.ServeHTTP(w, r)
+}
+
+// testCluster is an in-process cluster of nodes connected by in-memory
+// transports
+type testCluster struct {
+	t     *testing.T
+	nodes []*testNode
+}
+
+func testConfig() *raft.Config {
+	config := raft.DefaultConfig()
+	config.HeartbeatTimeout = 50 * time.Millisecond
+	config.ElectionTimeout = 50 * time.Millisecond
+	config.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.CommitTimeout = 5 * time.Millisecond
+	return config
+}
+
+func newTestCluster(t *testing.T, size int) *testCluster {
+	c := &testCluster{t: t}
+
+	var peers []Peer
+	for i := 0; i < size; i++ {
+		tn := c.newTestNode(fmt.Sprintf("node%d", i))
+		peers = append(peers, Peer{
+			ID:      fmt.Sprintf("node%d", i),
+			Address: string(tn.transport.LocalAddr()),
+			API:     tn.server.URL,
+		})
+	}
+
+	for i, tn := range c.nodes {
+		c.start(tn, &Options{Bootstrap: true, Peers: peers}, peers[i].ID)
+	}
+
+	t.Cleanup(c.shutdown)
+
+	return c
+}
+
+// newTestNode returns a node not started yet, connected to all others
+func (c *testCluster) newTestNode(id string) *testNode {
+	tn := &testNode{bus: msgbus.New(nil)}
+	tn.server = httptest.NewServer(tn)
+	_, tn.transport = raft.NewInmemTransport("")
+
+	for _, other := range c.nodes {
+		tn.transport.Connect(other.transport.LocalAddr(), other.transport)
+		other.transport.Connect(tn.transport.LocalAddr(), tn.transport)
+	}
+	c.nodes = append(c.nodes, tn)
+
+	return tn
+}
+
+func (c *testCluster) start(tn *testNode, options *Options, id string) {
+	options.ID = id
+	options.API = tn.server.URL
+	options.Transport = tn.transport
+	options.Config = testConfig()
+
+	node, err := NewNode(tn.bus, options)
+	require.NoError(c.t, err)
+
+	mux := http.NewServeMux()
+	mux.Handle("/", node)
+	mux.Handle("/_cluster/", http.StripPrefix("/_cluster", node.Admin()))
+
+	tn.Lock()
+	tn.Node = node
+	tn.mux = mux
+	tn.Unlock()
+}
+
+func (c *testCluster) shutdown() {
+	for _, tn := range c.nodes {
+		if tn.Node != nil {
+			tn.Shutdown()
+		}
+		tn.server.Close()
+	}
+}
+
+// leader waits for a leader to be elected among the running nodes
+func (c *testCluster) leader() *testNode {
+	var leader *testNode
+	waitFor(c.t, func() bool {
+		for _, tn := range c.nodes {
+			if tn.Node != nil && tn.IsLeader() {
+				leader = tn
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+// follower returns a running node that is not the leader
+func (c *testCluster) follower() *testNode {
+	leader := c.leader()
+	for _, tn := range c.nodes {
+		if tn != leader && tn.Node != nil {
+			return tn
+		}
+	}
+	c.t.Fatal("no follower")
+	return nil
+}
+
+// kill stops a node and disconnects it from all others
+func (c *testCluster) kill(tn *testNode) {
+	require.NoError(c.t, tn.Shutdown())
+	tn.Node = nil
+	for _, other := range c.nodes {
+		other.transport.Disconnect(tn.transport.LocalAddr())
+	}
+}
+
+// queue returns the payloads of the queue of topic on a node
+func queue(tn *testNode, topic string) []string {
+	var payloads []string
+	for _, ts := range tn.bus.Snapshot() {
+		if ts.Topic.Name == topic {
+			for _, m := range ts.Messages {
+				payloads = append(payloads, fmt.Sprintf("%d:%s", m.ID, m.Payload))
+			}
+		}
+	}
+	return payloads
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for condition")
+}
+
+// replicated waits for the queue of topic to be expected on all running
+// nodes
+func (c *testCluster) replicated(topic string, expected ...string) {
+	for _, tn := range c.nodes {
+		if tn.Node == nil {
+			continue
+		}
+		waitFor(c.t, func() bool { return assert.ObjectsAreEqual(expected, queue(tn, topic)) })
+	}
+}
+
+func TestClusterForward(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newTestCluster(t, 3)
+	follower := c.follower()
+
+	// Publishes to followers are forwarded to the leader
+	for _, payload := range []string{"a", "b"} {
+		res, err := http.Post(follower.server.URL+"/hello", "text/plain", bytes.NewBufferString(payload))
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(http.StatusAccepted, res.StatusCode)
+	}
+	c.replicated("hello", "0:a", "1:b")
+
+	// Pulls too, removing the message on all nodes
+	res, err := http.Get(follower.server.URL + "/hello")
+	require.NoError(t, err)
+	var message msgbus.Message
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&message))
+	res.Body.Close()
+	assert.Equal(uint64(0), message.ID)
+	assert.Equal("a", string(message.Payload))
+	c.replicated("hello", "1:b")
+
+	message, ok, err := follower.Pull(context.Background(), "hello")
+	require.NoError(t, err)
+	assert.True(ok)
+	assert.Equal("b", string(message.Payload))
+
+	_, ok, err = c.leader().Pull(context.Background(), "hello")
+	require.NoError(t, err)
+	assert.False(ok)
+
+	res, err = http.Get(follower.server.URL + "/hello")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(http.StatusNotFound, res.StatusCode)
+}
+
+func TestClusterBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newTestCluster(t, 3)
+	follower := c.follower()
+
+	body := `[{"topic": "foo", "payload": "YQ=="}, {"topic": "bar", "payload": "Yg=="}, {"topic": "foo", "payload": "Yw=="}]`
+	res, err := http.Post(follower.server.URL+msgbus.BatchPath, "application/json", bytes.NewBufferString(body))
+	require.NoError(t, err)
+	var results []msgbus.BatchResult
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&results))
+	res.Body.Close()
+	assert.Equal(http.StatusAccepted, res.StatusCode)
+	if assert.Len(results, 3) {
+		assert.Equal(uint64(0), results[0].ID)
+		assert.Equal(uint64(0), results[1].ID)
+		assert.Equal(uint64(1), results[2].ID)
+	}
+
+	c.replicated("foo", "0:a", "1:c")
+	c.replicated("bar", "0:b")
+}
+
+func TestClusterTransaction(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newTestCluster(t, 3)
+	follower := c.follower()
+
+	transaction := func(body string) *http.Response {
+		res, err := http.Post(follower.server.URL+msgbus.TransactionPath, "application/json", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		return res
+	}
+
+	res := transaction(`[{"topic": "orders.created", "payload": "YQ=="}, {"topic": "audit.orders", "payload": "Yg=="}]`)
+	res.Body.Close()
+	assert.Equal(http.StatusAccepted, res.StatusCode)
+	c.replicated("orders.created", "0:a")
+	c.replicated("audit.orders", "0:b")
+
+	// Aborted transactions are published on no node
+	res = transaction(`[{"topic": "orders.created", "payload": "Yw=="}, {"topic": "audit/#", "payload": "ZA=="}]`)
+	res.Body.Close()
+	assert.Equal(http.StatusBadRequest, res.StatusCode)
+
+	require.NoError(t, c.leader().Publish(context.Background(), "orders.created", []byte("e"), nil))
+	c.replicated("orders.created", "0:a", "1:e")
+}
+
+func TestClusterRetained(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newTestCluster(t, 3)
+	follower := c.follower()
+
+	res, err := http.Post(follower.server.URL+"/status?retain=true", "text/plain", bytes.NewBufferString("online"))
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(http.StatusAccepted, res.StatusCode)
+
+	for _, tn := range c.nodes {
+		waitFor(t, func() bool { return len(tn.bus.Retained("status")) == 1 })
+	}
+
+	req, _ := http.NewRequest("DELETE", follower.server.URL+"/status?retained", nil)
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(http.StatusNoContent, res.StatusCode)
+
+	for _, tn := range c.nodes {
+		waitFor(t, func() bool { return len(tn.bus.Retained("status")) == 0 })
+	}
+}
+
+func TestClusterLeaderFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newTestCluster(t, 3)
+	ctx := context.Background()
+
+	for _, payload := range []string{"a", "b", "c"} {
+		require.NoError(t, c.follower().Publish(ctx, "events", []byte(payload), nil))
+	}
+
+	old := c.leader()
+	c.kill(old)
+
+	// Acknowledged publishes survive and sequences continue
+	leader := c.leader()
+	assert.NotEqual(old, leader)
+	c.replicated("events", "0:a", "1:b", "2:c")
+
+	require.NoError(t, c.follower().Publish(ctx, "events", []byte("d"), nil))
+	c.replicated("events", "0:a", "1:b", "2:c", "3:d")
+}
+
+func TestClusterJoin(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newTestCluster(t, 3)
+	ctx := context.Background()
+
+	require.NoError(t, c.leader().Publish(ctx, "events", []byte("a"), nil))
+
+	tn := c.newTestNode("node3")
+	c.start(tn, &Options{}, "node3")
+
+	// Joins are forwarded to the leader
+	require.NoError(t, tn.JoinCluster(ctx, c.follower().server.URL+"/_cluster/"))
+	c.replicated("events", "0:a")
+	waitFor(t, func() bool { _, ok := tn.Leader(); return ok })
+
+	res, err := http.Get(tn.server.URL + "/_cluster/")
+	require.NoError(t, err)
+	var status Status
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&status))
+	res.Body.Close()
+	assert.Equal("node3", status.ID)
+	assert.Equal(c.leader().ID(), status.Leader)
+	assert.Len(status.Nodes, 4)
+
+	// The new node can forward to the leader
+	require.NoError(t, tn.Publish(ctx, "events", []byte("b"), nil))
+	c.replicated("events", "0:a", "1:b")
+
+	req, _ := http.NewRequest("DELETE", tn.server.URL+"/_cluster/node3", nil)
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(http.StatusNoContent, res.StatusCode)
+
+	nodes, err := c.leader().Nodes()
+	require.NoError(t, err)
+	assert.Len(nodes, 3)
+}
+
+func TestFSMIdempotentPut(t *testing.T) {
+	assert := assert.New(t)
+
+	bus := msgbus.New(nil)
+	f := newFSM(bus, nil)
+
+	data, _ := json.Marshal(command{
+		Op: opPut, Topic: "foo", Payload: []byte("x"), Created: time.Now(),
+		IdempotencyKey: "a",
+	})
+	first := f.Apply(&raft.Log{Data: data}).(putResult)
+	second := f.Apply(&raft.Log{Data: data}).(putResult)
+	assert.False(first.Duplicate)
+	assert.True(second.Duplicate)
+	assert.Equal(first.Message.ID, second.Message.ID)
+
+	t1 := bus.NewTopic("foo")
+	_, ok := bus.Get(t1)
+	assert.True(ok)
+	_, ok = bus.Get(t1)
+	assert.False(ok)
+}
+
+func TestFSMSnapshotRestore(t *testing.T) {
+	assert := assert.New(t)
+
+	bus := msgbus.New(nil)
+	f := newFSM(bus, []Peer{{ID: "a", API: "http://a"}})
+
+	data, _ := json.Marshal(command{Op: opPut, Topic: "foo", Payload: []byte("x"), Created: time.Now()})
+	put, ok := f.Apply(&raft.Log{Data: data}).(putResult)
+	require.True(t, ok)
+	assert.Equal(uint64(0), put.Message.ID)
+	assert.False(put.Duplicate)
+
+	assert.Error(f.Apply(&raft.Log{Data: []byte(`{"op": "nope"}`)}).(error))
+
+	s, err := f.Snapshot()
+	require.NoError(t, err)
+	sink := &testSink{}
+	require.NoError(t, s.Persist(sink))
+
+	other := msgbus.New(nil)
+	g := newFSM(other, nil)
+	require.NoError(t, g.Restore(sink))
+
+	p, ok := g.node("a")
+	assert.True(ok)
+	assert.Equal("http://a", p.API)
+
+	message, ok := other.Get(other.NewTopic("foo"))
+	assert.True(ok)
+	assert.Equal("x", string(message.Payload))
+	assert.Equal(uint64(1), other.NewTopic("foo").Sequence)
+}
+
+// testSink is an in-memory raft.SnapshotSink
+type testSink struct {
+	bytes.Buffer
+}
+
+func (s *testSink) ID() string    { return "test" }
+func (s *testSink) Cancel() error { return nil }
+func (s *testSink) Close() error  { return nil }
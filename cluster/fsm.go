@@ -0,0 +1,229 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+
+	"github.com/prologic/msgbus"
+)
+
+// Operations of commands in the raft log
+const (
+	opPut         = "put"
+	opBatch       = "batch"
+	opTransaction = "transaction"
+	opGet         = "get"
+	opClear       = "clear"
+	opJoin        = "join"
+	opRemove      = "remove"
+)
+
+// command is an operation on the bus replicated by the raft log
+type command struct {
+	Op string `json:"op"`
+
+	// Topic, Key, Payload, Headers and Created describe the message of a
+	// put, Created is set by the leader so all nodes agree on it. Retain
+	// stores the message as the retained message of its topic and a put
+	// with an IdempotencyKey already published is not put again.
+	Topic          string            `json:"topic,omitempty"`
+	Key            string            `json:"key,omitempty"`
+	Payload        []byte            `json:"payload,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	Created        time.Time         `json:"created,omitempty"`
+	Retain         bool              `json:"retain,omitempty"`
+	IdempotencyKey string            `json:"idempotency_key,omitempty"`
+
+	// Messages are the messages of a batch or transaction, all created at
+	// Created
+	Messages []msgbus.Publishing `json:"messages,omitempty"`
+
+	// Partition is the partition of a get, any partition if nil
+	Partition *int `json:"partition,omitempty"`
+
+	// Node is the node joining or removed, Nodes the other nodes known to
+	// the leader when one joins so the joining node learns their APIs
+	Node  *Peer  `json:"node,omitempty"`
+	Nodes []Peer `json:"nodes,omitempty"`
+}
+
+// putResult is the result of applying a put, Duplicate if the message was
+// published before with the same idempotency key. Delivered counts the
+// subscribers of the node applying it.
+type putResult struct {
+	Message   msgbus.Message
+	Delivered int
+	Duplicate bool
+}
+
+// getResult is the result of applying a get
+type getResult struct {
+	Message msgbus.Message
+	OK      bool
+}
+
+// fsm applies the raft log to a bus. Since every node applies the same
+// commands in the same order, topics have the same sequences and queues
+// on every node.
+type fsm struct {
+	sync.RWMutex
+
+	bus *msgbus.MessageBus
+
+	// nodes are the nodes of the cluster by id, used to find the API of
+	// the leader
+	nodes map[string]Peer
+}
+
+func newFSM(bus *msgbus.MessageBus, peers []Peer) *fsm {
+	f := &fsm{bus: bus, nodes: make(map[string]Peer)}
+	for _, p := range peers {
+		f.nodes[p.ID] = p
+	}
+	return f
+}
+
+// Apply applies a committed command, the result is returned to the leader
+// that proposed it
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	var cmd command
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		return fmt.Errorf("invalid command at index %d: %s", l.Index, err)
+	}
+
+	switch cmd.Op {
+	case opPut:
+		message, result, err := f.bus.PutMessage(context.Background(), msgbus.Publishing{
+			Topic: cmd.Topic, Key: cmd.Key, Payload: cmd.Payload, Headers: cmd.Headers,
+			IdempotencyKey: cmd.IdempotencyKey, Created: cmd.Created, Retain: cmd.Retain,
+		})
+		if err != nil {
+			return err
+		}
+		if result.Duplicate {
+			return putResult{Message: message, Duplicate: true}
+		}
+		return putResult{Message: message, Delivered: result.Delivered}
+	case opBatch:
+		for i := range cmd.Messages {
+			cmd.Messages[i].Created = cmd.Created
+		}
+		return f.bus.PutBatch(context.Background(), cmd.Messages)
+	case opTransaction:
+		for i := range cmd.Messages {
+			cmd.Messages[i].Created = cmd.Created
+		}
+		results, err := f.bus.PutTransaction(context.Background(), cmd.Messages)
+		if err != nil {
+			return err
+		}
+		return results
+	case opGet:
+		t := f.bus.NewTopic(cmd.Topic)
+		if cmd.Partition != nil {
+			message, ok := f.bus.GetPartition(t, *cmd.Partition)
+			return getResult{Message: message, OK: ok}
+		}
+		message, ok := f.bus.Get(t)
+		return getResult{Message: message, OK: ok}
+	case opClear:
+		return f.bus.ClearRetained(cmd.Topic)
+	case opJoin:
+		f.Lock()
+		for _, p := range cmd.Nodes {
+			f.nodes[p.ID] = p
+		}
+		if cmd.Node != nil {
+			f.nodes[cmd.Node.ID] = *cmd.Node
+		}
+		f.Unlock()
+		return nil
+	case opRemove:
+		if cmd.Node != nil {
+			f.Lock()
+			delete(f.nodes, cmd.Node.ID)
+			f.Unlock()
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q at index %d", cmd.Op, l.Index)
+	}
+}
+
+// node returns the node with id
+func (f *fsm) node(id string) (Peer, bool) {
+	f.RLock()
+	defer f.RUnlock()
+
+	p, ok := f.nodes[id]
+	return p, ok
+}
+
+// peers returns all known nodes
+func (f *fsm) peers() []Peer {
+	f.RLock()
+	defer f.RUnlock()
+
+	peers := make([]Peer, 0, len(f.nodes))
+	for _, p := range f.nodes {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// snapshot is the state of the fsm
+type snapshot struct {
+	Topics []msgbus.TopicSnapshot `json:"topics"`
+	Nodes  map[string]Peer        `json:"nodes"`
+}
+
+// Snapshot returns the current state of the bus and nodes
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	f.RLock()
+	defer f.RUnlock()
+
+	s := &snapshot{Topics: f.bus.Snapshot(), Nodes: make(map[string]Peer, len(f.nodes))}
+	for id, p := range f.nodes {
+		s.Nodes[id] = p
+	}
+	return s, nil
+}
+
+// Restore replaces the state of the bus and nodes with a snapshot
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	var s snapshot
+	if err := json.NewDecoder(rc).Decode(&s); err != nil {
+		return fmt.Errorf("error decoding snapshot: %s", err)
+	}
+
+	f.bus.Restore(s.Topics)
+
+	f.Lock()
+	defer f.Unlock()
+	f.nodes = s.Nodes
+	if f.nodes == nil {
+		f.nodes = make(map[string]Peer)
+	}
+
+	return nil
+}
+
+// Persist writes the snapshot to sink
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+// Release ...
+func (s *snapshot) Release() {}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
 	"io/ioutil"
 	"log"
 	"os"
@@ -8,6 +11,7 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	"github.com/prologic/msgbus"
 	"github.com/prologic/msgbus/client"
 )
 
@@ -20,7 +24,10 @@ var pubCmd = &cobra.Command{
 arguments or from standard input if - is used as the first and only argument.
 
 This is an asynchronous operation and does not wait for a response unless the
--w/--wait option is also present.`,
+-w/--wait option is also present.
+
+With -b/--batch each line of standard input is published as a message, in
+batches of up to 100 messages per request.`,
 	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		uri := viper.GetString("uri")
@@ -33,7 +40,33 @@ This is an asynchronous operation and does not wait for a response unless the
 			message = args[1]
 		}
 
-		publish(client, topic, message)
+		key, _ := cmd.Flags().GetString("key")
+		retain, _ := cmd.Flags().GetBool("retain")
+
+		if key != "" && retain {
+			log.Fatalf("--key and --retain cannot be used together")
+		}
+
+		spool, _ := cmd.Flags().GetString("spool")
+		wait, _ := cmd.Flags().GetBool("wait")
+
+		if spool != "" && wait {
+			log.Fatalf("--spool and --wait cannot be used together")
+		}
+
+		batch, _ := cmd.Flags().GetBool("batch")
+		if batch {
+			if retain || spool != "" {
+				log.Fatalf("--batch cannot be used with --retain or --spool")
+			}
+			if message != "" && message != "-" {
+				log.Fatalf("--batch reads messages from stdin")
+			}
+			publishBatch(client, topic, key, wait)
+			return
+		}
+
+		publish(client, topic, key, retain, spool, wait, message)
 	},
 }
 
@@ -44,11 +77,36 @@ func init() {
 		"wait", "w", false,
 		"Waits for a response and prints it before terminating",
 	)
+
+	pubCmd.Flags().StringP(
+		"key", "k", "",
+		"Key of the message, messages with the same key are kept in order",
+	)
+
+	pubCmd.Flags().BoolP(
+		"retain", "r", false,
+		"Retains the message as the last message sent to new subscribers",
+	)
+
+	pubCmd.Flags().StringP(
+		"spool", "s", "",
+		"Spools the message to the given directory if the server is unavailable",
+	)
+
+	pubCmd.Flags().BoolP(
+		"batch", "b", false,
+		"Publishes each line of stdin as a message in batches",
+	)
 }
 
-const defaultTopic = "hello"
+const (
+	defaultTopic = "hello"
+
+	// batchLength is the number of lines published per batch by --batch
+	batchLength = 100
+)
 
-func publish(client *client.Client, topic, message string) {
+func publish(c *client.Client, topic, key string, retain bool, spool string, wait bool, message string) {
 	if topic == "" {
 		topic = defaultTopic
 	}
@@ -62,8 +120,102 @@ func publish(client *client.Client, topic, message string) {
 		message = string(buf[:])
 	}
 
-	err := client.Publish(topic, message)
+	var opts []client.PublishOption
+	if key != "" {
+		opts = append(opts, client.WithKey(key))
+	}
+	if retain {
+		opts = append(opts, client.WithRetain())
+	}
+
+	ctx := context.Background()
+
+	if spool == "" {
+		result, err := c.PublishContext(ctx, topic, []byte(message), opts...)
+		if err != nil {
+			log.Fatalf("error publishing message: %s", err)
+		}
+		if wait {
+			out, err := json.Marshal(result)
+			if err != nil {
+				log.Fatalf("error marshalling result: %s", err)
+			}
+			os.Stdout.Write(out)
+			os.Stdout.Write([]byte{'\n'})
+		}
+		return
+	}
+
+	p, err := client.NewSpoolingPublisher(c, spool, nil)
 	if err != nil {
+		log.Fatalf("error opening spool: %s", err)
+	}
+	defer p.Close()
+
+	// Replay messages spooled by previous runs first so they are published
+	// before this one
+	if err := p.Flush(ctx); err != nil {
+		log.Printf("error replaying spool: %s", err)
+	}
+
+	if err := p.Publish(ctx, topic, []byte(message), opts...); err != nil {
 		log.Fatalf("error publishing message: %s", err)
 	}
+
+	if depth := p.Depth(); depth > 0 {
+		log.Printf("%d message(s) spooled in %s", depth, spool)
+	}
+}
+
+func publishBatch(c *client.Client, topic, key string, wait bool) {
+	if topic == "" {
+		topic = defaultTopic
+	}
+
+	ctx := context.Background()
+	rejected := 0
+
+	flush := func(messages []msgbus.Publishing) {
+		results, err := c.PublishBatch(ctx, topic, messages)
+		if err != nil {
+			log.Fatalf("error publishing batch: %s", err)
+		}
+		for _, result := range results {
+			if result.Error != "" {
+				log.Printf("message rejected: %s", result.Error)
+				rejected++
+				continue
+			}
+			if wait {
+				out, err := json.Marshal(result.PublishResult)
+				if err != nil {
+					log.Fatalf("error marshalling result: %s", err)
+				}
+				os.Stdout.Write(out)
+				os.Stdout.Write([]byte{'\n'})
+			}
+		}
+	}
+
+	var messages []msgbus.Publishing
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		messages = append(messages, msgbus.Publishing{
+			Key:     key,
+			Payload: append([]byte(nil), scanner.Bytes()...),
+		})
+		if len(messages) == batchLength {
+			flush(messages)
+			messages = messages[:0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("error reading messages from stdin: %s", err)
+	}
+	flush(messages)
+
+	if rejected > 0 {
+		log.Fatalf("%d message(s) rejected", rejected)
+	}
 }
@@ -1,9 +1,18 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	"github.com/prologic/msgbus"
 	"github.com/prologic/msgbus/client"
 )
 
@@ -16,6 +25,9 @@ var pullCmd = &cobra.Command{
 and prints the message to standard output. Otherwise if the queue for the
 given topic is empty, this does nothing.
 
+With -a/--all messages are pulled until the queue is empty and with
+-f/--follow the queue is polled for new messages until interrupted.
+
 This is primarily useful in situations where a subscription was lost and you
 want to "catch up" and pull any messages left in the queue for that topic.`,
 	Args: cobra.MinimumNArgs(1),
@@ -25,18 +37,91 @@ want to "catch up" and pull any messages left in the queue for that topic.`,
 
 		topic := args[0]
 
-		pull(client, topic)
+		partition, _ := cmd.Flags().GetInt("partition")
+		all, _ := cmd.Flags().GetBool("all")
+		follow, _ := cmd.Flags().GetBool("follow")
+		interval, _ := cmd.Flags().GetDuration("interval")
+
+		if !follow {
+			interval = 0
+		}
+
+		if err := pull(client, topic, partition, all || follow, interval); err != nil {
+			log.Fatalf("error pulling from %s: %s", topic, err)
+		}
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(pullCmd)
+
+	pullCmd.Flags().IntP(
+		"partition", "p", -1,
+		"Pulls from the given partition of a partitioned topic only",
+	)
+
+	pullCmd.Flags().BoolP(
+		"all", "a", false,
+		"Pulls messages until the queue is empty",
+	)
+
+	pullCmd.Flags().BoolP(
+		"follow", "f", false,
+		"Pulls messages continuously, polling the queue when it is empty",
+	)
+
+	pullCmd.Flags().DurationP(
+		"interval", "i", time.Second,
+		"Interval to poll an empty queue at with -f/--follow",
+	)
 }
 
-func pull(client *client.Client, topic string) {
+func pull(c *client.Client, topic string, partition int, all bool, interval time.Duration) error {
 	if topic == "" {
 		topic = defaultTopic
 	}
 
-	client.Pull(topic)
+	var opts []client.PullOption
+	if partition >= 0 {
+		opts = append(opts, client.WithPartition(partition))
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	if !all {
+		msg, err := c.PullContext(ctx, topic, opts...)
+		if err == client.ErrEmpty {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return printMessage(msg)
+	}
+
+	p := c.Puller(topic, opts...)
+	p.PollInterval = interval
+	for p.Next(ctx) {
+		if err := printMessage(p.Message()); err != nil {
+			return err
+		}
+	}
+	if err := p.Err(); err != nil && ctx.Err() == nil {
+		return err
+	}
+
+	return nil
+}
+
+// printMessage writes msg as JSON to standard output
+func printMessage(msg *msgbus.Message) error {
+	out, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	os.Stdout.Write(out)
+	os.Stdout.Write([]byte{'\r', '\n'})
+	return nil
 }
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/spf13/cobra"
@@ -27,7 +29,6 @@ supplied command is executed with the contents of the message as stdin.`,
 	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		uri := viper.GetString("uri")
-		client := client.NewClient(uri, nil)
 
 		topic := args[0]
 
@@ -40,28 +41,57 @@ supplied command is executed with the contents of the message as stdin.`,
 			args = args[2:]
 		}
 
-		subscribe(client, topic, command, args)
+		if strings.HasPrefix(uri, "tcp://") {
+			subscribeTCP(strings.TrimPrefix(uri, "tcp://"), topic, command, args)
+			return
+		}
+
+		group, _ := cmd.Flags().GetString("group")
+		partition, _ := cmd.Flags().GetInt("partition")
+		concurrency, _ := cmd.Flags().GetInt("concurrency")
+		ordered, _ := cmd.Flags().GetBool("ordered")
+
+		client := client.NewClient(uri, nil)
+		subscribe(client, topic, group, partition, concurrency, ordered, command, args)
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(subCmd)
+
+	subCmd.Flags().StringP(
+		"group", "g", "",
+		"Subscribes as a member of the given consumer group",
+	)
+
+	subCmd.Flags().IntP(
+		"partition", "p", -1,
+		"Subscribes to the given partition of a partitioned topic only",
+	)
+
+	subCmd.Flags().IntP(
+		"concurrency", "c", 1,
+		"Number of messages handled concurrently",
+	)
+
+	subCmd.Flags().BoolP(
+		"ordered", "o", false,
+		"Handles messages with the same key in order when concurrent",
+	)
 }
 
 func handler(command string, args []string) msgbus.HandlerFunc {
-	return func(msg *msgbus.Message) error {
+	return func(ctx context.Context, msg *msgbus.Message) error {
+		if command == "" {
+			return printMessage(msg)
+		}
+
 		out, err := json.Marshal(msg)
 		if err != nil {
 			log.Printf("error marshalling message: %s", err)
 			return err
 		}
 
-		if command == "" {
-			os.Stdout.Write(out)
-			os.Stdout.Write([]byte{'\r', '\n'})
-			return nil
-		}
-
 		cmd := exec.Command(command, args...)
 		stdin, err := cmd.StdinPipe()
 		if err != nil {
@@ -86,25 +116,59 @@ func handler(command string, args []string) msgbus.HandlerFunc {
 	}
 }
 
-func subscribe(client *client.Client, topic, command string, args []string) {
+func subscribe(c *client.Client, topic, group string, partition, concurrency int, ordered bool, command string, args []string) {
+	if topic == "" {
+		topic = defaultTopic
+	}
+
+	var s *client.Subscriber
+	switch {
+	case group != "":
+		s = c.SubscribeGroup(topic, group, handler(command, args))
+	case partition >= 0:
+		s = c.SubscribePartition(topic, partition, handler(command, args))
+	default:
+		s = c.Subscribe(topic, handler(command, args))
+	}
+	s.Concurrency = concurrency
+	s.Ordered = ordered
+	s.OnState = func(state client.State) {
+		log.Printf("subscription to %s %s", topic, state)
+	}
+	s.OnError = func(err error) {
+		log.Printf("%s", err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	if err := s.Run(ctx); err != nil {
+		log.Fatalf("error subscribing to %s: %s", topic, err)
+	}
+}
+
+func subscribeTCP(addr, topic, command string, args []string) {
 	if topic == "" {
 		topic = defaultTopic
 	}
 
-	s := client.Subscribe(topic, handler(command, args))
-	s.Start()
+	c, err := client.DialTCP(addr)
+	if err != nil {
+		log.Fatalf("error connecting to %s: %s", addr, err)
+	}
 
-	sigs := make(chan os.Signal, 1)
-	done := make(chan bool, 1)
+	if err := c.Subscribe(topic, handler(command, args)); err != nil {
+		log.Fatalf("error subscribing to %s: %s", topic, err)
+	}
 
+	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
-	go func() {
-		sig := <-sigs
+	select {
+	case sig := <-sigs:
 		log.Printf("caught signal %s: ", sig)
-		s.Stop()
-		done <- true
-	}()
-
-	<-done
+		c.Close()
+	case <-c.Done():
+		log.Fatalf("connection to %s lost: %s", addr, c.Err())
+	}
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/prologic/msgbus"
+)
+
+// AuditConfig configures the audit log
+type AuditConfig struct {
+	Enabled        bool   `mapstructure:"enabled"`
+	File           string `mapstructure:"file"`
+	IncludePayload bool   `mapstructure:"include_payload"`
+}
+
+// auditFile is an audit log written to a file (or stdout if the file is
+// empty or "-") that can be reopened after the file was rotated.
+type auditFile struct {
+	sync.Mutex
+
+	*msgbus.AuditLog
+
+	path string
+	w    io.WriteCloser
+}
+
+func newAuditFile(config AuditConfig) (*auditFile, error) {
+	a := &auditFile{path: config.File}
+
+	w, err := a.open()
+	if err != nil {
+		return nil, err
+	}
+
+	a.w = w
+	a.AuditLog = msgbus.NewAuditLog(w, config.IncludePayload)
+
+	return a, nil
+}
+
+func (a *auditFile) open() (io.WriteCloser, error) {
+	if a.path == "" || a.path == "-" {
+		return os.Stdout, nil
+	}
+
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log %s: %s", a.path, err)
+	}
+	return f, nil
+}
+
+// Reopen reopens the audit log file
+func (a *auditFile) Reopen() error {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.w == os.Stdout {
+		return nil
+	}
+
+	w, err := a.open()
+	if err != nil {
+		return err
+	}
+
+	a.SetOutput(w)
+	a.w.Close()
+	a.w = w
+
+	return nil
+}
+
+// Close closes the audit log file
+func (a *auditFile) Close() error {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.w == os.Stdout {
+		return nil
+	}
+	return a.w.Close()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prologic/msgbus"
+)
+
+// authenticator authenticates requests with HTTP Basic auth and bearer tokens.
+// Credentials can be swapped at runtime with Update.
+type authenticator struct {
+	sync.RWMutex
+
+	config AuthConfig
+}
+
+// newAuthenticator ...
+func newAuthenticator(config AuthConfig) *authenticator {
+	return &authenticator{config: config}
+}
+
+// Update replaces the accepted credentials
+func (a *authenticator) Update(config AuthConfig) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.config = config
+}
+
+// Authenticate returns the identity of the request and whether the
+// request carries valid credentials. If authentication is disabled every
+// request is valid and has an empty identity.
+func (a *authenticator) Authenticate(r *http.Request) (string, bool) {
+	a.RLock()
+	defer a.RUnlock()
+
+	if !a.config.Enabled() {
+		return "", true
+	}
+
+	if username, password, ok := r.BasicAuth(); ok {
+		for _, u := range a.config.Users {
+			if secureCompare(u.Username, username) && secureCompare(u.Password, password) {
+				return u.Username, true
+			}
+		}
+		return "", false
+	}
+
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		token := strings.TrimPrefix(header, "Bearer ")
+		for _, t := range a.config.Tokens {
+			if secureCompare(t.Token, token) {
+				return t.Name, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// AuthenticateCredentials returns the identity of a username and password
+// and whether they are valid, for protocols other than HTTP. The password
+// may also be a bearer token, in which case the username is ignored.
+func (a *authenticator) AuthenticateCredentials(username, password string) (string, bool) {
+	a.RLock()
+	defer a.RUnlock()
+
+	if !a.config.Enabled() {
+		return "", true
+	}
+
+	for _, u := range a.config.Users {
+		if secureCompare(u.Username, username) && secureCompare(u.Password, password) {
+			return u.Username, true
+		}
+	}
+
+	for _, t := range a.config.Tokens {
+		if secureCompare(t.Token, password) {
+			return t.Name, true
+		}
+	}
+
+	return "", false
+}
+
+// authHandler wraps next requiring valid credentials and passing on the
+// authenticated identity in the request context. Denied requests are
+// recorded in the audit log of bus.
+func authHandler(auth *authenticator, bus *msgbus.MessageBus, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := auth.Authenticate(r)
+		if !ok {
+			ctx := msgbus.WithRemoteAddr(r.Context(), r.RemoteAddr)
+			bus.Audit(ctx, msgbus.AuditEvent{
+				Action: msgbus.AuditAuth,
+				Result: msgbus.AuditDenied,
+				Detail: fmt.Sprintf("%s %s", r.Method, r.URL.Path),
+			})
+
+			w.Header().Set("WWW-Authenticate", `Basic realm="msgbus"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := msgbus.WithIdentity(r.Context(), identity)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prologic/msgbus/bridge"
+)
+
+// BridgeRemoteConfig is a remote msgbusd bridged with this one
+type BridgeRemoteConfig struct {
+	Name     string   `mapstructure:"name"`
+	URL      string   `mapstructure:"url"`
+	Token    string   `mapstructure:"token"`
+	Username string   `mapstructure:"username"`
+	Password string   `mapstructure:"password"`
+	Import   []string `mapstructure:"import"`
+	Export   []string `mapstructure:"export"`
+}
+
+// Remote returns the bridge remote described by c
+func (c BridgeRemoteConfig) Remote() bridge.Remote {
+	header := make(http.Header)
+	if c.Token != "" {
+		header.Set("Authorization", "Bearer "+c.Token)
+	} else if c.Username != "" {
+		r := &http.Request{Header: header}
+		r.SetBasicAuth(c.Username, c.Password)
+	}
+
+	return bridge.Remote{
+		Name:   c.Name,
+		URL:    c.URL,
+		Header: header,
+		Import: c.Import,
+		Export: c.Export,
+	}
+}
+
+// BridgeConfig configures bridges importing topics of remote msgbusd
+// instances and exporting local topics to them
+type BridgeConfig struct {
+	Enabled bool                 `mapstructure:"enabled"`
+	ID      string               `mapstructure:"id"`
+	MaxHops int                  `mapstructure:"max_hops"`
+	Remotes []BridgeRemoteConfig `mapstructure:"remotes"`
+}
+
+// Validate checks the bridge configuration for errors
+func (c BridgeConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+
+	if c.ID == "" {
+		return fmt.Errorf("bridge.id must be set when bridging is enabled")
+	}
+
+	seen := make(map[string]bool)
+	for _, r := range c.Remotes {
+		if err := r.Remote().Validate(); err != nil {
+			return fmt.Errorf("invalid bridge remote: %s", err)
+		}
+		if r.Name == c.ID {
+			return fmt.Errorf("bridge remote %q has the name of bridge.id", r.Name)
+		}
+		if seen[r.Name] {
+			return fmt.Errorf("duplicate bridge remote %q", r.Name)
+		}
+		seen[r.Name] = true
+	}
+
+	return nil
+}
+
+// newBridge returns a bridge of the bus of s with the remotes of the
+// configuration
+func (s *server) newBridge() (*bridge.Bridge, error) {
+	config := s.config.Bridge
+
+	// Remotes importing from this server resume from its history
+	if s.config.HistoryLength == 0 {
+		log.Warnf("bridge enabled without history_length, remotes importing from this server lose the messages published while disconnected")
+	}
+
+	b := bridge.New(s.bus, &bridge.Options{
+		ID:      config.ID,
+		MaxHops: config.MaxHops,
+	})
+
+	for _, r := range config.Remotes {
+		if err := b.Add(r.Remote()); err != nil {
+			b.Close()
+			return nil, fmt.Errorf("error adding bridge remote: %s", err)
+		}
+	}
+
+	return b, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prologic/msgbus/cluster"
+)
+
+// defaultClusterBind is the default interface and port of the raft
+// transport
+const defaultClusterBind = ":8003"
+
+const (
+	// clusterPath is where the cluster admin API is mounted
+	clusterPath = "/_cluster/"
+
+	// joinAttempts is the number of times joining each url is attempted
+	// at startup
+	joinAttempts = 10
+
+	// joinBackoff is the initial delay between attempts to join
+	joinBackoff = time.Second
+)
+
+// ClusterPeerConfig is a node of the cluster bootstrapped
+type ClusterPeerConfig struct {
+	ID      string `mapstructure:"id"`
+	Address string `mapstructure:"address"`
+	API     string `mapstructure:"api"`
+}
+
+// ClusterConfig configures the replication of the bus with other msgbusd
+// nodes using raft
+type ClusterConfig struct {
+	Enabled   bool                `mapstructure:"enabled"`
+	ID        string              `mapstructure:"id"`
+	Bind      string              `mapstructure:"bind"`
+	Advertise string              `mapstructure:"advertise"`
+	API       string              `mapstructure:"api"`
+	Dir       string              `mapstructure:"dir"`
+	Bootstrap bool                `mapstructure:"bootstrap"`
+	Peers     []ClusterPeerConfig `mapstructure:"peers"`
+	Join      []string            `mapstructure:"join"`
+	Token     string              `mapstructure:"token"`
+}
+
+// Validate checks the cluster configuration for errors
+func (c ClusterConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+
+	if c.ID == "" {
+		return fmt.Errorf("cluster.id must be set when clustering is enabled")
+	}
+	if c.Bind == "" {
+		return fmt.Errorf("cluster.bind must be set when clustering is enabled")
+	}
+	if c.API == "" {
+		return fmt.Errorf("cluster.api must be set when clustering is enabled")
+	}
+	if c.Bootstrap && len(c.Join) > 0 {
+		return fmt.Errorf("cluster.bootstrap and cluster.join are mutually exclusive")
+	}
+
+	seen := make(map[string]bool)
+	for _, p := range c.Peers {
+		if p.ID == "" || p.Address == "" || p.API == "" {
+			return fmt.Errorf("cluster peers require an id, address and api")
+		}
+		if seen[p.ID] {
+			return fmt.Errorf("duplicate cluster peer %q", p.ID)
+		}
+		seen[p.ID] = true
+	}
+	if len(c.Peers) > 0 && !seen[c.ID] {
+		return fmt.Errorf("cluster.peers must include cluster.id %q", c.ID)
+	}
+
+	return nil
+}
+
+// header returns the headers sent to other nodes
+func (c ClusterConfig) header() http.Header {
+	header := make(http.Header)
+	if c.Token != "" {
+		header.Set("Authorization", "Bearer "+c.Token)
+	}
+	return header
+}
+
+// newClusterNode returns a node replicating the bus of s, which has joined
+// the cluster if configured to
+func (s *server) newClusterNode() (*cluster.Node, error) {
+	config := s.config.Cluster
+
+	var peers []cluster.Peer
+	for _, p := range config.Peers {
+		peers = append(peers, cluster.Peer{ID: p.ID, Address: p.Address, API: p.API})
+	}
+
+	node, err := cluster.NewNode(s.bus, &cluster.Options{
+		ID:        config.ID,
+		Bind:      config.Bind,
+		Advertise: config.Advertise,
+		API:       config.API,
+		Dir:       config.Dir,
+		Bootstrap: config.Bootstrap,
+		Peers:     peers,
+		Header:    config.header(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(config.Join) > 0 {
+		if err := joinCluster(node, config.Join); err != nil {
+			node.Shutdown()
+			return nil, err
+		}
+	}
+
+	return node, nil
+}
+
+// joinCluster asks the nodes with the APIs at urls to add node to their
+// cluster until one succeeds, the nodes may still be starting so joining
+// is retried
+func joinCluster(node *cluster.Node, urls []string) error {
+	var err error
+
+	backoff := joinBackoff
+	for i := 0; i < joinAttempts; i++ {
+		for _, url := range urls {
+			ctx, cancel := context.WithTimeout(context.Background(), cluster.DefaultApplyTimeout)
+			err = node.JoinCluster(ctx, strings.TrimSuffix(url, "/")+clusterPath)
+			cancel()
+			if err == nil {
+				log.Infof("joined cluster at %s", url)
+				return nil
+			}
+			log.Warnf("error joining cluster at %s: %s", url, err)
+		}
+
+		time.Sleep(backoff)
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+
+	return fmt.Errorf("error joining cluster: %s", err)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/prologic/msgbus"
+	"github.com/prologic/msgbus/bridge"
+	"github.com/prologic/msgbus/hooks"
+	"github.com/prologic/msgbus/mqtt"
+	"github.com/prologic/msgbus/stomp"
+	"github.com/prologic/msgbus/webhook"
+)
+
+const (
+	// defaultBind is the default interface and port to bind to
+	defaultBind = ":8000"
+
+	// defaultMetricsPath is the default path the metrics are served on
+	defaultMetricsPath = "/metrics"
+
+	// envPrefix is the prefix of environment variables read by msgbusd
+	envPrefix = "MSGBUSD"
+)
+
+// TopicConfig overrides the bus-wide limits for a single topic
+type TopicConfig struct {
+	Name           string `mapstructure:"name"`
+	BufferLength   int    `mapstructure:"buffer_length"`
+	MaxQueueSize   int    `mapstructure:"max_queue_size"`
+	MaxPayloadSize int    `mapstructure:"max_payload_size"`
+	Partitions     int    `mapstructure:"partitions"`
+	Compacted      bool   `mapstructure:"compacted"`
+}
+
+// UserConfig is a username and password accepted with HTTP Basic auth
+type UserConfig struct {
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+}
+
+// TokenConfig is a named bearer token
+type TokenConfig struct {
+	Name  string `mapstructure:"name"`
+	Token string `mapstructure:"token"`
+}
+
+// AuthConfig configures authentication of the bus API. If no users and
+// no tokens are configured the API is open.
+type AuthConfig struct {
+	Users  []UserConfig  `mapstructure:"users"`
+	Tokens []TokenConfig `mapstructure:"tokens"`
+}
+
+// Enabled returns true if any credentials are configured
+func (c AuthConfig) Enabled() bool {
+	return len(c.Users) > 0 || len(c.Tokens) > 0
+}
+
+// TLSConfig configures serving over HTTPS
+type TLSConfig struct {
+	Cert string `mapstructure:"cert"`
+	Key  string `mapstructure:"key"`
+}
+
+// Enabled returns true if a certificate and key are configured
+func (c TLSConfig) Enabled() bool {
+	return c.Cert != "" && c.Key != ""
+}
+
+// MetricsConfig configures the Prometheus metrics endpoint
+type MetricsConfig struct {
+	Enabled   bool   `mapstructure:"enabled"`
+	Path      string `mapstructure:"path"`
+	MaxTopics int    `mapstructure:"max_topics"`
+}
+
+// LogConfig configures logging
+type LogConfig struct {
+	Level  string `mapstructure:"level"`
+	Format string `mapstructure:"format"`
+}
+
+// Config is the configuration of msgbusd
+type Config struct {
+	Bind           string `mapstructure:"bind"`
+	BufferLength   int    `mapstructure:"buffer_length"`
+	MaxQueueSize   int    `mapstructure:"max_queue_size"`
+	MaxPayloadSize int    `mapstructure:"max_payload_size"`
+	HistoryLength  int    `mapstructure:"history_length"`
+
+	DedupWindow time.Duration `mapstructure:"dedup_window"`
+	DedupSize   int           `mapstructure:"dedup_size"`
+
+	MaxBatchLength int `mapstructure:"max_batch_length"`
+	MaxBatchSize   int `mapstructure:"max_batch_size"`
+
+	Topics []TopicConfig `mapstructure:"topics"`
+
+	Auth     AuthConfig     `mapstructure:"auth"`
+	TLS      TLSConfig      `mapstructure:"tls"`
+	Metrics  MetricsConfig  `mapstructure:"metrics"`
+	Tracing  TracingConfig  `mapstructure:"tracing"`
+	Audit    AuditConfig    `mapstructure:"audit"`
+	MQTT     MQTTConfig     `mapstructure:"mqtt"`
+	STOMP    STOMPConfig    `mapstructure:"stomp"`
+	TCP      TCPConfig      `mapstructure:"tcp"`
+	GRPC     GRPCConfig     `mapstructure:"grpc"`
+	Webhooks WebhooksConfig `mapstructure:"webhooks"`
+	Hooks    HooksConfig    `mapstructure:"hooks"`
+	Bridge   BridgeConfig   `mapstructure:"bridge"`
+	Cluster  ClusterConfig  `mapstructure:"cluster"`
+	Log      LogConfig      `mapstructure:"log"`
+}
+
+// BusOptions returns the bus options described by the configuration
+func (c *Config) BusOptions() *msgbus.Options {
+	topics := make(map[string]msgbus.TopicOptions)
+	for _, t := range c.Topics {
+		topics[t.Name] = msgbus.TopicOptions{
+			BufferLength:   t.BufferLength,
+			MaxQueueSize:   t.MaxQueueSize,
+			MaxPayloadSize: t.MaxPayloadSize,
+			Partitions:     t.Partitions,
+			Compacted:      t.Compacted,
+		}
+	}
+
+	return &msgbus.Options{
+		BufferLength:     c.BufferLength,
+		MaxQueueSize:     c.MaxQueueSize,
+		MaxPayloadSize:   c.MaxPayloadSize,
+		HistoryLength:    c.HistoryLength,
+		DedupWindow:      c.DedupWindow,
+		DedupSize:        c.DedupSize,
+		MaxBatchLength:   c.MaxBatchLength,
+		MaxBatchSize:     c.MaxBatchSize,
+		WithMetrics:      c.Metrics.Enabled,
+		MaxMetricsTopics: c.Metrics.MaxTopics,
+		Topics:           topics,
+	}
+}
+
+// Validate checks the configuration for errors
+func (c *Config) Validate() error {
+	if c.Bind == "" {
+		return fmt.Errorf("bind address must not be empty")
+	}
+
+	if c.TLS.Cert != "" && c.TLS.Key == "" || c.TLS.Cert == "" && c.TLS.Key != "" {
+		return fmt.Errorf("both tls.cert and tls.key must be set")
+	}
+
+	if c.Metrics.Enabled && !strings.HasPrefix(c.Metrics.Path, "/") {
+		return fmt.Errorf("invalid metrics.path %q: must start with /", c.Metrics.Path)
+	}
+
+	if c.Tracing.Enabled {
+		if c.Tracing.Endpoint == "" {
+			return fmt.Errorf("tracing.endpoint must be set when tracing is enabled")
+		}
+		if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+			return fmt.Errorf("invalid tracing.sample_ratio %v: must be between 0 and 1", c.Tracing.SampleRatio)
+		}
+	}
+
+	if c.MQTT.Enabled && c.MQTT.Bind == "" {
+		return fmt.Errorf("mqtt.bind must be set when mqtt is enabled")
+	}
+
+	if c.TCP.Enabled && c.TCP.Bind == "" {
+		return fmt.Errorf("tcp.bind must be set when tcp is enabled")
+	}
+	if c.GRPC.Enabled && c.GRPC.Bind == "" {
+		return fmt.Errorf("grpc.bind must be set when grpc is enabled")
+	}
+
+	if err := c.Webhooks.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Hooks.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Bridge.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Cluster.Validate(); err != nil {
+		return err
+	}
+	if c.Cluster.Enabled {
+		// Only publishes and pulls of the HTTP API are replicated
+		switch {
+		case c.MQTT.Enabled:
+			return fmt.Errorf("mqtt is not supported when clustering is enabled")
+		case c.STOMP.Enabled:
+			return fmt.Errorf("stomp is not supported when clustering is enabled")
+		case c.TCP.Enabled:
+			return fmt.Errorf("tcp is not supported when clustering is enabled")
+		case c.GRPC.Enabled:
+			return fmt.Errorf("grpc is not supported when clustering is enabled")
+		case c.Hooks.Enabled:
+			return fmt.Errorf("hooks are not supported when clustering is enabled")
+		case c.Bridge.Enabled:
+			return fmt.Errorf("bridge is not supported when clustering is enabled")
+		}
+	}
+
+	if c.HistoryLength < 0 {
+		return fmt.Errorf("invalid history_length %d: must not be negative", c.HistoryLength)
+	}
+
+	switch c.Log.Format {
+	case "text", "json":
+	default:
+		return fmt.Errorf("invalid log.format %q: must be text or json", c.Log.Format)
+	}
+
+	seen := make(map[string]bool)
+	for _, t := range c.Topics {
+		if t.Name == "" {
+			return fmt.Errorf("topic override without a name")
+		}
+		if seen[t.Name] {
+			return fmt.Errorf("duplicate topic override for %q", t.Name)
+		}
+		if t.Partitions < 0 {
+			return fmt.Errorf("invalid partitions %d for topic %q", t.Partitions, t.Name)
+		}
+		seen[t.Name] = true
+	}
+
+	for _, u := range c.Auth.Users {
+		if u.Username == "" || u.Password == "" {
+			return fmt.Errorf("auth users require a username and password")
+		}
+	}
+
+	for _, t := range c.Auth.Tokens {
+		if t.Token == "" {
+			return fmt.Errorf("auth token %q must not be empty", t.Name)
+		}
+	}
+
+	return nil
+}
+
+// newViper returns a viper instance with the defaults and environment
+// mapping of msgbusd. Environment variables are prefixed with MSGBUSD_
+// and nested keys are separated by underscores, e.g: MSGBUSD_TLS_CERT.
+func newViper() *viper.Viper {
+	v := viper.New()
+
+	v.SetDefault("bind", defaultBind)
+	v.SetDefault("buffer_length", msgbus.DefaultBufferLength)
+	v.SetDefault("max_queue_size", msgbus.DefaultMaxQueueSize)
+	v.SetDefault("max_payload_size", msgbus.DefaultMaxPayloadSize)
+	v.SetDefault("history_length", 0)
+	v.SetDefault("dedup_window", msgbus.DefaultDedupWindow)
+	v.SetDefault("dedup_size", msgbus.DefaultDedupSize)
+	v.SetDefault("max_batch_length", msgbus.DefaultMaxBatchLength)
+	v.SetDefault("max_batch_size", msgbus.DefaultMaxBatchSize)
+
+	v.SetDefault("tls.cert", "")
+	v.SetDefault("tls.key", "")
+
+	v.SetDefault("metrics.enabled", true)
+	v.SetDefault("metrics.path", defaultMetricsPath)
+	v.SetDefault("metrics.max_topics", msgbus.DefaultMaxMetricsTopics)
+
+	v.SetDefault("tracing.enabled", false)
+	v.SetDefault("tracing.endpoint", "http://localhost:4318")
+	v.SetDefault("tracing.insecure", false)
+	v.SetDefault("tracing.sample_ratio", 1.0)
+	v.SetDefault("tracing.service_name", "msgbusd")
+
+	v.SetDefault("audit.enabled", false)
+	v.SetDefault("audit.file", "")
+	v.SetDefault("audit.include_payload", false)
+
+	v.SetDefault("mqtt.enabled", false)
+	v.SetDefault("mqtt.bind", defaultMQTTBind)
+	v.SetDefault("mqtt.max_packet_size", mqtt.DefaultMaxPacketSize)
+	v.SetDefault("mqtt.max_inflight", mqtt.DefaultMaxInflight)
+
+	v.SetDefault("stomp.enabled", false)
+	v.SetDefault("stomp.bind", defaultSTOMPBind)
+	v.SetDefault("stomp.max_frame_size", stomp.DefaultMaxFrameSize)
+	v.SetDefault("stomp.max_pending", stomp.DefaultMaxPending)
+
+	v.SetDefault("tcp.enabled", false)
+	v.SetDefault("tcp.bind", defaultTCPBind)
+
+	v.SetDefault("grpc.enabled", false)
+	v.SetDefault("grpc.bind", defaultGRPCBind)
+
+	v.SetDefault("webhooks.enabled", false)
+	v.SetDefault("webhooks.max_attempts", webhook.DefaultMaxAttempts)
+	v.SetDefault("webhooks.max_failures", webhook.DefaultMaxFailures)
+	v.SetDefault("webhooks.max_concurrency", webhook.DefaultMaxConcurrency)
+	v.SetDefault("webhooks.max_queue_length", webhook.DefaultMaxQueueLength)
+
+	v.SetDefault("hooks.enabled", false)
+	v.SetDefault("hooks.max_body_size", hooks.DefaultMaxBodySize)
+	v.SetDefault("hooks.replay_window", hooks.DefaultReplayWindow)
+	v.SetDefault("hooks.max_deliveries", hooks.DefaultMaxDeliveries)
+
+	v.SetDefault("bridge.enabled", false)
+	v.SetDefault("bridge.id", "")
+	v.SetDefault("bridge.max_hops", bridge.DefaultMaxHops)
+
+	v.SetDefault("cluster.enabled", false)
+	v.SetDefault("cluster.id", "")
+	v.SetDefault("cluster.bind", defaultClusterBind)
+	v.SetDefault("cluster.advertise", "")
+	v.SetDefault("cluster.api", "")
+	v.SetDefault("cluster.dir", "")
+	v.SetDefault("cluster.bootstrap", false)
+
+	v.SetDefault("log.level", "info")
+	v.SetDefault("log.format", "text")
+
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+
+	return v
+}
+
+// loadConfig (re)reads the config file, if any, and returns the merged
+// configuration of defaults, config file, environment and overrides.
+func loadConfig(v *viper.Viper, configFile string) (*Config, error) {
+	if configFile != "" {
+		v.SetConfigFile(configFile)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("error reading config file %s: %s", configFile, err)
+		}
+	}
+
+	var config Config
+	if err := v.Unmarshal(&config); err != nil {
+		return nil, fmt.Errorf("error parsing config: %s", err)
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// configFileFromEnv returns the config file named by $MSGBUSD_CONFIG
+func configFileFromEnv() string {
+	return os.Getenv(envPrefix + "_CONFIG")
+}
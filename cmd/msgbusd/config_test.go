@@ -0,0 +1,505 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/prologic/msgbus"
+	"github.com/prologic/msgbus/stomp"
+)
+
+const testConfig = `
+bind: ":9000"
+max_payload_size: 16
+dedup_window: 5m
+max_batch_length: 50
+topics:
+  - name: Big
+    max_payload_size: 1024
+    partitions: 4
+    compacted: true
+auth:
+  tokens:
+    - name: ci
+      token: s3cr3t
+log:
+  level: warn
+  format: json
+`
+
+func writeConfig(t *testing.T, data string) string {
+	dir, err := ioutil.TempDir("", "msgbusd")
+	require.NoError(t, err)
+
+	fn := filepath.Join(dir, "msgbusd.yaml")
+	require.NoError(t, ioutil.WriteFile(fn, []byte(data), 0644))
+
+	return fn
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	assert := assert.New(t)
+
+	config, err := loadConfig(newViper(), "")
+	require.NoError(t, err)
+
+	assert.Equal(defaultBind, config.Bind)
+	assert.Equal(defaultMetricsPath, config.Metrics.Path)
+	assert.True(config.Metrics.Enabled)
+	assert.False(config.Auth.Enabled())
+	assert.False(config.TLS.Enabled())
+}
+
+func TestLoadConfigFileAndEnv(t *testing.T) {
+	assert := assert.New(t)
+
+	fn := writeConfig(t, testConfig)
+	defer os.RemoveAll(filepath.Dir(fn))
+
+	os.Setenv("MSGBUSD_MAX_QUEUE_SIZE", "42")
+	defer os.Unsetenv("MSGBUSD_MAX_QUEUE_SIZE")
+
+	config, err := loadConfig(newViper(), fn)
+	require.NoError(t, err)
+
+	assert.Equal(":9000", config.Bind)
+	assert.Equal(42, config.MaxQueueSize)
+	assert.Equal("warn", config.Log.Level)
+	assert.Equal("json", config.Log.Format)
+
+	opts := config.BusOptions()
+	assert.Equal(16, opts.MaxPayloadSize)
+	assert.Equal(1024, opts.Topics["Big"].MaxPayloadSize)
+	assert.Equal(4, opts.Topics["Big"].Partitions)
+	assert.True(opts.Topics["Big"].Compacted)
+	assert.Equal(5*time.Minute, opts.DedupWindow)
+	assert.Equal(msgbus.DefaultDedupSize, opts.DedupSize)
+	assert.Equal(50, opts.MaxBatchLength)
+	assert.Equal(msgbus.DefaultMaxBatchSize, opts.MaxBatchSize)
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	for _, data := range []string{
+		"log:\n  format: xml\n",
+		"topics:\n  - name: foo\n    partitions: -1\n",
+	} {
+		fn := writeConfig(t, data)
+		defer os.RemoveAll(filepath.Dir(fn))
+
+		_, err := loadConfig(newViper(), fn)
+		assert.Error(t, err)
+	}
+}
+
+func TestServerAuthAndReload(t *testing.T) {
+	assert := assert.New(t)
+
+	fn := writeConfig(t, testConfig)
+	defer os.RemoveAll(filepath.Dir(fn))
+
+	v := newViper()
+	config, err := loadConfig(v, fn)
+	require.NoError(t, err)
+
+	s, err := newServer(config)
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(http.StatusUnauthorized, res.StatusCode)
+
+	req, _ := http.NewRequest("GET", ts.URL+"/", nil)
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+
+	require.NoError(t, ioutil.WriteFile(fn, []byte("max_payload_size: 32\n"), 0644))
+	config, err = loadConfig(v, fn)
+	require.NoError(t, err)
+	require.NoError(t, s.Reload(config))
+
+	assert.Equal(32, s.bus.TopicOptions("Big").MaxPayloadSize)
+
+	res, err = http.Get(ts.URL + "/")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+}
+
+func TestAuthenticateCredentials(t *testing.T) {
+	assert := assert.New(t)
+
+	auth := newAuthenticator(AuthConfig{
+		Users:  []UserConfig{{Username: "admin", Password: "secret"}},
+		Tokens: []TokenConfig{{Name: "ci", Token: "s3cr3t"}},
+	})
+
+	identity, ok := auth.AuthenticateCredentials("admin", "secret")
+	assert.True(ok)
+	assert.Equal("admin", identity)
+
+	identity, ok = auth.AuthenticateCredentials("device", "s3cr3t")
+	assert.True(ok)
+	assert.Equal("ci", identity)
+
+	_, ok = auth.AuthenticateCredentials("admin", "wrong")
+	assert.False(ok)
+
+	_, ok = newAuthenticator(AuthConfig{}).AuthenticateCredentials("", "")
+	assert.True(ok)
+}
+
+func TestServerAudit(t *testing.T) {
+	assert := assert.New(t)
+
+	fn := writeConfig(t, testConfig)
+	defer os.RemoveAll(filepath.Dir(fn))
+
+	auditLog := filepath.Join(filepath.Dir(fn), "audit.log")
+
+	v := newViper()
+	v.Set("metrics.enabled", false)
+	v.Set("audit.enabled", true)
+	v.Set("audit.file", auditLog)
+
+	config, err := loadConfig(v, fn)
+	require.NoError(t, err)
+
+	s, err := newServer(config)
+	require.NoError(t, err)
+	defer s.Shutdown()
+
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/hello", "text/plain", strings.NewReader("hello"))
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(http.StatusUnauthorized, res.StatusCode)
+
+	req, _ := http.NewRequest("POST", ts.URL+"/hello", strings.NewReader("hello"))
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(http.StatusAccepted, res.StatusCode)
+
+	// simulate log rotation
+	require.NoError(t, os.Rename(auditLog, auditLog+".1"))
+	require.NoError(t, s.Reload(config))
+
+	rotated, err := ioutil.ReadFile(auditLog + ".1")
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(rotated)), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(lines[0], `"action":"auth","result":"denied"`)
+	assert.Contains(lines[1], `"action":"publish","result":"ok","identity":"ci"`)
+	assert.NotContains(string(rotated), `"payload"`)
+
+	current, err := ioutil.ReadFile(auditLog)
+	require.NoError(t, err)
+	assert.Contains(string(current), `"action":"admin","result":"ok"`)
+}
+
+func TestServerWebhooks(t *testing.T) {
+	assert := assert.New(t)
+
+	delivered := make(chan string, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal("abc", r.Header.Get("X-Api-Key"))
+		delivered <- string(body)
+	}))
+	defer target.Close()
+
+	fn := writeConfig(t, testConfig+`
+webhooks:
+  enabled: true
+  subscriptions:
+    - id: deploys
+      topic: deploys
+      url: `+target.URL+`
+      headers:
+        X-Api-Key: abc
+`)
+	defer os.RemoveAll(filepath.Dir(fn))
+
+	config, err := loadConfig(newViper(), fn)
+	require.NoError(t, err)
+
+	s, err := newServer(config)
+	require.NoError(t, err)
+	defer s.Shutdown()
+
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	req, _ := http.NewRequest("POST", ts.URL+"/deploys", strings.NewReader("v1.2.3"))
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+
+	assert.Equal("v1.2.3", <-delivered)
+
+	res, err = http.Get(ts.URL + "/_webhooks/deploys")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(http.StatusUnauthorized, res.StatusCode)
+
+	req, _ = http.NewRequest("GET", ts.URL+"/_webhooks/deploys", nil)
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+}
+
+func TestServerHooks(t *testing.T) {
+	assert := assert.New(t)
+
+	fn := writeConfig(t, testConfig+`
+hooks:
+  enabled: true
+  replay_window: 1h
+  adapters:
+    - name: github
+      type: github
+      secret: hunter2
+`)
+	defer os.RemoveAll(filepath.Dir(fn))
+
+	config, err := loadConfig(newViper(), fn)
+	require.NoError(t, err)
+	assert.Equal(time.Hour, config.Hooks.ReplayWindow)
+
+	s, err := newServer(config)
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	body := `{"zen":"ok"}`
+	mac := hmac.New(sha256.New, []byte("hunter2"))
+	mac.Write([]byte(body))
+
+	// Hooks are authenticated by their signature, not the bus credentials
+	req, _ := http.NewRequest("POST", ts.URL+"/hooks/github/ci", strings.NewReader(body))
+	req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	req.Header.Set("X-GitHub-Event", "ping")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(http.StatusAccepted, res.StatusCode)
+
+	message, ok := s.bus.Get(s.bus.NewTopic("ci"))
+	require.True(t, ok)
+	assert.Equal("ping", message.Headers["hook-event"])
+
+	fn = writeConfig(t, "hooks:\n  adapters:\n    - name: github\n      type: github\n")
+	defer os.RemoveAll(filepath.Dir(fn))
+
+	_, err = loadConfig(newViper(), fn)
+	assert.Error(err)
+}
+
+func TestServerBridge(t *testing.T) {
+	assert := assert.New(t)
+
+	fn := writeConfig(t, testConfig)
+	defer os.RemoveAll(filepath.Dir(fn))
+
+	config, err := loadConfig(newViper(), fn)
+	require.NoError(t, err)
+
+	remote, err := newServer(config)
+	require.NoError(t, err)
+
+	rs := httptest.NewServer(remote.Handler())
+	defer rs.Close()
+
+	fn = writeConfig(t, testConfig+`
+history_length: 10
+bridge:
+  enabled: true
+  id: local
+  remotes:
+    - name: remote
+      url: `+rs.URL+`
+      token: s3cr3t
+      export:
+        - events/#
+`)
+	defer os.RemoveAll(filepath.Dir(fn))
+
+	config, err = loadConfig(newViper(), fn)
+	require.NoError(t, err)
+	assert.Equal(10, config.HistoryLength)
+
+	s, err := newServer(config)
+	require.NoError(t, err)
+	defer s.Shutdown()
+
+	s.bus.Put(s.bus.NewMessage(s.bus.NewTopic("events/a"), []byte("hi")))
+
+	var (
+		message msgbus.Message
+		ok      bool
+	)
+	for i := 0; i < 200 && !ok; i++ {
+		time.Sleep(10 * time.Millisecond)
+		message, ok = remote.bus.Get(remote.bus.NewTopic("events/a"))
+	}
+	require.True(t, ok)
+	assert.Equal("hi", string(message.Payload))
+	assert.Equal("local", message.Headers["msgbus-origin"])
+
+	for _, bad := range []string{
+		"bridge:\n  enabled: true\n",
+		"bridge:\n  enabled: true\n  id: a\n  remotes:\n    - name: a\n      url: http://b\n      import: [x]\n",
+		"bridge:\n  enabled: true\n  id: a\n  remotes:\n    - name: b\n      url: http://b\n",
+	} {
+		fn = writeConfig(t, bad)
+		defer os.RemoveAll(filepath.Dir(fn))
+
+		_, err = loadConfig(newViper(), fn)
+		assert.Error(err)
+	}
+}
+
+func TestServerCluster(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	bind := l.Addr().String()
+	l.Close()
+
+	dir, err := ioutil.TempDir("", "msgbusd-cluster")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := writeConfig(t, testConfig+`
+cluster:
+  enabled: true
+  id: node1
+  bind: `+bind+`
+  api: http://localhost:9000
+  dir: `+dir+`
+  bootstrap: true
+`)
+	defer os.RemoveAll(filepath.Dir(fn))
+
+	config, err := loadConfig(newViper(), fn)
+	require.NoError(t, err)
+
+	s, err := newServer(config)
+	require.NoError(t, err)
+	defer s.Shutdown()
+
+	for i := 0; i < 200 && !s.cluster.IsLeader(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.True(t, s.cluster.IsLeader())
+
+	h := s.Handler()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PUT", "/hello", strings.NewReader("hi"))
+	r.Header.Set("Authorization", "Bearer s3cr3t")
+	h.ServeHTTP(w, r)
+	assert.Equal(http.StatusAccepted, w.Code)
+
+	message, ok := s.bus.Get(s.bus.NewTopic("hello"))
+	require.True(t, ok)
+	assert.Equal("hi", string(message.Payload))
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/_cluster/", nil)
+	h.ServeHTTP(w, r)
+	assert.Equal(http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	r.Header.Set("Authorization", "Bearer s3cr3t")
+	h.ServeHTTP(w, r)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `"leader":"node1"`)
+
+	for _, bad := range []string{
+		"cluster:\n  enabled: true\n  api: http://a\n",
+		"cluster:\n  enabled: true\n  id: a\n",
+		"cluster:\n  enabled: true\n  id: a\n  api: http://a\n  bootstrap: true\n  join: [http://b]\n",
+		"cluster:\n  enabled: true\n  id: a\n  api: http://a\n  peers:\n    - id: b\n      address: b:8003\n      api: http://b\n",
+		"cluster:\n  enabled: true\n  id: a\n  api: http://a\nmqtt:\n  enabled: true\n",
+	} {
+		fn = writeConfig(t, bad)
+		defer os.RemoveAll(filepath.Dir(fn))
+
+		_, err = loadConfig(newViper(), fn)
+		assert.Error(err)
+	}
+}
+
+func TestServerSTOMPWebsocketAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	fn := writeConfig(t, testConfig+"stomp:\n  enabled: true\n  bind: \"\"\n")
+	defer os.RemoveAll(filepath.Dir(fn))
+
+	config, err := loadConfig(newViper(), fn)
+	require.NoError(t, err)
+
+	s, err := newServer(config)
+	require.NoError(t, err)
+	s.newSTOMPServer()
+
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	u := strings.Replace(ts.URL, "http", "ws", 1) + "/"
+
+	// Other websocket clients still need HTTP credentials
+	_, res, err := websocket.DefaultDialer.Dial(u+"foo", nil)
+	assert.Error(err)
+	require.NotNil(t, res)
+	assert.Equal(http.StatusUnauthorized, res.StatusCode)
+
+	connect := func(passcode string) string {
+		dialer := websocket.Dialer{Subprotocols: []string{stomp.Subprotocol}}
+		ws, _, err := dialer.Dial(u, nil)
+		require.NoError(t, err)
+		defer ws.Close()
+
+		frame := "CONNECT\naccept-version:1.2\nhost:/\npasscode:" + passcode + "\n\n\x00"
+		require.NoError(t, ws.WriteMessage(websocket.TextMessage, []byte(frame)))
+
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, err := ws.ReadMessage()
+		require.NoError(t, err)
+		return strings.SplitN(string(data), "\n", 2)[0]
+	}
+
+	// STOMP websocket clients authenticate with their CONNECT frame
+	assert.Equal("ERROR", connect("wrong"))
+	assert.Equal("CONNECTED", connect("s3cr3t"))
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/prologic/msgbus/grpcapi"
+)
+
+// defaultGRPCBind is the default interface and port of the gRPC listener
+const defaultGRPCBind = ":8002"
+
+// GRPCConfig configures the listener of the gRPC API
+type GRPCConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Bind    string `mapstructure:"bind"`
+}
+
+// newGRPCServer returns a gRPC API server for the bus of s, served over
+// tls with the certificate of the HTTP API if configured. Clients
+// authenticate with the username and password of a user as basic
+// credentials or with a bearer token.
+func (s *server) newGRPCServer() *grpcapi.Server {
+	var serverOptions []grpc.ServerOption
+	if s.config.TLS.Enabled() {
+		serverOptions = append(serverOptions, grpc.Creds(credentials.NewTLS(s.tlsConfig())))
+	}
+
+	return grpcapi.NewServer(s.bus, &grpcapi.Options{
+		Authenticate:  s.auth.AuthenticateCredentials,
+		ServerOptions: serverOptions,
+	})
+}
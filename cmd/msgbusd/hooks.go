@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prologic/msgbus/hooks"
+)
+
+// HookConfig is an inbound webhook adapter receiving webhooks on
+// /hooks/<name>/<topic>
+type HookConfig struct {
+	Name string `mapstructure:"name"`
+
+	// Type is one of github, gitea, alertmanager or shared_secret
+	Type   string `mapstructure:"type"`
+	Secret string `mapstructure:"secret"`
+
+	// Split splits Alertmanager notifications into a message per alert
+	Split bool `mapstructure:"split"`
+
+	// Header, EventHeader and DeliveryHeader configure shared_secret
+	// adapters
+	Header         string `mapstructure:"header"`
+	EventHeader    string `mapstructure:"event_header"`
+	DeliveryHeader string `mapstructure:"delivery_header"`
+}
+
+// Adapter returns the adapter described by c
+func (c HookConfig) Adapter() (hooks.Adapter, error) {
+	switch c.Type {
+	case "github":
+		return &hooks.GitHub{Secret: c.Secret}, nil
+	case "gitea":
+		return &hooks.Gitea{Secret: c.Secret}, nil
+	case "alertmanager":
+		return &hooks.Alertmanager{Secret: c.Secret, Split: c.Split}, nil
+	case "shared_secret":
+		return &hooks.SharedSecret{
+			Secret:         c.Secret,
+			Header:         c.Header,
+			EventHeader:    c.EventHeader,
+			DeliveryHeader: c.DeliveryHeader,
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid type %q: must be github, gitea, alertmanager or shared_secret", c.Type)
+	}
+}
+
+// HooksConfig configures inbound webhook adapters
+type HooksConfig struct {
+	Enabled       bool          `mapstructure:"enabled"`
+	MaxBodySize   int64         `mapstructure:"max_body_size"`
+	ReplayWindow  time.Duration `mapstructure:"replay_window"`
+	MaxDeliveries int           `mapstructure:"max_deliveries"`
+	Adapters      []HookConfig  `mapstructure:"adapters"`
+}
+
+// Validate checks the hooks configuration for errors
+func (c HooksConfig) Validate() error {
+	seen := make(map[string]bool)
+	for _, h := range c.Adapters {
+		if h.Name == "" {
+			return fmt.Errorf("hook adapter without a name")
+		}
+		if seen[h.Name] {
+			return fmt.Errorf("duplicate hook adapter %q", h.Name)
+		}
+		seen[h.Name] = true
+
+		// Hooks bypass the authentication of the bus, the secret is what
+		// authenticates them
+		if h.Secret == "" {
+			return fmt.Errorf("hook adapter %q requires a secret", h.Name)
+		}
+		if _, err := h.Adapter(); err != nil {
+			return fmt.Errorf("hook adapter %q: %s", h.Name, err)
+		}
+	}
+	return nil
+}
+
+// newHooksReceiver returns a receiver of the configured inbound webhooks
+// publishing to the bus of s
+func (s *server) newHooksReceiver() *hooks.Receiver {
+	config := s.config.Hooks
+
+	rc := hooks.NewReceiver(s.bus, &hooks.Options{
+		MaxBodySize:   config.MaxBodySize,
+		ReplayWindow:  config.ReplayWindow,
+		MaxDeliveries: config.MaxDeliveries,
+	})
+
+	for _, h := range config.Adapters {
+		// Validated with the configuration
+		adapter, _ := h.Adapter()
+		rc.Handle(h.Name, adapter)
+	}
+
+	return rc
+}
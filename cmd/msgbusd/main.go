@@ -1,21 +1,42 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/mmcloughlin/professor"
 	"github.com/prologic/msgbus"
+	"github.com/prologic/msgbus/bridge"
+	"github.com/prologic/msgbus/cluster"
+	"github.com/prologic/msgbus/hooks"
+	"github.com/prologic/msgbus/webhook"
+	"github.com/spf13/viper"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
+// flagKeys maps command-line flags onto their configuration keys
+var flagKeys = map[string]string{
+	"bind":             "bind",
+	"buffer-length":    "buffer_length",
+	"max-queue-size":   "max_queue_size",
+	"max-payload-size": "max_payload_size",
+}
+
 func main() {
 	var (
 		version        bool
 		debug          bool
+		configFile     string
 		bind           string
 		bufferLength   int
 		maxQueueSize   int
@@ -25,7 +46,9 @@ func main() {
 	flag.BoolVar(&version, "v", false, "display version information")
 	flag.BoolVar(&debug, "d", false, "enable debug logging")
 
-	flag.StringVar(&bind, "bind", ":8000", "interface and port to bind to")
+	flag.StringVar(&configFile, "config", configFileFromEnv(), "config file (yaml, toml or json)")
+
+	flag.StringVar(&bind, "bind", defaultBind, "interface and port to bind to")
 
 	flag.IntVar(&bufferLength, "buffer-length", msgbus.DefaultBufferLength, "buffer length")
 	flag.IntVar(&maxQueueSize, "max-queue-size", msgbus.DefaultMaxQueueSize, "maximum queue size")
@@ -33,31 +56,377 @@ func main() {
 
 	flag.Parse()
 
-	if debug {
-		log.SetLevel(log.DebugLevel)
-	} else {
-		log.SetLevel(log.InfoLevel)
-	}
-
 	if version {
 		fmt.Printf("msgbusd %s", msgbus.FullVersion())
 		os.Exit(0)
 	}
 
+	v := newViper()
+
+	// Flags given explicitly on the command-line take precedence over
+	// the config file and environment.
+	flag.Visit(func(f *flag.Flag) {
+		if key, ok := flagKeys[f.Name]; ok {
+			v.Set(key, f.Value.String())
+		}
+	})
 	if debug {
+		v.Set("log.level", "debug")
+	}
+
+	config, err := loadConfig(v, configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := setupLogging(config.Log); err != nil {
+		log.Fatal(err)
+	}
+
+	if config.Log.Level == "debug" {
 		go professor.Launch(":6060")
 	}
 
-	opts := msgbus.Options{
-		BufferLength:   bufferLength,
-		MaxQueueSize:   maxQueueSize,
-		MaxPayloadSize: maxPayloadSize,
-		WithMetrics:    true,
+	s, err := newServer(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	go s.reloadOnSignal(v, configFile)
+
+	if config.MQTT.Enabled {
+		go func() {
+			log.Infof("msgbusd mqtt listening on %s", config.MQTT.Bind)
+			log.Fatal(s.newMQTTServer().ListenAndServe(config.MQTT.Bind))
+		}()
+	}
+
+	if config.STOMP.Enabled {
+		srv := s.newSTOMPServer()
+		if config.STOMP.Bind != "" {
+			go func() {
+				log.Infof("msgbusd stomp listening on %s", config.STOMP.Bind)
+				log.Fatal(srv.ListenAndServe(config.STOMP.Bind))
+			}()
+		}
+	}
+
+	if config.TCP.Enabled {
+		go func() {
+			log.Infof("msgbusd tcp listening on %s", config.TCP.Bind)
+			log.Fatal(s.newTCPServer().ListenAndServe(config.TCP.Bind))
+		}()
+	}
+
+	if config.GRPC.Enabled {
+		go func() {
+			log.Infof("msgbusd grpc listening on %s", config.GRPC.Bind)
+			log.Fatal(s.newGRPCServer().ListenAndServe(config.GRPC.Bind))
+		}()
+	}
+
+	log.Infof("msgbusd %s listening on %s", msgbus.FullVersion(), config.Bind)
+	err = s.ListenAndServe()
+	s.Shutdown()
+	log.Fatal(err)
+}
+
+// server ...
+type server struct {
+	sync.RWMutex
+
+	config *Config
+	bus    *msgbus.MessageBus
+	auth   *authenticator
+	cert   *tls.Certificate
+	tracer *sdktrace.TracerProvider
+	audit  *auditFile
+
+	webhooks *webhook.Manager
+	hooks    *hooks.Receiver
+	bridge   *bridge.Bridge
+	cluster  *cluster.Node
+}
+
+// newServer ...
+func newServer(config *Config) (*server, error) {
+	s := &server{
+		config: config,
+		auth:   newAuthenticator(config.Auth),
+	}
+
+	opts := config.BusOptions()
+
+	if config.Tracing.Enabled {
+		tp, err := newTracerProvider(config.Tracing)
+		if err != nil {
+			return nil, err
+		}
+		s.tracer = tp
+		opts.TracerProvider = tp
+	}
+
+	if config.Audit.Enabled {
+		audit, err := newAuditFile(config.Audit)
+		if err != nil {
+			return nil, err
+		}
+		s.audit = audit
+		opts.Auditor = audit
+	}
+
+	s.bus = msgbus.New(opts)
+
+	if config.Webhooks.Enabled {
+		webhooks, err := s.newWebhookManager()
+		if err != nil {
+			return nil, err
+		}
+		s.webhooks = webhooks
+	}
+
+	if config.Hooks.Enabled {
+		s.hooks = s.newHooksReceiver()
+	}
+
+	if config.Bridge.Enabled {
+		b, err := s.newBridge()
+		if err != nil {
+			return nil, err
+		}
+		s.bridge = b
+	}
+
+	if config.Cluster.Enabled {
+		node, err := s.newClusterNode()
+		if err != nil {
+			return nil, err
+		}
+		s.cluster = node
+	}
+
+	if config.TLS.Enabled() {
+		if err := s.loadCertificate(config.TLS); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Handler returns the http.Handler serving the bus and metrics
+func (s *server) Handler() http.Handler {
+	// STOMP websocket clients may authenticate with their CONNECT frame
+	rootAuth := authHandler
+	if s.config.STOMP.Enabled {
+		rootAuth = stompAuthHandler
+	}
+
+	mux := http.NewServeMux()
+	if s.cluster != nil {
+		mux.Handle("/", rootAuth(s.auth, s.bus, s.cluster))
+		mux.Handle(clusterPath, authHandler(s.auth, s.bus, http.StripPrefix("/_cluster", s.cluster.Admin())))
+	} else {
+		mux.Handle("/", rootAuth(s.auth, s.bus, s.bus))
+	}
+	if s.webhooks != nil {
+		mux.Handle("/_webhooks/", authHandler(s.auth, s.bus, http.StripPrefix("/_webhooks", s.webhooks)))
+	}
+	if s.hooks != nil {
+		// Inbound webhooks are authenticated by their adapters
+		mux.Handle("/hooks/", http.StripPrefix("/hooks", s.hooks))
+	}
+	if s.config.Metrics.Enabled {
+		mux.Handle(s.config.Metrics.Path, s.bus.Metrics().Handler())
+	}
+	return mux
+}
+
+// ListenAndServe ...
+func (s *server) ListenAndServe() error {
+	server := &http.Server{
+		Addr:    s.config.Bind,
+		Handler: s.Handler(),
+	}
+
+	if !s.config.TLS.Enabled() {
+		return server.ListenAndServe()
+	}
+
+	server.TLSConfig = s.tlsConfig()
+
+	return server.ListenAndServeTLS("", "")
+}
+
+// tlsConfig returns a tls configuration serving the current certificate,
+// which may change on reload
+func (s *server) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			s.RLock()
+			defer s.RUnlock()
+			return s.cert, nil
+		},
+	}
+}
+
+// Shutdown stops webhook deliveries, bridges and the cluster node, flushes
+// any pending traces and closes the audit log
+func (s *server) Shutdown() {
+	if s.webhooks != nil {
+		s.webhooks.Close()
+	}
+
+	if s.bridge != nil {
+		s.bridge.Close()
+	}
+
+	if s.cluster != nil {
+		if err := s.cluster.Shutdown(); err != nil {
+			log.Warnf("error shutting down cluster node: %s", err)
+		}
+	}
+
+	if s.tracer != nil {
+		if err := s.tracer.Shutdown(context.Background()); err != nil {
+			log.Warnf("error shutting down tracer: %s", err)
+		}
+	}
+
+	if s.audit != nil {
+		if err := s.audit.Close(); err != nil {
+			log.Warnf("error closing audit log: %s", err)
+		}
+	}
+}
+
+func (s *server) loadCertificate(config TLSConfig) error {
+	cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+	if err != nil {
+		return fmt.Errorf("error loading tls certificate: %s", err)
+	}
+
+	s.Lock()
+	s.cert = &cert
+	s.Unlock()
+
+	return nil
+}
+
+// Reload applies the settings of config that can change at runtime:
+// logging, limits, topic overrides, credentials and the tls certificate,
+// and reopens the audit log. Changes to the bind address, tls being
+// enabled, the metrics endpoint, tracing, auditing and the mqtt, stomp,
+// tcp and grpc listeners, webhooks, hooks, bridges and clustering require
+// a restart.
+func (s *server) Reload(config *Config) (err error) {
+	defer func() {
+		result, detail := msgbus.AuditOK, "reload"
+		if err != nil {
+			result, detail = msgbus.AuditError, fmt.Sprintf("reload: %s", err)
+		}
+		s.bus.Audit(context.Background(), msgbus.AuditEvent{
+			Action: msgbus.AuditAdmin, Result: result, Detail: detail,
+		})
+	}()
+
+	if err := setupLogging(config.Log); err != nil {
+		return err
+	}
+
+	if s.audit != nil {
+		if err := s.audit.Reopen(); err != nil {
+			return err
+		}
+	}
+
+	if config.TLS.Enabled() && s.config.TLS.Enabled() {
+		if err := s.loadCertificate(config.TLS); err != nil {
+			return err
+		}
+	}
+
+	if config.Bind != s.config.Bind {
+		log.Warnf("bind address changed to %s, restart required", config.Bind)
+	}
+	if config.TLS.Enabled() != s.config.TLS.Enabled() {
+		log.Warnf("tls enabled changed to %t, restart required", config.TLS.Enabled())
+	}
+	if config.Metrics != s.config.Metrics {
+		log.Warnf("metrics configuration changed, restart required")
+	}
+	if !reflect.DeepEqual(config.Tracing, s.config.Tracing) {
+		log.Warnf("tracing configuration changed, restart required")
+	}
+	if config.Audit != s.config.Audit {
+		log.Warnf("audit configuration changed, restart required")
+	}
+	if config.MQTT != s.config.MQTT {
+		log.Warnf("mqtt configuration changed, restart required")
+	}
+	if config.STOMP != s.config.STOMP {
+		log.Warnf("stomp configuration changed, restart required")
+	}
+	if config.TCP != s.config.TCP {
+		log.Warnf("tcp configuration changed, restart required")
+	}
+	if config.GRPC != s.config.GRPC {
+		log.Warnf("grpc configuration changed, restart required")
+	}
+	if !reflect.DeepEqual(config.Webhooks, s.config.Webhooks) {
+		log.Warnf("webhooks configuration changed, restart required")
+	}
+	if !reflect.DeepEqual(config.Hooks, s.config.Hooks) {
+		log.Warnf("hooks configuration changed, restart required")
+	}
+	if !reflect.DeepEqual(config.Bridge, s.config.Bridge) {
+		log.Warnf("bridge configuration changed, restart required")
+	}
+	if !reflect.DeepEqual(config.Cluster, s.config.Cluster) {
+		log.Warnf("cluster configuration changed, restart required")
+	}
+
+	s.bus.Configure(config.BusOptions())
+	s.auth.Update(config.Auth)
+
+	return nil
+}
+
+func (s *server) reloadOnSignal(v *viper.Viper, configFile string) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+
+	for range sigs {
+		log.Infof("caught SIGHUP, reloading configuration ...")
+
+		config, err := loadConfig(v, configFile)
+		if err != nil {
+			log.Errorf("error reloading configuration: %s", err)
+			continue
+		}
+
+		if err := s.Reload(config); err != nil {
+			log.Errorf("error reloading configuration: %s", err)
+			continue
+		}
+
+		log.Infof("configuration reloaded")
+	}
+}
+
+func setupLogging(config LogConfig) error {
+	level, err := log.ParseLevel(config.Level)
+	if err != nil {
+		return fmt.Errorf("invalid log.level %q: %s", config.Level, err)
+	}
+	log.SetLevel(level)
+
+	switch config.Format {
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		log.SetFormatter(&log.TextFormatter{})
 	}
-	mb := msgbus.New(&opts)
 
-	http.Handle("/", mb)
-	http.Handle("/metrics", mb.Metrics().Handler())
-	log.Infof("msgbusd %s listening on %s", msgbus.FullVersion(), bind)
-	log.Fatal(http.ListenAndServe(bind, nil))
+	return nil
 }
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/prologic/msgbus/mqtt"
+)
+
+// defaultMQTTBind is the default interface and port of the MQTT listener
+const defaultMQTTBind = ":1883"
+
+// MQTTConfig configures the MQTT 3.1.1 listener
+type MQTTConfig struct {
+	Enabled       bool   `mapstructure:"enabled"`
+	Bind          string `mapstructure:"bind"`
+	MaxPacketSize int    `mapstructure:"max_packet_size"`
+	MaxInflight   int    `mapstructure:"max_inflight"`
+}
+
+// newMQTTServer returns an MQTT server for the bus of s. Clients
+// authenticate with the username and password of a user or with a bearer
+// token as the password.
+func (s *server) newMQTTServer() *mqtt.Server {
+	return mqtt.NewServer(s.bus, &mqtt.Options{
+		Authenticate:  s.auth.AuthenticateCredentials,
+		MaxPacketSize: s.config.MQTT.MaxPacketSize,
+		MaxInflight:   s.config.MQTT.MaxInflight,
+	})
+}
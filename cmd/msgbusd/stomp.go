@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/prologic/msgbus"
+	"github.com/prologic/msgbus/stomp"
+)
+
+// defaultSTOMPBind is the default interface and port of the STOMP listener
+const defaultSTOMPBind = ":61613"
+
+// STOMPConfig configures the STOMP 1.2 listener and websocket subprotocol
+type STOMPConfig struct {
+	Enabled      bool   `mapstructure:"enabled"`
+	Bind         string `mapstructure:"bind"`
+	MaxFrameSize int    `mapstructure:"max_frame_size"`
+	MaxPending   int    `mapstructure:"max_pending"`
+}
+
+// newSTOMPServer returns a STOMP server for the bus of s and registers it
+// as the handler of the STOMP websocket subprotocol. Clients authenticate
+// with the login and passcode of a user or with a bearer token as the
+// passcode, websocket clients may instead authenticate their upgrade with
+// the HTTP API.
+func (s *server) newSTOMPServer() *stomp.Server {
+	srv := stomp.NewServer(s.bus, &stomp.Options{
+		Authenticate: s.auth.AuthenticateCredentials,
+		MaxFrameSize: s.config.STOMP.MaxFrameSize,
+		MaxPending:   s.config.STOMP.MaxPending,
+	})
+	s.bus.HandleSubprotocol(stomp.Subprotocol, srv.ServeWebsocket)
+	return srv
+}
+
+// stompAuthHandler wraps next as authHandler does, except that STOMP
+// websocket upgrades without valid HTTP credentials are let through
+// without an identity, to authenticate with their CONNECT frame.
+func stompAuthHandler(auth *authenticator, bus *msgbus.MessageBus, next http.Handler) http.Handler {
+	authed := authHandler(auth, bus, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isSTOMPUpgrade(r) {
+			if _, ok := auth.Authenticate(r); !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		authed.ServeHTTP(w, r)
+	})
+}
+
+// isSTOMPUpgrade returns true if r is a websocket upgrade offering the
+// STOMP subprotocol
+func isSTOMPUpgrade(r *http.Request) bool {
+	if r.Method != "GET" || !websocket.IsWebSocketUpgrade(r) {
+		return false
+	}
+	for _, name := range websocket.Subprotocols(r) {
+		if name == stomp.Subprotocol {
+			return true
+		}
+	}
+	return false
+}
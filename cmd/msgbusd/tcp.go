@@ -0,0 +1,23 @@
+package main
+
+import (
+	"github.com/prologic/msgbus/tcp"
+)
+
+// defaultTCPBind is the default interface and port of the TCP listener
+const defaultTCPBind = ":8001"
+
+// TCPConfig configures the listener of the TCP line protocol
+type TCPConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Bind    string `mapstructure:"bind"`
+}
+
+// newTCPServer returns a line protocol server for the bus of s. Clients
+// authenticate with AUTH and the username and password of a user or with
+// a bearer token.
+func (s *server) newTCPServer() *tcp.Server {
+	return tcp.NewServer(s.bus, &tcp.Options{
+		Authenticate: s.auth.AuthenticateCredentials,
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector is a stand-in for an OTLP/HTTP collector recording span names
+type collector struct {
+	sync.Mutex
+
+	spans []string
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || r.URL.Path != "/v1/traces" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	var req coltracepb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.Lock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, span := range ss.Spans {
+				c.spans = append(c.spans, span.Name)
+			}
+		}
+	}
+	c.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	out, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	w.Write(out)
+}
+
+func TestServerTracing(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &collector{}
+	cs := httptest.NewServer(c)
+	defer cs.Close()
+
+	v := newViper()
+	v.Set("metrics.enabled", false)
+	v.Set("tracing.enabled", true)
+	v.Set("tracing.endpoint", cs.URL)
+	v.Set("tracing.insecure", true)
+
+	config, err := loadConfig(v, "")
+	require.NoError(t, err)
+
+	s, err := newServer(config)
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	req, _ := http.NewRequest("PUT", ts.URL+"/hello", bytes.NewBufferString("hello"))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+
+	res, err = http.Get(ts.URL + "/hello")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+
+	s.Shutdown()
+
+	c.Lock()
+	defer c.Unlock()
+	assert.Equal([]string{"msgbus.put", "msgbus.queue", "msgbus.deliver"}, c.spans)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/prologic/msgbus/webhook"
+)
+
+// WebhookConfig is a push subscription delivering the messages of a topic
+// to a URL
+type WebhookConfig struct {
+	ID             string            `mapstructure:"id"`
+	Topic          string            `mapstructure:"topic"`
+	URL            string            `mapstructure:"url"`
+	Headers        map[string]string `mapstructure:"headers"`
+	Secret         string            `mapstructure:"secret"`
+	MaxConcurrency int               `mapstructure:"max_concurrency"`
+}
+
+// Subscription returns the webhook subscription described by c
+func (c WebhookConfig) Subscription() webhook.Subscription {
+	return webhook.Subscription{
+		ID:             c.ID,
+		Topic:          c.Topic,
+		URL:            c.URL,
+		Headers:        c.Headers,
+		Secret:         c.Secret,
+		MaxConcurrency: c.MaxConcurrency,
+	}
+}
+
+// WebhooksConfig configures outbound webhook push subscriptions, added
+// from the configuration or with the API on /_webhooks/. Only those of the
+// configuration survive a restart.
+type WebhooksConfig struct {
+	Enabled        bool            `mapstructure:"enabled"`
+	MaxAttempts    int             `mapstructure:"max_attempts"`
+	MaxFailures    int             `mapstructure:"max_failures"`
+	MaxConcurrency int             `mapstructure:"max_concurrency"`
+	MaxQueueLength int             `mapstructure:"max_queue_length"`
+	Subscriptions  []WebhookConfig `mapstructure:"subscriptions"`
+}
+
+// Validate checks the webhook configuration for errors
+func (c WebhooksConfig) Validate() error {
+	for _, sub := range c.Subscriptions {
+		if err := sub.Subscription().Validate(); err != nil {
+			return fmt.Errorf("invalid webhook subscription: %s", err)
+		}
+	}
+	return nil
+}
+
+// newWebhookManager returns a webhook manager for the bus of s with the
+// subscriptions of the configuration added
+func (s *server) newWebhookManager() (*webhook.Manager, error) {
+	config := s.config.Webhooks
+
+	m := webhook.NewManager(s.bus, &webhook.Options{
+		MaxAttempts:    config.MaxAttempts,
+		MaxFailures:    config.MaxFailures,
+		MaxConcurrency: config.MaxConcurrency,
+		MaxQueueLength: config.MaxQueueLength,
+	})
+
+	for _, sub := range config.Subscriptions {
+		if _, err := m.Add(sub.Subscription()); err != nil {
+			m.Close()
+			return nil, fmt.Errorf("error adding webhook subscription: %s", err)
+		}
+	}
+
+	return m, nil
+}
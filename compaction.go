@@ -0,0 +1,144 @@
+package msgbus
+
+import (
+	"sort"
+	"sync"
+)
+
+// compactThreshold is the number of messages appended to the log of a
+// compacted topic after which the log is compacted in the background
+const compactThreshold = 256
+
+// compaction is the store of a compacted topic, which keeps only the latest
+// message of each key. Messages are appended to a log that is compacted into
+// the table of latest messages in the background, so publishing never waits
+// for compaction.
+type compaction struct {
+	// mu guards the log not compacted yet
+	mu         sync.Mutex
+	log        []Message
+	compacting bool
+
+	// tableMu guards the table and is held while the log is compacted into
+	// it, readers never see messages taken off the log but not in the table
+	tableMu sync.RWMutex
+	table   map[string]Message
+}
+
+func newCompaction() *compaction {
+	return &compaction{table: make(map[string]Message)}
+}
+
+// append adds message to the log, compacting the log in the background
+// once it reaches compactThreshold
+func (c *compaction) append(message Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.log = append(c.log, message)
+	if len(c.log) >= compactThreshold && !c.compacting {
+		c.compacting = true
+		go c.compact()
+	}
+}
+
+// compact takes the messages off the log and keeps the latest message of
+// each key in the table, removing the keys of tombstones
+func (c *compaction) compact() {
+	c.tableMu.Lock()
+	defer c.tableMu.Unlock()
+
+	c.mu.Lock()
+	log := c.log
+	c.log = nil
+	c.compacting = false
+	c.mu.Unlock()
+
+	fold(c.table, log)
+}
+
+// fold applies the messages of log to table in order, a message with an
+// empty payload is a tombstone deleting its key
+func fold(table map[string]Message, log []Message) {
+	for _, message := range log {
+		if len(message.Payload) == 0 {
+			delete(table, message.Key)
+			continue
+		}
+		table[message.Key] = message
+	}
+}
+
+// latest returns the latest message of each key including those not
+// compacted yet, ordered by partition and id
+func (c *compaction) latest() []Message {
+	c.tableMu.RLock()
+	defer c.tableMu.RUnlock()
+
+	table := make(map[string]Message, len(c.table))
+	for key, message := range c.table {
+		table[key] = message
+	}
+
+	c.mu.Lock()
+	fold(table, c.log)
+	c.mu.Unlock()
+
+	messages := make([]Message, 0, len(table))
+	for _, message := range table {
+		messages = append(messages, message)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if messages[i].Partition != messages[j].Partition {
+			return messages[i].Partition < messages[j].Partition
+		}
+		return messages[i].ID < messages[j].ID
+	})
+
+	return messages
+}
+
+// reset replaces the contents of the store with messages
+func (c *compaction) reset(messages []Message) {
+	c.tableMu.Lock()
+	defer c.tableMu.Unlock()
+
+	c.mu.Lock()
+	c.log = nil
+	c.mu.Unlock()
+
+	c.table = make(map[string]Message, len(messages))
+	fold(c.table, messages)
+}
+
+// compact keeps message in the store of t if t is compacted, messages
+// without a key are not kept
+func (t *Topic) compact(message Message) {
+	if t.compaction == nil || message.Key == "" {
+		return
+	}
+	t.compaction.append(message)
+}
+
+// Compacted returns the latest message of each key of the compacted topic,
+// or of the compacted topics matching a pattern. Keys whose latest message
+// is a tombstone, i.e: has an empty payload, are left out.
+func (mb *MessageBus) Compacted(topic string) []Message {
+	mb.RLock()
+	defer mb.RUnlock()
+
+	var names []string
+	for name, t := range mb.topics {
+		if t.compaction != nil && MatchTopic(topic, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var messages []Message
+	for _, name := range names {
+		messages = append(messages, mb.topics[name].compaction.latest()...)
+	}
+
+	return messages
+}
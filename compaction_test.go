@@ -0,0 +1,186 @@
+package msgbus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCompactedBus(options TopicOptions) *MessageBus {
+	options.Compacted = true
+	return New(&Options{
+		BufferLength:   DefaultBufferLength,
+		MaxQueueSize:   DefaultMaxQueueSize,
+		MaxPayloadSize: DefaultMaxPayloadSize,
+		Topics:         map[string]TopicOptions{"devices": options},
+	})
+}
+
+// payloads returns the key=payload of messages
+func payloads(messages []Message) []string {
+	var out []string
+	for _, m := range messages {
+		out = append(out, fmt.Sprintf("%s=%s", m.Key, m.Payload))
+	}
+	return out
+}
+
+func TestCompactedLatest(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := newCompactedBus(TopicOptions{})
+	topic := mb.NewTopic("devices")
+	assert.True(topic.Compacted)
+
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "1"}, {"a", "2"}, {"c", "1"}, {"b", ""}} {
+		mb.Put(mb.NewMessageWithKey(topic, kv[0], []byte(kv[1])))
+	}
+	// Messages without a key are not kept
+	mb.Put(mb.NewMessage(topic, []byte("x")))
+
+	assert.Equal([]string{"a=2", "c=1"}, payloads(mb.Compacted("devices")))
+	assert.Equal([]string{"a=2", "c=1"}, payloads(mb.Compacted("#")))
+
+	// Topics that are not compacted have no latest messages
+	mb.Put(mb.NewMessageWithKey(mb.NewTopic("other"), "a", []byte("1")))
+	assert.Empty(mb.Compacted("other"))
+}
+
+func TestCompactedBackground(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := newCompactedBus(TopicOptions{})
+	topic := mb.NewTopic("devices")
+
+	n := compactThreshold * 3
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("%d", i%10)
+		mb.Put(mb.NewMessageWithKey(topic, key, []byte(fmt.Sprintf("%d", i))))
+	}
+
+	for i := 0; i < 100; i++ {
+		topic.compaction.mu.Lock()
+		pending := len(topic.compaction.log)
+		topic.compaction.mu.Unlock()
+		if pending < compactThreshold {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	topic.compaction.tableMu.RLock()
+	assert.True(len(topic.compaction.table) <= 10)
+	topic.compaction.tableMu.RUnlock()
+
+	latest := mb.Compacted("devices")
+	require.Len(t, latest, 10)
+	for _, m := range latest {
+		assert.True(m.ID >= uint64(n-10))
+		assert.Equal(fmt.Sprintf("%d", m.ID), string(m.Payload))
+	}
+}
+
+func TestCompactedPartitions(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := newCompactedBus(TopicOptions{Partitions: 4})
+	topic := mb.NewTopic("devices")
+
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "1"}, {"a", "2"}} {
+		mb.Put(mb.NewMessageWithKey(topic, kv[0], []byte(kv[1])))
+	}
+
+	latest := mb.Compacted("devices")
+	assert.ElementsMatch([]string{"a=2", "b=1"}, payloads(latest))
+	for _, m := range latest {
+		assert.Equal(PartitionFor(m.Key, 4), m.Partition)
+	}
+}
+
+func TestCompactedSnapshotRestore(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := newCompactedBus(TopicOptions{})
+	topic := mb.NewTopic("devices")
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "1"}, {"a", "2"}} {
+		mb.Put(mb.NewMessageWithKey(topic, kv[0], []byte(kv[1])))
+	}
+
+	other := New(nil)
+	other.Restore(mb.Snapshot())
+
+	devices := other.NewTopic("devices")
+	assert.True(devices.Compacted)
+	latest := other.Compacted("devices")
+	assert.Equal([]string{"b=1", "a=2"}, payloads(latest))
+	assert.Equal(devices, latest[0].Topic)
+
+	other.Restore(nil)
+	assert.Empty(other.Compacted("devices"))
+}
+
+func TestPutMessageRequiresKey(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := newCompactedBus(TopicOptions{})
+
+	_, _, err := mb.PutMessage(context.Background(), Publishing{Topic: "devices", Payload: []byte("on")})
+	assert.ErrorIs(err, ErrKeyRequired)
+	assert.Equal(uint64(0), mb.NewTopic("devices").Sequence)
+
+	message, _, err := mb.PutMessage(context.Background(), Publishing{
+		Topic: "devices", Key: "a", Payload: []byte("on"),
+	})
+	assert.NoError(err)
+	assert.Equal("a", message.Key)
+	assert.Equal([]string{"a=on"}, payloads(mb.Compacted("devices")))
+}
+
+func TestServeHTTPCompacted(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := newCompactedBus(TopicOptions{})
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("PUT", "/devices", bytes.NewBufferString("on"))
+	mb.ServeHTTP(w, r)
+	assert.Equal(http.StatusBadRequest, w.Code)
+
+	for _, kv := range [][2]string{{"a", "on"}, {"b", "on"}, {"a", "off"}} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("PUT", "/devices?key="+kv[0], bytes.NewBufferString(kv[1]))
+		mb.ServeHTTP(w, r)
+		assert.Equal(http.StatusAccepted, w.Code)
+	}
+
+	s := httptest.NewServer(mb)
+	defer s.Close()
+
+	u := fmt.Sprintf("ws%s/devices", strings.TrimPrefix(s.URL, "http"))
+	ws, _, err := websocket.DefaultDialer.Dial(u, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	read := func() string {
+		var msg *Message
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		require.NoError(t, ws.ReadJSON(&msg))
+		return fmt.Sprintf("%s=%s", msg.Key, msg.Payload)
+	}
+
+	// The latest message of each key is sent first, then live messages
+	assert.Equal("b=on", read())
+	assert.Equal("a=off", read())
+
+	mb.Put(mb.NewMessageWithKey(mb.NewTopic("devices"), "b", nil))
+	assert.Equal("b=", read())
+}
@@ -0,0 +1,178 @@
+package msgbus
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// IdempotencyKeyHeader is the request header identifying a publish,
+	// publishes to a topic with the same key within the dedup window are
+	// only put once
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	// IDHeader is the response header of a publish with the id of the
+	// message published, which is also in the PublishResult of the body
+	IDHeader = "X-Msgbus-Id"
+
+	// DuplicateHeader is set to "true" in the response of a publish whose
+	// idempotency key was already published, IDHeader is then the id of the
+	// message published first
+	DuplicateHeader = "X-Msgbus-Duplicate"
+
+	// DefaultDedupWindow is the default time idempotency keys are remembered
+	DefaultDedupWindow = 10 * time.Minute
+
+	// DefaultDedupSize is the default number of idempotency keys remembered
+	// per topic
+	DefaultDedupSize = 10000
+)
+
+// dedupEntry is an idempotency key remembered by a dedup window, seen when
+// the message published with it was created
+type dedupEntry struct {
+	key  string
+	seen time.Time
+}
+
+// DedupEntry is a message remembered by the dedup window of a topic with
+// the idempotency key it was published with
+type DedupEntry struct {
+	Key     string  `json:"key"`
+	Message Message `json:"message"`
+}
+
+// dedup is the dedup window of a topic, remembering the messages published
+// with an idempotency key for a time and up to a number of keys. Keys are
+// expired as of the creation of the messages published, not the local
+// clock, so the nodes of a cluster applying the same messages remember the
+// same keys.
+type dedup struct {
+	sync.Mutex
+
+	messages map[string]Message
+
+	// entries are the keys remembered in the order they were seen, the
+	// oldest are forgotten first
+	entries []dedupEntry
+}
+
+func newDedup() *dedup {
+	return &dedup{messages: make(map[string]Message)}
+}
+
+// expire forgets the keys seen longer than window before now and the
+// oldest keys beyond size, the caller must hold the lock
+func (d *dedup) expire(now time.Time, window time.Duration, size int) {
+	cutoff := now.Add(-window)
+
+	n := 0
+	for n < len(d.entries) && (len(d.entries)-n > size || d.entries[n].seen.Before(cutoff)) {
+		delete(d.messages, d.entries[n].key)
+		n++
+	}
+	if n > 0 {
+		d.entries = append(d.entries[:0:0], d.entries[n:]...)
+	}
+}
+
+// lookup returns the message published with key within window before now,
+// if remembered
+func (d *dedup) lookup(key string, now time.Time, window time.Duration) (Message, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.get(key, now, window)
+}
+
+// get is lookup for callers holding the lock
+func (d *dedup) get(key string, now time.Time, window time.Duration) (Message, bool) {
+	message, ok := d.messages[key]
+	if !ok || message.Created.Before(now.Add(-window)) {
+		return Message{}, false
+	}
+	return message, true
+}
+
+// remember remembers message as published with key, which must not be
+// remembered within window before message was created, the caller must
+// hold the lock
+func (d *dedup) remember(key string, message Message, window time.Duration, size int) {
+	if _, ok := d.messages[key]; ok {
+		d.forget(key)
+	}
+
+	d.messages[key] = message
+	d.entries = append(d.entries, dedupEntry{key: key, seen: message.Created})
+	d.expire(message.Created, window, size)
+}
+
+// forget forgets key, which may have expired without being forgotten yet
+// if messages were not created in order, the caller must hold the lock
+func (d *dedup) forget(key string) {
+	delete(d.messages, key)
+	for i, e := range d.entries {
+		if e.key == key {
+			d.entries = append(d.entries[:i:i], d.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// snapshot returns the messages remembered with their keys, oldest first
+func (d *dedup) snapshot() []DedupEntry {
+	d.Lock()
+	defer d.Unlock()
+
+	entries := make([]DedupEntry, len(d.entries))
+	for i, e := range d.entries {
+		entries[i] = DedupEntry{Key: e.key, Message: d.messages[e.key]}
+	}
+	return entries
+}
+
+// reset replaces the messages remembered with entries, oldest first
+func (d *dedup) reset(entries []DedupEntry) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.messages = make(map[string]Message, len(entries))
+	d.entries = make([]dedupEntry, len(entries))
+	for i, e := range entries {
+		d.messages[e.Key] = e.Message
+		d.entries[i] = dedupEntry{key: e.Key, seen: e.Message.Created}
+	}
+}
+
+// Published returns the message published to topic with the idempotency
+// key within the dedup window before now, if any. PutMessage looks the key
+// up again as the message is put.
+func (mb *MessageBus) Published(topic *Topic, key string) (Message, bool) {
+	mb.RLock()
+	defer mb.RUnlock()
+
+	if !mb.dedupEnabled() || key == "" || topic.dedup == nil {
+		return Message{}, false
+	}
+
+	return topic.dedup.lookup(key, time.Now(), mb.dedupWindow)
+}
+
+// dedupEnabled returns false if dedup is disabled by a negative window or
+// size, the caller must hold the bus lock
+func (mb *MessageBus) dedupEnabled() bool {
+	return mb.dedupWindow >= 0 && mb.dedupSize >= 0
+}
+
+// duplicate responds to a publish that duplicates original
+func (mb *MessageBus) duplicate(ctx context.Context, w http.ResponseWriter, original Message) {
+	mb.Audit(ctx, AuditEvent{
+		Action: AuditPublish, Result: AuditOK, Detail: "duplicate",
+	}.WithMessage(original))
+
+	result := NewPublishResult(original, 0)
+	result.Duplicate = true
+	WritePublishResult(w, result)
+}
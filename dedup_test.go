@@ -0,0 +1,149 @@
+package msgbus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupWindow(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	d := newDedup()
+	for i := 0; i < 5; i++ {
+		d.remember(fmt.Sprintf("%d", i), Message{ID: uint64(i), Created: now}, time.Minute, 3)
+	}
+
+	// Only the newest keys are remembered
+	_, ok := d.lookup("1", now, time.Minute)
+	assert.False(ok)
+	message, ok := d.lookup("4", now, time.Minute)
+	assert.True(ok)
+	assert.Equal(uint64(4), message.ID)
+
+	// Keys are forgotten after the window as of the creation of messages,
+	// not the local clock
+	later := now.Add(2 * time.Minute)
+	_, ok = d.lookup("4", later, time.Minute)
+	assert.False(ok)
+	d.remember("4", Message{ID: 11, Created: later}, time.Minute, 3)
+	assert.Len(d.entries, 1)
+	message, ok = d.lookup("4", later, time.Minute)
+	assert.True(ok)
+	assert.Equal(uint64(11), message.ID)
+}
+
+func TestServeHTTPIdempotent(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := New(nil)
+
+	put := func(key, payload string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("PUT", "/hello", bytes.NewBufferString(payload))
+		if key != "" {
+			r.Header.Set(IdempotencyKeyHeader, key)
+		}
+		mb.ServeHTTP(w, r)
+		return w
+	}
+
+	w := put("a", "first")
+	assert.Equal(http.StatusAccepted, w.Code)
+	assert.Equal("0", w.Header().Get(IDHeader))
+	assert.Empty(w.Header().Get(DuplicateHeader))
+
+	w = put("a", "retry")
+	assert.Equal(http.StatusAccepted, w.Code)
+	assert.Equal("0", w.Header().Get(IDHeader))
+	assert.Equal("true", w.Header().Get(DuplicateHeader))
+
+	assert.Equal("1", put("b", "second").Header().Get(IDHeader))
+	assert.Equal("2", put("", "third").Header().Get(IDHeader))
+
+	topic := mb.NewTopic("hello")
+	for _, expected := range []string{"first", "second", "third"} {
+		message, ok := mb.Get(topic)
+		assert.True(ok)
+		assert.Equal(expected, string(message.Payload))
+	}
+	_, ok := mb.Get(topic)
+	assert.False(ok)
+
+	// Deduplication can be disabled
+	mb = New(&Options{DedupWindow: -1})
+	for i := 0; i < 2; i++ {
+		_, result, _ := mb.PutMessage(context.Background(), Publishing{
+			Topic: "hello", Payload: []byte("x"), IdempotencyKey: "a",
+		})
+		assert.False(result.Duplicate)
+	}
+}
+
+func TestPutMessageConcurrentDuplicates(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := New(nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mb.PutMessage(context.Background(), Publishing{
+				Topic: "hello", Payload: []byte("x"), IdempotencyKey: "a",
+			})
+		}()
+	}
+	wg.Wait()
+
+	// Duplicates are not assigned a sequence, so no id is skipped
+	message, result, _ := mb.PutMessage(context.Background(), Publishing{Topic: "hello", Payload: []byte("y")})
+	assert.False(result.Duplicate)
+	assert.Equal(uint64(1), message.ID)
+}
+
+func TestDedupSnapshotRestore(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := New(nil)
+	original, _, _ := mb.PutMessage(context.Background(), Publishing{
+		Topic: "hello", Payload: []byte("x"), IdempotencyKey: "a",
+	})
+
+	// A retry after failover to a node restored from a snapshot is not put
+	// again
+	other := New(nil)
+	other.Restore(mb.Snapshot())
+	message, result, _ := other.PutMessage(context.Background(), Publishing{
+		Topic: "hello", Payload: []byte("x"), IdempotencyKey: "a",
+	})
+	assert.True(result.Duplicate)
+	assert.Equal(original.ID, message.ID)
+	assert.Equal(other.NewTopic("hello"), message.Topic)
+
+	// Topics not known before the restore deduplicate new publishes too
+	message, result, _ = other.PutMessage(context.Background(), Publishing{
+		Topic: "hello", Payload: []byte("y"), IdempotencyKey: "b",
+	})
+	assert.False(result.Duplicate)
+	_, result, _ = other.PutMessage(context.Background(), Publishing{
+		Topic: "hello", Payload: []byte("y"), IdempotencyKey: "b",
+	})
+	assert.True(result.Duplicate)
+	assert.Equal(uint64(1), message.ID)
+
+	other.Restore(nil)
+	_, result, _ = other.PutMessage(context.Background(), Publishing{
+		Topic: "hello", Payload: []byte("x"), IdempotencyKey: "a",
+	})
+	assert.False(result.Duplicate)
+}
@@ -0,0 +1,174 @@
+package grpcapi
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/prologic/msgbus"
+)
+
+// Client is a client of the msgbus gRPC API
+type Client struct {
+	conn *grpc.ClientConn
+	api  MessageBusClient
+}
+
+// Dial returns a client of the gRPC API of msgbusd at target, e.g:
+// localhost:8002. Unless transport credentials are given in opts the
+// connection is not encrypted.
+func Dial(target string, opts ...grpc.DialOption) (*Client, error) {
+	opts = append([]grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}, opts...)
+
+	conn, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{conn: conn, api: NewMessageBusClient(conn)}, nil
+}
+
+// NewClient returns a client using the established connection conn
+func NewClient(conn grpc.ClientConnInterface) *Client {
+	return &Client{api: NewMessageBusClient(conn)}
+}
+
+// Close closes the connection of a client created with Dial
+func (c *Client) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// Publish publishes payload with optional headers to topic and returns the
+// published message
+func (c *Client) Publish(ctx context.Context, topic string, payload []byte, headers map[string]string) (*msgbus.Message, error) {
+	res, err := c.api.Publish(ctx, &PublishRequest{
+		Topic:   topic,
+		Payload: payload,
+		Headers: headers,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &msgbus.Message{
+		ID:      res.GetId(),
+		Topic:   &msgbus.Topic{Name: res.GetTopic()},
+		Payload: payload,
+		Headers: headers,
+		Created: res.GetCreated().AsTime(),
+	}, nil
+}
+
+// Pull pulls the next message of topic, if the topic is empty the message
+// is nil
+func (c *Client) Pull(ctx context.Context, topic string) (*msgbus.Message, error) {
+	message, _, err := c.PullWithAck(ctx, topic, 0)
+	return message, err
+}
+
+// PullWithAck pulls the next message of topic which must be acknowledged
+// with its ack id before deadline, otherwise it is put back on the queue.
+// If the topic is empty the message is nil.
+func (c *Client) PullWithAck(ctx context.Context, topic string, deadline time.Duration) (*msgbus.Message, string, error) {
+	req := &PullRequest{Topic: topic}
+	if deadline > 0 {
+		req.AckDeadline = durationpb.New(deadline)
+	}
+
+	res, err := c.api.Pull(ctx, req)
+	if err != nil {
+		return nil, "", err
+	}
+	if res.GetMessage() == nil {
+		return nil, "", nil
+	}
+
+	return fromProto(res.GetMessage()), res.GetAckId(), nil
+}
+
+// Ack acknowledges messages pulled with PullWithAck
+func (c *Client) Ack(ctx context.Context, ackIDs ...string) error {
+	_, err := c.api.Ack(ctx, &AckRequest{AckIds: ackIDs})
+	return err
+}
+
+// ListTopics returns the topics of the bus
+func (c *Client) ListTopics(ctx context.Context) ([]*msgbus.Topic, error) {
+	res, err := c.api.ListTopics(ctx, &ListTopicsRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	topics := make([]*msgbus.Topic, 0, len(res.GetTopics()))
+	for _, t := range res.GetTopics() {
+		topics = append(topics, &msgbus.Topic{
+			Name:     t.GetName(),
+			Sequence: t.GetSeq(),
+			Created:  t.GetCreated().AsTime(),
+		})
+	}
+	return topics, nil
+}
+
+// Subscribe calls handler for every message published to topic, which may
+// be a pattern, until ctx is done or the stream fails. Handlers are called
+// one message at a time, while a handler runs messages are buffered by the
+// server up to the subscriber buffer length of the topic.
+func (c *Client) Subscribe(ctx context.Context, topic string, handler msgbus.HandlerFunc) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := c.api.Subscribe(ctx, &SubscribeRequest{Topic: topic})
+	if err != nil {
+		return err
+	}
+
+	for {
+		m, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		if err := handler(ctx, fromProto(m)); err != nil {
+			return err
+		}
+	}
+}
+
+// WithCredentials returns a dial option authenticating calls with a
+// username and password or, if username is empty, with a token
+func WithCredentials(username, password string) grpc.DialOption {
+	return grpc.WithPerRPCCredentials(&credentials{username: username, password: password})
+}
+
+// credentials implements credentials.PerRPCCredentials
+type credentials struct {
+	username string
+	password string
+}
+
+func (c *credentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	if c.username == "" {
+		return map[string]string{"authorization": "Bearer " + c.password}, nil
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte(c.username + ":" + c.password))
+	return map[string]string{"authorization": "Basic " + auth}, nil
+}
+
+// RequireTransportSecurity returns false as msgbusd may serve plain text
+func (c *credentials) RequireTransportSecurity() bool {
+	return false
+}
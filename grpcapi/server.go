@@ -0,0 +1,454 @@
+// Package grpcapi implements the msgbus gRPC API defined in msgbus.proto on
+// a msgbus.MessageBus, and a client of the API.
+//
+// Messages published over gRPC are pulled and delivered over HTTP and the
+// other protocols of the bus and vice versa. Pull optionally takes an ack
+// deadline, unacknowledged messages are put back on the queue of their
+// topic once the deadline passes. Subscribe streams messages through the
+// buffer of a bus subscriber: while the client is not receiving, e.g: the
+// flow control window of the stream is full, messages are buffered up to
+// the subscriber buffer length of the topic and further messages dropped.
+//
+// The code generated from msgbus.proto is regenerated with:
+//
+//	protoc --go_out=. --go_opt=paths=source_relative \
+//	    --go-grpc_out=. --go-grpc_opt=paths=source_relative msgbus.proto
+package grpcapi
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/prologic/msgbus"
+)
+
+const (
+	// MaxAckDeadline is the maximum ack deadline of pulled messages
+	MaxAckDeadline = 10 * time.Minute
+
+	// subscriberPrefix prefixes the bus subscriber id of a stream
+	subscriberPrefix = "grpc:"
+)
+
+// ErrServerClosed is returned by Serve after Close is called
+var ErrServerClosed = errors.New("grpcapi: server closed")
+
+// Options ...
+type Options struct {
+	// Authenticate validates the credentials of the "authorization"
+	// metadata of calls, either "Basic <base64 username:password>" or
+	// "Bearer <token>" with the token passed as the password, and returns
+	// the identity of the client. If set calls without valid credentials
+	// fail with codes.Unauthenticated.
+	Authenticate func(username, password string) (identity string, ok bool)
+
+	// ServerOptions are passed to the underlying grpc.Server, e.g: to
+	// configure transport credentials
+	ServerOptions []grpc.ServerOption
+}
+
+// lease is a pulled message awaiting acknowledgement
+type lease struct {
+	message msgbus.Message
+	timer   *time.Timer
+}
+
+// Server serves the MessageBus gRPC service on a bus
+type Server struct {
+	UnimplementedMessageBusServer
+
+	sync.Mutex
+
+	bus          *msgbus.MessageBus
+	authenticate func(username, password string) (string, bool)
+	grpcServer   *grpc.Server
+
+	leases  map[string]*lease
+	nextAck uint64
+	nextID  uint64
+	closed  bool
+}
+
+// NewServer ...
+func NewServer(bus *msgbus.MessageBus, options *Options) *Server {
+	if options == nil {
+		options = &Options{}
+	}
+
+	s := &Server{
+		bus:          bus,
+		authenticate: options.Authenticate,
+		leases:       make(map[string]*lease),
+	}
+
+	serverOptions := append([]grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(s.unaryInterceptor),
+		grpc.ChainStreamInterceptor(s.streamInterceptor),
+	}, options.ServerOptions...)
+
+	s.grpcServer = grpc.NewServer(serverOptions...)
+	RegisterMessageBusServer(s.grpcServer, s)
+
+	return s
+}
+
+// ListenAndServe listens on the TCP address addr and serves clients
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts and serves clients on l until Close is called
+func (s *Server) Serve(l net.Listener) error {
+	s.Lock()
+	closed := s.closed
+	s.Unlock()
+
+	if closed {
+		l.Close()
+		return ErrServerClosed
+	}
+
+	if err := s.grpcServer.Serve(l); err != nil && err != grpc.ErrServerStopped {
+		return err
+	}
+	return ErrServerClosed
+}
+
+// Close stops all listeners and closes all connections, messages pulled
+// but not yet acknowledged are put back on their queues
+func (s *Server) Close() error {
+	s.Lock()
+	s.closed = true
+	leases := s.leases
+	s.leases = make(map[string]*lease)
+	s.Unlock()
+
+	s.grpcServer.Stop()
+
+	for _, l := range leases {
+		if l.timer.Stop() {
+			s.bus.Requeue(l.message)
+		}
+	}
+
+	return nil
+}
+
+// context returns a copy of ctx carrying the remote address of the peer
+// and the authenticated identity of the call
+func (s *Server) context(ctx context.Context) (context.Context, error) {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		ctx = msgbus.WithRemoteAddr(ctx, p.Addr.String())
+	}
+
+	if s.authenticate == nil {
+		return ctx, nil
+	}
+
+	var authorization string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			authorization = values[0]
+		}
+	}
+
+	username, password, ok := parseAuthorization(authorization)
+	if ok {
+		var identity string
+		if identity, ok = s.authenticate(username, password); ok {
+			return msgbus.WithIdentity(ctx, identity), nil
+		}
+	}
+
+	s.bus.Audit(ctx, msgbus.AuditEvent{
+		Action: msgbus.AuditAuth, Result: msgbus.AuditDenied, Detail: "invalid credentials",
+	})
+	return nil, status.Error(codes.Unauthenticated, "invalid credentials")
+}
+
+func (s *Server) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.context(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *Server) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.context(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+}
+
+// serverStream overrides the context of a stream
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (ss *serverStream) Context() context.Context {
+	return ss.ctx
+}
+
+// Publish ...
+func (s *Server) Publish(ctx context.Context, req *PublishRequest) (*PublishResponse, error) {
+	topic := req.GetTopic()
+	if topic == "" || msgbus.IsPattern(topic) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid topic %q", topic)
+	}
+
+	bus := s.bus
+	if len(req.GetPayload()) > bus.TopicOptions(topic).MaxPayloadSize {
+		msg := "payload exceeds max-payload-size"
+		bus.Audit(ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditPublish, Result: msgbus.AuditRejected,
+			Topic: topic, Size: len(req.GetPayload()), Detail: msg,
+		})
+		return nil, status.Error(codes.ResourceExhausted, msg)
+	}
+
+	var headers map[string]string
+	if len(req.GetHeaders()) > 0 {
+		headers = make(map[string]string, len(req.GetHeaders()))
+		for k, v := range req.GetHeaders() {
+			headers[k] = v
+		}
+	}
+	message, _, err := bus.PutMessage(ctx, msgbus.Publishing{
+		Topic: topic, Payload: req.GetPayload(), Headers: headers,
+	})
+	if err != nil {
+		bus.Audit(ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditPublish, Result: msgbus.AuditRejected,
+			Topic: topic, Size: len(req.GetPayload()), Detail: err.Error(),
+		})
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	bus.Audit(ctx, msgbus.AuditEvent{
+		Action: msgbus.AuditPublish, Result: msgbus.AuditOK,
+	}.WithMessage(message))
+
+	return &PublishResponse{
+		Id:      message.ID,
+		Topic:   topic,
+		Created: timestamppb.New(message.Created),
+	}, nil
+}
+
+// Pull ...
+func (s *Server) Pull(ctx context.Context, req *PullRequest) (*PullResponse, error) {
+	topic := req.GetTopic()
+	if topic == "" || msgbus.IsPattern(topic) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid topic %q", topic)
+	}
+
+	var deadline time.Duration
+	if req.GetAckDeadline() != nil {
+		deadline = req.GetAckDeadline().AsDuration()
+		if deadline < 0 || deadline > MaxAckDeadline {
+			return nil, status.Errorf(codes.InvalidArgument, "ack deadline must be between 0 and %s", MaxAckDeadline)
+		}
+	}
+
+	bus := s.bus
+	message, ok := bus.Get(bus.NewTopic(topic))
+	if !ok {
+		bus.Audit(ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditPull, Result: msgbus.AuditEmpty, Topic: topic,
+		})
+		return &PullResponse{}, nil
+	}
+
+	bus.Audit(ctx, msgbus.AuditEvent{
+		Action: msgbus.AuditPull, Result: msgbus.AuditOK,
+	}.WithMessage(message))
+
+	res := &PullResponse{Message: toProto(message)}
+	if deadline > 0 {
+		res.AckId = s.lease(message, deadline)
+	}
+
+	return res, nil
+}
+
+// lease holds message until it is acknowledged or deadline passes and it
+// is put back on its queue, and returns its ack id
+func (s *Server) lease(message msgbus.Message, deadline time.Duration) string {
+	s.Lock()
+	defer s.Unlock()
+
+	s.nextAck++
+	ackID := strconv.FormatUint(s.nextAck, 10)
+
+	s.leases[ackID] = &lease{
+		message: message,
+		timer: time.AfterFunc(deadline, func() {
+			s.Lock()
+			_, ok := s.leases[ackID]
+			delete(s.leases, ackID)
+			s.Unlock()
+
+			if ok {
+				log.Debugf("[grpc] ack deadline of %s exceeded, requeuing", ackID)
+				s.bus.Requeue(message)
+			}
+		}),
+	}
+
+	return ackID
+}
+
+// Ack ...
+func (s *Server) Ack(ctx context.Context, req *AckRequest) (*AckResponse, error) {
+	var unknown []string
+
+	s.Lock()
+	for _, ackID := range req.GetAckIds() {
+		l, ok := s.leases[ackID]
+		if !ok {
+			unknown = append(unknown, ackID)
+			continue
+		}
+		l.timer.Stop()
+		delete(s.leases, ackID)
+	}
+	s.Unlock()
+
+	if len(unknown) > 0 {
+		return nil, status.Errorf(
+			codes.NotFound, "unknown or expired ack ids: %s", strings.Join(unknown, ", "),
+		)
+	}
+
+	return &AckResponse{}, nil
+}
+
+// ListTopics ...
+func (s *Server) ListTopics(ctx context.Context, req *ListTopicsRequest) (*ListTopicsResponse, error) {
+	res := &ListTopicsResponse{}
+	for _, t := range s.bus.Topics() {
+		t = t.Copy()
+		res.Topics = append(res.Topics, &Topic{
+			Name:    t.Name,
+			Seq:     t.Sequence,
+			Created: timestamppb.New(t.Created),
+		})
+	}
+	return res, nil
+}
+
+// Subscribe ...
+func (s *Server) Subscribe(req *SubscribeRequest, stream MessageBus_SubscribeServer) error {
+	topic := req.GetTopic()
+	if topic == "" || !msgbus.ValidPattern(topic) {
+		return status.Errorf(codes.InvalidArgument, "invalid topic %q", topic)
+	}
+
+	s.Lock()
+	s.nextID++
+	id := subscriberPrefix + strconv.FormatUint(s.nextID, 10)
+	s.Unlock()
+
+	ctx := stream.Context()
+	bus := s.bus
+
+	var ch chan msgbus.Message
+	if msgbus.IsPattern(topic) {
+		ch = bus.SubscribePattern(id, topic)
+		defer bus.UnsubscribePattern(id, topic)
+	} else {
+		ch = bus.Subscribe(id, topic)
+		defer bus.Unsubscribe(id, topic)
+	}
+
+	bus.Audit(ctx, msgbus.AuditEvent{
+		Action: msgbus.AuditSubscribe, Result: msgbus.AuditOK, Topic: topic,
+	})
+	defer bus.Audit(ctx, msgbus.AuditEvent{
+		Action: msgbus.AuditUnsubscribe, Result: msgbus.AuditOK, Topic: topic,
+	})
+
+	log.Debugf("[grpc] %s subscribed to %s", id, topic)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case message, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			// Blocks while the flow control window of the stream is full,
+			// meanwhile messages are buffered by the subscriber channel
+			if err := stream.Send(toProto(message)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// parseAuthorization parses the value of the "authorization" metadata
+func parseAuthorization(authorization string) (username, password string, ok bool) {
+	scheme, credentials, found := strings.Cut(authorization, " ")
+	if !found {
+		return "", "", false
+	}
+
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		return "", credentials, credentials != ""
+	case "basic":
+		decoded, err := base64.StdEncoding.DecodeString(credentials)
+		if err != nil {
+			return "", "", false
+		}
+		return strings.Cut(string(decoded), ":")
+	default:
+		return "", "", false
+	}
+}
+
+// toProto converts a bus message to its protobuf representation
+func toProto(message msgbus.Message) *Message {
+	m := &Message{
+		Id:      message.ID,
+		Payload: message.Payload,
+		Headers: message.Headers,
+		Created: timestamppb.New(message.Created),
+	}
+	if message.Topic != nil {
+		m.Topic = message.Topic.Name
+	}
+	return m
+}
+
+// fromProto converts a protobuf message to a bus message
+func fromProto(m *Message) *msgbus.Message {
+	return &msgbus.Message{
+		ID:      m.GetId(),
+		Topic:   &msgbus.Topic{Name: m.GetTopic()},
+		Payload: m.GetPayload(),
+		Headers: m.GetHeaders(),
+		Created: m.GetCreated().AsTime(),
+	}
+}
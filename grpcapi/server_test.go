@@ -0,0 +1,230 @@
+package grpcapi
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/prologic/msgbus"
+)
+
+func newTestServer(t *testing.T, options *Options, opts ...grpc.DialOption) (*msgbus.MessageBus, *Client) {
+	mb := msgbus.New(nil)
+	s := NewServer(mb, options)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	c, err := Dial(l.Addr().String(), opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+
+	return mb, c
+}
+
+func TestPublishPull(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	mb, c := newTestServer(t, nil)
+
+	message, err := c.Publish(ctx, "foo", []byte("bar"), map[string]string{"x-key": "1"})
+	require.NoError(t, err)
+	assert.Equal(uint64(0), message.ID)
+	assert.Equal("foo", message.Topic.Name)
+
+	// Messages published over gRPC can be pulled over HTTP
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/foo", nil)
+	mb.ServeHTTP(w, r)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `"x-key":"1"`)
+
+	// Messages published over HTTP can be pulled over gRPC
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("PUT", "/foo", bytes.NewBufferString("baz"))
+	mb.ServeHTTP(w, r)
+
+	message, err = c.Pull(ctx, "foo")
+	require.NoError(t, err)
+	require.NotNil(t, message)
+	assert.Equal(uint64(1), message.ID)
+	assert.Equal([]byte("baz"), message.Payload)
+
+	message, err = c.Pull(ctx, "foo")
+	assert.NoError(err)
+	assert.Nil(message)
+
+	_, err = c.Publish(ctx, "foo/+", nil, nil)
+	assert.Equal(codes.InvalidArgument, status.Code(err))
+
+	_, err = c.Publish(ctx, "foo", make([]byte, msgbus.DefaultMaxPayloadSize+1), nil)
+	assert.Equal(codes.ResourceExhausted, status.Code(err))
+}
+
+func TestPublishCompacted(t *testing.T) {
+	mb := msgbus.New(&msgbus.Options{
+		MaxPayloadSize: msgbus.DefaultMaxPayloadSize,
+		Topics:         map[string]msgbus.TopicOptions{"devices": {Compacted: true}},
+	})
+	s := NewServer(mb, nil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l)
+	defer s.Close()
+
+	c, err := Dial(l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+
+	_, err = c.Publish(context.Background(), "devices", []byte("on"), nil)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestPullWithAck(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	_, c := newTestServer(t, nil)
+
+	_, err := c.Publish(ctx, "jobs", []byte("a"), nil)
+	require.NoError(t, err)
+	_, err = c.Publish(ctx, "jobs", []byte("b"), nil)
+	require.NoError(t, err)
+
+	a, ackA, err := c.PullWithAck(ctx, "jobs", 50*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal([]byte("a"), a.Payload)
+	assert.NotEmpty(ackA)
+
+	b, ackB, err := c.PullWithAck(ctx, "jobs", time.Minute)
+	require.NoError(t, err)
+	assert.Equal([]byte("b"), b.Payload)
+	assert.NoError(c.Ack(ctx, ackB))
+
+	// Unacknowledged messages are requeued once their deadline passes
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(codes.NotFound, status.Code(c.Ack(ctx, ackA)))
+
+	message, err := c.Pull(ctx, "jobs")
+	require.NoError(t, err)
+	require.NotNil(t, message)
+	assert.Equal([]byte("a"), message.Payload)
+
+	message, err = c.Pull(ctx, "jobs")
+	assert.NoError(err)
+	assert.Nil(message)
+}
+
+func TestListTopics(t *testing.T) {
+	ctx := context.Background()
+
+	_, c := newTestServer(t, nil)
+
+	for _, topic := range []string{"foo", "bar", "foo"} {
+		_, err := c.Publish(ctx, topic, []byte("x"), nil)
+		require.NoError(t, err)
+	}
+
+	topics, err := c.ListTopics(ctx)
+	require.NoError(t, err)
+	require.Len(t, topics, 2)
+	assert.Equal(t, "bar", topics[0].Name)
+	assert.Equal(t, "foo", topics[1].Name)
+	assert.Equal(t, uint64(2), topics[1].Sequence)
+}
+
+func TestSubscribe(t *testing.T) {
+	assert := assert.New(t)
+
+	mb, c := newTestServer(t, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages := make(chan *msgbus.Message)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.Subscribe(ctx, "sensors/+", func(ctx context.Context, msg *msgbus.Message) error {
+			select {
+			case messages <- msg:
+			case <-ctx.Done():
+			}
+			return nil
+		})
+	}()
+
+	// Wait for the subscription to be registered
+	topic := mb.NewTopic("sensors/kitchen")
+wait:
+	for i := 0; i < 50; i++ {
+		mb.Put(mb.NewMessage(topic, []byte("21")))
+		select {
+		case msg := <-messages:
+			assert.Equal("sensors/kitchen", msg.Topic.Name)
+			assert.Equal([]byte("21"), msg.Payload)
+			break wait
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	_, err := c.Publish(context.Background(), "sensors/garage", []byte("12"), nil)
+	require.NoError(t, err)
+
+	for msg := range messages {
+		if msg.Topic.Name == "sensors/garage" {
+			assert.Equal([]byte("12"), msg.Payload)
+			break
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-errs:
+		assert.Equal(context.Canceled, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscribe did not return")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	ctx := context.Background()
+
+	options := &Options{
+		Authenticate: func(username, password string) (string, bool) {
+			if username == "" {
+				return "token", password == "abc"
+			}
+			return username, username == "alice" && password == "secret"
+		},
+	}
+
+	_, c := newTestServer(t, options)
+	_, err := c.Publish(ctx, "foo", []byte("bar"), nil)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, c = newTestServer(t, options, WithCredentials("alice", "wrong"))
+	_, err = c.ListTopics(ctx)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, c = newTestServer(t, options, WithCredentials("alice", "secret"))
+	_, err = c.Publish(ctx, "foo", []byte("bar"), nil)
+	assert.NoError(t, err)
+
+	_, c = newTestServer(t, options, WithCredentials("", "abc"))
+	_, err = c.Pull(ctx, "foo")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,207 @@
+package hooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Event is a message extracted from a webhook request
+type Event struct {
+	// Type is the type of event, e.g: the GitHub event "push"
+	Type string
+
+	// DeliveryID uniquely identifies the request, used to reject replays,
+	// empty if the source doesn't identify deliveries
+	DeliveryID string
+
+	// Payload is the payload of the message
+	Payload []byte
+
+	// Headers are additional headers of the message
+	Headers map[string]string
+}
+
+// Adapter verifies and normalizes the requests of a webhook source
+type Adapter interface {
+	// Verify returns ErrInvalidSignature if the request with the raw body
+	// body was not sent by the source
+	Verify(r *http.Request, body []byte) error
+
+	// Parse returns the events of a verified request
+	Parse(r *http.Request, body []byte) ([]Event, error)
+}
+
+// GitHub is an adapter for GitHub webhooks, signed with HMAC-SHA256 of the
+// body with the secret of the webhook
+type GitHub struct {
+	Secret string
+}
+
+// Verify checks the X-Hub-Signature-256 header
+func (a *GitHub) Verify(r *http.Request, body []byte) error {
+	signature := strings.TrimPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+	return verifyHMAC(a.Secret, body, signature)
+}
+
+// Parse returns the request as a single event of the type and delivery id
+// of the X-GitHub-Event and X-GitHub-Delivery headers
+func (a *GitHub) Parse(r *http.Request, body []byte) ([]Event, error) {
+	return []Event{{
+		Type:       r.Header.Get("X-GitHub-Event"),
+		DeliveryID: r.Header.Get("X-GitHub-Delivery"),
+		Payload:    body,
+	}}, nil
+}
+
+// Gitea is an adapter for Gitea and Forgejo webhooks, signed with
+// HMAC-SHA256 of the body with the secret of the webhook
+type Gitea struct {
+	Secret string
+}
+
+// Verify checks the X-Gitea-Signature header
+func (a *Gitea) Verify(r *http.Request, body []byte) error {
+	return verifyHMAC(a.Secret, body, r.Header.Get("X-Gitea-Signature"))
+}
+
+// Parse returns the request as a single event of the type and delivery id
+// of the X-Gitea-Event and X-Gitea-Delivery headers
+func (a *Gitea) Parse(r *http.Request, body []byte) ([]Event, error) {
+	return []Event{{
+		Type:       r.Header.Get("X-Gitea-Event"),
+		DeliveryID: r.Header.Get("X-Gitea-Delivery"),
+		Payload:    body,
+	}}, nil
+}
+
+// Alertmanager is an adapter for Prometheus Alertmanager webhooks, which
+// authenticate with a shared secret as bearer token. Alertmanager batches
+// alerts of a group in one notification, which is split into a message per
+// alert if Split is true.
+type Alertmanager struct {
+	Secret string
+	Split  bool
+}
+
+// alertmanagerNotification is the payload of an Alertmanager webhook
+type alertmanagerNotification struct {
+	Version           string            `json:"version"`
+	GroupKey          string            `json:"groupKey"`
+	Status            string            `json:"status"`
+	Receiver          string            `json:"receiver"`
+	GroupLabels       map[string]string `json:"groupLabels"`
+	CommonLabels      map[string]string `json:"commonLabels"`
+	CommonAnnotations map[string]string `json:"commonAnnotations"`
+	ExternalURL       string            `json:"externalURL"`
+	Alerts            []json.RawMessage `json:"alerts"`
+}
+
+// alertmanagerAlert is the part of an alert of an Alertmanager webhook
+// copied into message headers
+type alertmanagerAlert struct {
+	Status      string `json:"status"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// Verify checks the bearer token of the Authorization header
+func (a *Alertmanager) Verify(r *http.Request, body []byte) error {
+	return verifyToken(a.Secret, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+}
+
+// Parse returns the notification as a single event of type "alerts" or, if
+// Split is true, an event of type "alert" per alert with the status and
+// fingerprint of the alert and the group key as headers
+func (a *Alertmanager) Parse(r *http.Request, body []byte) ([]Event, error) {
+	var n alertmanagerNotification
+	if err := json.Unmarshal(body, &n); err != nil {
+		return nil, fmt.Errorf("invalid alertmanager notification: %s", err)
+	}
+
+	if !a.Split {
+		return []Event{{
+			Type:    "alerts",
+			Payload: body,
+			Headers: map[string]string{"alertmanager-status": n.Status},
+		}}, nil
+	}
+
+	events := make([]Event, 0, len(n.Alerts))
+	for _, raw := range n.Alerts {
+		var alert alertmanagerAlert
+		if err := json.Unmarshal(raw, &alert); err != nil {
+			return nil, fmt.Errorf("invalid alertmanager alert: %s", err)
+		}
+
+		events = append(events, Event{
+			Type:    "alert",
+			Payload: raw,
+			Headers: map[string]string{
+				"alertmanager-status":      alert.Status,
+				"alertmanager-fingerprint": alert.Fingerprint,
+				"alertmanager-group-key":   n.GroupKey,
+			},
+		})
+	}
+
+	return events, nil
+}
+
+// SharedSecret is an adapter for generic webhooks that authenticate with a
+// shared secret in a header, by default X-Webhook-Secret. Event types and
+// delivery ids are taken from the optional EventHeader and DeliveryHeader.
+type SharedSecret struct {
+	Secret         string
+	Header         string
+	EventHeader    string
+	DeliveryHeader string
+}
+
+// Verify checks the secret header
+func (a *SharedSecret) Verify(r *http.Request, body []byte) error {
+	header := a.Header
+	if header == "" {
+		header = "X-Webhook-Secret"
+	}
+	return verifyToken(a.Secret, r.Header.Get(header))
+}
+
+// Parse returns the request as a single event
+func (a *SharedSecret) Parse(r *http.Request, body []byte) ([]Event, error) {
+	event := Event{Payload: body}
+	if a.EventHeader != "" {
+		event.Type = r.Header.Get(a.EventHeader)
+	}
+	if a.DeliveryHeader != "" {
+		event.DeliveryID = r.Header.Get(a.DeliveryHeader)
+	}
+	return []Event{event}, nil
+}
+
+// verifyHMAC checks signature is the hex HMAC-SHA256 of body with secret
+func verifyHMAC(secret string, body []byte, signature string) error {
+	expected, err := hex.DecodeString(signature)
+	if err != nil || signature == "" {
+		return ErrInvalidSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// verifyToken checks token is the shared secret
+func verifyToken(secret, token string) error {
+	if token == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(token)) != 1 {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+// Package hooks receives webhooks of third-party services, e.g: GitHub,
+// Gitea or Alertmanager, and publishes them to a msgbus.MessageBus.
+//
+// Requests to /<adapter>/<topic>, relative to where the Receiver is
+// mounted, are verified by the named Adapter, e.g: by checking their
+// signature, and normalized into messages published to the topic. The type
+// of event and the delivery id of the request are set as the "hook-event"
+// and "hook-delivery" headers of the messages, and requests with a delivery
+// id that was already received are rejected as replays.
+package hooks
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prologic/msgbus"
+)
+
+const (
+	// DefaultMaxBodySize is the default maximum size of a request body
+	DefaultMaxBodySize = 1 << 20 // 1MB
+
+	// DefaultReplayWindow is the default time delivery ids are remembered
+	// to reject replays
+	DefaultReplayWindow = 24 * time.Hour
+
+	// DefaultMaxDeliveries is the default maximum number of delivery ids
+	// remembered to reject replays
+	DefaultMaxDeliveries = 10000
+)
+
+// Message headers
+const (
+	HeaderAdapter  = "hook-adapter"
+	HeaderEvent    = "hook-event"
+	HeaderDelivery = "hook-delivery"
+)
+
+// ErrInvalidSignature is returned by adapters for requests that could not
+// be verified
+var ErrInvalidSignature = errors.New("hooks: invalid signature")
+
+// Options ...
+type Options struct {
+	// MaxBodySize is the maximum size of a request body, which may be a
+	// batch of several messages
+	MaxBodySize int64
+
+	// ReplayWindow is the time delivery ids are remembered
+	ReplayWindow time.Duration
+
+	// MaxDeliveries is the maximum number of delivery ids remembered
+	MaxDeliveries int
+}
+
+// Receiver publishes webhooks received by adapters to a bus
+type Receiver struct {
+	sync.RWMutex
+
+	bus         *msgbus.MessageBus
+	adapters    map[string]Adapter
+	maxBodySize int64
+	seen        *replayCache
+}
+
+// NewReceiver ...
+func NewReceiver(bus *msgbus.MessageBus, options *Options) *Receiver {
+	rc := &Receiver{
+		bus:         bus,
+		adapters:    make(map[string]Adapter),
+		maxBodySize: DefaultMaxBodySize,
+	}
+
+	window, max := DefaultReplayWindow, DefaultMaxDeliveries
+	if options != nil {
+		if options.MaxBodySize > 0 {
+			rc.maxBodySize = options.MaxBodySize
+		}
+		if options.ReplayWindow > 0 {
+			window = options.ReplayWindow
+		}
+		if options.MaxDeliveries > 0 {
+			max = options.MaxDeliveries
+		}
+	}
+	rc.seen = newReplayCache(window, max)
+
+	return rc
+}
+
+// Handle registers adapter to receive webhooks on /<name>/<topic>
+func (rc *Receiver) Handle(name string, adapter Adapter) {
+	rc.Lock()
+	defer rc.Unlock()
+
+	rc.adapters[name] = adapter
+}
+
+func (rc *Receiver) adapter(name string) Adapter {
+	rc.RLock()
+	defer rc.RUnlock()
+
+	return rc.adapters[name]
+}
+
+func (rc *Receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := msgbus.WithRemoteAddr(r.Context(), r.RemoteAddr)
+
+	if r.Method != "POST" && r.Method != "PUT" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, topic, _ := strings.Cut(strings.Trim(r.URL.Path, "/"), "/")
+	adapter := rc.adapter(name)
+	if adapter == nil {
+		http.Error(w, fmt.Sprintf("unknown adapter %q", name), http.StatusNotFound)
+		return
+	}
+	if topic == "" || msgbus.IsPattern(topic) {
+		http.Error(w, fmt.Sprintf("invalid topic %q", topic), http.StatusBadRequest)
+		return
+	}
+
+	ctx = msgbus.WithIdentity(ctx, "hook:"+name)
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, rc.maxBodySize))
+	if err != nil {
+		msg := fmt.Sprintf("error reading payload: %s", err)
+		rc.bus.Audit(ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditPublish, Result: msgbus.AuditRejected, Topic: topic, Detail: msg,
+		})
+		http.Error(w, msg, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err := adapter.Verify(r, body); err != nil {
+		rc.bus.Audit(ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditAuth, Result: msgbus.AuditDenied, Topic: topic,
+			Detail: fmt.Sprintf("hook %s: %s", name, err),
+		})
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	events, err := adapter.Parse(r, body)
+	if err != nil {
+		rc.bus.Audit(ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditPublish, Result: msgbus.AuditRejected, Topic: topic,
+			Detail: err.Error(),
+		})
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	maxPayloadSize := rc.bus.TopicOptions(topic).MaxPayloadSize
+	for _, event := range events {
+		if len(event.Payload) > maxPayloadSize {
+			msg := "payload exceeds max-payload-size"
+			rc.bus.Audit(ctx, msgbus.AuditEvent{
+				Action: msgbus.AuditPublish, Result: msgbus.AuditRejected, Topic: topic,
+				Size: len(event.Payload), Detail: msg,
+			})
+			http.Error(w, msg, http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+
+	// Deliveries are remembered per adapter once published, so a request
+	// failing above or while publishing may be retried
+	for _, event := range events {
+		if event.DeliveryID == "" {
+			continue
+		}
+		if rc.seen.Contains(name + ":" + event.DeliveryID) {
+			msg := fmt.Sprintf("delivery %s already received", event.DeliveryID)
+			rc.bus.Audit(ctx, msgbus.AuditEvent{
+				Action: msgbus.AuditPublish, Result: msgbus.AuditRejected, Topic: topic, Detail: msg,
+			})
+			http.Error(w, msg, http.StatusConflict)
+			return
+		}
+	}
+
+	published, err := rc.publish(ctx, name, topic, events)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if published == 0 && len(events) > 0 {
+		http.Error(w, "deliveries already received", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// publish publishes events to topic, stopping at the first event that
+// cannot be published, and returns the number of events published. Events
+// are published with their delivery id as idempotency key, so a delivery
+// received concurrently by another request is only published once, and
+// remembered once published.
+func (rc *Receiver) publish(ctx context.Context, name, topic string, events []Event) (int, error) {
+	published := 0
+	for _, event := range events {
+		headers := make(map[string]string, len(event.Headers)+3)
+		for k, v := range event.Headers {
+			headers[k] = v
+		}
+		headers[HeaderAdapter] = name
+		if event.Type != "" {
+			headers[HeaderEvent] = event.Type
+		}
+		if event.DeliveryID != "" {
+			headers[HeaderDelivery] = event.DeliveryID
+		}
+
+		var key string
+		if event.DeliveryID != "" {
+			key = "hook:" + name + ":" + event.DeliveryID
+		}
+
+		message, result, err := rc.bus.PutMessage(ctx, msgbus.Publishing{
+			Topic: topic, Payload: event.Payload, Headers: headers, IdempotencyKey: key,
+		})
+		if err != nil {
+			rc.bus.Audit(ctx, msgbus.AuditEvent{
+				Action: msgbus.AuditPublish, Result: msgbus.AuditRejected, Topic: topic,
+				Size: len(event.Payload), Detail: err.Error(),
+			})
+			return published, err
+		}
+		if result.Duplicate {
+			rc.bus.Audit(ctx, msgbus.AuditEvent{
+				Action: msgbus.AuditPublish, Result: msgbus.AuditRejected, Topic: topic,
+				Size:   len(event.Payload),
+				Detail: fmt.Sprintf("delivery %s already received", event.DeliveryID),
+			})
+			continue
+		}
+		rc.bus.Audit(ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditPublish, Result: msgbus.AuditOK,
+		}.WithMessage(message))
+
+		if event.DeliveryID != "" {
+			rc.seen.Add(name + ":" + event.DeliveryID)
+		}
+		published++
+	}
+
+	log.Debugf("[hooks] published %d message(s) from %s to %s", published, name, topic)
+
+	return published, nil
+}
+
+// replayCache remembers keys for a time window, bounded by a maximum
+// number of keys evicting the oldest first
+type replayCache struct {
+	sync.Mutex
+
+	window time.Duration
+	max    int
+
+	keys  map[string]*list.Element
+	order *list.List
+}
+
+type replayEntry struct {
+	key  string
+	seen time.Time
+}
+
+func newReplayCache(window time.Duration, max int) *replayCache {
+	return &replayCache{
+		window: window,
+		max:    max,
+		keys:   make(map[string]*list.Element),
+		order:  list.New(),
+	}
+}
+
+// Contains returns true if key is remembered
+func (c *replayCache) Contains(key string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	c.expire(time.Now())
+
+	_, ok := c.keys[key]
+	return ok
+}
+
+// Add remembers key and returns false if it was already remembered
+func (c *replayCache) Add(key string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	c.expire(now)
+
+	if _, ok := c.keys[key]; ok {
+		return false
+	}
+
+	if c.order.Len() >= c.max {
+		c.evict(c.order.Front())
+	}
+
+	c.keys[key] = c.order.PushBack(&replayEntry{key: key, seen: now})
+	return true
+}
+
+// expire evicts the keys remembered for longer than the window
+func (c *replayCache) expire(now time.Time) {
+	for e := c.order.Front(); e != nil; e = c.order.Front() {
+		if now.Sub(e.Value.(*replayEntry).seen) < c.window {
+			break
+		}
+		c.evict(e)
+	}
+}
+
+func (c *replayCache) evict(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.keys, e.Value.(*replayEntry).key)
+}
@@ -0,0 +1,231 @@
+package hooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/prologic/msgbus"
+)
+
+const alerts = `{
+  "version": "4",
+  "groupKey": "{}:{alertname=\"HighLoad\"}",
+  "status": "firing",
+  "alerts": [
+    {"status": "firing", "labels": {"instance": "a"}, "fingerprint": "f1"},
+    {"status": "resolved", "labels": {"instance": "b"}, "fingerprint": "f2"}
+  ]
+}`
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newTestReceiver() (*msgbus.MessageBus, *Receiver) {
+	mb := msgbus.New(nil)
+	rc := NewReceiver(mb, nil)
+	rc.Handle("github", &GitHub{Secret: "s3cret"})
+	rc.Handle("gitea", &Gitea{Secret: "s3cret"})
+	rc.Handle("alertmanager", &Alertmanager{Secret: "t0ken", Split: true})
+	rc.Handle("generic", &SharedSecret{Secret: "abc", EventHeader: "X-Event"})
+	return mb, rc
+}
+
+func post(rc *Receiver, path, body string, headers ...string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("POST", path, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	rc.ServeHTTP(w, r)
+	return w
+}
+
+func TestGitHub(t *testing.T) {
+	assert := assert.New(t)
+
+	mb, rc := newTestReceiver()
+
+	body := `{"ref": "refs/heads/master"}`
+	headers := []string{
+		"X-Hub-Signature-256", "sha256=" + sign("s3cret", body),
+		"X-GitHub-Event", "push",
+		"X-GitHub-Delivery", "72d3162e",
+	}
+
+	w := post(rc, "/github/repos/msgbus", body, headers...)
+	assert.Equal(http.StatusAccepted, w.Code)
+
+	message, ok := mb.Get(mb.NewTopic("repos/msgbus"))
+	require.True(t, ok)
+	assert.Equal([]byte(body), message.Payload)
+	assert.Equal("github", message.Headers[HeaderAdapter])
+	assert.Equal("push", message.Headers[HeaderEvent])
+	assert.Equal("72d3162e", message.Headers[HeaderDelivery])
+
+	// Replays are rejected
+	w = post(rc, "/github/repos/msgbus", body, headers...)
+	assert.Equal(http.StatusConflict, w.Code)
+
+	w = post(rc, "/github/repos/msgbus", body, "X-Hub-Signature-256", "sha256="+sign("wrong", body))
+	assert.Equal(http.StatusUnauthorized, w.Code)
+
+	w = post(rc, "/github/repos/msgbus", body)
+	assert.Equal(http.StatusUnauthorized, w.Code)
+}
+
+func TestReplayRemembersPublished(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := msgbus.New(&msgbus.Options{
+		BufferLength:   msgbus.DefaultBufferLength,
+		MaxQueueSize:   msgbus.DefaultMaxQueueSize,
+		MaxPayloadSize: msgbus.DefaultMaxPayloadSize,
+		DedupWindow:    time.Minute,
+		Topics:         map[string]msgbus.TopicOptions{"state": {Compacted: true}},
+	})
+	rc := NewReceiver(mb, nil)
+	rc.Handle("github", &GitHub{Secret: "s3cret"})
+
+	body := `{"ref": "refs/heads/master"}`
+	headers := []string{
+		"X-Hub-Signature-256", "sha256=" + sign("s3cret", body),
+		"X-GitHub-Event", "push",
+		"X-GitHub-Delivery", "72d3162e",
+	}
+
+	// A delivery that could not be published may be retried
+	w := post(rc, "/github/state", body, headers...)
+	assert.Equal(http.StatusBadRequest, w.Code)
+
+	// Concurrent replays of a delivery are published once
+	var (
+		wg       sync.WaitGroup
+		accepted int32
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if post(rc, "/github/repos", body, headers...).Code == http.StatusAccepted {
+				atomic.AddInt32(&accepted, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(int32(1), accepted)
+
+	_, ok := mb.Get(mb.NewTopic("repos"))
+	assert.True(ok)
+	_, ok = mb.Get(mb.NewTopic("repos"))
+	assert.False(ok)
+}
+
+func TestGitea(t *testing.T) {
+	mb, rc := newTestReceiver()
+
+	body := `{"ref": "refs/heads/master"}`
+	w := post(rc, "/gitea/repos", body,
+		"X-Gitea-Signature", sign("s3cret", body),
+		"X-Gitea-Event", "push",
+		"X-Gitea-Delivery", "1",
+	)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	message, ok := mb.Get(mb.NewTopic("repos"))
+	require.True(t, ok)
+	assert.Equal(t, "push", message.Headers[HeaderEvent])
+}
+
+func TestAlertmanagerSplit(t *testing.T) {
+	assert := assert.New(t)
+
+	mb, rc := newTestReceiver()
+
+	w := post(rc, "/alertmanager/alerts", alerts, "Authorization", "Bearer wrong")
+	assert.Equal(http.StatusUnauthorized, w.Code)
+
+	w = post(rc, "/alertmanager/alerts", alerts, "Authorization", "Bearer t0ken")
+	assert.Equal(http.StatusAccepted, w.Code)
+
+	topic := mb.NewTopic("alerts")
+	for _, expected := range []struct{ status, fingerprint, instance string }{
+		{"firing", "f1", "a"},
+		{"resolved", "f2", "b"},
+	} {
+		message, ok := mb.Get(topic)
+		require.True(t, ok)
+		assert.Equal("alert", message.Headers[HeaderEvent])
+		assert.Equal(expected.status, message.Headers["alertmanager-status"])
+		assert.Equal(expected.fingerprint, message.Headers["alertmanager-fingerprint"])
+
+		var alert struct {
+			Labels map[string]string `json:"labels"`
+		}
+		require.NoError(t, json.Unmarshal(message.Payload, &alert))
+		assert.Equal(expected.instance, alert.Labels["instance"])
+	}
+
+	_, ok := mb.Get(topic)
+	assert.False(ok)
+
+	w = post(rc, "/alertmanager/alerts", "not json", "Authorization", "Bearer t0ken")
+	assert.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestSharedSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	mb, rc := newTestReceiver()
+
+	w := post(rc, "/generic/deploys", "v1", "X-Webhook-Secret", "abc", "X-Event", "deploy")
+	assert.Equal(http.StatusAccepted, w.Code)
+
+	message, ok := mb.Get(mb.NewTopic("deploys"))
+	require.True(t, ok)
+	assert.Equal("deploy", message.Headers[HeaderEvent])
+
+	w = post(rc, "/generic/deploys", "v1", "X-Webhook-Secret", "abd")
+	assert.Equal(http.StatusUnauthorized, w.Code)
+
+	w = post(rc, "/unknown/deploys", "v1")
+	assert.Equal(http.StatusNotFound, w.Code)
+
+	w = post(rc, "/generic/", "v1", "X-Webhook-Secret", "abc")
+	assert.Equal(http.StatusBadRequest, w.Code)
+
+	w = post(rc, "/generic/deploys", strings.Repeat("x", msgbus.DefaultMaxPayloadSize+1), "X-Webhook-Secret", "abc")
+	assert.Equal(http.StatusRequestEntityTooLarge, w.Code)
+}
+
+func TestReplayCache(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newReplayCache(50*time.Millisecond, 2)
+	assert.True(c.Add("a"))
+	assert.False(c.Add("a"))
+	assert.True(c.Add("b"))
+
+	// The oldest key is evicted once the cache is full
+	assert.True(c.Add("c"))
+	assert.True(c.Add("a"))
+	assert.False(c.Add("c"))
+
+	// Keys expire after the window
+	time.Sleep(60 * time.Millisecond)
+	assert.True(c.Add("c"))
+}
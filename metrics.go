@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -19,25 +20,105 @@ var DefObjectives = map[float64]float64{
 	0.99: 0.001,
 }
 
+// DefBuckets are the default histogram buckets in seconds, from 1ms to
+// ~4m to cover both pushed and pulled messages.
+var DefBuckets = prometheus.ExponentialBuckets(0.001, 4, 10)
+
+// OtherLabel is the label value used in place of label values beyond the
+// cardinality limit of a LabelGuard.
+const OtherLabel = "_other"
+
+// LabelGuard limits the number of distinct values of a label, such as
+// topic names, to guard against unbounded metric cardinality.
+type LabelGuard struct {
+	sync.Mutex
+
+	max  int
+	seen map[string]bool
+}
+
+// NewLabelGuard returns a LabelGuard allowing up to max distinct values,
+// if max is <= 0 the number of values is unbounded.
+func NewLabelGuard(max int) *LabelGuard {
+	return &LabelGuard{max: max, seen: make(map[string]bool)}
+}
+
+// Label returns value if it is known or there is room for it, otherwise
+// OtherLabel.
+func (g *LabelGuard) Label(value string) string {
+	g.Lock()
+	defer g.Unlock()
+
+	if g.seen[value] {
+		return value
+	}
+	if g.max > 0 && len(g.seen) >= g.max {
+		return OtherLabel
+	}
+	g.seen[value] = true
+	return value
+}
+
+// MetricsOptions ...
+type MetricsOptions struct {
+	// Registry is the registry metrics are registered with and served
+	// from. If nil a new registry is created with the standard Go and
+	// process collectors.
+	Registry *prometheus.Registry
+
+	// ConstLabels are added to every metric, e.g: {"bus": "name"}
+	ConstLabels prometheus.Labels
+}
+
 // Metrics ...
 type Metrics struct {
 	sync.RWMutex
 
 	namespace   string
+	registry    *prometheus.Registry
+	constLabels prometheus.Labels
 	metrics     map[string]prometheus.Metric
 	countervecs map[string]*prometheus.CounterVec
 	guagevecs   map[string]*prometheus.GaugeVec
 	sumvecs     map[string]*prometheus.SummaryVec
+	histvecs    map[string]*prometheus.HistogramVec
 }
 
-// NewMetrics ...
+// NewMetrics returns metrics registered with a new registry, see
+// NewMetricsWithOptions
 func NewMetrics(namespace string) *Metrics {
+	return NewMetricsWithOptions(namespace, nil)
+}
+
+// NewMetricsWithOptions ...
+func NewMetricsWithOptions(namespace string, options *MetricsOptions) *Metrics {
+	var (
+		registry    *prometheus.Registry
+		constLabels prometheus.Labels
+	)
+
+	if options != nil {
+		registry = options.Registry
+		constLabels = options.ConstLabels
+	}
+
+	if registry == nil {
+		registry = prometheus.NewRegistry()
+		registry.MustRegister(prometheus.NewGoCollector())
+		registry.MustRegister(
+			prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		)
+	}
+
 	return &Metrics{
 		namespace:   namespace,
+		registry:    registry,
+		constLabels: constLabels,
 		metrics:     make(map[string]prometheus.Metric),
 		countervecs: make(map[string]*prometheus.CounterVec),
 		guagevecs:   make(map[string]*prometheus.GaugeVec),
 		sumvecs:     make(map[string]*prometheus.SummaryVec),
+		histvecs:    make(map[string]*prometheus.HistogramVec),
 	}
 }
 
@@ -45,10 +126,11 @@ func NewMetrics(namespace string) *Metrics {
 func (m *Metrics) NewCounter(subsystem, name, help string) prometheus.Counter {
 	counter := prometheus.NewCounter(
 		prometheus.CounterOpts{
-			Namespace: m.namespace,
-			Subsystem: subsystem,
-			Name:      name,
-			Help:      help,
+			Namespace:   m.namespace,
+			Subsystem:   subsystem,
+			Name:        name,
+			Help:        help,
+			ConstLabels: m.constLabels,
 		},
 	)
 
@@ -56,7 +138,7 @@ func (m *Metrics) NewCounter(subsystem, name, help string) prometheus.Counter {
 	m.Lock()
 	m.metrics[key] = counter
 	m.Unlock()
-	prometheus.MustRegister(counter)
+	m.registry.MustRegister(counter)
 
 	return counter
 }
@@ -65,10 +147,11 @@ func (m *Metrics) NewCounter(subsystem, name, help string) prometheus.Counter {
 func (m *Metrics) NewCounterFunc(subsystem, name, help string, f func() float64) prometheus.CounterFunc {
 	counter := prometheus.NewCounterFunc(
 		prometheus.CounterOpts{
-			Namespace: m.namespace,
-			Subsystem: subsystem,
-			Name:      name,
-			Help:      help,
+			Namespace:   m.namespace,
+			Subsystem:   subsystem,
+			Name:        name,
+			Help:        help,
+			ConstLabels: m.constLabels,
 		},
 		f,
 	)
@@ -77,7 +160,7 @@ func (m *Metrics) NewCounterFunc(subsystem, name, help string, f func() float64)
 	m.Lock()
 	m.metrics[key] = counter
 	m.Unlock()
-	prometheus.MustRegister(counter)
+	m.registry.MustRegister(counter)
 
 	return counter
 }
@@ -86,10 +169,11 @@ func (m *Metrics) NewCounterFunc(subsystem, name, help string, f func() float64)
 func (m *Metrics) NewCounterVec(subsystem, name, help string, labels []string) *prometheus.CounterVec {
 	countervec := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: m.namespace,
-			Subsystem: subsystem,
-			Name:      name,
-			Help:      help,
+			Namespace:   m.namespace,
+			Subsystem:   subsystem,
+			Name:        name,
+			Help:        help,
+			ConstLabels: m.constLabels,
 		},
 		labels,
 	)
@@ -98,7 +182,7 @@ func (m *Metrics) NewCounterVec(subsystem, name, help string, labels []string) *
 	m.Lock()
 	m.countervecs[key] = countervec
 	m.Unlock()
-	prometheus.MustRegister(countervec)
+	m.registry.MustRegister(countervec)
 
 	return countervec
 }
@@ -107,10 +191,11 @@ func (m *Metrics) NewCounterVec(subsystem, name, help string, labels []string) *
 func (m *Metrics) NewGauge(subsystem, name, help string) prometheus.Gauge {
 	guage := prometheus.NewGauge(
 		prometheus.GaugeOpts{
-			Namespace: m.namespace,
-			Subsystem: subsystem,
-			Name:      name,
-			Help:      help,
+			Namespace:   m.namespace,
+			Subsystem:   subsystem,
+			Name:        name,
+			Help:        help,
+			ConstLabels: m.constLabels,
 		},
 	)
 
@@ -118,7 +203,7 @@ func (m *Metrics) NewGauge(subsystem, name, help string) prometheus.Gauge {
 	m.Lock()
 	m.metrics[key] = guage
 	m.Unlock()
-	prometheus.MustRegister(guage)
+	m.registry.MustRegister(guage)
 
 	return guage
 }
@@ -127,10 +212,11 @@ func (m *Metrics) NewGauge(subsystem, name, help string) prometheus.Gauge {
 func (m *Metrics) NewGaugeFunc(subsystem, name, help string, f func() float64) prometheus.GaugeFunc {
 	guage := prometheus.NewGaugeFunc(
 		prometheus.GaugeOpts{
-			Namespace: m.namespace,
-			Subsystem: subsystem,
-			Name:      name,
-			Help:      help,
+			Namespace:   m.namespace,
+			Subsystem:   subsystem,
+			Name:        name,
+			Help:        help,
+			ConstLabels: m.constLabels,
 		},
 		f,
 	)
@@ -139,7 +225,7 @@ func (m *Metrics) NewGaugeFunc(subsystem, name, help string, f func() float64) p
 	m.Lock()
 	m.metrics[key] = guage
 	m.Unlock()
-	prometheus.MustRegister(guage)
+	m.registry.MustRegister(guage)
 
 	return guage
 }
@@ -148,10 +234,11 @@ func (m *Metrics) NewGaugeFunc(subsystem, name, help string, f func() float64) p
 func (m *Metrics) NewGaugeVec(subsystem, name, help string, labels []string) *prometheus.GaugeVec {
 	guagevec := prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: m.namespace,
-			Subsystem: subsystem,
-			Name:      name,
-			Help:      help,
+			Namespace:   m.namespace,
+			Subsystem:   subsystem,
+			Name:        name,
+			Help:        help,
+			ConstLabels: m.constLabels,
 		},
 		labels,
 	)
@@ -160,7 +247,7 @@ func (m *Metrics) NewGaugeVec(subsystem, name, help string, labels []string) *pr
 	m.Lock()
 	m.guagevecs[key] = guagevec
 	m.Unlock()
-	prometheus.MustRegister(guagevec)
+	m.registry.MustRegister(guagevec)
 
 	return guagevec
 }
@@ -169,11 +256,12 @@ func (m *Metrics) NewGaugeVec(subsystem, name, help string, labels []string) *pr
 func (m *Metrics) NewSummary(subsystem, name, help string) prometheus.Summary {
 	summary := prometheus.NewSummary(
 		prometheus.SummaryOpts{
-			Namespace:  m.namespace,
-			Subsystem:  subsystem,
-			Name:       name,
-			Help:       help,
-			Objectives: DefObjectives,
+			Namespace:   m.namespace,
+			Subsystem:   subsystem,
+			Name:        name,
+			Help:        help,
+			Objectives:  DefObjectives,
+			ConstLabels: m.constLabels,
 		},
 	)
 
@@ -181,7 +269,7 @@ func (m *Metrics) NewSummary(subsystem, name, help string) prometheus.Summary {
 	m.Lock()
 	m.metrics[key] = summary
 	m.Unlock()
-	prometheus.MustRegister(summary)
+	m.registry.MustRegister(summary)
 
 	return summary
 }
@@ -190,11 +278,12 @@ func (m *Metrics) NewSummary(subsystem, name, help string) prometheus.Summary {
 func (m *Metrics) NewSummaryVec(subsystem, name, help string, labels []string) *prometheus.SummaryVec {
 	sumvec := prometheus.NewSummaryVec(
 		prometheus.SummaryOpts{
-			Namespace:  m.namespace,
-			Subsystem:  subsystem,
-			Name:       name,
-			Help:       help,
-			Objectives: DefObjectives,
+			Namespace:   m.namespace,
+			Subsystem:   subsystem,
+			Name:        name,
+			Help:        help,
+			Objectives:  DefObjectives,
+			ConstLabels: m.constLabels,
 		},
 		labels,
 	)
@@ -203,11 +292,48 @@ func (m *Metrics) NewSummaryVec(subsystem, name, help string, labels []string) *
 	m.Lock()
 	m.sumvecs[key] = sumvec
 	m.Unlock()
-	prometheus.MustRegister(sumvec)
+	m.registry.MustRegister(sumvec)
 
 	return sumvec
 }
 
+// NewHistogramVec ...
+func (m *Metrics) NewHistogramVec(subsystem, name, help string, labels []string) *prometheus.HistogramVec {
+	histvec := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace:   m.namespace,
+			Subsystem:   subsystem,
+			Name:        name,
+			Help:        help,
+			Buckets:     DefBuckets,
+			ConstLabels: m.constLabels,
+		},
+		labels,
+	)
+
+	key := fmt.Sprintf("%s_%s", subsystem, name)
+	m.Lock()
+	m.histvecs[key] = histvec
+	m.Unlock()
+	m.registry.MustRegister(histvec)
+
+	return histvec
+}
+
+// NewDesc returns a metric description in the namespace and with the
+// constant labels of m for use by custom collectors.
+func (m *Metrics) NewDesc(subsystem, name, help string, labels []string) *prometheus.Desc {
+	return prometheus.NewDesc(
+		prometheus.BuildFQName(m.namespace, subsystem, name),
+		help, labels, m.constLabels,
+	)
+}
+
+// Register registers a custom collector
+func (m *Metrics) Register(collector prometheus.Collector) {
+	m.registry.MustRegister(collector)
+}
+
 // Counter ...
 func (m *Metrics) Counter(subsystem, name string) prometheus.Counter {
 	key := fmt.Sprintf("%s_%s", subsystem, name)
@@ -254,9 +380,24 @@ func (m *Metrics) SummaryVec(subsystem, name string) *prometheus.SummaryVec {
 	return m.sumvecs[key]
 }
 
+// HistogramVec ...
+func (m *Metrics) HistogramVec(subsystem, name string) *prometheus.HistogramVec {
+	key := fmt.Sprintf("%s_%s", subsystem, name)
+	m.RLock()
+	defer m.RUnlock()
+	return m.histvecs[key]
+}
+
+// Registry returns the registry the metrics are registered with
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
 // Handler ...
 func (m *Metrics) Handler() http.Handler {
-	return promhttp.Handler()
+	return promhttp.InstrumentMetricHandler(
+		m.registry, promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}),
+	)
 }
 
 // Run ...
@@ -265,3 +406,61 @@ func (m *Metrics) Run(addr string) {
 	log.Infof("metrics endpoint listening on %s", addr)
 	log.Fatal(http.ListenAndServe(addr, nil))
 }
+
+// queueCollector collects the age of the oldest message in the queue of
+// each topic at scrape time.
+type queueCollector struct {
+	bus  *MessageBus
+	desc *prometheus.Desc
+}
+
+func newQueueCollector(bus *MessageBus, metrics *Metrics) *queueCollector {
+	return &queueCollector{
+		bus: bus,
+		desc: metrics.NewDesc(
+			"queue", "oldest_age_seconds",
+			"Age in seconds of the oldest message in the queue of each topic",
+			[]string{"topic"},
+		),
+	}
+}
+
+// Describe ...
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect ...
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	ages := make(map[string]float64)
+
+	observe := func(t *Topic, q *Queue) {
+		m, ok := q.Peek().(Message)
+		if !ok || m.Created.IsZero() {
+			return
+		}
+
+		// topics over the cardinality limit share a label, report the max
+		label := c.bus.topicLabels.Label(t.Name)
+		if age := time.Since(m.Created).Seconds(); age > ages[label] {
+			ages[label] = age
+		}
+	}
+
+	c.bus.RLock()
+	for t, q := range c.bus.queues {
+		observe(t, q)
+	}
+	for _, t := range c.bus.topics {
+		for _, p := range t.partitions {
+			observe(t, p.queue)
+		}
+	}
+	c.bus.RUnlock()
+
+	for label, age := range ages {
+		ch <- prometheus.MustNewConstMetric(
+			c.desc, prometheus.GaugeValue, age, label,
+		)
+	}
+}
@@ -1,6 +1,7 @@
 package msgbus
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -54,3 +55,34 @@ test_foo_gauge_vec{test="test"} 1
 		w.Body.String(),
 	)
 }
+
+func TestMetricsConstLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	m := NewMetricsWithOptions("test", &MetricsOptions{
+		ConstLabels: map[string]string{"bus": "foo"},
+	})
+	m.NewCounter("foo", "counter", "help").Inc()
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/", nil)
+
+	m.Handler().ServeHTTP(w, r)
+	assert.Equal(w.Code, http.StatusOK)
+	assert.Contains(w.Body.String(), `test_foo_counter{bus="foo"} 1`)
+}
+
+func TestLabelGuard(t *testing.T) {
+	assert := assert.New(t)
+
+	g := NewLabelGuard(2)
+	assert.Equal("foo", g.Label("foo"))
+	assert.Equal("bar", g.Label("bar"))
+	assert.Equal(OtherLabel, g.Label("baz"))
+	assert.Equal("foo", g.Label("foo"))
+
+	g = NewLabelGuard(0)
+	for i := 0; i < 100; i++ {
+		assert.NotEqual(OtherLabel, g.Label(fmt.Sprintf("%d", i)))
+	}
+}
@@ -0,0 +1,392 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Control packet types
+const (
+	CONNECT     = 1
+	CONNACK     = 2
+	PUBLISH     = 3
+	PUBACK      = 4
+	PUBREC      = 5
+	PUBREL      = 6
+	PUBCOMP     = 7
+	SUBSCRIBE   = 8
+	SUBACK      = 9
+	UNSUBSCRIBE = 10
+	UNSUBACK    = 11
+	PINGREQ     = 12
+	PINGRESP    = 13
+	DISCONNECT  = 14
+)
+
+// CONNACK return codes
+const (
+	Accepted                   = 0x00
+	RefusedProtocolVersion     = 0x01
+	RefusedIdentifierRejected  = 0x02
+	RefusedServerUnavailable   = 0x03
+	RefusedBadUsernamePassword = 0x04
+	RefusedNotAuthorized       = 0x05
+)
+
+// subackFailure is the SUBACK return code of a rejected subscription
+const subackFailure = 0x80
+
+// CONNECT flags
+const (
+	flagCleanSession = 0x02
+	flagWill         = 0x04
+	flagWillRetain   = 0x20
+	flagPassword     = 0x40
+	flagUsername     = 0x80
+)
+
+// maxRemainingLength is the largest remaining length that can be encoded
+const maxRemainingLength = 268435455
+
+var (
+	// ErrPacketTooLarge is returned when reading a packet larger than the
+	// maximum packet size
+	ErrPacketTooLarge = errors.New("mqtt: packet too large")
+
+	// ErrMalformedPacket is returned when reading an invalid packet
+	ErrMalformedPacket = errors.New("mqtt: malformed packet")
+)
+
+// packet is a decoded MQTT 3.1.1 control packet, only the fields relevant
+// to its type are set.
+type packet struct {
+	Type  byte
+	Flags byte
+
+	// CONNECT
+	ProtocolName  string
+	ProtocolLevel byte
+	ConnectFlags  byte
+	KeepAlive     uint16
+	ClientID      string
+	WillTopic     string
+	WillMessage   []byte
+	Username      string
+	Password      []byte
+
+	// CONNACK
+	SessionPresent bool
+	ReturnCode     byte
+
+	// PUBLISH, PUBACK, PUBREC, PUBREL, PUBCOMP, SUBSCRIBE, SUBACK,
+	// UNSUBSCRIBE and UNSUBACK
+	PacketID uint16
+	Topic    string
+	Payload  []byte
+
+	// SUBSCRIBE, SUBACK and UNSUBSCRIBE
+	Topics []string
+	QoS    []byte
+}
+
+// qos returns the QoS level of a PUBLISH packet
+func (p *packet) qos() byte {
+	return (p.Flags >> 1) & 0x03
+}
+
+// retain returns the RETAIN flag of a PUBLISH packet
+func (p *packet) retain() bool {
+	return p.Flags&0x01 != 0
+}
+
+// dup returns the DUP flag of a PUBLISH packet
+func (p *packet) dup() bool {
+	return p.Flags&0x08 != 0
+}
+
+// publishFlags returns the fixed header flags of a PUBLISH packet
+func publishFlags(qos byte, retain, dup bool) byte {
+	flags := (qos & 0x03) << 1
+	if retain {
+		flags |= 0x01
+	}
+	if dup {
+		flags |= 0x08
+	}
+	return flags
+}
+
+// readPacket reads the next packet from r, packets with a remaining length
+// over maxSize are rejected with ErrPacketTooLarge.
+func readPacket(r *bufio.Reader, maxSize int) (*packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := readRemainingLength(r)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && length > maxSize {
+		return nil, ErrPacketTooLarge
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	p := &packet{Type: header >> 4, Flags: header & 0x0f}
+	if err := p.decode(&decoder{buf: body}); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func readRemainingLength(r io.ByteReader) (int, error) {
+	var (
+		length     int
+		multiplier = 1
+	)
+
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			return length, nil
+		}
+		multiplier *= 128
+	}
+
+	return 0, ErrMalformedPacket
+}
+
+func (p *packet) decode(d *decoder) error {
+	switch p.Type {
+	case CONNECT:
+		p.ProtocolName = d.string()
+		p.ProtocolLevel = d.byte()
+		p.ConnectFlags = d.byte()
+		p.KeepAlive = d.uint16()
+		p.ClientID = d.string()
+		if p.ConnectFlags&flagWill != 0 {
+			p.WillTopic = d.string()
+			p.WillMessage = d.binary()
+		}
+		if p.ConnectFlags&flagUsername != 0 {
+			p.Username = d.string()
+		}
+		if p.ConnectFlags&flagPassword != 0 {
+			p.Password = d.binary()
+		}
+	case CONNACK:
+		p.SessionPresent = d.byte()&0x01 != 0
+		p.ReturnCode = d.byte()
+	case PUBLISH:
+		p.Topic = d.string()
+		if p.qos() > 0 {
+			p.PacketID = d.uint16()
+		}
+		p.Payload = d.rest()
+	case PUBACK, PUBREC, PUBREL, PUBCOMP, UNSUBACK:
+		p.PacketID = d.uint16()
+	case SUBSCRIBE:
+		p.PacketID = d.uint16()
+		for d.err == nil && d.len() > 0 {
+			p.Topics = append(p.Topics, d.string())
+			p.QoS = append(p.QoS, d.byte())
+		}
+		if len(p.Topics) == 0 {
+			return ErrMalformedPacket
+		}
+	case SUBACK:
+		p.PacketID = d.uint16()
+		p.QoS = d.rest()
+	case UNSUBSCRIBE:
+		p.PacketID = d.uint16()
+		for d.err == nil && d.len() > 0 {
+			p.Topics = append(p.Topics, d.string())
+		}
+		if len(p.Topics) == 0 {
+			return ErrMalformedPacket
+		}
+	case PINGREQ, PINGRESP, DISCONNECT:
+	default:
+		return fmt.Errorf("mqtt: unknown packet type %d", p.Type)
+	}
+
+	return d.err
+}
+
+// writePacket encodes and writes p to w
+func writePacket(w io.Writer, p *packet) error {
+	e := &encoder{}
+
+	switch p.Type {
+	case CONNECT:
+		e.string(p.ProtocolName)
+		e.byte(p.ProtocolLevel)
+		e.byte(p.ConnectFlags)
+		e.uint16(p.KeepAlive)
+		e.string(p.ClientID)
+		if p.ConnectFlags&flagWill != 0 {
+			e.string(p.WillTopic)
+			e.binary(p.WillMessage)
+		}
+		if p.ConnectFlags&flagUsername != 0 {
+			e.string(p.Username)
+		}
+		if p.ConnectFlags&flagPassword != 0 {
+			e.binary(p.Password)
+		}
+	case CONNACK:
+		if p.SessionPresent {
+			e.byte(0x01)
+		} else {
+			e.byte(0x00)
+		}
+		e.byte(p.ReturnCode)
+	case PUBLISH:
+		e.string(p.Topic)
+		if p.qos() > 0 {
+			e.uint16(p.PacketID)
+		}
+		e.buf = append(e.buf, p.Payload...)
+	case PUBACK, PUBREC, PUBREL, PUBCOMP, UNSUBACK:
+		e.uint16(p.PacketID)
+	case SUBSCRIBE:
+		e.uint16(p.PacketID)
+		for i, topic := range p.Topics {
+			e.string(topic)
+			e.byte(p.QoS[i])
+		}
+	case SUBACK:
+		e.uint16(p.PacketID)
+		e.buf = append(e.buf, p.QoS...)
+	case UNSUBSCRIBE:
+		e.uint16(p.PacketID)
+		for _, topic := range p.Topics {
+			e.string(topic)
+		}
+	case PINGREQ, PINGRESP, DISCONNECT:
+	default:
+		return fmt.Errorf("mqtt: unknown packet type %d", p.Type)
+	}
+
+	length := len(e.buf)
+	if length > maxRemainingLength {
+		return ErrPacketTooLarge
+	}
+
+	flags := p.Flags
+	switch p.Type {
+	case PUBREL, SUBSCRIBE, UNSUBSCRIBE:
+		// reserved flags required by the specification
+		flags = 0x02
+	}
+
+	header := []byte{p.Type<<4 | flags}
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		header = append(header, b)
+		if length == 0 {
+			break
+		}
+	}
+
+	_, err := w.Write(append(header, e.buf...))
+	return err
+}
+
+// decoder decodes the fields of a packet body, the first error is kept
+// and subsequent reads return zero values.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) len() int {
+	return len(d.buf)
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.buf) < n {
+		d.err = ErrMalformedPacket
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) byte() byte {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) uint16() uint16 {
+	b := d.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (d *decoder) binary() []byte {
+	n := d.uint16()
+	b := d.next(int(n))
+	if b == nil {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+func (d *decoder) string() string {
+	return string(d.binary())
+}
+
+func (d *decoder) rest() []byte {
+	b := d.buf
+	d.buf = nil
+	return b
+}
+
+// encoder encodes the fields of a packet body
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) byte(b byte) {
+	e.buf = append(e.buf, b)
+}
+
+func (e *encoder) uint16(n uint16) {
+	e.buf = append(e.buf, byte(n>>8), byte(n))
+}
+
+func (e *encoder) binary(b []byte) {
+	e.uint16(uint16(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) string(s string) {
+	e.binary([]byte(s))
+}
@@ -0,0 +1,713 @@
+// Package mqtt implements an MQTT 3.1.1 frontend to a msgbus.MessageBus.
+//
+// MQTT topics map 1:1 onto msgbus topics, topic levels are separated by
+// "/" as in the HTTP API, so a message published by a device to
+// "sensors/kitchen/temp" can be pulled from GET /sensors/kitchen/temp and
+// vice versa. Subscriptions support the "+" and "#" wildcards, QoS 0 and 1
+// (QoS 2 subscriptions are downgraded to 1), retained messages, keepalive,
+// will messages and clean or persistent sessions.
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prologic/msgbus"
+)
+
+const (
+	// DefaultMaxPacketSize is the default maximum size of a packet
+	DefaultMaxPacketSize = 1 << 20 // 1MB
+
+	// DefaultMaxInflight is the default maximum number of QoS 1 messages
+	// delivered to a client awaiting acknowledgement
+	DefaultMaxInflight = 100
+
+	// Time allowed to receive the CONNECT packet of a new connection.
+	connectWait = 10 * time.Second
+
+	// Time allowed to write a packet to the peer.
+	writeWait = 10 * time.Second
+
+	// subscriberPrefix prefixes the bus subscriber id of a session
+	subscriberPrefix = "mqtt:"
+)
+
+// ErrServerClosed is returned by Serve after Close is called
+var ErrServerClosed = errors.New("mqtt: server closed")
+
+// Options ...
+type Options struct {
+	// Authenticate validates the username and password of connecting
+	// clients and returns their identity. If nil all clients are accepted.
+	Authenticate func(username, password string) (identity string, ok bool)
+
+	// MaxPacketSize is the maximum size of packets received from clients
+	MaxPacketSize int
+
+	// MaxInflight is the maximum number of unacknowledged QoS 1 messages
+	// per client, further delivery waits for acknowledgements
+	MaxInflight int
+}
+
+// Server is an MQTT server publishing to and subscribing from a bus
+type Server struct {
+	sync.Mutex
+
+	bus *msgbus.MessageBus
+
+	authenticate  func(username, password string) (string, bool)
+	maxPacketSize int
+	maxInflight   int
+
+	sessions  map[string]*session
+	listeners map[net.Listener]bool
+	conns     map[*conn]bool
+	closed    bool
+}
+
+// NewServer ...
+func NewServer(bus *msgbus.MessageBus, options *Options) *Server {
+	var (
+		authenticate  func(username, password string) (string, bool)
+		maxPacketSize = DefaultMaxPacketSize
+		maxInflight   = DefaultMaxInflight
+	)
+
+	if options != nil {
+		authenticate = options.Authenticate
+		if options.MaxPacketSize != 0 {
+			maxPacketSize = options.MaxPacketSize
+		}
+		if options.MaxInflight != 0 {
+			maxInflight = options.MaxInflight
+		}
+	}
+
+	return &Server{
+		bus: bus,
+
+		authenticate:  authenticate,
+		maxPacketSize: maxPacketSize,
+		maxInflight:   maxInflight,
+
+		sessions:  make(map[string]*session),
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[*conn]bool),
+	}
+}
+
+// ListenAndServe listens on the TCP address addr and serves clients
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts and serves clients on l until Close is called
+func (s *Server) Serve(l net.Listener) error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = true
+	s.Unlock()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.Lock()
+			closed := s.closed
+			delete(s.listeners, l)
+			s.Unlock()
+
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		c := newConn(s, nc)
+		go c.serve()
+	}
+}
+
+// Close stops all listeners and closes all connections
+func (s *Server) Close() error {
+	s.Lock()
+	s.closed = true
+	listeners := s.listeners
+	conns := s.conns
+	s.listeners = make(map[net.Listener]bool)
+	s.conns = make(map[*conn]bool)
+	s.Unlock()
+
+	for l := range listeners {
+		l.Close()
+	}
+	for c := range conns {
+		c.close()
+	}
+
+	return nil
+}
+
+// attach binds c to the session of its client, creating or resuming the
+// session, and returns whether a previous session was resumed. An existing
+// connection of the same client is closed.
+func (s *Server) attach(c *conn, clientID string, clean bool) (*session, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	existing, ok := s.sessions[clientID]
+	if ok && existing.conn != nil {
+		existing.conn.close()
+	}
+
+	if ok && clean {
+		existing.discard(s.bus)
+		ok = false
+	}
+
+	sess := existing
+	if !ok {
+		sess = newSession(clientID, clean, s.maxInflight)
+		s.sessions[clientID] = sess
+	}
+
+	sess.Lock()
+	sess.conn = c
+	sess.Unlock()
+
+	s.conns[c] = true
+
+	return sess, ok
+}
+
+// detach unbinds c from its session, discarding the session if it is clean
+func (s *Server) detach(c *conn) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.conns, c)
+
+	sess := c.session
+	if sess == nil {
+		return
+	}
+
+	sess.Lock()
+	current := sess.conn == c
+	if current {
+		sess.conn = nil
+	}
+	sess.Unlock()
+
+	if current && sess.clean && s.sessions[sess.id] == sess {
+		sess.discard(s.bus)
+		delete(s.sessions, sess.id)
+	}
+}
+
+// session is the state of a client kept across connections unless the
+// client connected with a clean session.
+type session struct {
+	sync.Mutex
+
+	id    string
+	clean bool
+	conn  *conn
+
+	subs     map[string]*subscription
+	inflight map[uint16]msgbus.Message
+	received map[uint16]bool
+	window   chan struct{}
+	nextID   uint16
+}
+
+// subscription is a topic filter subscribed to on the bus
+type subscription struct {
+	filter string
+	qos    byte
+	ch     chan msgbus.Message
+}
+
+func newSession(id string, clean bool, maxInflight int) *session {
+	return &session{
+		id:    id,
+		clean: clean,
+
+		subs:     make(map[string]*subscription),
+		inflight: make(map[uint16]msgbus.Message),
+		received: make(map[uint16]bool),
+		window:   make(chan struct{}, maxInflight),
+	}
+}
+
+// subscriberID returns the id the session subscribes to the bus with
+func (sess *session) subscriberID() string {
+	return subscriberPrefix + sess.id
+}
+
+// discard unsubscribes all subscriptions of the session from the bus
+func (sess *session) discard(bus *msgbus.MessageBus) {
+	sess.Lock()
+	defer sess.Unlock()
+
+	for filter := range sess.subs {
+		bus.UnsubscribePattern(sess.subscriberID(), filter)
+	}
+	sess.subs = make(map[string]*subscription)
+}
+
+// packetID returns the next unused packet id, the caller must hold the
+// session lock.
+func (sess *session) packetID() uint16 {
+	for {
+		sess.nextID++
+		if sess.nextID == 0 {
+			continue
+		}
+		if _, ok := sess.inflight[sess.nextID]; !ok {
+			return sess.nextID
+		}
+	}
+}
+
+// conn is a client connection
+type conn struct {
+	server  *Server
+	netConn net.Conn
+	r       *bufio.Reader
+
+	wmu sync.Mutex
+
+	ctx     context.Context
+	session *session
+	will    *msgbus.Publishing
+	retain  bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newConn(s *Server, nc net.Conn) *conn {
+	return &conn{
+		server:  s,
+		netConn: nc,
+		r:       bufio.NewReader(nc),
+		ctx:     msgbus.WithRemoteAddr(context.Background(), nc.RemoteAddr().String()),
+		done:    make(chan struct{}),
+	}
+}
+
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.netConn.Close()
+	})
+}
+
+func (c *conn) write(p *packet) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.netConn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := writePacket(c.netConn, p); err != nil {
+		c.close()
+		return err
+	}
+	return nil
+}
+
+func (c *conn) serve() {
+	defer c.close()
+
+	c.netConn.SetReadDeadline(time.Now().Add(connectWait))
+	p, err := readPacket(c.r, c.server.maxPacketSize)
+	if err != nil {
+		log.Debugf("[mqtt] error reading connect from %s: %s", c.netConn.RemoteAddr(), err)
+		return
+	}
+
+	if p.Type != CONNECT {
+		log.Warnf("[mqtt] expected connect from %s got packet type %d", c.netConn.RemoteAddr(), p.Type)
+		return
+	}
+
+	if !c.connect(p) {
+		return
+	}
+
+	graceful := c.readLoop(time.Duration(p.KeepAlive) * time.Second)
+
+	c.server.detach(c)
+
+	if !graceful && c.will != nil {
+		log.Debugf("[mqtt] publishing will of %s to %s", c.session.id, c.will.Topic)
+		if err := c.publish(*c.will, c.retain); err != nil {
+			log.Warnf("[mqtt] error publishing will of %s to %s: %s", c.session.id, c.will.Topic, err)
+		}
+	}
+}
+
+// connect handles the CONNECT packet and returns true if the client was
+// accepted.
+func (c *conn) connect(p *packet) bool {
+	if !(p.ProtocolName == "MQTT" && p.ProtocolLevel == 4) &&
+		!(p.ProtocolName == "MQIsdp" && p.ProtocolLevel == 3) {
+		c.write(&packet{Type: CONNACK, ReturnCode: RefusedProtocolVersion})
+		return false
+	}
+
+	clean := p.ConnectFlags&flagCleanSession != 0
+	clientID := p.ClientID
+	if clientID == "" {
+		if !clean {
+			c.write(&packet{Type: CONNACK, ReturnCode: RefusedIdentifierRejected})
+			return false
+		}
+		clientID = randomID()
+	}
+
+	if c.server.authenticate != nil {
+		identity, ok := c.server.authenticate(p.Username, string(p.Password))
+		if !ok {
+			c.server.bus.Audit(c.ctx, msgbus.AuditEvent{
+				Action: msgbus.AuditAuth,
+				Result: msgbus.AuditDenied,
+				Detail: fmt.Sprintf("mqtt connect %s", clientID),
+			})
+			c.write(&packet{Type: CONNACK, ReturnCode: RefusedBadUsernamePassword})
+			return false
+		}
+		c.ctx = msgbus.WithIdentity(c.ctx, identity)
+	}
+
+	if p.ConnectFlags&flagWill != 0 {
+		if !validTopic(p.WillTopic) {
+			return false
+		}
+		c.will = &msgbus.Publishing{Topic: p.WillTopic, Payload: p.WillMessage}
+		c.retain = p.ConnectFlags&flagWillRetain != 0
+	}
+
+	sess, present := c.server.attach(c, clientID, clean)
+	c.session = sess
+
+	if err := c.write(&packet{Type: CONNACK, SessionPresent: present, ReturnCode: Accepted}); err != nil {
+		return false
+	}
+
+	log.Debugf("[mqtt] client %s connected from %s (clean=%t)", clientID, c.netConn.RemoteAddr(), clean)
+
+	// Resend unacknowledged messages and resume subscriptions
+	sess.Lock()
+	ids := make([]int, 0, len(sess.inflight))
+	for id := range sess.inflight {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		message := sess.inflight[uint16(id)]
+		c.write(&packet{
+			Type:     PUBLISH,
+			Flags:    publishFlags(1, false, true),
+			PacketID: uint16(id),
+			Topic:    message.Topic.Name,
+			Payload:  message.Payload,
+		})
+	}
+	for _, sub := range sess.subs {
+		go c.forward(sub)
+	}
+	sess.Unlock()
+
+	return true
+}
+
+// readLoop handles packets until the connection is closed and returns
+// true if the client disconnected gracefully.
+func (c *conn) readLoop(keepAlive time.Duration) bool {
+	for {
+		if keepAlive > 0 {
+			c.netConn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		} else {
+			c.netConn.SetReadDeadline(time.Time{})
+		}
+
+		p, err := readPacket(c.r, c.server.maxPacketSize)
+		if err != nil {
+			select {
+			case <-c.done:
+			default:
+				log.Debugf("[mqtt] error reading from %s: %s", c.session.id, err)
+			}
+			return false
+		}
+
+		switch p.Type {
+		case PUBLISH:
+			err = c.handlePublish(p)
+		case PUBACK:
+			c.handlePuback(p)
+		case PUBREL:
+			c.session.Lock()
+			delete(c.session.received, p.PacketID)
+			c.session.Unlock()
+			err = c.write(&packet{Type: PUBCOMP, PacketID: p.PacketID})
+		case SUBSCRIBE:
+			err = c.handleSubscribe(p)
+		case UNSUBSCRIBE:
+			err = c.handleUnsubscribe(p)
+		case PINGREQ:
+			err = c.write(&packet{Type: PINGRESP})
+		case DISCONNECT:
+			return true
+		default:
+			err = fmt.Errorf("unexpected packet type %d", p.Type)
+		}
+
+		if err != nil {
+			log.Warnf("[mqtt] error handling packet from %s: %s", c.session.id, err)
+			return false
+		}
+	}
+}
+
+func (c *conn) handlePublish(p *packet) error {
+	qos := p.qos()
+	if qos > 2 {
+		return fmt.Errorf("invalid qos %d", qos)
+	}
+
+	if !validTopic(p.Topic) {
+		return fmt.Errorf("invalid topic %q", p.Topic)
+	}
+
+	if max := c.server.bus.TopicOptions(p.Topic).MaxPayloadSize; len(p.Payload) > max {
+		c.server.bus.Audit(c.ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditPublish, Result: msgbus.AuditRejected,
+			Topic: p.Topic, Size: len(p.Payload), Detail: "payload exceeds max-payload-size",
+		})
+		return fmt.Errorf("payload of %d bytes exceeds max-payload-size", len(p.Payload))
+	}
+
+	if qos == 2 {
+		c.session.Lock()
+		duplicate := c.session.received[p.PacketID]
+		c.session.received[p.PacketID] = true
+		c.session.Unlock()
+
+		if !duplicate {
+			if err := c.publish(msgbus.Publishing{Topic: p.Topic, Payload: p.Payload}, p.retain()); err != nil {
+				c.session.Lock()
+				delete(c.session.received, p.PacketID)
+				c.session.Unlock()
+				return err
+			}
+		}
+		return c.write(&packet{Type: PUBREC, PacketID: p.PacketID})
+	}
+
+	if err := c.publish(msgbus.Publishing{Topic: p.Topic, Payload: p.Payload}, p.retain()); err != nil {
+		return err
+	}
+
+	if qos == 1 {
+		return c.write(&packet{Type: PUBACK, PacketID: p.PacketID})
+	}
+	return nil
+}
+
+// publish puts m on the bus, storing it as the retained message of its
+// topic if retain is true.
+func (c *conn) publish(m msgbus.Publishing, retain bool) error {
+	m.Retain = retain
+	message, _, err := c.server.bus.PutMessage(c.ctx, m)
+	if err != nil {
+		c.server.bus.Audit(c.ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditPublish, Result: msgbus.AuditRejected,
+			Topic: m.Topic, Size: len(m.Payload), Detail: err.Error(),
+		})
+		return err
+	}
+	c.server.bus.Audit(c.ctx, msgbus.AuditEvent{
+		Action: msgbus.AuditPublish, Result: msgbus.AuditOK,
+	}.WithMessage(message))
+
+	return nil
+}
+
+func (c *conn) handlePuback(p *packet) {
+	c.session.Lock()
+	defer c.session.Unlock()
+
+	if _, ok := c.session.inflight[p.PacketID]; ok {
+		delete(c.session.inflight, p.PacketID)
+		<-c.session.window
+	}
+}
+
+func (c *conn) handleSubscribe(p *packet) error {
+	codes := make([]byte, len(p.Topics))
+
+	c.session.Lock()
+	var started []*subscription
+	for i, filter := range p.Topics {
+		if !msgbus.ValidPattern(filter) || p.QoS[i] > 2 {
+			codes[i] = subackFailure
+			continue
+		}
+
+		qos := p.QoS[i]
+		if qos > 1 {
+			qos = 1
+		}
+		codes[i] = qos
+
+		if sub, ok := c.session.subs[filter]; ok {
+			sub.qos = qos
+			continue
+		}
+
+		sub := &subscription{
+			filter: filter,
+			qos:    qos,
+			ch:     c.server.bus.SubscribePattern(c.session.subscriberID(), filter),
+		}
+		c.session.subs[filter] = sub
+		started = append(started, sub)
+	}
+	c.session.Unlock()
+
+	for _, sub := range started {
+		go c.forward(sub)
+	}
+
+	if err := c.write(&packet{Type: SUBACK, PacketID: p.PacketID, QoS: codes}); err != nil {
+		return err
+	}
+
+	for i, filter := range p.Topics {
+		if codes[i] == subackFailure {
+			c.server.bus.Audit(c.ctx, msgbus.AuditEvent{
+				Action: msgbus.AuditSubscribe, Result: msgbus.AuditRejected, Topic: filter,
+			})
+			continue
+		}
+
+		c.server.bus.Audit(c.ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditSubscribe, Result: msgbus.AuditOK, Topic: filter,
+		})
+
+		if retained := c.server.bus.Retained(filter); len(retained) > 0 {
+			go c.deliverRetained(codes[i], retained)
+		}
+	}
+
+	return nil
+}
+
+// deliverRetained sends the retained messages of topics matching a filter
+// subscribed to. They are sent off the read loop, which must keep reading
+// the acknowledgements that free the inflight window QoS 1 messages wait
+// for.
+func (c *conn) deliverRetained(qos byte, messages []msgbus.Message) {
+	for _, message := range messages {
+		if !c.deliver(qos, message, true) {
+			return
+		}
+	}
+}
+
+func (c *conn) handleUnsubscribe(p *packet) error {
+	c.session.Lock()
+	for _, filter := range p.Topics {
+		if _, ok := c.session.subs[filter]; ok {
+			delete(c.session.subs, filter)
+			c.server.bus.UnsubscribePattern(c.session.subscriberID(), filter)
+		}
+	}
+	c.session.Unlock()
+
+	for _, filter := range p.Topics {
+		c.server.bus.Audit(c.ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditUnsubscribe, Result: msgbus.AuditOK, Topic: filter,
+		})
+	}
+
+	return c.write(&packet{Type: UNSUBACK, PacketID: p.PacketID})
+}
+
+// forward delivers messages of sub until the connection is closed or the
+// subscription removed. While a persistent session is disconnected its
+// messages are buffered by the bus.
+func (c *conn) forward(sub *subscription) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case message, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			if !c.deliver(sub.qos, message, false) {
+				return
+			}
+		}
+	}
+}
+
+// deliver sends message to the client and returns false if the connection
+// was closed. QoS 1 messages are kept until acknowledged and resent when a
+// persistent session reconnects.
+func (c *conn) deliver(qos byte, message msgbus.Message, retain bool) bool {
+	p := &packet{
+		Type:    PUBLISH,
+		Flags:   publishFlags(qos, retain, false),
+		Topic:   message.Topic.Name,
+		Payload: message.Payload,
+	}
+
+	if qos > 0 {
+		select {
+		case c.session.window <- struct{}{}:
+		case <-c.done:
+			return false
+		}
+
+		c.session.Lock()
+		p.PacketID = c.session.packetID()
+		c.session.inflight[p.PacketID] = message
+		c.session.Unlock()
+	}
+
+	return c.write(p) == nil
+}
+
+// validTopic returns true if topic is a valid topic name to publish to
+func validTopic(topic string) bool {
+	return topic != "" && !msgbus.IsPattern(topic) && !strings.ContainsRune(topic, 0)
+}
+
+func randomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "auto-" + hex.EncodeToString(b)
+}
@@ -0,0 +1,309 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/prologic/msgbus"
+)
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newTestServer(t *testing.T, options *Options) (*msgbus.MessageBus, string) {
+	mb := msgbus.New(nil)
+	s := NewServer(mb, options)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	return mb, l.Addr().String()
+}
+
+func dial(t *testing.T, addr string, connect *packet) (*testClient, *packet) {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	c := &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	if connect.ProtocolName == "" {
+		connect.ProtocolName = "MQTT"
+		connect.ProtocolLevel = 4
+	}
+	connect.Type = CONNECT
+	c.send(connect)
+
+	connack := c.recv()
+	require.Equal(t, byte(CONNACK), connack.Type)
+	return c, connack
+}
+
+func (c *testClient) send(p *packet) {
+	require.NoError(c.t, writePacket(c.conn, p))
+}
+
+func (c *testClient) recv() *packet {
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	p, err := readPacket(c.r, 0)
+	require.NoError(c.t, err)
+	return p
+}
+
+func (c *testClient) subscribe(id uint16, filter string, qos byte) byte {
+	c.send(&packet{Type: SUBSCRIBE, PacketID: id, Topics: []string{filter}, QoS: []byte{qos}})
+	suback := c.recv()
+	require.Equal(c.t, byte(SUBACK), suback.Type)
+	require.Equal(c.t, id, suback.PacketID)
+	return suback.QoS[0]
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	packets := []*packet{
+		{
+			Type: CONNECT, ProtocolName: "MQTT", ProtocolLevel: 4,
+			ConnectFlags: flagCleanSession | flagWill | flagUsername | flagPassword,
+			KeepAlive:    30, ClientID: "foo", WillTopic: "will", WillMessage: []byte("bye"),
+			Username: "alice", Password: []byte("secret"),
+		},
+		{Type: PUBLISH, Flags: publishFlags(1, true, false), PacketID: 7, Topic: "a/b", Payload: []byte("hello")},
+		{Type: SUBSCRIBE, Flags: 0x02, PacketID: 8, Topics: []string{"a/+", "#"}, QoS: []byte{0, 1}},
+		{Type: PINGREQ},
+	}
+
+	for _, expected := range packets {
+		buf := &bytes.Buffer{}
+		require.NoError(t, writePacket(buf, expected))
+
+		actual, err := readPacket(bufio.NewReader(buf), 0)
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+}
+
+func TestReadPacketTooLarge(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writePacket(buf, &packet{Type: PUBLISH, Topic: "foo", Payload: make([]byte, 128)})
+
+	_, err := readPacket(bufio.NewReader(buf), 64)
+	assert.Equal(t, ErrPacketTooLarge, err)
+}
+
+func TestConnectRefused(t *testing.T) {
+	_, addr := newTestServer(t, &Options{
+		Authenticate: func(username, password string) (string, bool) {
+			return username, username == "alice" && password == "secret"
+		},
+	})
+
+	_, connack := dial(t, addr, &packet{ProtocolName: "MQTT", ProtocolLevel: 5})
+	assert.Equal(t, byte(RefusedProtocolVersion), connack.ReturnCode)
+
+	_, connack = dial(t, addr, &packet{ClientID: "", ConnectFlags: 0})
+	assert.Equal(t, byte(RefusedIdentifierRejected), connack.ReturnCode)
+
+	_, connack = dial(t, addr, &packet{
+		ClientID: "foo", ConnectFlags: flagCleanSession | flagUsername | flagPassword,
+		Username: "alice", Password: []byte("wrong"),
+	})
+	assert.Equal(t, byte(RefusedBadUsernamePassword), connack.ReturnCode)
+
+	_, connack = dial(t, addr, &packet{
+		ClientID: "foo", ConnectFlags: flagCleanSession | flagUsername | flagPassword,
+		Username: "alice", Password: []byte("secret"),
+	})
+	assert.Equal(t, byte(Accepted), connack.ReturnCode)
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	assert := assert.New(t)
+
+	mb, addr := newTestServer(t, nil)
+
+	sub, _ := dial(t, addr, &packet{ClientID: "sub", ConnectFlags: flagCleanSession})
+	assert.Equal(byte(1), sub.subscribe(1, "sensors/+/temp", 2))
+	assert.Equal(byte(subackFailure), sub.subscribe(2, "sensors/#/temp", 0))
+
+	pub, _ := dial(t, addr, &packet{ClientID: "pub", ConnectFlags: flagCleanSession})
+	pub.send(&packet{Type: PUBLISH, Flags: publishFlags(1, false, false), PacketID: 1, Topic: "sensors/kitchen/temp", Payload: []byte("21")})
+
+	puback := pub.recv()
+	assert.Equal(byte(PUBACK), puback.Type)
+	assert.Equal(uint16(1), puback.PacketID)
+
+	p := sub.recv()
+	assert.Equal(byte(PUBLISH), p.Type)
+	assert.Equal("sensors/kitchen/temp", p.Topic)
+	assert.Equal([]byte("21"), p.Payload)
+	assert.Equal(byte(1), p.qos())
+	sub.send(&packet{Type: PUBACK, PacketID: p.PacketID})
+
+	// Messages published over MQTT can be pulled over HTTP
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/sensors/kitchen/temp", nil)
+	mb.ServeHTTP(w, r)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `"payload":"MjE="`)
+
+	// Messages published over HTTP are delivered over MQTT
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("PUT", "/sensors/garage/temp", bytes.NewBufferString("12"))
+	mb.ServeHTTP(w, r)
+	assert.Equal(http.StatusAccepted, w.Code)
+
+	p = sub.recv()
+	assert.Equal("sensors/garage/temp", p.Topic)
+	assert.Equal([]byte("12"), p.Payload)
+}
+
+func TestPublishQoS2(t *testing.T) {
+	assert := assert.New(t)
+
+	mb, addr := newTestServer(t, nil)
+
+	c, _ := dial(t, addr, &packet{ClientID: "foo", ConnectFlags: flagCleanSession})
+	for i := 0; i < 2; i++ {
+		c.send(&packet{Type: PUBLISH, Flags: publishFlags(2, false, i > 0), PacketID: 9, Topic: "foo", Payload: []byte("bar")})
+		pubrec := c.recv()
+		assert.Equal(byte(PUBREC), pubrec.Type)
+		assert.Equal(uint16(9), pubrec.PacketID)
+	}
+
+	c.send(&packet{Type: PUBREL, PacketID: 9})
+	pubcomp := c.recv()
+	assert.Equal(byte(PUBCOMP), pubcomp.Type)
+
+	// The duplicate was not published twice
+	assert.Equal(1, mb.Len())
+}
+
+func TestRetained(t *testing.T) {
+	assert := assert.New(t)
+
+	_, addr := newTestServer(t, nil)
+
+	pub, _ := dial(t, addr, &packet{ClientID: "pub", ConnectFlags: flagCleanSession})
+	pub.send(&packet{Type: PUBLISH, Flags: publishFlags(1, true, false), PacketID: 1, Topic: "status/a", Payload: []byte("online")})
+	pub.recv()
+
+	sub, _ := dial(t, addr, &packet{ClientID: "sub", ConnectFlags: flagCleanSession})
+	sub.subscribe(1, "status/#", 0)
+
+	p := sub.recv()
+	assert.Equal("status/a", p.Topic)
+	assert.Equal([]byte("online"), p.Payload)
+	assert.True(p.retain())
+
+	// An empty retained message clears the retained message
+	pub.send(&packet{Type: PUBLISH, Flags: publishFlags(1, true, false), PacketID: 2, Topic: "status/a"})
+	pub.recv()
+
+	sub2, _ := dial(t, addr, &packet{ClientID: "sub2", ConnectFlags: flagCleanSession})
+	sub2.subscribe(1, "status/#", 0)
+	sub2.send(&packet{Type: PINGREQ})
+	assert.Equal(byte(PINGRESP), sub2.recv().Type)
+}
+
+func TestRetainedExceedingInflight(t *testing.T) {
+	assert := assert.New(t)
+
+	mb, addr := newTestServer(t, &Options{MaxInflight: 2})
+
+	for i := 0; i < 5; i++ {
+		message, _, _ := mb.PutMessage(context.Background(), msgbus.Publishing{
+			Topic: fmt.Sprintf("status/%d", i), Payload: []byte("online"),
+		})
+		mb.Retain(message)
+	}
+
+	sub, _ := dial(t, addr, &packet{ClientID: "sub", ConnectFlags: flagCleanSession})
+	sub.subscribe(1, "status/#", 1)
+
+	// The connection keeps reading while the inflight window is full
+	var received []*packet
+	for i := 0; i < 2; i++ {
+		received = append(received, sub.recv())
+	}
+	sub.send(&packet{Type: PINGREQ})
+	assert.Equal(byte(PINGRESP), sub.recv().Type)
+
+	// Each acknowledgement frees the window for the next retained message
+	for acked := 0; len(received) < 5; acked++ {
+		sub.send(&packet{Type: PUBACK, PacketID: received[acked].PacketID})
+		received = append(received, sub.recv())
+	}
+
+	for i, p := range received {
+		assert.Equal(byte(PUBLISH), p.Type)
+		assert.Equal(fmt.Sprintf("status/%d", i), p.Topic)
+		assert.True(p.retain())
+	}
+}
+
+func TestPersistentSession(t *testing.T) {
+	assert := assert.New(t)
+
+	mb, addr := newTestServer(t, nil)
+
+	c, connack := dial(t, addr, &packet{ClientID: "dev", KeepAlive: 60})
+	assert.False(connack.SessionPresent)
+	c.subscribe(1, "cmd/dev", 1)
+	c.send(&packet{Type: DISCONNECT})
+	c.conn.Close()
+
+	// Wait for the server to detach the connection
+	time.Sleep(100 * time.Millisecond)
+
+	mb.Put(mb.NewMessage(mb.NewTopic("cmd/dev"), []byte("reboot")))
+
+	c, connack = dial(t, addr, &packet{ClientID: "dev", KeepAlive: 60})
+	assert.True(connack.SessionPresent)
+
+	p := c.recv()
+	assert.Equal("cmd/dev", p.Topic)
+	assert.Equal([]byte("reboot"), p.Payload)
+
+	// Unacknowledged messages are resent on reconnect
+	c.conn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	c, _ = dial(t, addr, &packet{ClientID: "dev", KeepAlive: 60})
+	p2 := c.recv()
+	assert.True(p2.dup())
+	assert.Equal(p.PacketID, p2.PacketID)
+	assert.Equal([]byte("reboot"), p2.Payload)
+}
+
+func TestWill(t *testing.T) {
+	assert := assert.New(t)
+
+	_, addr := newTestServer(t, nil)
+
+	sub, _ := dial(t, addr, &packet{ClientID: "sub", ConnectFlags: flagCleanSession})
+	sub.subscribe(1, "will/+", 0)
+
+	dev, _ := dial(t, addr, &packet{
+		ClientID: "dev", ConnectFlags: flagCleanSession | flagWill,
+		WillTopic: "will/dev", WillMessage: []byte("gone"),
+	})
+	dev.conn.Close()
+
+	p := sub.recv()
+	assert.Equal("will/dev", p.Topic)
+	assert.Equal([]byte("gone"), p.Payload)
+}
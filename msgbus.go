@@ -1,18 +1,26 @@
 package msgbus
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -25,6 +33,19 @@ const (
 	// DefaultBufferLength is the default buffer length for subscriber chans
 	DefaultBufferLength = 100
 
+	// HeaderPrefix prefixes the HTTP request headers of a publish that are
+	// stored in the message headers, e.g: "Msgbus-Origin: a" is stored as
+	// "msgbus-origin: a"
+	HeaderPrefix = "Msgbus-"
+
+	// HistoryLengthHeader is the response header of websocket subscriptions
+	// with the number of messages kept per topic to resume subscriptions
+	HistoryLengthHeader = "X-Msgbus-History-Length"
+
+	// DefaultMaxMetricsTopics is the default maximum number of topics with
+	// their own per-topic metrics, further topics are counted as "_other"
+	DefaultMaxMetricsTopics = 1000
+
 	// Time allowed to write a message to the peer.
 	writeWait = 10 * time.Second
 
@@ -44,26 +65,115 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-// HandlerFunc ...
-type HandlerFunc func(msg *Message) error
+// SubprotocolHandler serves a websocket connection that negotiated a
+// subprotocol registered with HandleSubprotocol. ctx carries the identity
+// and remote address of the caller.
+type SubprotocolHandler func(ctx context.Context, conn *websocket.Conn)
+
+// HandlerFunc handles a message, ctx carries the trace context the
+// message was delivered with.
+type HandlerFunc func(ctx context.Context, msg *Message) error
 
 // Topic ...
 type Topic struct {
 	Name     string    `json:"name"`
 	Sequence uint64    `json:"seq"`
 	Created  time.Time `json:"created"`
+
+	// Partitions is the number of partitions of a partitioned topic, each
+	// with its own sequence and queue
+	Partitions int `json:"partitions,omitempty"`
+
+	partitions []*partition
+
+	// Compacted topics keep the latest message of each key, which new
+	// subscribers receive before live messages
+	Compacted bool `json:"compacted,omitempty"`
+
+	compaction *compaction
+
+	// dedup remembers the messages published with an idempotency key
+	dedup *dedup
+
+	// nextPut and nextGet are the next partitions messages without a key
+	// are published to and pulled from
+	nextPut uint32
+	nextGet uint32
 }
 
 func (t *Topic) String() string {
 	return t.Name
 }
 
+// Copy returns a copy of t that is safe to serialize or hand to subscribers
+// while messages are published to t, its sequence is read atomically
+func (t *Topic) Copy() *Topic {
+	return &Topic{
+		Name:       t.Name,
+		Sequence:   atomic.LoadUint64(&t.Sequence),
+		Created:    t.Created,
+		Partitions: t.Partitions,
+		Compacted:  t.Compacted,
+	}
+}
+
 // Message ...
 type Message struct {
-	ID      uint64    `json:"id"`
-	Topic   *Topic    `json:"topic"`
-	Payload []byte    `json:"payload"`
-	Created time.Time `json:"created"`
+	ID        uint64            `json:"id"`
+	Topic     *Topic            `json:"topic"`
+	Key       string            `json:"key,omitempty"`
+	Partition int               `json:"partition,omitempty"`
+	Payload   []byte            `json:"payload"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Created   time.Time         `json:"created"`
+}
+
+// PublishResult is the result of publishing a message, returned as the
+// response of a publish over HTTP
+type PublishResult struct {
+	ID        uint64    `json:"id"`
+	Topic     string    `json:"topic"`
+	Partition int       `json:"partition,omitempty"`
+	Created   time.Time `json:"created"`
+
+	// Delivered is the number of subscribers the message was delivered to,
+	// zero for duplicates
+	Delivered int `json:"delivered"`
+
+	// Duplicate is true if a message was already published with the same
+	// idempotency key, the result is then that of the message published
+	// first
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// NewPublishResult returns the result of publishing message to delivered
+// subscribers
+func NewPublishResult(message Message, delivered int) PublishResult {
+	return PublishResult{
+		ID:        message.ID,
+		Topic:     message.Topic.Name,
+		Partition: message.Partition,
+		Created:   message.Created,
+		Delivered: delivered,
+	}
+}
+
+// WritePublishResult writes result as the JSON response of a publish with
+// status 202 Accepted
+func WritePublishResult(w http.ResponseWriter, result PublishResult) {
+	out, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error serializing result: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(IDHeader, strconv.FormatUint(result.ID, 10))
+	if result.Duplicate {
+		w.Header().Set(DuplicateHeader, "true")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(out)
 }
 
 // ListenerOptions ...
@@ -160,39 +270,135 @@ func (ls *Listeners) NotifyAll(message Message) int {
 	for id, ch := range ls.chs {
 		select {
 		case ch <- message:
-			log.Debugf("successfully published message to %s: %+v", id, message)
+			log.Debugf("successfully published message %d to %s", message.ID, id)
 			i++
 		default:
 			// TODO: Drop this client?
 			// TODO: Retry later?
-			log.Warnf("cannot publish message to %s: %+v", id, message)
+			log.Warnf("cannot publish message %d to %s", message.ID, id)
 		}
 	}
 
 	return i
 }
 
+// Notify sends message to the listener id only, it returns false if id
+// does not exist or its buffer is full
+func (ls *Listeners) Notify(id string, message Message) bool {
+	ls.RLock()
+	defer ls.RUnlock()
+
+	ch, ok := ls.chs[id]
+	if !ok {
+		return false
+	}
+
+	select {
+	case ch <- message:
+		log.Debugf("successfully published message %d to %s", message.ID, id)
+		return true
+	default:
+		return false
+	}
+}
+
+// TopicOptions ...
+type TopicOptions struct {
+	BufferLength   int
+	MaxQueueSize   int
+	MaxPayloadSize int
+
+	// Partitions partitions the topic when it is created, with a queue of
+	// MaxQueueSize per partition. It cannot be changed afterwards.
+	Partitions int
+
+	// Compacted makes the topic keep the latest message of each key when it
+	// is created. It cannot be changed afterwards.
+	Compacted bool
+}
+
 // Options ...
 type Options struct {
 	BufferLength   int
 	MaxQueueSize   int
 	MaxPayloadSize int
 	WithMetrics    bool
+
+	// MetricsRegistry is the registry metrics are registered with when
+	// WithMetrics is true. If nil each bus has its own registry.
+	MetricsRegistry *prometheus.Registry
+
+	// MetricsLabels are constant labels added to every metric of the bus,
+	// e.g: {"bus": "name"} to tell apart buses sharing a registry.
+	MetricsLabels map[string]string
+
+	// MaxMetricsTopics limits the number of topics with per-topic metrics
+	// (default: DefaultMaxMetricsTopics), negative values are unbounded.
+	MaxMetricsTopics int
+
+	// Auditor records an audit log of operations on the bus, if set
+	Auditor Auditor
+
+	// TracerProvider provides the tracer used to trace messages from
+	// publishing to delivery. If nil the global provider is used.
+	TracerProvider trace.TracerProvider
+
+	// HistoryLength is the number of recently published messages kept per
+	// topic so websocket subscribers can resume after reconnecting, zero
+	// keeps none.
+	HistoryLength int
+
+	// DedupWindow and DedupSize bound the time and number of idempotency
+	// keys remembered per topic to deduplicate publishes (default:
+	// DefaultDedupWindow and DefaultDedupSize), negative values disable
+	// deduplication.
+	DedupWindow time.Duration
+	DedupSize   int
+
+	// MaxBatchLength and MaxBatchSize bound the number of messages and the
+	// size of the body of a batch publish (default: DefaultMaxBatchLength
+	// and DefaultMaxBatchSize), each message is also limited to the
+	// MaxPayloadSize of its topic.
+	MaxBatchLength int
+	MaxBatchSize   int
+
+	// Topics overrides the limits above for individual topics by name.
+	// Zero values fall back to the bus-wide limits.
+	Topics map[string]TopicOptions
 }
 
 // MessageBus ...
 type MessageBus struct {
 	sync.RWMutex
 
-	metrics *Metrics
+	metrics     *Metrics
+	topicLabels *LabelGuard
+	tracer      trace.Tracer
+	auditor     Auditor
 
 	bufferLength   int
 	maxQueueSize   int
 	maxPayloadSize int
+	topicOptions   map[string]TopicOptions
+	historyLength  int
+	dedupWindow    time.Duration
+	dedupSize      int
+	maxBatchLength int
+	maxBatchSize   int
 
 	topics    map[string]*Topic
 	queues    map[*Topic]*Queue
 	listeners map[*Topic]*Listeners
+	patterns  map[string]*Listeners
+	groups    map[*Topic]map[string]*group
+	history   map[*Topic][]Message
+
+	// retainedMu guards retained, which messages put to partitions update
+	// holding only the bus read lock
+	retainedMu sync.RWMutex
+	retained   map[string]Message
+
+	subprotocols map[string]SubprotocolHandler
 }
 
 // New ...
@@ -202,6 +408,16 @@ func New(options *Options) *MessageBus {
 		maxQueueSize   int
 		maxPayloadSize int
 		withMetrics    bool
+		metricsOptions *MetricsOptions
+		maxMetrics     int
+		tracerProvider trace.TracerProvider
+		auditor        Auditor
+		topicOptions   map[string]TopicOptions
+		historyLength  int
+		dedupWindow    time.Duration
+		dedupSize      int
+		maxBatchLength int
+		maxBatchSize   int
 	)
 
 	if options != nil {
@@ -209,6 +425,19 @@ func New(options *Options) *MessageBus {
 		maxQueueSize = options.MaxQueueSize
 		maxPayloadSize = options.MaxPayloadSize
 		withMetrics = options.WithMetrics
+		metricsOptions = &MetricsOptions{
+			Registry:    options.MetricsRegistry,
+			ConstLabels: options.MetricsLabels,
+		}
+		maxMetrics = options.MaxMetricsTopics
+		tracerProvider = options.TracerProvider
+		auditor = options.Auditor
+		topicOptions = options.Topics
+		historyLength = options.HistoryLength
+		dedupWindow = options.DedupWindow
+		dedupSize = options.DedupSize
+		maxBatchLength = options.MaxBatchLength
+		maxBatchSize = options.MaxBatchSize
 	} else {
 		bufferLength = DefaultBufferLength
 		maxQueueSize = DefaultMaxQueueSize
@@ -216,10 +445,58 @@ func New(options *Options) *MessageBus {
 		withMetrics = false
 	}
 
+	if maxMetrics == 0 {
+		maxMetrics = DefaultMaxMetricsTopics
+	}
+
+	if tracerProvider == nil {
+		tracerProvider = otel.GetTracerProvider()
+	}
+
+	if dedupWindow == 0 {
+		dedupWindow = DefaultDedupWindow
+	}
+	if dedupSize == 0 {
+		dedupSize = DefaultDedupSize
+	}
+
+	if maxBatchLength == 0 {
+		maxBatchLength = DefaultMaxBatchLength
+	}
+	if maxBatchSize == 0 {
+		maxBatchSize = DefaultMaxBatchSize
+	}
+
+	mb := &MessageBus{
+		topicLabels: NewLabelGuard(maxMetrics),
+		tracer:      tracerProvider.Tracer(tracerName),
+		auditor:     auditor,
+
+		bufferLength:   bufferLength,
+		maxQueueSize:   maxQueueSize,
+		maxPayloadSize: maxPayloadSize,
+		topicOptions:   topicOptions,
+		historyLength:  historyLength,
+		dedupWindow:    dedupWindow,
+		dedupSize:      dedupSize,
+		maxBatchLength: maxBatchLength,
+		maxBatchSize:   maxBatchSize,
+
+		topics:    make(map[string]*Topic),
+		queues:    make(map[*Topic]*Queue),
+		listeners: make(map[*Topic]*Listeners),
+		patterns:  make(map[string]*Listeners),
+		groups:    make(map[*Topic]map[string]*group),
+		history:   make(map[*Topic][]Message),
+		retained:  make(map[string]Message),
+
+		subprotocols: make(map[string]SubprotocolHandler),
+	}
+
 	var metrics *Metrics
 
 	if withMetrics {
-		metrics = NewMetrics("msgbus")
+		metrics = NewMetricsWithOptions("msgbus", metricsOptions)
 
 		ctime := time.Now()
 
@@ -288,31 +565,88 @@ func New(options *Options) *MessageBus {
 		)
 
 		// queue size gauge vec
-		// TODO: Implement this gauge by somehow getting queue sizes per topic!
 		metrics.NewGaugeVec(
 			"queue", "size",
-			"Queue length of each topic",
+			"Queue size in bytes of payloads of each topic",
 			[]string{"topic"},
 		)
 
+		// queue evicted counter vec
+		metrics.NewCounterVec(
+			"queue", "evicted",
+			"Number of messages evicted from full queues of each topic",
+			[]string{"topic"},
+		)
+
+		// queue oldest message age
+		metrics.Register(newQueueCollector(mb, metrics))
+
 		// bus subscribers gauge
 		metrics.NewGauge(
 			"bus", "subscribers",
 			"Number of active subscribers",
 		)
-	}
 
-	return &MessageBus{
-		metrics: metrics,
+		// topic published counter vec
+		metrics.NewCounterVec(
+			"topic", "published",
+			"Number of messages published to each topic",
+			[]string{"topic"},
+		)
 
-		bufferLength:   bufferLength,
-		maxQueueSize:   maxQueueSize,
-		maxPayloadSize: maxPayloadSize,
+		// topic delivered counter vec
+		metrics.NewCounterVec(
+			"topic", "delivered",
+			"Number of messages delivered to subscribers of each topic",
+			[]string{"topic"},
+		)
 
-		topics:    make(map[string]*Topic),
-		queues:    make(map[*Topic]*Queue),
-		listeners: make(map[*Topic]*Listeners),
+		// topic dropped counter vec
+		metrics.NewCounterVec(
+			"topic", "dropped",
+			"Number of messages dropped to subscribers of each topic",
+			[]string{"topic"},
+		)
+
+		// topic fetched counter vec
+		metrics.NewCounterVec(
+			"topic", "fetched",
+			"Number of messages fetched from each topic",
+			[]string{"topic"},
+		)
+
+		// topic bytes in counter vec
+		metrics.NewCounterVec(
+			"topic", "bytes_in",
+			"Number of payload bytes published to each topic",
+			[]string{"topic"},
+		)
+
+		// topic bytes out counter vec
+		metrics.NewCounterVec(
+			"topic", "bytes_out",
+			"Number of payload bytes delivered and fetched from each topic",
+			[]string{"topic"},
+		)
+
+		// topic subscribers gauge vec
+		metrics.NewGaugeVec(
+			"topic", "subscribers",
+			"Number of active subscribers of each topic",
+			[]string{"topic"},
+		)
+
+		// topic latency histogram vec
+		metrics.NewHistogramVec(
+			"topic", "latency_seconds",
+			"Latency in seconds from publishing to delivering or fetching messages",
+			[]string{"topic"},
+		)
 	}
+
+	mb.metrics = metrics
+
+	return mb
 }
 
 // Len ...
@@ -320,11 +654,103 @@ func (mb *MessageBus) Len() int {
 	return len(mb.topics)
 }
 
+// Topics returns the topics of the bus sorted by name
+func (mb *MessageBus) Topics() []*Topic {
+	mb.RLock()
+	defer mb.RUnlock()
+
+	topics := make([]*Topic, 0, len(mb.topics))
+	for _, t := range mb.topics {
+		topics = append(topics, t)
+	}
+	sort.Slice(topics, func(i, j int) bool { return topics[i].Name < topics[j].Name })
+
+	return topics
+}
+
 // Metrics ...
 func (mb *MessageBus) Metrics() *Metrics {
 	return mb.metrics
 }
 
+// Configure updates the limits of a running bus. New limits apply to
+// subscribers that join afterwards and to the queues of existing topics.
+// Metrics cannot be enabled or disabled once the bus is created.
+func (mb *MessageBus) Configure(options *Options) {
+	mb.Lock()
+	defer mb.Unlock()
+
+	mb.bufferLength = options.BufferLength
+	mb.maxQueueSize = options.MaxQueueSize
+	mb.maxPayloadSize = options.MaxPayloadSize
+	mb.topicOptions = options.Topics
+	mb.historyLength = options.HistoryLength
+
+	mb.dedupWindow = options.DedupWindow
+	if mb.dedupWindow == 0 {
+		mb.dedupWindow = DefaultDedupWindow
+	}
+	mb.dedupSize = options.DedupSize
+	if mb.dedupSize == 0 {
+		mb.dedupSize = DefaultDedupSize
+	}
+
+	mb.maxBatchLength = options.MaxBatchLength
+	if mb.maxBatchLength == 0 {
+		mb.maxBatchLength = DefaultMaxBatchLength
+	}
+	mb.maxBatchSize = options.MaxBatchSize
+	if mb.maxBatchSize == 0 {
+		mb.maxBatchSize = DefaultMaxBatchSize
+	}
+
+	for t, q := range mb.queues {
+		q.SetMaxLen(mb.limits(t.Name).MaxQueueSize)
+	}
+	for _, t := range mb.topics {
+		for _, p := range t.partitions {
+			p.queue.SetMaxLen(mb.limits(t.Name).MaxQueueSize)
+		}
+	}
+}
+
+// TopicOptions returns the effective limits for the named topic
+func (mb *MessageBus) TopicOptions(topic string) TopicOptions {
+	mb.RLock()
+	defer mb.RUnlock()
+
+	return mb.limits(topic)
+}
+
+// limits returns the effective limits for a topic, the caller must hold
+// the bus lock.
+func (mb *MessageBus) limits(topic string) TopicOptions {
+	opts := TopicOptions{
+		BufferLength:   mb.bufferLength,
+		MaxQueueSize:   mb.maxQueueSize,
+		MaxPayloadSize: mb.maxPayloadSize,
+	}
+
+	override, ok := mb.topicOptions[topic]
+	if !ok {
+		return opts
+	}
+
+	if override.BufferLength != 0 {
+		opts.BufferLength = override.BufferLength
+	}
+	if override.MaxQueueSize != 0 {
+		opts.MaxQueueSize = override.MaxQueueSize
+	}
+	if override.MaxPayloadSize != 0 {
+		opts.MaxPayloadSize = override.MaxPayloadSize
+	}
+	opts.Partitions = override.Partitions
+	opts.Compacted = override.Compacted
+
+	return opts
+}
+
 // NewTopic ...
 func (mb *MessageBus) NewTopic(topic string) *Topic {
 	mb.Lock()
@@ -332,8 +758,7 @@ func (mb *MessageBus) NewTopic(topic string) *Topic {
 
 	t, ok := mb.topics[topic]
 	if !ok {
-		t = &Topic{Name: topic, Created: time.Now()}
-		mb.topics[topic] = t
+		t = mb.newTopic(topic)
 		if mb.metrics != nil {
 			mb.metrics.Counter("bus", "topics").Inc()
 		}
@@ -341,160 +766,913 @@ func (mb *MessageBus) NewTopic(topic string) *Topic {
 	return t
 }
 
-// NewMessage ...
-func (mb *MessageBus) NewMessage(topic *Topic, payload []byte) Message {
-	defer func() {
-		topic.Sequence++
-		if mb.metrics != nil {
-			mb.metrics.Counter("bus", "messages").Inc()
-		}
-	}()
-
-	return Message{
-		ID:      topic.Sequence,
-		Topic:   topic,
-		Payload: payload,
-		Created: time.Now(),
+// newTopic creates the topic name, partitioned and compacted if configured
+// to, the caller must hold the lock
+func (mb *MessageBus) newTopic(name string) *Topic {
+	t := &Topic{Name: name, Created: time.Now(), dedup: newDedup()}
+	limits := mb.limits(name)
+	if limits.Partitions > 1 {
+		t.Partitions = limits.Partitions
+		t.partitions = newPartitions(limits.Partitions, limits.MaxQueueSize)
+	}
+	if limits.Compacted {
+		t.Compacted = true
+		t.compaction = newCompaction()
 	}
+	mb.topics[name] = t
+	return t
+}
+
+// NewMessage returns a new message of topic without a key
+func (mb *MessageBus) NewMessage(topic *Topic, payload []byte) Message {
+	return mb.NewMessageWithKey(topic, "", payload)
 }
 
 // Put ...
 func (mb *MessageBus) Put(message Message) {
-	mb.Lock()
-	defer mb.Unlock()
+	mb.PutContext(context.Background(), message)
+}
 
-	log.Debugf(
-		"[msgbus] PUT id=%d topic=%s payload=%s",
-		message.ID, message.Topic.Name, message.Payload,
-	)
+// PutContext puts message on the bus as a child span of the trace context
+// in ctx or, if ctx has none, of the trace context already propagated in
+// the message headers. The span context is stored in the message headers
+// to be propagated to subscribers. It returns the number of subscribers the
+// message was delivered to.
+func (mb *MessageBus) PutContext(ctx context.Context, message Message) int {
+	span := mb.startPut(ctx, &message)
+	defer span.End()
 
-	t := message.Topic
-	q, ok := mb.queues[t]
-	if !ok {
-		q = NewQueue(mb.maxQueueSize)
-		mb.queues[message.Topic] = q
-	}
-	q.Push(message)
+	return mb.put(message)
+}
 
-	if mb.metrics != nil {
-		mb.metrics.GaugeVec("queue", "len").WithLabelValues(t.Name).Inc()
+// startPut starts the span of putting message as a child of the trace
+// context in ctx or in the message headers, and stores the span context in
+// the message headers
+func (mb *MessageBus) startPut(ctx context.Context, message *Message) trace.Span {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = ExtractContext(ctx, message)
 	}
 
-	mb.publish(message)
+	ctx, span := mb.tracer.Start(
+		ctx, "msgbus.put",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(messageAttributes(*message)...),
+	)
+
+	InjectContext(ctx, message)
+
+	return span
 }
 
-// Get ...
-func (mb *MessageBus) Get(t *Topic) (Message, bool) {
+// ErrKeyRequired is returned when publishing a message without a key to a
+// compacted topic
+var ErrKeyRequired = errors.New("compacted topics require a key")
+
+// Publishing is a message to put on the bus with PutMessage, which creates
+// its topic if needed and assigns its id, or a message of a batch publish.
+// Its payload is encoded in base64 like the payload of a Message and its
+// topic may be left out in batches to a single topic.
+type Publishing struct {
+	Topic   string            `json:"topic,omitempty"`
+	Key     string            `json:"key,omitempty"`
+	Payload []byte            `json:"payload"`
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// IdempotencyKey identifies the publish, a message published to the
+	// topic with the same key within the dedup window is not put again
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	// Retain stores the message as the retained message of its topic as it
+	// is put, see Retain
+	Retain bool `json:"-"`
+
+	// Created is the time the message was created, now if zero
+	Created time.Time `json:"-"`
+}
+
+// PutMessage puts a new message on the bus like PutContext, looking up its
+// idempotency key and assigning its id as it is queued holding the bus
+// lock, or only the read lock for partitioned topics, so messages are
+// queued and delivered in the order of their ids and a concurrent publish
+// with the same key cannot take an id and then not be put. It returns the
+// message put and the result of the publish or, if a message was already
+// published with its idempotency key, the message published first and a
+// Duplicate result. ErrKeyRequired is returned if the topic is compacted
+// and the message has no key.
+func (mb *MessageBus) PutMessage(ctx context.Context, p Publishing) (Message, PublishResult, error) {
+	// Messages of partitions are put holding only the bus read lock
 	mb.RLock()
-	defer mb.RUnlock()
+	if t, ok := mb.topics[p.Topic]; ok && t.partitions != nil {
+		defer mb.RUnlock()
+		return mb.putMessage(ctx, p)
+	}
+	mb.RUnlock()
 
-	log.Debugf("[msgbus] GET topic=%s", t)
+	mb.Lock()
+	defer mb.Unlock()
 
-	q, ok := mb.queues[t]
+	return mb.putMessage(ctx, p)
+}
+
+// putMessage is PutMessage for callers holding the bus lock, or the read
+// lock if the topic of p is partitioned
+func (mb *MessageBus) putMessage(ctx context.Context, p Publishing) (Message, PublishResult, error) {
+	if p.Key == "" && mb.limits(p.Topic).Compacted {
+		return Message{}, PublishResult{Topic: p.Topic}, ErrKeyRequired
+	}
+
+	t, ok := mb.topics[p.Topic]
 	if !ok {
-		return Message{}, false
+		t = mb.newTopic(p.Topic)
+		if mb.metrics != nil {
+			mb.metrics.Counter("bus", "topics").Inc()
+		}
 	}
 
-	m := q.Pop()
-	if m == nil {
-		return Message{}, false
+	// Keys are looked up as of the creation of the message, set by the
+	// leader of a cluster, so all nodes find the same duplicates
+	if p.Created.IsZero() {
+		p.Created = time.Now()
 	}
 
-	if mb.metrics != nil {
-		mb.metrics.Counter("bus", "fetched").Inc()
-		mb.metrics.GaugeVec("queue", "len").WithLabelValues(t.Name).Dec()
+	// The dedup window is held from the lookup of the key until the message
+	// is remembered, so a concurrent publish with the same key waits for it
+	// and is then a duplicate
+	d := t.dedup
+	if !mb.dedupEnabled() || p.IdempotencyKey == "" {
+		d = nil
+	}
+	if d != nil {
+		d.Lock()
+		defer d.Unlock()
+
+		if original, ok := d.get(p.IdempotencyKey, p.Created, mb.dedupWindow); ok {
+			result := NewPublishResult(original, 0)
+			result.Duplicate = true
+			return original, result, nil
+		}
 	}
 
-	return m.(Message), true
+	message, delivered := mb.putNext(ctx, t, p)
+	if d != nil {
+		d.remember(p.IdempotencyKey, message, mb.dedupWindow, mb.dedupSize)
+	}
+	return message, NewPublishResult(message, delivered), nil
 }
 
-// publish ...
-func (mb *MessageBus) publish(message Message) {
-	log.Debugf(
-		"[msgbus] publish id=%d topic=%s payload=%s",
-		message.ID, message.Topic.Name, message.Payload,
-	)
-	ls, ok := mb.listeners[message.Topic]
-	if !ok {
-		return
+// put ...
+func (mb *MessageBus) put(message Message) int {
+	// Messages of partitions are put holding only the bus read lock
+	if message.Topic.partition(message.Partition) != nil {
+		mb.RLock()
+		defer mb.RUnlock()
+	} else {
+		mb.Lock()
+		defer mb.Unlock()
 	}
 
-	n := ls.NotifyAll(message)
-	if n != ls.Length() && mb.metrics != nil {
-		log.Warnf("%d/%d subscribers notified", n, ls.Length())
-		mb.metrics.Counter("bus", "dropped").Inc()
-	}
+	return mb.putLocked(message)
 }
 
-// Subscribe ...
-func (mb *MessageBus) Subscribe(id, topic string) chan Message {
-	mb.Lock()
-	defer mb.Unlock()
+// putLocked puts message on its queue and publishes it, the caller must
+// hold the bus lock or, for messages of partitions, the read lock
+func (mb *MessageBus) putLocked(message Message) int {
+	if p := message.Topic.partition(message.Partition); p != nil {
+		return mb.putPartition(p, message)
+	}
 
-	log.Debugf("[msgbus] Subscribe id=%s topic=%s", id, topic)
+	log.Debugf(
+		"[msgbus] PUT id=%d topic=%s size=%d",
+		message.ID, message.Topic.Name, len(message.Payload),
+	)
 
-	t, ok := mb.topics[topic]
+	t := message.Topic
+	q, ok := mb.queues[t]
 	if !ok {
-		t = &Topic{Name: topic, Created: time.Now()}
-		mb.topics[topic] = t
+		q = NewQueue(mb.limits(t.Name).MaxQueueSize)
+		mb.queues[message.Topic] = q
 	}
+	evicted := q.Push(message)
+	t.compact(message)
 
-	ls, ok := mb.listeners[t]
-	if !ok {
-		ls = NewListeners(&ListenerOptions{BufferLength: mb.bufferLength})
-		mb.listeners[t] = ls
-	}
+	mb.observePut(message, evicted)
+	mb.record(message)
+	return mb.publish(message)
+}
 
-	if ls.Exists(id) {
-		// Already verified the listener exists
-		ch, _ := ls.Get(id)
-		return ch
+// observePut records the metrics of a message published and queued, which
+// evicted the oldest message of the queue if evicted is not nil
+func (mb *MessageBus) observePut(message Message, evicted interface{}) {
+	if mb.metrics == nil {
+		return
 	}
 
-	if mb.metrics != nil {
-		mb.metrics.Gauge("bus", "subscribers").Inc()
-	}
+	label := mb.topicLabels.Label(message.Topic.Name)
+	size := float64(len(message.Payload))
+	mb.metrics.CounterVec("topic", "published").WithLabelValues(label).Inc()
+	mb.metrics.CounterVec("topic", "bytes_in").WithLabelValues(label).Add(size)
 
-	return ls.Add(id)
+	mb.observeQueued(message, evicted)
 }
 
-// Unsubscribe ...
-func (mb *MessageBus) Unsubscribe(id, topic string) {
-	mb.Lock()
-	defer mb.Unlock()
+// observeQueued records the metrics of the queue of a message pushed on
+// it, which evicted the oldest message if evicted is not nil
+func (mb *MessageBus) observeQueued(message Message, evicted interface{}) {
+	if mb.metrics == nil {
+		return
+	}
 
-	log.Debugf("[msgbus] Unsubscribe id=%s topic=%s", id, topic)
+	label := mb.topicLabels.Label(message.Topic.Name)
+	mb.metrics.GaugeVec("queue", "size").WithLabelValues(label).Add(float64(len(message.Payload)))
 
-	t, ok := mb.topics[topic]
-	if !ok {
-		return
+	if evicted != nil {
+		mb.metrics.CounterVec("queue", "evicted").WithLabelValues(label).Inc()
+		mb.metrics.GaugeVec("queue", "size").WithLabelValues(label).Sub(
+			float64(len(evicted.(Message).Payload)),
+		)
+	} else {
+		mb.metrics.GaugeVec("queue", "len").WithLabelValues(label).Inc()
 	}
+}
 
-	ls, ok := mb.listeners[t]
-	if !ok {
+// record keeps message in the history of its topic, the caller must hold
+// the lock
+func (mb *MessageBus) record(message Message) {
+	h := mb.history[message.Topic]
+	if mb.historyLength <= 0 {
+		if h != nil {
+			delete(mb.history, message.Topic)
+		}
 		return
 	}
 
-	if ls.Exists(id) {
-		// Already verified the listener exists
-		ls.Remove(id)
-
-		if mb.metrics != nil {
-			mb.metrics.Gauge("bus", "subscribers").Dec()
-		}
+	h = append(h, message)
+	if len(h) > mb.historyLength {
+		h = append(h[:0:0], h[len(h)-mb.historyLength:]...)
 	}
+	mb.history[message.Topic] = h
 }
 
-func (mb *MessageBus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	defer func() {
-		if mb.metrics != nil {
-			mb.metrics.Counter("server", "requests").Inc()
-		}
-	}()
+// History returns the messages kept in the history of topic, or of the
+// topics matching a pattern, that were published after since ordered by
+// their creation
+func (mb *MessageBus) History(topic string, since time.Time) []Message {
+	return mb.HistoryAfter(topic, since, nil)
+}
+
+// Position is the id of the last message received of a topic, or of a
+// partition of a partitioned topic, to resume a subscription after
+type Position struct {
+	Topic     string
+	Partition int
+	ID        uint64
+}
+
+// ParsePosition parses a position formatted as <topic>:<partition>:<id>
+func ParsePosition(s string) (Position, error) {
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return Position{}, fmt.Errorf("invalid position %q", s)
+	}
+	j := strings.LastIndex(s[:i], ":")
+	if j <= 0 {
+		return Position{}, fmt.Errorf("invalid position %q", s)
+	}
+
+	partition, err := strconv.Atoi(s[j+1 : i])
+	if err != nil || partition < 0 {
+		return Position{}, fmt.Errorf("invalid partition of position %q", s)
+	}
+	id, err := strconv.ParseUint(s[i+1:], 10, 64)
+	if err != nil {
+		return Position{}, fmt.Errorf("invalid id of position %q", s)
+	}
+
+	return Position{Topic: s[:j], Partition: partition, ID: id}, nil
+}
+
+// String formats p as <topic>:<partition>:<id>
+func (p Position) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.Topic, p.Partition, p.ID)
+}
+
+// HistoryAfter returns the messages kept in the history of topic, or of
+// the topics matching a pattern, ordered by their creation that follow the
+// position of their topic or partition in after. Messages of topics or
+// partitions without a position are returned if they were published after
+// since. Unlike timestamps, positions resume exactly after the last message
+// received even if messages were created at the same time.
+func (mb *MessageBus) HistoryAfter(topic string, since time.Time, after []Position) []Message {
+	type source struct {
+		topic     string
+		partition int
+	}
+	positions := make(map[source]uint64, len(after))
+	for _, p := range after {
+		positions[source{p.Topic, p.Partition}] = p.ID
+	}
+	follows := func(message Message) bool {
+		if id, ok := positions[source{message.Topic.Name, message.Partition}]; ok {
+			return message.ID > id
+		}
+		return message.Created.After(since)
+	}
+
+	mb.RLock()
+	defer mb.RUnlock()
+
+	var messages []Message
+	for t, h := range mb.history {
+		if !MatchTopic(topic, t.Name) {
+			continue
+		}
+		for _, message := range h {
+			if follows(message) {
+				messages = append(messages, message)
+			}
+		}
+	}
+	for _, t := range mb.topics {
+		if t.partitions == nil || !MatchTopic(topic, t.Name) {
+			continue
+		}
+		for _, p := range t.partitions {
+			p.Lock()
+			for _, message := range p.history {
+				if follows(message) {
+					messages = append(messages, message)
+				}
+			}
+			p.Unlock()
+		}
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Created.Before(messages[j].Created)
+	})
+
+	return messages
+}
+
+// TopicSnapshot is the state of a topic and the messages of its queue, or
+// of the queues of its partitions
+type TopicSnapshot struct {
+	Topic    Topic     `json:"topic"`
+	Messages []Message `json:"messages,omitempty"`
+
+	// Sequences are the sequences of the partitions of a partitioned topic
+	Sequences []uint64 `json:"sequences,omitempty"`
+
+	// Latest are the latest messages of each key of a compacted topic
+	Latest []Message `json:"latest,omitempty"`
+
+	// Retained is the retained message of the topic, if any
+	Retained *Message `json:"retained,omitempty"`
+
+	// Dedup are the messages remembered by the dedup window of the topic
+	// with their idempotency keys, oldest first
+	Dedup []DedupEntry `json:"dedup,omitempty"`
+}
+
+// Snapshot returns the state of all topics and their queues ordered by
+// topic name, e.g: to replicate the bus
+func (mb *MessageBus) Snapshot() []TopicSnapshot {
+	mb.RLock()
+	defer mb.RUnlock()
+
+	mb.retainedMu.RLock()
+	defer mb.retainedMu.RUnlock()
+
+	snapshot := make([]TopicSnapshot, 0, len(mb.topics))
+	for _, t := range mb.topics {
+		topic := t.Copy()
+		ts := TopicSnapshot{Topic: *topic}
+		if q, ok := mb.queues[t]; ok {
+			for _, m := range q.Items() {
+				ts.Messages = append(ts.Messages, m.(Message))
+			}
+		}
+		for _, p := range t.partitions {
+			p.Lock()
+			ts.Sequences = append(ts.Sequences, p.sequence)
+			for _, m := range p.queue.Items() {
+				ts.Messages = append(ts.Messages, m.(Message))
+			}
+			p.Unlock()
+		}
+		if t.compaction != nil {
+			ts.Latest = t.compaction.latest()
+		}
+		if message, ok := mb.retained[t.Name]; ok {
+			ts.Retained = &message
+		}
+		if t.dedup != nil {
+			ts.Dedup = t.dedup.snapshot()
+		}
+
+		// The messages refer to the copy of their topic, so the snapshot can
+		// be serialized while messages are published to it
+		for i := range ts.Messages {
+			ts.Messages[i].Topic = topic
+		}
+		for i := range ts.Latest {
+			ts.Latest[i].Topic = topic
+		}
+		if ts.Retained != nil {
+			ts.Retained.Topic = topic
+		}
+		for i := range ts.Dedup {
+			ts.Dedup[i].Message.Topic = topic
+		}
+		snapshot = append(snapshot, ts)
+	}
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].Topic.Name < snapshot[j].Topic.Name
+	})
+
+	return snapshot
+}
+
+// Restore replaces the sequences and queues of all topics with those of a
+// snapshot. Topics not in the snapshot are emptied and their sequences
+// reset, subscribers are kept.
+func (mb *MessageBus) Restore(snapshot []TopicSnapshot) {
+	mb.Lock()
+	defer mb.Unlock()
+
+	mb.retainedMu.Lock()
+	defer mb.retainedMu.Unlock()
+
+	for _, t := range mb.topics {
+		atomic.StoreUint64(&t.Sequence, 0)
+		mb.resetQueue(t)
+		mb.resetPartitions(t)
+		if t.compaction != nil {
+			t.compaction.reset(nil)
+		}
+		if t.dedup != nil {
+			t.dedup.reset(nil)
+		}
+	}
+	mb.retained = make(map[string]Message)
+
+	for _, ts := range snapshot {
+		t, ok := mb.topics[ts.Topic.Name]
+		if !ok {
+			t = &Topic{Name: ts.Topic.Name, dedup: newDedup()}
+			mb.topics[t.Name] = t
+		}
+		atomic.StoreUint64(&t.Sequence, ts.Topic.Sequence)
+		t.Created = ts.Topic.Created
+		mb.restoreCompaction(t, ts)
+		mb.restoreDedup(t, ts)
+		if ts.Retained != nil {
+			message := *ts.Retained
+			message.Topic = t
+			mb.retained[t.Name] = message
+		}
+
+		if len(ts.Sequences) > 0 {
+			mb.restorePartitions(t, ts)
+			continue
+		}
+		t.Partitions, t.partitions = 0, nil
+
+		if len(ts.Messages) == 0 {
+			continue
+		}
+
+		q := NewQueue(mb.limits(t.Name).MaxQueueSize)
+		size := 0
+		for _, message := range ts.Messages {
+			message.Topic = t
+			q.Push(message)
+			size += len(message.Payload)
+		}
+		mb.queues[t] = q
+
+		if mb.metrics != nil {
+			label := mb.topicLabels.Label(t.Name)
+			mb.metrics.GaugeVec("queue", "len").WithLabelValues(label).Add(float64(q.Len()))
+			mb.metrics.GaugeVec("queue", "size").WithLabelValues(label).Add(float64(size))
+		}
+	}
+}
+
+// restoreCompaction replaces the latest messages of t with those of ts if
+// ts is compacted, the caller must hold the lock
+func (mb *MessageBus) restoreCompaction(t *Topic, ts TopicSnapshot) {
+	t.Compacted = ts.Topic.Compacted
+	if !t.Compacted {
+		t.compaction = nil
+		return
+	}
+
+	if t.compaction == nil {
+		t.compaction = newCompaction()
+	}
+
+	latest := make([]Message, len(ts.Latest))
+	for i, message := range ts.Latest {
+		message.Topic = t
+		latest[i] = message
+	}
+	t.compaction.reset(latest)
+}
+
+// restoreDedup replaces the messages remembered by the dedup window of t
+// with those of ts, the caller must hold the lock
+func (mb *MessageBus) restoreDedup(t *Topic, ts TopicSnapshot) {
+	if t.dedup == nil {
+		t.dedup = newDedup()
+	}
+
+	entries := make([]DedupEntry, len(ts.Dedup))
+	for i, e := range ts.Dedup {
+		e.Message.Topic = t
+		entries[i] = e
+	}
+	t.dedup.reset(entries)
+}
+
+// resetQueue removes the queue of t, the caller must hold the lock
+func (mb *MessageBus) resetQueue(t *Topic) {
+	q, ok := mb.queues[t]
+	if !ok {
+		return
+	}
+	delete(mb.queues, t)
+	delete(mb.history, t)
+
+	if mb.metrics != nil {
+		size := 0
+		for _, m := range q.Items() {
+			size += len(m.(Message).Payload)
+		}
+		label := mb.topicLabels.Label(t.Name)
+		mb.metrics.GaugeVec("queue", "len").WithLabelValues(label).Sub(float64(q.Len()))
+		mb.metrics.GaugeVec("queue", "size").WithLabelValues(label).Sub(float64(size))
+	}
+}
+
+// resetPartitions empties the partitions of t and resets their sequences,
+// the caller must hold the lock
+func (mb *MessageBus) resetPartitions(t *Topic) {
+	for _, p := range t.partitions {
+		p.Lock()
+		size := 0
+		items := p.queue.Items()
+		for _, m := range items {
+			size += len(m.(Message).Payload)
+		}
+		p.sequence = 0
+		p.queue = NewQueue(p.queue.MaxLen())
+		p.history = nil
+		p.Unlock()
+
+		if mb.metrics != nil {
+			label := mb.topicLabels.Label(t.Name)
+			mb.metrics.GaugeVec("queue", "len").WithLabelValues(label).Sub(float64(len(items)))
+			mb.metrics.GaugeVec("queue", "size").WithLabelValues(label).Sub(float64(size))
+		}
+	}
+}
+
+// restorePartitions replaces the partitions of t with those of ts, the
+// caller must hold the lock
+func (mb *MessageBus) restorePartitions(t *Topic, ts TopicSnapshot) {
+	if len(t.partitions) != len(ts.Sequences) {
+		t.Partitions = len(ts.Sequences)
+		t.partitions = newPartitions(t.Partitions, mb.limits(t.Name).MaxQueueSize)
+	}
+
+	for i, seq := range ts.Sequences {
+		t.partitions[i].sequence = seq
+	}
+
+	size := 0
+	for _, message := range ts.Messages {
+		p := t.partition(message.Partition)
+		if p == nil {
+			continue
+		}
+		message.Topic = t
+		p.queue.Push(message)
+		size += len(message.Payload)
+	}
+
+	if mb.metrics != nil {
+		label := mb.topicLabels.Label(t.Name)
+		mb.metrics.GaugeVec("queue", "len").WithLabelValues(label).Add(float64(len(ts.Messages)))
+		mb.metrics.GaugeVec("queue", "size").WithLabelValues(label).Add(float64(size))
+	}
+}
+
+// Requeue puts message back on the queue of its topic, e.g: after a
+// subscriber rejected it, so it can be pulled again. Subscribers are not
+// notified again.
+func (mb *MessageBus) Requeue(message Message) {
+	if p := message.Topic.partition(message.Partition); p != nil {
+		mb.requeuePartition(p, message)
+		return
+	}
+
+	mb.Lock()
+	defer mb.Unlock()
+
+	log.Debugf(
+		"[msgbus] REQUEUE id=%d topic=%s size=%d",
+		message.ID, message.Topic.Name, len(message.Payload),
+	)
+
+	t := message.Topic
+	q, ok := mb.queues[t]
+	if !ok {
+		q = NewQueue(mb.limits(t.Name).MaxQueueSize)
+		mb.queues[message.Topic] = q
+	}
+	evicted := q.Push(message)
+
+	mb.observeQueued(message, evicted)
+}
+
+// Get pulls the next message of t, of any of its partitions if t is
+// partitioned
+func (mb *MessageBus) Get(t *Topic) (Message, bool) {
+	if t.partitions != nil {
+		return mb.getPartitioned(t)
+	}
+
+	mb.RLock()
+	defer mb.RUnlock()
+
+	log.Debugf("[msgbus] GET topic=%s", t)
+
+	q, ok := mb.queues[t]
+	if !ok {
+		return Message{}, false
+	}
+
+	m := q.Pop()
+	if m == nil {
+		return Message{}, false
+	}
+
+	message := m.(Message)
+	mb.observeGet(message)
+
+	return message, true
+}
+
+// observeGet records the metrics of a message fetched from its queue
+func (mb *MessageBus) observeGet(message Message) {
+	if mb.metrics == nil {
+		return
+	}
+
+	label := mb.topicLabels.Label(message.Topic.Name)
+	size := float64(len(message.Payload))
+
+	mb.metrics.Counter("bus", "fetched").Inc()
+	mb.metrics.CounterVec("topic", "fetched").WithLabelValues(label).Inc()
+	mb.metrics.GaugeVec("queue", "len").WithLabelValues(label).Dec()
+	mb.metrics.GaugeVec("queue", "size").WithLabelValues(label).Sub(size)
+	mb.observeDelivery(label, message)
+}
+
+// observeDelivery records the bytes out and latency of a message that was
+// delivered to a subscriber or fetched, the caller must check metrics are
+// enabled.
+func (mb *MessageBus) observeDelivery(label string, message Message) {
+	mb.metrics.CounterVec("topic", "bytes_out").WithLabelValues(label).Add(
+		float64(len(message.Payload)),
+	)
+
+	if !message.Created.IsZero() {
+		mb.metrics.HistogramVec("topic", "latency_seconds").WithLabelValues(label).Observe(
+			time.Since(message.Created).Seconds(),
+		)
+	}
+}
+
+// publish notifies the subscribers of message, returning the number
+// notified
+func (mb *MessageBus) publish(message Message) int {
+	log.Debugf(
+		"[msgbus] publish id=%d topic=%s size=%d",
+		message.ID, message.Topic.Name, len(message.Payload),
+	)
+
+	delivered := 0
+	if ls, ok := mb.listeners[message.Topic]; ok {
+		delivered += mb.notify(ls, message)
+	}
+
+	for _, g := range mb.groups[message.Topic] {
+		if mb.notifyGroup(g, message) {
+			delivered++
+		}
+	}
+
+	for pattern, ls := range mb.patterns {
+		if MatchTopic(pattern, message.Topic.Name) {
+			delivered += mb.notify(ls, message)
+		}
+	}
+
+	return delivered
+}
+
+// notify notifies the listeners of message, returning the number notified
+func (mb *MessageBus) notify(ls *Listeners, message Message) int {
+	n := ls.NotifyAll(message)
+	if dropped := ls.Length() - n; dropped > 0 {
+		log.Warnf("%d/%d subscribers notified", n, ls.Length())
+		if mb.metrics != nil {
+			label := mb.topicLabels.Label(message.Topic.Name)
+			mb.metrics.Counter("bus", "dropped").Add(float64(dropped))
+			mb.metrics.CounterVec("topic", "dropped").WithLabelValues(label).Add(float64(dropped))
+		}
+	}
+	return n
+}
+
+// Subscribe ...
+func (mb *MessageBus) Subscribe(id, topic string) chan Message {
+	mb.Lock()
+	defer mb.Unlock()
+
+	log.Debugf("[msgbus] Subscribe id=%s topic=%s", id, topic)
+
+	t, ok := mb.topics[topic]
+	if !ok {
+		t = mb.newTopic(topic)
+	}
+
+	ls, ok := mb.listeners[t]
+	if !ok {
+		ls = NewListeners(&ListenerOptions{
+			BufferLength: mb.limits(topic).BufferLength,
+		})
+		mb.listeners[t] = ls
+	}
+
+	if ls.Exists(id) {
+		// Already verified the listener exists
+		ch, _ := ls.Get(id)
+		return ch
+	}
+
+	if mb.metrics != nil {
+		label := mb.topicLabels.Label(topic)
+		mb.metrics.Gauge("bus", "subscribers").Inc()
+		mb.metrics.GaugeVec("topic", "subscribers").WithLabelValues(label).Inc()
+	}
+
+	return ls.Add(id)
+}
+
+// Unsubscribe ...
+func (mb *MessageBus) Unsubscribe(id, topic string) {
+	mb.Lock()
+	defer mb.Unlock()
+
+	log.Debugf("[msgbus] Unsubscribe id=%s topic=%s", id, topic)
+
+	t, ok := mb.topics[topic]
+	if !ok {
+		return
+	}
+
+	ls, ok := mb.listeners[t]
+	if !ok {
+		return
+	}
+
+	if ls.Exists(id) {
+		// Already verified the listener exists
+		ls.Remove(id)
+
+		if mb.metrics != nil {
+			label := mb.topicLabels.Label(topic)
+			mb.metrics.Gauge("bus", "subscribers").Dec()
+			mb.metrics.GaugeVec("topic", "subscribers").WithLabelValues(label).Dec()
+		}
+	}
+}
+
+// SubscribePattern subscribes to all current and future topics matching
+// pattern (see MatchTopic). A pattern without wildcards matches only the
+// topic of the same name.
+func (mb *MessageBus) SubscribePattern(id, pattern string) chan Message {
+	mb.Lock()
+	defer mb.Unlock()
+
+	log.Debugf("[msgbus] SubscribePattern id=%s pattern=%s", id, pattern)
+
+	ls, ok := mb.patterns[pattern]
+	if !ok {
+		ls = NewListeners(&ListenerOptions{BufferLength: mb.bufferLength})
+		mb.patterns[pattern] = ls
+	}
+
+	if ls.Exists(id) {
+		// Already verified the listener exists
+		ch, _ := ls.Get(id)
+		return ch
+	}
+
+	if mb.metrics != nil {
+		mb.metrics.Gauge("bus", "subscribers").Inc()
+	}
+
+	return ls.Add(id)
+}
+
+// UnsubscribePattern ...
+func (mb *MessageBus) UnsubscribePattern(id, pattern string) {
+	mb.Lock()
+	defer mb.Unlock()
+
+	log.Debugf("[msgbus] UnsubscribePattern id=%s pattern=%s", id, pattern)
+
+	ls, ok := mb.patterns[pattern]
+	if !ok {
+		return
+	}
+
+	if ls.Exists(id) {
+		// Already verified the listener exists
+		ls.Remove(id)
+
+		if ls.Length() == 0 {
+			delete(mb.patterns, pattern)
+		}
+
+		if mb.metrics != nil {
+			mb.metrics.Gauge("bus", "subscribers").Dec()
+		}
+	}
+}
+
+// HandleSubprotocol registers handler to serve websocket connections, on
+// any path, that negotiate the subprotocol name, e.g: "v12.stomp".
+// Connections without a registered subprotocol subscribe to the topic of
+// their path as before.
+func (mb *MessageBus) HandleSubprotocol(name string, handler SubprotocolHandler) {
+	mb.Lock()
+	defer mb.Unlock()
+
+	mb.subprotocols[name] = handler
+}
+
+// subprotocol returns the first subprotocol requested by r that has a
+// registered handler, if any.
+func (mb *MessageBus) subprotocol(r *http.Request) (string, SubprotocolHandler) {
+	mb.RLock()
+	defer mb.RUnlock()
+
+	for _, name := range websocket.Subprotocols(r) {
+		if handler, ok := mb.subprotocols[name]; ok {
+			return name, handler
+		}
+	}
+
+	return "", nil
+}
+
+func (mb *MessageBus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if mb.metrics != nil {
+			mb.metrics.Counter("server", "requests").Inc()
+		}
+	}()
+
+	if r.Method == "GET" && websocket.IsWebSocketUpgrade(r) {
+		if name, handler := mb.subprotocol(r); handler != nil {
+			ctx := WithRemoteAddr(r.Context(), r.RemoteAddr)
+
+			u := upgrader
+			u.Subprotocols = []string{name}
+			conn, err := u.Upgrade(w, r, nil)
+			if err != nil {
+				log.Errorf("error creating %s websocket client: %s", name, err)
+				return
+			}
+
+			handler(ctx, conn)
+			return
+		}
+	}
 
 	if r.Method == "GET" && (r.URL.Path == "/" || r.URL.Path == "") {
-		// XXX: guard with a mutex?
-		out, err := json.Marshal(mb.topics)
+		mb.RLock()
+		topics := make(map[string]*Topic, len(mb.topics))
+		for name, t := range mb.topics {
+			topics[name] = t.Copy()
+		}
+		mb.RUnlock()
+
+		out, err := json.Marshal(topics)
 		if err != nil {
 			msg := fmt.Sprintf("error serializing topics: %s", err)
 			http.Error(w, msg, http.StatusInternalServerError)
@@ -507,15 +1685,65 @@ func (mb *MessageBus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.URL.Path == BatchPath || r.URL.Path == TransactionPath {
+		if r.Method != "POST" && r.Method != "PUT" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Path == TransactionPath {
+			mb.serveTransaction(w, r)
+		} else {
+			mb.serveBatch(w, r, "")
+		}
+		return
+	}
+
 	topic := strings.TrimLeft(r.URL.Path, "/")
 	topic = strings.TrimRight(topic, "/")
 
-	t := mb.NewTopic(topic)
+	ctx := WithRemoteAddr(r.Context(), r.RemoteAddr)
+
+	// Websocket subscriptions to a pattern don't create a topic
+	var t *Topic
+	if r.Method == "GET" && IsPattern(topic) && websocket.IsWebSocketUpgrade(r) {
+		t = &Topic{Name: topic}
+	} else {
+		t = mb.NewTopic(topic)
+	}
 
 	switch r.Method {
 	case "POST", "PUT":
-		if r.ContentLength > int64(mb.maxPayloadSize) {
+		if IsBatch(r) {
+			mb.serveBatch(w, r, topic)
+			return
+		}
+
+		key := r.URL.Query().Get("key")
+
+		retain, err := ParseRetain(r.URL.Query().Get("retain"), r.Header.Get(RetainHeader))
+		if err != nil {
+			msg := fmt.Sprintf("invalid retain: %s", err)
+			mb.Audit(ctx, AuditEvent{
+				Action: AuditPublish, Result: AuditRejected, Topic: topic, Detail: msg,
+			})
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		idempotencyKey := r.Header.Get(IdempotencyKeyHeader)
+		if original, ok := mb.Published(t, idempotencyKey); ok {
+			mb.duplicate(ctx, w, original)
+			return
+		}
+
+		maxPayloadSize := mb.TopicOptions(topic).MaxPayloadSize
+
+		if r.ContentLength > int64(maxPayloadSize) {
 			msg := "payload exceeds max-payload-size"
+			mb.Audit(ctx, AuditEvent{
+				Action: AuditPublish, Result: AuditRejected, Topic: topic,
+				Size: int(r.ContentLength), Detail: msg,
+			})
 			http.Error(w, msg, http.StatusRequestEntityTooLarge)
 			return
 		}
@@ -523,49 +1751,180 @@ func (mb *MessageBus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			msg := fmt.Sprintf("error reading payload: %s", err)
+			mb.Audit(ctx, AuditEvent{
+				Action: AuditPublish, Result: AuditError, Topic: topic, Detail: msg,
+			})
 			http.Error(w, msg, http.StatusBadRequest)
 			return
 		}
-		if len(body) > mb.maxPayloadSize {
+		if len(body) > maxPayloadSize {
 			msg := "payload exceeds max-payload-size"
+			mb.Audit(ctx, AuditEvent{
+				Action: AuditPublish, Result: AuditRejected, Topic: topic,
+				Size: len(body), Detail: msg,
+			})
 			http.Error(w, msg, http.StatusRequestEntityTooLarge)
 			return
 		}
 
-		mb.Put(mb.NewMessage(t, body))
+		var headers map[string]string
+		for k, vs := range r.Header {
+			if strings.HasPrefix(k, HeaderPrefix) && len(vs) > 0 {
+				if headers == nil {
+					headers = make(map[string]string)
+				}
+				headers[strings.ToLower(k)] = vs[0]
+			}
+		}
+		// The key is looked up again as the message is put, a concurrent
+		// publish with the same key may have been published since
+		message, result, err := mb.PutMessage(
+			propagator.Extract(ctx, propagation.HeaderCarrier(r.Header)),
+			Publishing{
+				Topic: topic, Key: key, Payload: body, Headers: headers,
+				IdempotencyKey: idempotencyKey, Retain: retain,
+			},
+		)
+		if err != nil {
+			mb.Audit(ctx, AuditEvent{
+				Action: AuditPublish, Result: AuditRejected, Topic: topic,
+				Size: len(body), Detail: err.Error(),
+			})
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if result.Duplicate {
+			mb.duplicate(ctx, w, message)
+			return
+		}
+		mb.Audit(ctx, AuditEvent{Action: AuditPublish, Result: AuditOK}.WithMessage(message))
 
-		w.WriteHeader(http.StatusAccepted)
+		WritePublishResult(w, result)
 	case "GET":
+		partition := -1
+		if v := r.URL.Query().Get("partition"); v != "" {
+			var err error
+			if partition, err = ParsePartition(t, v); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
 		if r.Header.Get("Upgrade") == "websocket" {
-			conn, err := upgrader.Upgrade(w, r, nil)
+			var since time.Time
+			if v := r.URL.Query().Get("since"); v != "" {
+				var err error
+				if since, err = time.Parse(time.RFC3339Nano, v); err != nil {
+					http.Error(w, fmt.Sprintf("invalid since %q: %s", v, err), http.StatusBadRequest)
+					return
+				}
+			}
+
+			var after []Position
+			for _, v := range r.URL.Query()["after"] {
+				p, err := ParsePosition(v)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				after = append(after, p)
+			}
+
+			group := r.URL.Query().Get("group")
+			if group != "" && IsPattern(topic) {
+				http.Error(w, "consumer groups cannot subscribe to patterns", http.StatusBadRequest)
+				return
+			}
+
+			mb.RLock()
+			header := http.Header{HistoryLengthHeader: {strconv.Itoa(mb.historyLength)}}
+			mb.RUnlock()
+
+			conn, err := upgrader.Upgrade(w, r, header)
 			if err != nil {
 				log.Errorf("error creating websocket client: %s", err)
+				mb.Audit(ctx, AuditEvent{
+					Action: AuditSubscribe, Result: AuditError, Topic: topic,
+					Detail: err.Error(),
+				})
 				return
 			}
 
-			NewClient(conn, t, mb).Start()
+			c := NewClient(conn, t, mb)
+			c.ctx = ctx
+			c.since = since
+			c.after = after
+			c.group = group
+			c.partition = partition
+			c.Start()
 			return
 		}
 
-		message, ok := mb.Get(t)
+		var (
+			message Message
+			ok      bool
+		)
+		if partition >= 0 {
+			message, ok = mb.GetPartition(t, partition)
+		} else {
+			message, ok = mb.Get(t)
+		}
 
 		if !ok {
 			msg := fmt.Sprintf("no messages enqueued for topic: %s", topic)
+			mb.Audit(ctx, AuditEvent{Action: AuditPull, Result: AuditEmpty, Topic: topic})
 			http.Error(w, msg, http.StatusNotFound)
 			return
 		}
 
+		mb.Audit(ctx, AuditEvent{Action: AuditPull, Result: AuditOK}.WithMessage(message))
+
+		// Link the delivery to the trace of the pulling request, if any
+		var links []trace.Link
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			links = append(links, trace.Link{SpanContext: sc})
+		}
+
+		message, span := mb.traceDelivery(context.Background(), message, "pull", links...)
+		message.Topic = message.Topic.Copy()
+
 		out, err := json.Marshal(message)
 		if err != nil {
+			endSpan(span, err)
 			msg := fmt.Sprintf("error serializing message: %s", err)
 			http.Error(w, msg, http.StatusInternalServerError)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		propagator.Inject(
+			trace.ContextWithSpan(r.Context(), span),
+			propagation.HeaderCarrier(w.Header()),
+		)
 		w.Header().Set("Content-Type", "application/json")
-		w.Write(out)
+		w.WriteHeader(http.StatusOK)
+		_, err = w.Write(out)
+		endSpan(span, err)
 	case "DELETE":
+		if _, ok := r.URL.Query()["retained"]; ok {
+			if !mb.ClearRetained(topic) {
+				mb.Audit(ctx, AuditEvent{
+					Action: AuditDelete, Result: AuditEmpty, Topic: topic, Detail: "retained",
+				})
+				http.Error(w, fmt.Sprintf("no retained message for topic: %s", topic), http.StatusNotFound)
+				return
+			}
+			mb.Audit(ctx, AuditEvent{
+				Action: AuditDelete, Result: AuditOK, Topic: topic, Detail: "retained",
+			})
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		mb.Audit(ctx, AuditEvent{
+			Action: AuditDelete, Result: AuditRejected, Topic: topic,
+			Detail: "not implemented",
+		})
 		http.Error(w, "Not Implemented", http.StatusNotImplemented)
 		// TODO: Implement deleting topics
 	}
@@ -576,18 +1935,50 @@ type Client struct {
 	conn  *websocket.Conn
 	topic *Topic
 	bus   *MessageBus
+	ctx   context.Context
 
 	id string
 	ch chan Message
+
+	// since and after resume the subscription with the messages of the
+	// history that follow them, which are sent before live messages
+	since   time.Time
+	after   []Position
+	backlog []Message
+
+	// group is the consumer group the client is a member of, if any, and
+	// partition the only partition it receives, if not negative
+	group     string
+	partition int
+
+	unsubscribe sync.Once
 }
 
 // NewClient ...
 func NewClient(conn *websocket.Conn, topic *Topic, bus *MessageBus) *Client {
-	return &Client{conn: conn, topic: topic, bus: bus}
+	return &Client{conn: conn, topic: topic, bus: bus, ctx: context.Background(), partition: -1}
+}
+
+// Unsubscribe removes the client from the bus once
+func (c *Client) Unsubscribe() {
+	c.unsubscribe.Do(func() {
+		switch {
+		case c.group != "":
+			c.bus.UnsubscribeGroup(c.id, c.topic.Name, c.group)
+		case IsPattern(c.topic.Name):
+			c.bus.UnsubscribePattern(c.id, c.topic.Name)
+		default:
+			c.bus.Unsubscribe(c.id, c.topic.Name)
+		}
+		c.bus.Audit(c.ctx, AuditEvent{
+			Action: AuditUnsubscribe, Result: AuditOK, Topic: c.topic.Name,
+		})
+	})
 }
 
 func (c *Client) readPump() {
 	defer func() {
+		c.Unsubscribe()
 		c.conn.Close()
 	}()
 
@@ -617,12 +2008,11 @@ func (c *Client) readPump() {
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure) {
 				log.Errorf("unexpected close error from %s: %s", c.id, err)
-				c.bus.Unsubscribe(c.id, c.topic.Name)
 			}
 			log.Errorf("error reading from %s: %s", c.id, err)
 			break
 		}
-		log.Debugf("recieved message from %s: %s", c.id, message)
+		log.Debugf("recieved message from %s: size=%d", c.id, len(message))
 	}
 }
 
@@ -633,30 +2023,58 @@ func (c *Client) writePump() {
 		c.conn.Close()
 	}()
 
-	var err error
+	// Live messages already sent from the backlog are skipped, ids are
+	// sequences of partitions for partitioned topics
+	type source struct {
+		topic     string
+		partition int
+	}
+	replayed := make(map[source]uint64)
+
+	// Members of a group only replay the partitions assigned to them
+	var assigned map[int]bool
+	if c.group != "" {
+		assigned = make(map[int]bool)
+		for _, i := range c.bus.Assignment(c.topic.Name, c.group, c.id) {
+			assigned[i] = true
+		}
+	}
+
+	for _, msg := range c.backlog {
+		if c.skip(msg) || (assigned != nil && !assigned[msg.Partition]) {
+			continue
+		}
+		c.write(msg)
+		src := source{msg.Topic.Name, msg.Partition}
+		if id, ok := replayed[src]; !ok || msg.ID > id {
+			replayed[src] = msg.ID
+		}
+	}
+	c.backlog = nil
 
 	for {
 		select {
 		case msg, ok := <-c.ch:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// The bus closed the channel.
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
-			err = c.conn.WriteJSON(msg)
-			if err != nil {
-				// TODO: Retry? Put the message back in the queue?
-				log.Errorf("Error sending msg to %s: %s", c.id, err)
-				if c.bus.metrics != nil {
-					c.bus.metrics.Counter("client", "errors").Inc()
-				}
-			} else {
-				if c.bus.metrics != nil {
-					c.bus.metrics.Counter("bus", "delivered").Inc()
+			if c.skip(msg) {
+				continue
+			}
+
+			src := source{msg.Topic.Name, msg.Partition}
+			if id, ok := replayed[src]; ok {
+				if msg.ID <= id {
+					continue
 				}
+				delete(replayed, src)
 			}
+
+			c.write(msg)
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			t := time.Now()
@@ -669,14 +2087,78 @@ func (c *Client) writePump() {
 	}
 }
 
+// backlogged returns true if msg is already in the backlog
+func (c *Client) backlogged(msg Message) bool {
+	for _, m := range c.backlog {
+		if m.Topic.Name == msg.Topic.Name && m.Partition == msg.Partition && m.ID == msg.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// skip returns true if msg is not of the partition the client receives
+func (c *Client) skip(msg Message) bool {
+	return c.partition >= 0 && msg.Partition != c.partition
+}
+
+// write sends msg to the client
+func (c *Client) write(msg Message) {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+
+	var span trace.Span
+	msg, span = c.bus.traceDelivery(context.Background(), msg, "websocket")
+	msg.Topic = msg.Topic.Copy()
+
+	err := c.conn.WriteJSON(msg)
+	endSpan(span, err)
+	if err != nil {
+		// TODO: Retry? Put the message back in the queue?
+		log.Errorf("Error sending msg to %s: %s", c.id, err)
+		if c.bus.metrics != nil {
+			c.bus.metrics.Counter("client", "errors").Inc()
+		}
+	} else {
+		if c.bus.metrics != nil {
+			label := c.bus.topicLabels.Label(msg.Topic.Name)
+			c.bus.metrics.Counter("bus", "delivered").Inc()
+			c.bus.metrics.CounterVec("topic", "delivered").WithLabelValues(label).Inc()
+			c.bus.observeDelivery(label, msg)
+		}
+	}
+}
+
 // Start ...
 func (c *Client) Start() {
 	c.id = c.conn.RemoteAddr().String()
-	c.ch = c.bus.Subscribe(c.id, c.topic.Name)
+	switch {
+	case c.group != "":
+		c.ch = c.bus.SubscribeGroup(c.id, c.topic.Name, c.group)
+	case IsPattern(c.topic.Name):
+		c.ch = c.bus.SubscribePattern(c.id, c.topic.Name)
+	default:
+		c.ch = c.bus.Subscribe(c.id, c.topic.Name)
+	}
+	// The history, or the retained message and the latest messages of
+	// compacted topics, is loaded after subscribing so no message is missed
+	// in between, duplicates are skipped by writePump
+	if !c.since.IsZero() || len(c.after) > 0 {
+		c.backlog = c.bus.HistoryAfter(c.topic.Name, c.since, c.after)
+	} else {
+		c.backlog = c.bus.Retained(c.topic.Name)
+		for _, msg := range c.bus.Compacted(c.topic.Name) {
+			if !c.backlogged(msg) {
+				c.backlog = append(c.backlog, msg)
+			}
+		}
+	}
+	c.bus.Audit(c.ctx, AuditEvent{
+		Action: AuditSubscribe, Result: AuditOK, Topic: c.topic.Name,
+	})
 
 	c.conn.SetCloseHandler(func(code int, text string) error {
 		log.Debugf("recieved close from client %s", c.id)
-		c.bus.Unsubscribe(c.id, c.topic.Name)
+		c.Unsubscribe()
 		message := websocket.FormatCloseMessage(code, "")
 		c.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second*1))
 		return nil
@@ -8,9 +8,12 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMessageBusLen(t *testing.T) {
@@ -18,6 +21,19 @@ func TestMessageBusLen(t *testing.T) {
 	assert.Equal(t, mb.Len(), 0)
 }
 
+func TestMessageBusTopics(t *testing.T) {
+	mb := New(nil)
+	assert.Empty(t, mb.Topics())
+
+	mb.NewTopic("foo")
+	mb.NewTopic("bar")
+
+	topics := mb.Topics()
+	assert.Len(t, topics, 2)
+	assert.Equal(t, "bar", topics[0].Name)
+	assert.Equal(t, "foo", topics[1].Name)
+}
+
 func TestMessage(t *testing.T) {
 	mb := New(nil)
 	assert.Equal(t, mb.Len(), 0)
@@ -52,6 +68,22 @@ func TestMessageBusPutGet(t *testing.T) {
 	assert.Equal(t, actual, expected)
 }
 
+func TestMessageBusRequeue(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := New(nil)
+	topic := mb.NewTopic("foo")
+	ch := mb.Subscribe("test", "foo")
+
+	expected := mb.NewMessage(topic, []byte("bar"))
+	mb.Requeue(expected)
+
+	actual, ok := mb.Get(topic)
+	assert.True(ok)
+	assert.Equal(expected, actual)
+	assert.Len(ch, 0)
+}
+
 func TestServeHTTPGETEmpty(t *testing.T) {
 	assert := assert.New(t)
 
@@ -102,6 +134,29 @@ func TestServeHTTPPOST(t *testing.T) {
 
 	mb.ServeHTTP(w, r)
 	assert.Equal(w.Code, http.StatusAccepted)
+	assert.Equal("application/json", w.Header().Get("Content-Type"))
+	assert.Equal("0", w.Header().Get(IDHeader))
+
+	var result PublishResult
+	assert.NoError(json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(uint64(0), result.ID)
+	assert.Equal("hello", result.Topic)
+	assert.False(result.Created.IsZero())
+	assert.Equal(0, result.Delivered)
+
+	// Delivered counts the subscribers notified
+	ch := mb.Subscribe("a", "hello")
+	defer mb.Unsubscribe("a", "hello")
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/hello", bytes.NewBufferString("hello again"))
+	mb.ServeHTTP(w, r)
+	assert.Equal(http.StatusAccepted, w.Code)
+
+	assert.NoError(json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(uint64(1), result.ID)
+	assert.Equal(1, result.Delivered)
+	assert.Equal("hello again", string((<-ch).Payload))
 }
 
 func TestServeHTTPMaxPayloadSize(t *testing.T) {
@@ -142,6 +197,48 @@ func TestServeHTTPSimple(t *testing.T) {
 	assert.Equal(msg.Payload, []byte("hello world"))
 }
 
+func TestServeHTTPTopicMaxPayloadSize(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := New(&Options{
+		MaxPayloadSize: 4,
+		Topics: map[string]TopicOptions{
+			"big": {MaxPayloadSize: 64},
+		},
+	})
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/hello", bytes.NewBufferString("hello world"))
+	mb.ServeHTTP(w, r)
+	assert.Equal(http.StatusRequestEntityTooLarge, w.Code)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "/big", bytes.NewBufferString("hello world"))
+	mb.ServeHTTP(w, r)
+	assert.Equal(http.StatusAccepted, w.Code)
+}
+
+func TestMessageBusConfigure(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := New(nil)
+	topic := mb.NewTopic("foo")
+	mb.Put(mb.NewMessage(topic, []byte("foo")))
+
+	mb.Configure(&Options{
+		BufferLength:   1,
+		MaxQueueSize:   2,
+		MaxPayloadSize: 3,
+		Topics: map[string]TopicOptions{
+			"foo": {MaxQueueSize: 5},
+		},
+	})
+
+	assert.Equal(TopicOptions{1, 5, 3, 0, false}, mb.TopicOptions("foo"))
+	assert.Equal(TopicOptions{1, 2, 3, 0, false}, mb.TopicOptions("bar"))
+	assert.Equal(5, mb.queues[topic].MaxLen())
+}
+
 func BenchmarkServeHTTPPOST(b *testing.B) {
 	mb := New(nil)
 
@@ -199,6 +296,159 @@ func TestServeHTTPSubscriber(t *testing.T) {
 	assert.Equal(msg.Payload, []byte("hello world"))
 }
 
+func TestMessageBusHistory(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := New(&Options{HistoryLength: 2})
+	since := time.Now()
+
+	for _, topic := range []string{"a/1", "a/2", "a/1", "a/1"} {
+		mb.Put(mb.NewMessage(mb.NewTopic(topic), []byte(topic)))
+	}
+
+	history := mb.History("a/1", since)
+	assert.Len(history, 2)
+	assert.Equal(uint64(1), history[0].ID)
+	assert.Equal(uint64(2), history[1].ID)
+
+	history = mb.History("a/+", since)
+	assert.Len(history, 3)
+
+	assert.Empty(mb.History("a/1", history[2].Created))
+	assert.Empty(New(nil).History("a/1", since))
+}
+
+func TestMessageBusHistoryAfter(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := New(&Options{HistoryLength: 10})
+	created := time.Now()
+
+	for _, topic := range []string{"a/1", "a/2", "a/1", "a/1"} {
+		message := mb.NewMessage(mb.NewTopic(topic), []byte(topic))
+		message.Created = created
+		mb.Put(message)
+	}
+
+	// Messages created at the same time are resumed after the position of
+	// their topic, since applies to topics without a position
+	history := mb.HistoryAfter("a/+", created, []Position{{Topic: "a/1", ID: 1}})
+	require.Len(t, history, 1)
+	assert.Equal("a/1", history[0].Topic.Name)
+	assert.Equal(uint64(2), history[0].ID)
+
+	history = mb.HistoryAfter("a/+", created.Add(-time.Second), []Position{{Topic: "a/1", ID: 2}})
+	require.Len(t, history, 1)
+	assert.Equal("a/2", history[0].Topic.Name)
+}
+
+func TestParsePosition(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := ParsePosition("a:b/c:1:42")
+	assert.NoError(err)
+	assert.Equal(Position{Topic: "a:b/c", Partition: 1, ID: 42}, p)
+	assert.Equal("a:b/c:1:42", p.String())
+
+	for _, s := range []string{"", "a", "a:1", ":1:2", "a:x:1", "a:-1:1", "a:0:x"} {
+		_, err := ParsePosition(s)
+		assert.Error(err, s)
+	}
+}
+
+func TestMessageBusSnapshotRestore(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := New(nil)
+	for _, payload := range []string{"a", "b", "c"} {
+		mb.Put(mb.NewMessage(mb.NewTopic("foo"), []byte(payload)))
+	}
+	mb.Get(mb.NewTopic("foo"))
+	mb.NewTopic("bar")
+
+	snapshot := mb.Snapshot()
+	assert.Len(snapshot, 2)
+	assert.Equal("bar", snapshot[0].Topic.Name)
+	assert.Equal(uint64(3), snapshot[1].Topic.Sequence)
+	assert.Len(snapshot[1].Messages, 2)
+
+	other := New(nil)
+	other.Put(other.NewMessage(other.NewTopic("baz"), []byte("x")))
+	other.Restore(snapshot)
+
+	_, ok := other.Get(other.NewTopic("baz"))
+	assert.False(ok)
+	assert.Equal(uint64(0), other.NewTopic("baz").Sequence)
+
+	foo := other.NewTopic("foo")
+	assert.Equal(uint64(3), foo.Sequence)
+	for _, expected := range []string{"b", "c"} {
+		msg, ok := other.Get(foo)
+		assert.True(ok)
+		assert.Equal(expected, string(msg.Payload))
+		assert.Equal(foo, msg.Topic)
+	}
+}
+
+func TestServeHTTPHeaders(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := New(nil)
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/hello", bytes.NewBufferString("hello"))
+	r.Header.Set("Msgbus-Origin", "a")
+	r.Header.Set("X-Other", "b")
+	mb.ServeHTTP(w, r)
+	assert.Equal(http.StatusAccepted, w.Code)
+
+	msg, ok := mb.Get(mb.NewTopic("hello"))
+	assert.True(ok)
+	assert.Equal(map[string]string{"msgbus-origin": "a"}, msg.Headers)
+}
+
+func TestServeHTTPSubscriberSince(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := New(&Options{HistoryLength: 10})
+
+	s := httptest.NewServer(mb)
+	defer s.Close()
+
+	mb.Put(mb.NewMessage(mb.NewTopic("a/1"), []byte("old")))
+	since := time.Now()
+	mb.Put(mb.NewMessage(mb.NewTopic("a/1"), []byte("one")))
+	mb.Put(mb.NewMessage(mb.NewTopic("a/2"), []byte("two")))
+
+	u := fmt.Sprintf("ws%s/a/%%2B?since=%s", strings.TrimPrefix(s.URL, "http"), since.Format(time.RFC3339Nano))
+	ws, _, err := websocket.DefaultDialer.Dial(u, nil)
+	assert.NoError(err)
+	defer ws.Close()
+
+	for _, expected := range []string{"one", "two"} {
+		var msg Message
+		assert.NoError(ws.ReadJSON(&msg))
+		assert.Equal(expected, string(msg.Payload))
+	}
+
+	mb.Put(mb.NewMessage(mb.NewTopic("a/2"), []byte("three")))
+
+	var msg Message
+	assert.NoError(ws.ReadJSON(&msg))
+	assert.Equal("three", string(msg.Payload))
+
+	// Subscribing to a pattern doesn't create a topic
+	_, ok := mb.topics["a/+"]
+	assert.False(ok)
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/hello?since=yesterday", nil)
+	r.Header.Set("Connection", "upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	mb.ServeHTTP(w, r)
+	assert.Equal(http.StatusBadRequest, w.Code)
+}
+
 func TestMsgBusMetrics(t *testing.T) {
 	assert := assert.New(t)
 
@@ -210,6 +460,64 @@ func TestMsgBusMetrics(t *testing.T) {
 	assert.IsType(&Metrics{}, mb.Metrics())
 }
 
+func TestMsgBusMetricsMultiple(t *testing.T) {
+	assert := assert.New(t)
+
+	a := New(&Options{WithMetrics: true})
+	b := New(&Options{WithMetrics: true})
+	assert.NotEqual(a.Metrics().Registry(), b.Metrics().Registry())
+
+	registry := prometheus.NewRegistry()
+	c := New(&Options{
+		WithMetrics:     true,
+		MetricsRegistry: registry,
+		MetricsLabels:   map[string]string{"bus": "c"},
+	})
+	d := New(&Options{
+		WithMetrics:     true,
+		MetricsRegistry: registry,
+		MetricsLabels:   map[string]string{"bus": "d"},
+	})
+	assert.Equal(registry, c.Metrics().Registry())
+	assert.Equal(registry, d.Metrics().Registry())
+}
+
+func TestMsgBusTopicMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := New(&Options{
+		MaxQueueSize:     2,
+		WithMetrics:      true,
+		MaxMetricsTopics: 1,
+	})
+
+	foo := mb.NewTopic("foo")
+	for _, payload := range []string{"a", "bb", "ccc"} {
+		mb.Put(mb.NewMessage(foo, []byte(payload)))
+	}
+	mb.Put(mb.NewMessage(mb.NewTopic("bar"), []byte("bar")))
+	mb.Put(mb.NewMessage(mb.NewTopic("baz"), []byte("baz")))
+
+	_, ok := mb.Get(foo)
+	assert.True(ok)
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/", nil)
+	mb.Metrics().Handler().ServeHTTP(w, r)
+	body := w.Body.String()
+
+	assert.Contains(body, `msgbus_topic_published{topic="foo"} 3`)
+	assert.Contains(body, `msgbus_topic_published{topic="_other"} 2`)
+	assert.Contains(body, `msgbus_topic_bytes_in{topic="foo"} 6`)
+	assert.Contains(body, `msgbus_topic_bytes_out{topic="foo"} 2`)
+	assert.Contains(body, `msgbus_topic_fetched{topic="foo"} 1`)
+	assert.Contains(body, `msgbus_queue_evicted{topic="foo"} 1`)
+	assert.Contains(body, `msgbus_queue_len{topic="foo"} 1`)
+	assert.Contains(body, `msgbus_queue_size{topic="foo"} 3`)
+	assert.Contains(body, `msgbus_queue_oldest_age_seconds{topic="foo"}`)
+	assert.Contains(body, `msgbus_topic_latency_seconds_count{topic="foo"} 1`)
+}
+
 func BenchmarkMessageBusPut(b *testing.B) {
 	mb := New(nil)
 	topic := mb.NewTopic("foo")
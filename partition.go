@@ -0,0 +1,454 @@
+package msgbus
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// partition is one of the partitions of a partitioned topic with its own
+// sequence, queue and history, so publishes to different partitions only
+// contend for the bus read lock
+type partition struct {
+	sync.Mutex
+
+	sequence uint64
+	queue    *Queue
+	history  []Message
+}
+
+// record keeps message in the history of the partition, the caller must
+// hold its lock
+func (p *partition) record(message Message, length int) {
+	if length <= 0 {
+		p.history = nil
+		return
+	}
+
+	p.history = append(p.history, message)
+	if len(p.history) > length {
+		p.history = append(p.history[:0:0], p.history[len(p.history)-length:]...)
+	}
+}
+
+// newPartitions returns n empty partitions with queues of maxQueueSize
+func newPartitions(n, maxQueueSize int) []*partition {
+	partitions := make([]*partition, n)
+	for i := range partitions {
+		partitions[i] = &partition{queue: NewQueue(maxQueueSize)}
+	}
+	return partitions
+}
+
+// partition returns the partition i of t, or nil if t is not partitioned
+// or has no partition i
+func (t *Topic) partition(i int) *partition {
+	if i < 0 || i >= len(t.partitions) {
+		return nil
+	}
+	return t.partitions[i]
+}
+
+// PartitionFor returns which of n partitions messages with key are
+// published to, a key always maps to the same partition
+func PartitionFor(key string, n int) int {
+	if n <= 1 {
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// ParsePartition parses the partition v of t, e.g: from a query parameter.
+// A topic that is not partitioned has the single partition 0.
+func ParsePartition(t *Topic, v string) (int, error) {
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid partition %q: %s", v, err)
+	}
+
+	n := partitionCount(t)
+	if i < 0 || i >= n {
+		return 0, fmt.Errorf("invalid partition %d: topic %s has %d partitions", i, t.Name, n)
+	}
+
+	return i, nil
+}
+
+// NewMessageWithKey returns a new message of topic with key. Messages of a
+// partitioned topic are assigned the partition of their key, or the next
+// partition in turn if the key is empty, and their id is the next sequence
+// of that partition so messages of a key are ordered. Concurrent publishers
+// should use PutMessage, which assigns the id as the message is queued.
+func (mb *MessageBus) NewMessageWithKey(topic *Topic, key string, payload []byte) Message {
+	mb.RLock()
+	defer mb.RUnlock()
+
+	return mb.newMessage(topic, key, payload)
+}
+
+// newMessage returns a new message of topic with key, the caller must hold
+// at least the bus read lock. Batches hold the bus lock so they are
+// assigned contiguous sequences.
+func (mb *MessageBus) newMessage(topic *Topic, key string, payload []byte) Message {
+	if topic.partitions == nil {
+		if mb.metrics != nil {
+			mb.metrics.Counter("bus", "messages").Inc()
+		}
+
+		return Message{
+			ID:      atomic.AddUint64(&topic.Sequence, 1) - 1,
+			Topic:   topic,
+			Key:     key,
+			Payload: payload,
+			Created: time.Now(),
+		}
+	}
+
+	i := topic.partitionFor(key)
+	p := topic.partitions[i]
+	p.Lock()
+	id := p.sequence
+	p.sequence++
+	p.Unlock()
+
+	atomic.AddUint64(&topic.Sequence, 1)
+	if mb.metrics != nil {
+		mb.metrics.Counter("bus", "messages").Inc()
+	}
+
+	return Message{
+		ID:        id,
+		Topic:     topic,
+		Key:       key,
+		Partition: i,
+		Payload:   payload,
+		Created:   time.Now(),
+	}
+}
+
+// partitionFor returns the partition of t messages with key are put on,
+// the next partition in turn if key is empty
+func (t *Topic) partitionFor(key string) int {
+	if key == "" {
+		return int((atomic.AddUint32(&t.nextPut, 1) - 1) % uint32(t.Partitions))
+	}
+	return PartitionFor(key, t.Partitions)
+}
+
+// putNext puts a new message of t created when p was, assigning it the
+// next sequence of t or of its partition as it is queued, so messages are
+// queued and delivered in the order of their ids. The message is stored as
+// the retained message of t before it is published if p.Retain is set. The
+// caller must hold the bus lock, or the read lock if t is partitioned.
+func (mb *MessageBus) putNext(ctx context.Context, t *Topic, p Publishing) (Message, int) {
+	if t.partitions == nil {
+		message := mb.newMessage(t, p.Key, p.Payload)
+		message.Headers = p.Headers
+		message.Created = p.Created
+
+		span := mb.startPut(ctx, &message)
+		defer span.End()
+
+		if p.Retain {
+			mb.Retain(message)
+		}
+		return message, mb.putLocked(message)
+	}
+
+	i := t.partitionFor(p.Key)
+	part := t.partitions[i]
+
+	part.Lock()
+	defer part.Unlock()
+
+	message := Message{
+		ID:        part.sequence,
+		Topic:     t,
+		Key:       p.Key,
+		Partition: i,
+		Payload:   p.Payload,
+		Headers:   p.Headers,
+		Created:   p.Created,
+	}
+	part.sequence++
+
+	atomic.AddUint64(&t.Sequence, 1)
+	if mb.metrics != nil {
+		mb.metrics.Counter("bus", "messages").Inc()
+	}
+
+	span := mb.startPut(ctx, &message)
+	defer span.End()
+
+	if p.Retain {
+		mb.Retain(message)
+	}
+	return message, mb.putPartitionLocked(part, message)
+}
+
+// putPartition puts message on the queue of its partition, the caller must
+// hold at least the bus read lock
+func (mb *MessageBus) putPartition(p *partition, message Message) int {
+	p.Lock()
+	defer p.Unlock()
+
+	return mb.putPartitionLocked(p, message)
+}
+
+// putPartitionLocked puts message on the queue of its partition and
+// publishes it, so the messages of the partition are delivered in the
+// order they are queued. The caller must hold the partition lock and at
+// least the bus read lock.
+func (mb *MessageBus) putPartitionLocked(p *partition, message Message) int {
+	log.Debugf(
+		"[msgbus] PUT id=%d topic=%s partition=%d size=%d",
+		message.ID, message.Topic.Name, message.Partition, len(message.Payload),
+	)
+
+	evicted := p.queue.Push(message)
+	p.record(message, mb.historyLength)
+	message.Topic.compact(message)
+
+	mb.observePut(message, evicted)
+	return mb.publish(message)
+}
+
+// requeuePartition puts message back on the queue of its partition
+func (mb *MessageBus) requeuePartition(p *partition, message Message) {
+	mb.RLock()
+	defer mb.RUnlock()
+
+	log.Debugf(
+		"[msgbus] REQUEUE id=%d topic=%s partition=%d size=%d",
+		message.ID, message.Topic.Name, message.Partition, len(message.Payload),
+	)
+
+	p.Lock()
+	evicted := p.queue.Push(message)
+	p.Unlock()
+
+	mb.observeQueued(message, evicted)
+}
+
+// GetPartition pulls the next message of the partition i of t. A topic
+// that is not partitioned has the single partition 0.
+func (mb *MessageBus) GetPartition(t *Topic, i int) (Message, bool) {
+	if t.partitions == nil {
+		if i != 0 {
+			return Message{}, false
+		}
+		return mb.Get(t)
+	}
+
+	p := t.partition(i)
+	if p == nil {
+		return Message{}, false
+	}
+
+	mb.RLock()
+	defer mb.RUnlock()
+
+	log.Debugf("[msgbus] GET topic=%s partition=%d", t, i)
+
+	m := p.queue.Pop()
+	if m == nil {
+		return Message{}, false
+	}
+
+	message := m.(Message)
+	mb.observeGet(message)
+
+	return message, true
+}
+
+// getPartitioned pulls the next message of any partition of t, starting
+// with the next partition in turn so all partitions are drained
+func (mb *MessageBus) getPartitioned(t *Topic) (Message, bool) {
+	start := int((atomic.AddUint32(&t.nextGet, 1) - 1) % uint32(t.Partitions))
+	for i := 0; i < t.Partitions; i++ {
+		if message, ok := mb.GetPartition(t, (start+i)%t.Partitions); ok {
+			return message, true
+		}
+	}
+	return Message{}, false
+}
+
+// group is a consumer group of a topic: each partition of the topic is
+// delivered to a single member, and partitions are rebalanced across the
+// members as they join and leave
+type group struct {
+	*Listeners
+
+	// owners are the members owning each partition
+	owners []string
+}
+
+// rebalance assigns the partitions of the topic to the members in turn,
+// ordered by id so the assignment only depends on the members
+func (g *group) rebalance(partitions int) {
+	g.RLock()
+	members := make([]string, 0, len(g.ids))
+	for id := range g.ids {
+		members = append(members, id)
+	}
+	g.RUnlock()
+	sort.Strings(members)
+
+	g.owners = nil
+	if len(members) == 0 {
+		return
+	}
+
+	g.owners = make([]string, partitions)
+	for i := range g.owners {
+		g.owners[i] = members[i%len(members)]
+	}
+}
+
+// notifyGroup sends message to the member of g owning its partition,
+// returning false if it could not be delivered
+func (mb *MessageBus) notifyGroup(g *group, message Message) bool {
+	if len(g.owners) == 0 {
+		return false
+	}
+
+	owner := g.owners[message.Partition%len(g.owners)]
+	if g.Notify(owner, message) {
+		return true
+	}
+
+	log.Warnf("cannot publish message %d to %s", message.ID, owner)
+	if mb.metrics != nil {
+		label := mb.topicLabels.Label(message.Topic.Name)
+		mb.metrics.Counter("bus", "dropped").Inc()
+		mb.metrics.CounterVec("topic", "dropped").WithLabelValues(label).Inc()
+	}
+	return false
+}
+
+// partitionCount returns the number of partitions of t, one if t is not
+// partitioned
+func partitionCount(t *Topic) int {
+	if t.Partitions > 1 {
+		return t.Partitions
+	}
+	return 1
+}
+
+// SubscribeGroup subscribes id to topic as a member of the consumer group
+// name. Each message is delivered to only one member of the group, the
+// member its partition is assigned to, so the messages of a key are
+// handled in order by a single member. Partitions are rebalanced when
+// members join or leave.
+func (mb *MessageBus) SubscribeGroup(id, topic, name string) chan Message {
+	mb.Lock()
+	defer mb.Unlock()
+
+	log.Debugf("[msgbus] SubscribeGroup id=%s topic=%s group=%s", id, topic, name)
+
+	t, ok := mb.topics[topic]
+	if !ok {
+		t = mb.newTopic(topic)
+	}
+
+	groups, ok := mb.groups[t]
+	if !ok {
+		groups = make(map[string]*group)
+		mb.groups[t] = groups
+	}
+
+	g, ok := groups[name]
+	if !ok {
+		g = &group{Listeners: NewListeners(&ListenerOptions{
+			BufferLength: mb.limits(topic).BufferLength,
+		})}
+		groups[name] = g
+	}
+
+	if ch, ok := g.Get(id); ok {
+		return ch
+	}
+
+	ch := g.Add(id)
+	g.rebalance(partitionCount(t))
+	log.Infof("rebalanced group %s of %s: %d members", name, topic, g.Length())
+
+	if mb.metrics != nil {
+		label := mb.topicLabels.Label(topic)
+		mb.metrics.Gauge("bus", "subscribers").Inc()
+		mb.metrics.GaugeVec("topic", "subscribers").WithLabelValues(label).Inc()
+	}
+
+	return ch
+}
+
+// UnsubscribeGroup removes id from the consumer group name of topic, its
+// partitions are rebalanced to the remaining members
+func (mb *MessageBus) UnsubscribeGroup(id, topic, name string) {
+	mb.Lock()
+	defer mb.Unlock()
+
+	log.Debugf("[msgbus] UnsubscribeGroup id=%s topic=%s group=%s", id, topic, name)
+
+	t, ok := mb.topics[topic]
+	if !ok {
+		return
+	}
+
+	g, ok := mb.groups[t][name]
+	if !ok || !g.Exists(id) {
+		return
+	}
+
+	g.Remove(id)
+	g.rebalance(partitionCount(t))
+	log.Infof("rebalanced group %s of %s: %d members", name, topic, g.Length())
+
+	if g.Length() == 0 {
+		delete(mb.groups[t], name)
+		if len(mb.groups[t]) == 0 {
+			delete(mb.groups, t)
+		}
+	}
+
+	if mb.metrics != nil {
+		label := mb.topicLabels.Label(topic)
+		mb.metrics.Gauge("bus", "subscribers").Dec()
+		mb.metrics.GaugeVec("topic", "subscribers").WithLabelValues(label).Dec()
+	}
+}
+
+// Assignment returns the partitions of topic currently assigned to the
+// member id of the consumer group name
+func (mb *MessageBus) Assignment(topic, name, id string) []int {
+	mb.RLock()
+	defer mb.RUnlock()
+
+	t, ok := mb.topics[topic]
+	if !ok {
+		return nil
+	}
+
+	g, ok := mb.groups[t][name]
+	if !ok {
+		return nil
+	}
+
+	var assigned []int
+	for i, owner := range g.owners {
+		if owner == id {
+			assigned = append(assigned, i)
+		}
+	}
+	return assigned
+}
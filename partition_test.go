@@ -0,0 +1,321 @@
+package msgbus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newPartitionedBus(partitions int) *MessageBus {
+	return New(&Options{
+		BufferLength:   DefaultBufferLength,
+		MaxQueueSize:   DefaultMaxQueueSize,
+		MaxPayloadSize: DefaultMaxPayloadSize,
+		Topics:         map[string]TopicOptions{"orders": {Partitions: partitions}},
+	})
+}
+
+func TestPartitionFor(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(0, PartitionFor("foo", 0))
+	assert.Equal(0, PartitionFor("foo", 1))
+	for _, key := range []string{"a", "b", "c", "d"} {
+		i := PartitionFor(key, 4)
+		assert.True(i >= 0 && i < 4)
+		assert.Equal(i, PartitionFor(key, 4))
+	}
+}
+
+func TestParsePartition(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := newPartitionedBus(4)
+
+	i, err := ParsePartition(mb.NewTopic("orders"), "3")
+	assert.NoError(err)
+	assert.Equal(3, i)
+
+	for _, v := range []string{"4", "-1", "x"} {
+		_, err := ParsePartition(mb.NewTopic("orders"), v)
+		assert.Error(err)
+	}
+
+	i, err = ParsePartition(mb.NewTopic("foo"), "0")
+	assert.NoError(err)
+	assert.Equal(0, i)
+
+	_, err = ParsePartition(mb.NewTopic("foo"), "1")
+	assert.Error(err)
+}
+
+func TestPartitionKeyOrdering(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := newPartitionedBus(4)
+	topic := mb.NewTopic("orders")
+	assert.Equal(4, topic.Partitions)
+
+	for i := 0; i < 3; i++ {
+		for _, key := range []string{"a", "b"} {
+			mb.Put(mb.NewMessageWithKey(topic, key, []byte(fmt.Sprintf("%s%d", key, i))))
+		}
+	}
+	assert.Equal(uint64(6), topic.Sequence)
+
+	// Messages of a key share a partition, and are in order with their own
+	// sequence
+	for _, key := range []string{"a", "b"} {
+		p := PartitionFor(key, 4)
+		for i := 0; i < 3; i++ {
+			msg, ok := mb.GetPartition(topic, p)
+			require.True(t, ok)
+			assert.Equal(key, msg.Key)
+			assert.Equal(p, msg.Partition)
+			assert.Equal(fmt.Sprintf("%s%d", key, i), string(msg.Payload))
+			if PartitionFor("a", 4) != PartitionFor("b", 4) {
+				assert.Equal(uint64(i), msg.ID)
+			}
+		}
+	}
+}
+
+func TestPartitionRoundRobin(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := newPartitionedBus(3)
+	topic := mb.NewTopic("orders")
+
+	for i := 0; i < 6; i++ {
+		mb.Put(mb.NewMessage(topic, []byte(fmt.Sprintf("%d", i))))
+	}
+
+	for p := 0; p < 3; p++ {
+		for i := 0; i < 2; i++ {
+			msg, ok := mb.GetPartition(topic, p)
+			require.True(t, ok)
+			assert.Equal(p, msg.Partition)
+			assert.Equal(uint64(i), msg.ID)
+		}
+		_, ok := mb.GetPartition(topic, p)
+		assert.False(ok)
+	}
+
+	_, ok := mb.GetPartition(topic, 3)
+	assert.False(ok)
+}
+
+func TestPartitionGet(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := newPartitionedBus(3)
+	topic := mb.NewTopic("orders")
+
+	for i := 0; i < 4; i++ {
+		mb.Put(mb.NewMessageWithKey(topic, "a", []byte(fmt.Sprintf("%d", i))))
+	}
+	mb.Put(mb.NewMessageWithKey(topic, "b", []byte("b")))
+
+	// Get drains all partitions
+	var payloads []string
+	for {
+		msg, ok := mb.Get(topic)
+		if !ok {
+			break
+		}
+		payloads = append(payloads, string(msg.Payload))
+	}
+	assert.ElementsMatch([]string{"0", "1", "2", "3", "b"}, payloads)
+
+	// Messages requeued go back to their partition
+	msg := mb.NewMessageWithKey(topic, "a", []byte("x"))
+	mb.Requeue(msg)
+	got, ok := mb.GetPartition(topic, msg.Partition)
+	assert.True(ok)
+	assert.Equal("x", string(got.Payload))
+}
+
+func TestPartitionGroups(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := newPartitionedBus(4)
+	topic := mb.NewTopic("orders")
+
+	a := mb.SubscribeGroup("a", "orders", "workers")
+	assert.Equal([]int{0, 1, 2, 3}, mb.Assignment("orders", "workers", "a"))
+
+	b := mb.SubscribeGroup("b", "orders", "workers")
+	assert.Equal([]int{0, 2}, mb.Assignment("orders", "workers", "a"))
+	assert.Equal([]int{1, 3}, mb.Assignment("orders", "workers", "b"))
+
+	// Each message is delivered to the single member owning its partition
+	for i := 0; i < 4; i++ {
+		mb.Put(mb.NewMessage(topic, []byte(fmt.Sprintf("%d", i))))
+	}
+	for _, expected := range []int{0, 2} {
+		msg := <-a
+		assert.Equal(expected, msg.Partition)
+	}
+	for _, expected := range []int{1, 3} {
+		msg := <-b
+		assert.Equal(expected, msg.Partition)
+	}
+	assert.Len(a, 0)
+	assert.Len(b, 0)
+
+	// Partitions are rebalanced when members leave
+	mb.UnsubscribeGroup("a", "orders", "workers")
+	assert.Nil(mb.Assignment("orders", "workers", "a"))
+	assert.Equal([]int{0, 1, 2, 3}, mb.Assignment("orders", "workers", "b"))
+
+	mb.UnsubscribeGroup("b", "orders", "workers")
+	assert.Nil(mb.Assignment("orders", "workers", "b"))
+}
+
+func TestPartitionSnapshotRestore(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := newPartitionedBus(2)
+	topic := mb.NewTopic("orders")
+	for i := 0; i < 4; i++ {
+		mb.Put(mb.NewMessage(topic, []byte(fmt.Sprintf("%d", i))))
+	}
+	mb.GetPartition(topic, 0)
+
+	other := newPartitionedBus(2)
+	other.Restore(mb.Snapshot())
+
+	orders := other.NewTopic("orders")
+	assert.Equal(uint64(4), orders.Sequence)
+
+	msg, ok := other.GetPartition(orders, 0)
+	assert.True(ok)
+	assert.Equal(uint64(1), msg.ID)
+	assert.Equal("2", string(msg.Payload))
+	_, ok = other.GetPartition(orders, 0)
+	assert.False(ok)
+
+	// Sequences continue after a restore
+	msg = other.NewMessage(orders, nil)
+	assert.Equal(uint64(2), msg.ID)
+}
+
+func TestServeHTTPPartitions(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := newPartitionedBus(4)
+	p := PartitionFor("a", 4)
+
+	for _, payload := range []string{"x", "y"} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("PUT", "/orders?key=a", bytes.NewBufferString(payload))
+		mb.ServeHTTP(w, r)
+		assert.Equal(http.StatusAccepted, w.Code)
+	}
+
+	for _, expected := range []string{"x", "y"} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", fmt.Sprintf("/orders?partition=%d", p), nil)
+		mb.ServeHTTP(w, r)
+		assert.Equal(http.StatusOK, w.Code)
+
+		var msg *Message
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &msg))
+		assert.Equal("a", msg.Key)
+		assert.Equal(p, msg.Partition)
+		assert.Equal(expected, string(msg.Payload))
+	}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/orders?partition=4", nil)
+	mb.ServeHTTP(w, r)
+	assert.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestServeHTTPGroupSubscriber(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := newPartitionedBus(2)
+
+	s := httptest.NewServer(mb)
+	defer s.Close()
+
+	u := fmt.Sprintf("ws%s/orders?group=workers", strings.TrimPrefix(s.URL, "http"))
+	ws, _, err := websocket.DefaultDialer.Dial(u, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	topic := mb.NewTopic("orders")
+	joined := func() bool {
+		mb.RLock()
+		defer mb.RUnlock()
+		_, ok := mb.groups[topic]["workers"]
+		return ok
+	}
+	for i := 0; i < 100 && !joined(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.True(t, joined())
+
+	for i := 0; i < 2; i++ {
+		mb.Put(mb.NewMessage(topic, []byte(fmt.Sprintf("%d", i))))
+	}
+
+	// The only member of the group owns all partitions
+	var partitions []int
+	for i := 0; i < 2; i++ {
+		var msg *Message
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		require.NoError(t, ws.ReadJSON(&msg))
+		partitions = append(partitions, msg.Partition)
+	}
+	assert.ElementsMatch([]int{0, 1}, partitions)
+
+	u = fmt.Sprintf("ws%s/orders/+?group=workers", strings.TrimPrefix(s.URL, "http"))
+	_, res, err := websocket.DefaultDialer.Dial(u, nil)
+	assert.Error(err)
+	if res != nil {
+		assert.Equal(http.StatusBadRequest, res.StatusCode)
+	}
+}
+
+func TestPutMessagePartitionOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := newPartitionedBus(4)
+	mb.NewTopic("orders")
+	ch := mb.Subscribe("a", "orders")
+	defer mb.Unsubscribe("a", "orders")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mb.PutMessage(context.Background(), Publishing{Topic: "orders", Key: "k", Payload: []byte("x")})
+		}()
+	}
+	wg.Wait()
+
+	// Messages of a key are queued and delivered in the order of their ids
+	p := PartitionFor("k", 4)
+	for i := 0; i < 50; i++ {
+		message := <-ch
+		assert.Equal(uint64(i), message.ID)
+
+		message, ok := mb.GetPartition(mb.NewTopic("orders"), p)
+		assert.True(ok)
+		assert.Equal(uint64(i), message.ID)
+	}
+}
@@ -0,0 +1,80 @@
+package msgbus
+
+import (
+	"strings"
+)
+
+const (
+	// TopicSeparator separates the levels of hierarchical topic names
+	TopicSeparator = "/"
+
+	// SingleLevelWildcard matches exactly one topic level in patterns
+	SingleLevelWildcard = "+"
+
+	// MultiLevelWildcard matches any number of trailing topic levels in
+	// patterns, including the parent level
+	MultiLevelWildcard = "#"
+)
+
+// IsPattern returns true if pattern contains wildcards
+func IsPattern(pattern string) bool {
+	return strings.Contains(pattern, SingleLevelWildcard) ||
+		strings.Contains(pattern, MultiLevelWildcard)
+}
+
+// ValidPattern returns true if pattern is a valid topic pattern. Wildcards
+// must occupy an entire level and the multi-level wildcard must be last.
+func ValidPattern(pattern string) bool {
+	if pattern == "" {
+		return false
+	}
+
+	levels := strings.Split(pattern, TopicSeparator)
+	for i, level := range levels {
+		switch {
+		case level == MultiLevelWildcard:
+			if i != len(levels)-1 {
+				return false
+			}
+		case level == SingleLevelWildcard:
+		case strings.Contains(level, SingleLevelWildcard),
+			strings.Contains(level, MultiLevelWildcard):
+			return false
+		}
+	}
+
+	return true
+}
+
+// MatchTopic returns true if topic matches pattern. Topics are split into
+// levels by "/", "+" matches a single level and a trailing "#" matches
+// any number of levels, e.g: "sensors/+/temp" and "sensors/#" both match
+// "sensors/kitchen/temp". As in MQTT topics starting with "$" are not
+// matched by a wildcard in the first level.
+func MatchTopic(pattern, topic string) bool {
+	if !IsPattern(pattern) {
+		return pattern == topic
+	}
+
+	if strings.HasPrefix(topic, "$") &&
+		(strings.HasPrefix(pattern, SingleLevelWildcard) || strings.HasPrefix(pattern, MultiLevelWildcard)) {
+		return false
+	}
+
+	ps := strings.Split(pattern, TopicSeparator)
+	ts := strings.Split(topic, TopicSeparator)
+
+	for i, p := range ps {
+		if p == MultiLevelWildcard {
+			return true
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if p != SingleLevelWildcard && p != ts[i] {
+			return false
+		}
+	}
+
+	return len(ps) == len(ts)
+}
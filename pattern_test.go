@@ -0,0 +1,69 @@
+package msgbus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidPattern(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, pattern := range []string{"foo", "foo/bar", "+", "#", "foo/+/bar", "foo/#", "+/+/#"} {
+		assert.True(ValidPattern(pattern), pattern)
+	}
+
+	for _, pattern := range []string{"", "foo#", "foo/#/bar", "foo+", "foo/ba+r"} {
+		assert.False(ValidPattern(pattern), pattern)
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"foo", "foo", true},
+		{"foo", "bar", false},
+		{"foo/+", "foo/bar", true},
+		{"foo/+", "foo/bar/baz", false},
+		{"foo/+/baz", "foo/bar/baz", true},
+		{"foo/#", "foo", true},
+		{"foo/#", "foo/bar/baz", true},
+		{"foo/#", "bar/foo", false},
+		{"#", "foo/bar", true},
+		{"+/+", "foo/bar", true},
+		{"+", "foo/bar", false},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+	}
+
+	for _, test := range tests {
+		assert.Equal(test.match, MatchTopic(test.pattern, test.topic), "%s %s", test.pattern, test.topic)
+	}
+}
+
+func TestSubscribePattern(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := New(nil)
+	ch := mb.SubscribePattern("test", "sensors/+/temp")
+
+	mb.Put(mb.NewMessage(mb.NewTopic("sensors/kitchen/temp"), []byte("21")))
+	mb.Put(mb.NewMessage(mb.NewTopic("sensors/kitchen/humidity"), []byte("40")))
+	mb.Put(mb.NewMessage(mb.NewTopic("sensors/garage/temp"), []byte("12")))
+
+	msg := <-ch
+	assert.Equal("sensors/kitchen/temp", msg.Topic.Name)
+	msg = <-ch
+	assert.Equal("sensors/garage/temp", msg.Topic.Name)
+	assert.Len(ch, 0)
+
+	mb.UnsubscribePattern("test", "sensors/+/temp")
+	_, ok := <-ch
+	assert.False(ok)
+}
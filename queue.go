@@ -45,6 +45,15 @@ func (q *Queue) MaxLen() int {
 	return q.maxlen
 }
 
+// SetMaxLen changes the maxlen of the queue. Elements already stored in
+// the queue are kept even if they exceed the new maxlen.
+func (q *Queue) SetMaxLen(maxlen int) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.maxlen = maxlen
+}
+
 // Size returns the current size of the queue
 func (q *Queue) Size() int {
 	q.RLock()
@@ -66,20 +75,29 @@ func (q *Queue) Full() bool {
 	q.RLock()
 	defer q.RUnlock()
 
-	return q.count == q.maxlen
+	return q.full()
 }
 
-// Push appends an element to the back of the queue.
-func (q *Queue) Push(elem interface{}) {
+// Push appends an element to the back of the queue. If the queue is
+// bounded and full the element at the front is removed and returned to
+// make room, otherwise Push returns nil.
+func (q *Queue) Push(elem interface{}) interface{} {
 	q.Lock()
 	defer q.Unlock()
 
+	var evicted interface{}
+	if q.full() {
+		evicted = q.pop()
+	}
+
 	q.growIfFull()
 
 	q.buf[q.tail] = elem
 	// Calculate new tail position.
 	q.tail = q.next(q.tail)
 	q.count++
+
+	return evicted
 }
 
 // Pop removes and returns the element from the front of the queue.
@@ -87,6 +105,16 @@ func (q *Queue) Pop() interface{} {
 	q.Lock()
 	defer q.Unlock()
 
+	return q.pop()
+}
+
+// full returns true if the queue is bounded and full.
+func (q *Queue) full() bool {
+	return q.maxlen > 0 && q.count >= q.maxlen
+}
+
+// pop removes and returns the element from the front of the queue.
+func (q *Queue) pop() interface{} {
 	if q.count <= 0 {
 		return nil
 	}
@@ -112,6 +140,19 @@ func (q *Queue) Peek() interface{} {
 	return q.buf[q.head]
 }
 
+// Items returns the elements of the queue from front to back without
+// removing them.
+func (q *Queue) Items() []interface{} {
+	q.RLock()
+	defer q.RUnlock()
+
+	items := make([]interface{}, 0, q.count)
+	for i, j := 0, q.head; i < q.count; i, j = i+1, q.next(j) {
+		items = append(items, q.buf[j])
+	}
+	return items
+}
+
 // next returns the next buffer position wrapping around buffer.
 func (q *Queue) next(i int) int {
 	return (i + 1) & (len(q.buf) - 1) // bitwise modulus
@@ -42,6 +42,25 @@ func TestFull(t *testing.T) {
 	assert.True(t, q.Full())
 }
 
+func TestPushEvictsWhenFull(t *testing.T) {
+	assert := assert.New(t)
+
+	q := NewQueue(3)
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(q.Push(i))
+	}
+
+	assert.Equal(0, q.Push(3))
+	assert.Equal(1, q.Push(4))
+	assert.Equal(3, q.Len())
+
+	for i := 2; i < 5; i++ {
+		assert.Equal(i, q.Pop())
+	}
+	assert.True(q.Empty())
+}
+
 func TestBufferWrap(t *testing.T) {
 	q := Queue{}
 
@@ -77,6 +96,19 @@ func TestLen(t *testing.T) {
 	}
 }
 
+func TestItems(t *testing.T) {
+	q := NewQueue(4)
+	assert.Empty(t, q.Items())
+
+	for i := 0; i < 6; i++ {
+		q.Push(i)
+	}
+	q.Pop()
+
+	assert.Equal(t, []interface{}{3, 4, 5}, q.Items())
+	assert.Equal(t, 3, q.Len())
+}
+
 func BenchmarkPush(b *testing.B) {
 	q := Queue{}
 	for i := 0; i < b.N; i++ {
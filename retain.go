@@ -0,0 +1,72 @@
+package msgbus
+
+import (
+	"sort"
+	"strconv"
+)
+
+// RetainHeader is the request header that, like the retain query
+// parameter, stores a published message as the retained message of its
+// topic, e.g: "X-Msgbus-Retain: true"
+const RetainHeader = "X-Msgbus-Retain"
+
+// Retain stores message as the retained message of its topic, which is
+// sent to new subscribers before live messages. A message with an empty
+// payload clears the retained message instead, like MQTT. Messages put with
+// Publishing.Retain are stored as they are put, so the retained message of
+// a topic is the last one put.
+func (mb *MessageBus) Retain(message Message) {
+	mb.retainedMu.Lock()
+	defer mb.retainedMu.Unlock()
+
+	if len(message.Payload) == 0 {
+		delete(mb.retained, message.Topic.Name)
+		return
+	}
+	mb.retained[message.Topic.Name] = message
+}
+
+// ClearRetained removes the retained message of topic, returning false if
+// it had none
+func (mb *MessageBus) ClearRetained(topic string) bool {
+	mb.retainedMu.Lock()
+	defer mb.retainedMu.Unlock()
+
+	if _, ok := mb.retained[topic]; !ok {
+		return false
+	}
+	delete(mb.retained, topic)
+	return true
+}
+
+// Retained returns the retained message of topic, or of the topics
+// matching a pattern, ordered by topic name
+func (mb *MessageBus) Retained(topic string) []Message {
+	mb.retainedMu.RLock()
+	defer mb.retainedMu.RUnlock()
+
+	var messages []Message
+	for name, message := range mb.retained {
+		if MatchTopic(topic, name) {
+			messages = append(messages, message)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Topic.Name < messages[j].Topic.Name
+	})
+
+	return messages
+}
+
+// ParseRetain returns whether a publish asks for its message to be
+// retained from the value of the retain query parameter or RetainHeader
+func ParseRetain(query, header string) (bool, error) {
+	v := query
+	if v == "" {
+		v = header
+	}
+	if v == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(v)
+}
@@ -0,0 +1,161 @@
+package msgbus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageBusRetain(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := New(nil)
+	a, b := mb.NewTopic("status/a"), mb.NewTopic("status/b")
+
+	mb.Retain(mb.NewMessage(b, []byte("b1")))
+	mb.Retain(mb.NewMessage(a, []byte("a1")))
+	mb.Retain(mb.NewMessage(a, []byte("a2")))
+
+	retained := mb.Retained("status/a")
+	require.Len(t, retained, 1)
+	assert.Equal("a2", string(retained[0].Payload))
+
+	retained = mb.Retained("status/+")
+	require.Len(t, retained, 2)
+	assert.Equal("status/a", retained[0].Topic.Name)
+	assert.Equal("status/b", retained[1].Topic.Name)
+
+	// An empty payload clears the retained message
+	mb.Retain(mb.NewMessage(b, nil))
+	assert.Empty(mb.Retained("status/b"))
+
+	assert.True(mb.ClearRetained("status/a"))
+	assert.False(mb.ClearRetained("status/a"))
+	assert.Empty(mb.Retained("#"))
+}
+
+func TestPutMessageRetain(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := New(nil)
+
+	// Concurrent retained publishes leave the last message put retained
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _, err := mb.PutMessage(context.Background(), Publishing{
+				Topic: "status", Payload: []byte(fmt.Sprintf("%d", i)), Retain: true,
+			})
+			assert.NoError(err)
+		}(i)
+	}
+	wg.Wait()
+
+	retained := mb.Retained("status")
+	require.Len(t, retained, 1)
+	assert.Equal(uint64(49), retained[0].ID)
+
+	_, _, err := mb.PutMessage(context.Background(), Publishing{Topic: "status", Payload: []byte("x")})
+	assert.NoError(err)
+	assert.Equal(uint64(49), mb.Retained("status")[0].ID)
+}
+
+func TestParseRetain(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, test := range []struct {
+		query, header string
+		retain, error bool
+	}{
+		{"", "", false, false},
+		{"true", "", true, false},
+		{"", "1", true, false},
+		{"false", "true", false, false},
+		{"maybe", "", false, true},
+	} {
+		retain, err := ParseRetain(test.query, test.header)
+		assert.Equal(test.retain, retain)
+		assert.Equal(test.error, err != nil)
+	}
+}
+
+func TestRetainSnapshotRestore(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := New(nil)
+	mb.Retain(mb.NewMessage(mb.NewTopic("status"), []byte("online")))
+
+	other := New(nil)
+	other.Restore(mb.Snapshot())
+
+	retained := other.Retained("status")
+	require.Len(t, retained, 1)
+	assert.Equal("online", string(retained[0].Payload))
+	assert.Equal(other.NewTopic("status"), retained[0].Topic)
+
+	other.Restore(nil)
+	assert.Empty(other.Retained("status"))
+}
+
+func TestServeHTTPRetained(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := New(nil)
+
+	put := func(url, payload string, header http.Header) int {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("PUT", url, bytes.NewBufferString(payload))
+		for k, vs := range header {
+			r.Header[k] = vs
+		}
+		mb.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(http.StatusAccepted, put("/status?retain=true", "starting", nil))
+	assert.Equal(http.StatusAccepted, put("/status", "not retained", nil))
+	assert.Equal(http.StatusBadRequest, put("/status?retain=maybe", "x", nil))
+	assert.Equal(http.StatusAccepted, put("/status", "online", http.Header{RetainHeader: {"true"}}))
+
+	s := httptest.NewServer(mb)
+	defer s.Close()
+
+	u := fmt.Sprintf("ws%s/status", strings.TrimPrefix(s.URL, "http"))
+	ws, _, err := websocket.DefaultDialer.Dial(u, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	read := func() string {
+		var msg *Message
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		require.NoError(t, ws.ReadJSON(&msg))
+		return string(msg.Payload)
+	}
+
+	// The retained message is sent first, then live messages
+	assert.Equal("online", read())
+	mb.Put(mb.NewMessage(mb.NewTopic("status"), []byte("busy")))
+	assert.Equal("busy", read())
+
+	del := func() int {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("DELETE", "/status?retained", nil)
+		mb.ServeHTTP(w, r)
+		return w.Code
+	}
+	assert.Equal(http.StatusNoContent, del())
+	assert.Equal(http.StatusNotFound, del())
+	assert.Empty(mb.Retained("status"))
+}
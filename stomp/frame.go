@@ -0,0 +1,286 @@
+package stomp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Client frames
+const (
+	CONNECT     = "CONNECT"
+	STOMP       = "STOMP"
+	SEND        = "SEND"
+	SUBSCRIBE   = "SUBSCRIBE"
+	UNSUBSCRIBE = "UNSUBSCRIBE"
+	ACK         = "ACK"
+	NACK        = "NACK"
+	BEGIN       = "BEGIN"
+	COMMIT      = "COMMIT"
+	ABORT       = "ABORT"
+	DISCONNECT  = "DISCONNECT"
+)
+
+// Server frames
+const (
+	CONNECTED = "CONNECTED"
+	MESSAGE   = "MESSAGE"
+	RECEIPT   = "RECEIPT"
+	ERROR     = "ERROR"
+)
+
+// Frame headers
+const (
+	hdrAcceptVersion = "accept-version"
+	hdrAck           = "ack"
+	hdrContentLength = "content-length"
+	hdrContentType   = "content-type"
+	hdrDestination   = "destination"
+	hdrHeartBeat     = "heart-beat"
+	hdrID            = "id"
+	hdrLogin         = "login"
+	hdrMessage       = "message"
+	hdrMessageID     = "message-id"
+	hdrPasscode      = "passcode"
+	hdrReceipt       = "receipt"
+	hdrReceiptID     = "receipt-id"
+	hdrServer        = "server"
+	hdrSession       = "session"
+	hdrSubscription  = "subscription"
+	hdrTransaction   = "transaction"
+	hdrVersion       = "version"
+)
+
+var (
+	// ErrFrameTooLarge is returned when reading a frame larger than the
+	// maximum frame size
+	ErrFrameTooLarge = errors.New("stomp: frame too large")
+
+	// ErrMalformedFrame is returned when reading an invalid frame
+	ErrMalformedFrame = errors.New("stomp: malformed frame")
+)
+
+// header is a single frame header, headers are kept in order as repeated
+// headers are allowed and only the first occurrence is significant.
+type header struct {
+	Key   string
+	Value string
+}
+
+// frame is a STOMP frame
+type frame struct {
+	Command string
+	Headers []header
+	Body    []byte
+}
+
+// newFrame returns a frame with the given command and key/value headers
+func newFrame(command string, headers ...string) *frame {
+	f := &frame{Command: command}
+	for i := 0; i+1 < len(headers); i += 2 {
+		f.Add(headers[i], headers[i+1])
+	}
+	return f
+}
+
+// Get returns the value of the first header named key
+func (f *frame) Get(key string) string {
+	value, _ := f.Lookup(key)
+	return value
+}
+
+// Lookup returns the value of the first header named key and whether the
+// header is present
+func (f *frame) Lookup(key string) (string, bool) {
+	for _, h := range f.Headers {
+		if h.Key == key {
+			return h.Value, true
+		}
+	}
+	return "", false
+}
+
+// Add appends a header
+func (f *frame) Add(key, value string) {
+	f.Headers = append(f.Headers, header{Key: key, Value: value})
+}
+
+// escaped returns true if the headers of frames with command are escaped,
+// the CONNECT and CONNECTED frames are not for backwards compatibility.
+func escaped(command string) bool {
+	return command != CONNECT && command != CONNECTED
+}
+
+var (
+	headerEscaper = strings.NewReplacer(
+		"\\", "\\\\", "\r", "\\r", "\n", "\\n", ":", "\\c",
+	)
+	headerUnescaper = strings.NewReplacer(
+		"\\\\", "\\", "\\r", "\r", "\\n", "\n", "\\c", ":",
+	)
+)
+
+// readFrame reads the next frame from r. A heart-beat (a lone EOL) is
+// returned as a nil frame. Frames with headers and body larger than
+// maxSize are rejected with ErrFrameTooLarge.
+func readFrame(r *bufio.Reader, maxSize int) (*frame, error) {
+	remaining := maxSize
+	if maxSize <= 0 {
+		remaining = math.MaxInt
+	}
+
+	command, err := readLine(r, &remaining)
+	if err != nil {
+		return nil, err
+	}
+	if command == "" {
+		return nil, nil
+	}
+
+	f := &frame{Command: command}
+	unescape := escaped(command)
+
+	for {
+		line, err := readLine(r, &remaining)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, ErrMalformedFrame
+		}
+
+		key, value := line[:i], line[i+1:]
+		if unescape {
+			if !validEscapes(key) || !validEscapes(value) {
+				return nil, ErrMalformedFrame
+			}
+			key, value = headerUnescaper.Replace(key), headerUnescaper.Replace(value)
+		}
+		f.Add(key, value)
+	}
+
+	if cl, ok := f.Lookup(hdrContentLength); ok {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n < 0 {
+			return nil, ErrMalformedFrame
+		}
+		if n > remaining {
+			return nil, ErrFrameTooLarge
+		}
+
+		f.Body = make([]byte, n)
+		if _, err := io.ReadFull(r, f.Body); err != nil {
+			return nil, err
+		}
+
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != 0 {
+			return nil, ErrMalformedFrame
+		}
+
+		return f, nil
+	}
+
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == 0 {
+			break
+		}
+		if remaining--; remaining < 0 {
+			return nil, ErrFrameTooLarge
+		}
+		f.Body = append(f.Body, b)
+	}
+
+	return f, nil
+}
+
+// readLine reads a line terminated by LF or CRLF, counting its length
+// against remaining.
+func readLine(r *bufio.Reader, remaining *int) (string, error) {
+	var line []byte
+
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == '\n' {
+			break
+		}
+		if len(line) == *remaining {
+			return "", ErrFrameTooLarge
+		}
+		line = append(line, b)
+	}
+	*remaining -= len(line)
+
+	return strings.TrimSuffix(string(line), "\r"), nil
+}
+
+// validEscapes returns true if s contains only the escape sequences
+// defined by STOMP 1.2
+func validEscapes(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			continue
+		}
+		if i+1 == len(s) {
+			return false
+		}
+		switch s[i+1] {
+		case '\\', 'r', 'n', 'c':
+			i++
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// writeFrame encodes and writes f to w with a single call to Write so
+// each frame is sent as a single websocket message.
+func writeFrame(w io.Writer, f *frame) error {
+	buf := &bytes.Buffer{}
+
+	buf.WriteString(f.Command)
+	buf.WriteByte('\n')
+
+	escape := escaped(f.Command)
+	for _, h := range f.Headers {
+		if h.Key == hdrContentLength {
+			continue
+		}
+		if escape {
+			fmt.Fprintf(buf, "%s:%s\n", headerEscaper.Replace(h.Key), headerEscaper.Replace(h.Value))
+		} else {
+			fmt.Fprintf(buf, "%s:%s\n", h.Key, h.Value)
+		}
+	}
+	if f.Body != nil || f.Command == SEND || f.Command == MESSAGE || f.Command == ERROR {
+		fmt.Fprintf(buf, "%s:%d\n", hdrContentLength, len(f.Body))
+	}
+
+	buf.WriteByte('\n')
+	buf.Write(f.Body)
+	buf.WriteByte(0)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,871 @@
+// Package stomp implements a STOMP 1.2 frontend to a msgbus.MessageBus,
+// served over TCP and as the "v12.stomp" websocket subprotocol.
+//
+// Destinations are topic names with an optional leading "/", so SEND to
+// "/sensors/kitchen" publishes to the topic "sensors/kitchen" as
+// PUT /sensors/kitchen does. SUBSCRIBE supports the "+" and "#" topic
+// wildcards and the auto, client and client-individual ack modes.
+// Subscriptions receive copies of the messages published, which stay on
+// the queue of their topic to be pulled, so messages that are NACKed or
+// still unacknowledged when a subscription ends are not queued again.
+package stomp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prologic/msgbus"
+)
+
+const (
+	// DefaultMaxFrameSize is the default maximum size of a frame
+	DefaultMaxFrameSize = 1 << 20 // 1MB
+
+	// DefaultHeartBeat is the default interval heart-beats are offered to
+	// be sent and requested to be received at
+	DefaultHeartBeat = 10 * time.Second
+
+	// DefaultMaxPending is the default maximum number of unacknowledged
+	// messages per subscription, further delivery waits for ACK or NACK
+	DefaultMaxPending = 100
+
+	// Time allowed to receive the CONNECT frame of a new connection.
+	connectWait = 10 * time.Second
+
+	// Time allowed to write a frame to the peer.
+	writeWait = 10 * time.Second
+
+	// subscriberPrefix prefixes the bus subscriber ids of a connection
+	subscriberPrefix = "stomp:"
+)
+
+// Ack modes
+const (
+	AckAuto             = "auto"
+	AckClient           = "client"
+	AckClientIndividual = "client-individual"
+)
+
+// Subprotocol is the websocket subprotocol served by ServeWebsocket
+const Subprotocol = "v12.stomp"
+
+// ErrServerClosed is returned by Serve after Close is called
+var ErrServerClosed = errors.New("stomp: server closed")
+
+// reservedHeaders are frame headers that are not copied to or from the
+// headers of bus messages
+var reservedHeaders = map[string]bool{
+	hdrAck:           true,
+	hdrContentLength: true,
+	hdrDestination:   true,
+	hdrMessageID:     true,
+	hdrReceipt:       true,
+	hdrSubscription:  true,
+	hdrTransaction:   true,
+}
+
+// Options ...
+type Options struct {
+	// Authenticate validates the login and passcode of connecting clients
+	// and returns their identity. It is not called for websocket clients
+	// already authenticated by the HTTP server. If nil all clients are
+	// accepted.
+	Authenticate func(login, passcode string) (identity string, ok bool)
+
+	// MaxFrameSize is the maximum size of frames received from clients
+	MaxFrameSize int
+
+	// HeartBeat is the interval heart-beats are offered and requested at,
+	// negative values disable heart-beats
+	HeartBeat time.Duration
+
+	// MaxPending is the maximum number of unacknowledged messages per
+	// subscription in the client and client-individual ack modes
+	MaxPending int
+}
+
+// Server is a STOMP server publishing to and subscribing from a bus
+type Server struct {
+	sync.Mutex
+
+	bus *msgbus.MessageBus
+
+	authenticate func(login, passcode string) (string, bool)
+	maxFrameSize int
+	heartBeat    time.Duration
+	maxPending   int
+
+	listeners map[net.Listener]bool
+	conns     map[*conn]bool
+	sessions  uint64
+	closed    bool
+}
+
+// NewServer ...
+func NewServer(bus *msgbus.MessageBus, options *Options) *Server {
+	var (
+		authenticate func(login, passcode string) (string, bool)
+		maxFrameSize = DefaultMaxFrameSize
+		heartBeat    = DefaultHeartBeat
+		maxPending   = DefaultMaxPending
+	)
+
+	if options != nil {
+		authenticate = options.Authenticate
+		if options.MaxFrameSize != 0 {
+			maxFrameSize = options.MaxFrameSize
+		}
+		if options.HeartBeat != 0 {
+			heartBeat = options.HeartBeat
+		}
+		if options.MaxPending != 0 {
+			maxPending = options.MaxPending
+		}
+	}
+
+	if heartBeat < 0 {
+		heartBeat = 0
+	}
+
+	return &Server{
+		bus: bus,
+
+		authenticate: authenticate,
+		maxFrameSize: maxFrameSize,
+		heartBeat:    heartBeat,
+		maxPending:   maxPending,
+
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[*conn]bool),
+	}
+}
+
+// ListenAndServe listens on the TCP address addr and serves clients
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts and serves clients on l until Close is called
+func (s *Server) Serve(l net.Listener) error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = true
+	s.Unlock()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.Lock()
+			closed := s.closed
+			delete(s.listeners, l)
+			s.Unlock()
+
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		ctx := msgbus.WithRemoteAddr(context.Background(), nc.RemoteAddr().String())
+		go s.serve(ctx, nc)
+	}
+}
+
+// ServeWebsocket serves a client connected with the "v12.stomp" websocket
+// subprotocol until it disconnects. It is a msgbus.SubprotocolHandler to
+// be registered with the bus:
+//
+//	bus.HandleSubprotocol(stomp.Subprotocol, server.ServeWebsocket)
+func (s *Server) ServeWebsocket(ctx context.Context, ws *websocket.Conn) {
+	s.serve(ctx, &wsTransport{Conn: ws})
+}
+
+// Close stops all listeners and closes all connections
+func (s *Server) Close() error {
+	s.Lock()
+	s.closed = true
+	listeners := s.listeners
+	conns := s.conns
+	s.listeners = make(map[net.Listener]bool)
+	s.conns = make(map[*conn]bool)
+	s.Unlock()
+
+	for l := range listeners {
+		l.Close()
+	}
+	for c := range conns {
+		c.close()
+	}
+
+	return nil
+}
+
+func (s *Server) serve(ctx context.Context, t transport) {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		t.Close()
+		return
+	}
+	s.sessions++
+	c := newConn(s, t, ctx, strconv.FormatUint(s.sessions, 10))
+	s.conns[c] = true
+	s.Unlock()
+
+	c.serve()
+
+	s.Lock()
+	delete(s.conns, c)
+	s.Unlock()
+}
+
+// transport is a stream of frames, a TCP connection or a websocket
+type transport interface {
+	io.ReadWriteCloser
+	RemoteAddr() net.Addr
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// wsTransport adapts a websocket to a stream, each write is sent as a
+// single text message
+type wsTransport struct {
+	*websocket.Conn
+
+	r io.Reader
+}
+
+func (t *wsTransport) Read(p []byte) (int, error) {
+	for {
+		if t.r == nil {
+			_, r, err := t.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			t.r = r
+		}
+
+		n, err := t.r.Read(p)
+		if err == io.EOF {
+			t.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (t *wsTransport) Write(p []byte) (int, error) {
+	if err := t.WriteMessage(websocket.TextMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// subscription is a destination subscribed to on the bus
+type subscription struct {
+	id    string
+	topic string
+	ack   string
+	busID string
+	ch    chan msgbus.Message
+
+	// window limits the number of pending messages in the client ack modes
+	window chan struct{}
+	done   chan struct{}
+
+	// pending are the ack ids of delivered messages awaiting
+	// acknowledgement in order of delivery, guarded by the connection
+	pending []string
+}
+
+// conn is a client connection
+type conn struct {
+	sync.Mutex
+
+	server    *Server
+	transport transport
+	r         *bufio.Reader
+	ctx       context.Context
+	session   string
+
+	wmu sync.Mutex
+
+	subs    map[string]*subscription
+	acks    map[string]*subscription
+	nextAck uint64
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newConn(s *Server, t transport, ctx context.Context, session string) *conn {
+	return &conn{
+		server:    s,
+		transport: t,
+		r:         bufio.NewReader(t),
+		ctx:       ctx,
+		session:   session,
+
+		subs: make(map[string]*subscription),
+		acks: make(map[string]*subscription),
+
+		done: make(chan struct{}),
+	}
+}
+
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.transport.Close()
+	})
+}
+
+func (c *conn) write(f *frame) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.transport.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := writeFrame(c.transport, f); err != nil {
+		c.close()
+		return err
+	}
+	return nil
+}
+
+// writeError sends an ERROR frame in response to f, if any, the connection
+// is closed afterwards as required by the specification.
+func (c *conn) writeError(f *frame, message, detail string) {
+	e := newFrame(ERROR, hdrMessage, message, hdrContentType, "text/plain")
+	if f != nil {
+		if receipt, ok := f.Lookup(hdrReceipt); ok {
+			e.Add(hdrReceiptID, receipt)
+		}
+	}
+	e.Body = []byte(detail)
+
+	c.write(e)
+}
+
+// heartBeat sends a heart-beat every interval until the connection is
+// closed
+func (c *conn) heartBeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.wmu.Lock()
+			c.transport.SetWriteDeadline(time.Now().Add(writeWait))
+			_, err := c.transport.Write([]byte{'\n'})
+			c.wmu.Unlock()
+
+			if err != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+// readFrame reads the next frame, skipping heart-beats, with the read
+// deadline extended by timeout for every frame or heart-beat received
+func (c *conn) readFrame(timeout time.Duration) (*frame, error) {
+	for {
+		if timeout > 0 {
+			c.transport.SetReadDeadline(time.Now().Add(timeout))
+		} else {
+			c.transport.SetReadDeadline(time.Time{})
+		}
+
+		f, err := readFrame(c.r, c.server.maxFrameSize)
+		if err != nil || f != nil {
+			return f, err
+		}
+	}
+}
+
+func (c *conn) serve() {
+	defer func() {
+		c.unsubscribeAll()
+		c.close()
+	}()
+
+	f, err := c.readFrame(connectWait)
+	if err != nil {
+		log.Debugf("[stomp] error reading connect from %s: %s", c.transport.RemoteAddr(), err)
+		return
+	}
+
+	if f.Command != CONNECT && f.Command != STOMP {
+		c.writeError(f, "expected CONNECT", fmt.Sprintf("expected CONNECT frame, got %s", f.Command))
+		return
+	}
+
+	timeout, ok := c.connect(f)
+	if !ok {
+		return
+	}
+
+	for {
+		f, err := c.readFrame(timeout)
+		if err != nil {
+			select {
+			case <-c.done:
+			default:
+				if err == ErrFrameTooLarge || err == ErrMalformedFrame {
+					c.writeError(nil, "invalid frame", err.Error())
+				}
+				log.Debugf("[stomp] error reading from %s: %s", c.transport.RemoteAddr(), err)
+			}
+			return
+		}
+
+		if f.Command == DISCONNECT {
+			c.receipt(f)
+			return
+		}
+
+		if err := c.handle(f); err != nil {
+			log.Warnf("[stomp] error handling %s from %s: %s", f.Command, c.transport.RemoteAddr(), err)
+			c.writeError(f, err.Error(), "")
+			return
+		}
+
+		if err := c.receipt(f); err != nil {
+			return
+		}
+	}
+}
+
+// connect handles the CONNECT frame and returns the read timeout of the
+// negotiated heart-beats and whether the client was accepted
+func (c *conn) connect(f *frame) (time.Duration, bool) {
+	versions := strings.Split(f.Get(hdrAcceptVersion), ",")
+	supported := false
+	for _, v := range versions {
+		if strings.TrimSpace(v) == "1.2" {
+			supported = true
+		}
+	}
+	if !supported {
+		e := newFrame(ERROR, hdrVersion, "1.2", hdrMessage, "unsupported protocol version", hdrContentType, "text/plain")
+		e.Body = []byte("Supported protocol versions are 1.2")
+		c.write(e)
+		return 0, false
+	}
+
+	if c.server.authenticate != nil && msgbus.IdentityFromContext(c.ctx) == "" {
+		identity, ok := c.server.authenticate(f.Get(hdrLogin), f.Get(hdrPasscode))
+		if !ok {
+			c.server.bus.Audit(c.ctx, msgbus.AuditEvent{
+				Action: msgbus.AuditAuth,
+				Result: msgbus.AuditDenied,
+				Detail: "stomp connect",
+			})
+			c.writeError(f, "bad credentials", "invalid login or passcode")
+			return 0, false
+		}
+		c.ctx = msgbus.WithIdentity(c.ctx, identity)
+	}
+
+	// Heart-beats are sent at the slower of the interval we offer and the
+	// interval the client wants, and expected likewise.
+	cx, cy, err := parseHeartBeat(f.Get(hdrHeartBeat))
+	if err != nil {
+		c.writeError(f, "invalid heart-beat", err.Error())
+		return 0, false
+	}
+
+	var send, receive time.Duration
+	if hb := c.server.heartBeat; hb > 0 {
+		if cy > 0 {
+			send = maxDuration(hb, cy)
+		}
+		if cx > 0 {
+			receive = maxDuration(hb, cx)
+		}
+	}
+
+	hb := fmt.Sprintf("%d,%d", c.server.heartBeat.Milliseconds(), c.server.heartBeat.Milliseconds())
+	connected := newFrame(
+		CONNECTED,
+		hdrVersion, "1.2",
+		hdrHeartBeat, hb,
+		hdrSession, c.session,
+		hdrServer, "msgbus/"+msgbus.Version,
+	)
+	if err := c.write(connected); err != nil {
+		return 0, false
+	}
+
+	log.Debugf("[stomp] session %s connected from %s", c.session, c.transport.RemoteAddr())
+
+	if send > 0 {
+		go c.heartBeat(send)
+	}
+
+	// Allow for network latency as recommended by the specification
+	return receive * 3 / 2, true
+}
+
+// receipt sends a RECEIPT for f if requested
+func (c *conn) receipt(f *frame) error {
+	if receipt, ok := f.Lookup(hdrReceipt); ok {
+		return c.write(newFrame(RECEIPT, hdrReceiptID, receipt))
+	}
+	return nil
+}
+
+func (c *conn) handle(f *frame) error {
+	if _, ok := f.Lookup(hdrTransaction); ok {
+		return errors.New("transactions are not supported")
+	}
+
+	switch f.Command {
+	case SEND:
+		return c.handleSend(f)
+	case SUBSCRIBE:
+		return c.handleSubscribe(f)
+	case UNSUBSCRIBE:
+		return c.handleUnsubscribe(f)
+	case ACK, NACK:
+		return c.handleAck(f)
+	case BEGIN, COMMIT, ABORT:
+		return errors.New("transactions are not supported")
+	case CONNECT, STOMP:
+		return errors.New("already connected")
+	default:
+		return fmt.Errorf("unknown command %q", f.Command)
+	}
+}
+
+func (c *conn) handleSend(f *frame) error {
+	topic, ok := topicName(f)
+	if !ok {
+		return errors.New("missing destination")
+	}
+	if msgbus.IsPattern(topic) {
+		return fmt.Errorf("invalid destination %q", f.Get(hdrDestination))
+	}
+
+	bus := c.server.bus
+	if max := bus.TopicOptions(topic).MaxPayloadSize; len(f.Body) > max {
+		bus.Audit(c.ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditPublish, Result: msgbus.AuditRejected,
+			Topic: topic, Size: len(f.Body), Detail: "payload exceeds max-payload-size",
+		})
+		return errors.New("payload exceeds max-payload-size")
+	}
+
+	var headers map[string]string
+	for _, h := range f.Headers {
+		if reservedHeaders[h.Key] {
+			continue
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		if _, ok := headers[h.Key]; !ok {
+			headers[h.Key] = h.Value
+		}
+	}
+
+	message, _, err := bus.PutMessage(c.ctx, msgbus.Publishing{
+		Topic: topic, Payload: f.Body, Headers: headers,
+	})
+	if err != nil {
+		bus.Audit(c.ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditPublish, Result: msgbus.AuditRejected,
+			Topic: topic, Size: len(f.Body), Detail: err.Error(),
+		})
+		return err
+	}
+	bus.Audit(c.ctx, msgbus.AuditEvent{
+		Action: msgbus.AuditPublish, Result: msgbus.AuditOK,
+	}.WithMessage(message))
+
+	return nil
+}
+
+func (c *conn) handleSubscribe(f *frame) error {
+	id, ok := f.Lookup(hdrID)
+	if !ok {
+		return errors.New("missing id")
+	}
+
+	topic, ok := topicName(f)
+	if !ok {
+		return errors.New("missing destination")
+	}
+	if !msgbus.ValidPattern(topic) {
+		return fmt.Errorf("invalid destination %q", f.Get(hdrDestination))
+	}
+
+	ack := f.Get(hdrAck)
+	switch ack {
+	case "":
+		ack = AckAuto
+	case AckAuto, AckClient, AckClientIndividual:
+	default:
+		return fmt.Errorf("invalid ack mode %q", ack)
+	}
+
+	c.Lock()
+	if _, ok := c.subs[id]; ok {
+		c.Unlock()
+		return fmt.Errorf("duplicate subscription id %q", id)
+	}
+
+	sub := &subscription{
+		id:     id,
+		topic:  topic,
+		ack:    ack,
+		busID:  subscriberPrefix + c.session + ":" + id,
+		window: make(chan struct{}, c.server.maxPending),
+		done:   make(chan struct{}),
+	}
+	if msgbus.IsPattern(topic) {
+		sub.ch = c.server.bus.SubscribePattern(sub.busID, topic)
+	} else {
+		sub.ch = c.server.bus.Subscribe(sub.busID, topic)
+	}
+	c.subs[id] = sub
+	c.Unlock()
+
+	c.server.bus.Audit(c.ctx, msgbus.AuditEvent{
+		Action: msgbus.AuditSubscribe, Result: msgbus.AuditOK, Topic: topic,
+	})
+
+	go c.forward(sub)
+
+	return nil
+}
+
+func (c *conn) handleUnsubscribe(f *frame) error {
+	id, ok := f.Lookup(hdrID)
+	if !ok {
+		return errors.New("missing id")
+	}
+
+	c.Lock()
+	sub, ok := c.subs[id]
+	if ok {
+		c.unsubscribe(sub)
+	}
+	c.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no subscription with id %q", id)
+	}
+
+	c.server.bus.Audit(c.ctx, msgbus.AuditEvent{
+		Action: msgbus.AuditUnsubscribe, Result: msgbus.AuditOK, Topic: sub.topic,
+	})
+
+	return nil
+}
+
+// unsubscribe removes sub from the bus and drops its unacknowledged
+// messages, the caller must hold the connection lock
+func (c *conn) unsubscribe(sub *subscription) {
+	delete(c.subs, sub.id)
+	close(sub.done)
+
+	if msgbus.IsPattern(sub.topic) {
+		c.server.bus.UnsubscribePattern(sub.busID, sub.topic)
+	} else {
+		c.server.bus.Unsubscribe(sub.busID, sub.topic)
+	}
+
+	for _, ackID := range sub.pending {
+		delete(c.acks, ackID)
+	}
+	sub.pending = nil
+}
+
+func (c *conn) unsubscribeAll() {
+	c.Lock()
+	subs := make([]*subscription, 0, len(c.subs))
+	for _, sub := range c.subs {
+		c.unsubscribe(sub)
+		subs = append(subs, sub)
+	}
+	c.Unlock()
+
+	for _, sub := range subs {
+		c.server.bus.Audit(c.ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditUnsubscribe, Result: msgbus.AuditOK, Topic: sub.topic,
+		})
+	}
+}
+
+// handleAck acknowledges (ACK) or rejects (NACK) the message with the ack
+// id of f and, in the client ack mode, all messages delivered before it on
+// the same subscription.
+func (c *conn) handleAck(f *frame) error {
+	id, ok := f.Lookup(hdrID)
+	if !ok {
+		return errors.New("missing id")
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	sub, ok := c.acks[id]
+	if !ok {
+		return fmt.Errorf("no message with ack id %q", id)
+	}
+
+	var (
+		done []string
+		rest []string
+	)
+	for i, ackID := range sub.pending {
+		if ackID == id {
+			if sub.ack == AckClient {
+				done = sub.pending[:i+1]
+			} else {
+				done = sub.pending[i : i+1]
+				rest = append(rest, sub.pending[:i]...)
+			}
+			rest = append(rest, sub.pending[i+1:]...)
+			break
+		}
+	}
+	sub.pending = rest
+
+	for _, ackID := range done {
+		delete(c.acks, ackID)
+		<-sub.window
+	}
+
+	return nil
+}
+
+// forward delivers messages of sub until the connection is closed or the
+// subscription removed.
+func (c *conn) forward(sub *subscription) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-sub.done:
+			return
+		case message, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			if !c.deliver(sub, message) {
+				return
+			}
+		}
+	}
+}
+
+// deliver sends message as a MESSAGE frame of sub and returns false if the
+// connection was closed or the subscription removed. In the client ack
+// modes delivery waits while the maximum number of messages are pending.
+func (c *conn) deliver(sub *subscription, message msgbus.Message) bool {
+	f := newFrame(
+		MESSAGE,
+		hdrSubscription, sub.id,
+		hdrMessageID, fmt.Sprintf("%s:%d", message.Topic.Name, message.ID),
+		hdrDestination, "/"+message.Topic.Name,
+	)
+
+	if sub.ack != AckAuto {
+		select {
+		case sub.window <- struct{}{}:
+		case <-sub.done:
+			return false
+		case <-c.done:
+			return false
+		}
+
+		c.Lock()
+		select {
+		case <-sub.done:
+			c.Unlock()
+			return false
+		default:
+		}
+		c.nextAck++
+		ackID := strconv.FormatUint(c.nextAck, 10)
+		c.acks[ackID] = sub
+		sub.pending = append(sub.pending, ackID)
+		c.Unlock()
+
+		f.Add(hdrAck, ackID)
+	}
+
+	for k, v := range message.Headers {
+		if !reservedHeaders[k] {
+			f.Add(k, v)
+		}
+	}
+	f.Body = message.Payload
+
+	return c.write(f) == nil
+}
+
+// topicName returns the topic named by the destination of f
+func topicName(f *frame) (string, bool) {
+	topic := strings.TrimLeft(f.Get(hdrDestination), "/")
+	return topic, topic != ""
+}
+
+// parseHeartBeat parses a heart-beat header into the intervals the sender
+// can send and wants to receive heart-beats at
+func parseHeartBeat(value string) (time.Duration, time.Duration, error) {
+	if value == "" {
+		return 0, 0, nil
+	}
+
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid heart-beat %q", value)
+	}
+
+	x, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid heart-beat %q", value)
+	}
+	y, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid heart-beat %q", value)
+	}
+
+	return time.Duration(x) * time.Millisecond, time.Duration(y) * time.Millisecond, nil
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
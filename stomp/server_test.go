@@ -0,0 +1,285 @@
+package stomp
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/prologic/msgbus"
+)
+
+type testClient struct {
+	t *testing.T
+	c transport
+	r *bufio.Reader
+}
+
+func newTestServer(t *testing.T, options *Options) (*msgbus.MessageBus, *Server, string) {
+	mb := msgbus.New(nil)
+	s := NewServer(mb, options)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	return mb, s, l.Addr().String()
+}
+
+func dial(t *testing.T, addr string, headers ...string) (*testClient, *frame) {
+	nc, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { nc.Close() })
+
+	return connect(t, nc, headers...)
+}
+
+func connect(t *testing.T, tr transport, headers ...string) (*testClient, *frame) {
+	c := &testClient{t: t, c: tr, r: bufio.NewReader(tr)}
+
+	headers = append([]string{hdrAcceptVersion, "1.1,1.2", "host", "localhost"}, headers...)
+	c.send(newFrame(CONNECT, headers...))
+
+	return c, c.recv()
+}
+
+func (c *testClient) send(f *frame) {
+	require.NoError(c.t, writeFrame(c.c, f))
+}
+
+func (c *testClient) recv() *frame {
+	for {
+		c.c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		f, err := readFrame(c.r, 0)
+		require.NoError(c.t, err)
+		if f != nil {
+			return f
+		}
+	}
+}
+
+// sendWithReceipt sends f and waits for its receipt
+func (c *testClient) sendWithReceipt(f *frame) {
+	f.Add(hdrReceipt, "r-"+f.Command)
+	c.send(f)
+
+	r := c.recv()
+	require.Equal(c.t, RECEIPT, r.Command, string(r.Body))
+	require.Equal(c.t, "r-"+f.Command, r.Get(hdrReceiptID))
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	f := newFrame(SEND, hdrDestination, "/foo", "x-key", "a:b\nc\\d")
+	f.Body = []byte("hello\x00world")
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, writeFrame(buf, f))
+
+	actual, err := readFrame(bufio.NewReader(buf), 0)
+	require.NoError(t, err)
+	assert.Equal(t, SEND, actual.Command)
+	assert.Equal(t, "a:b\nc\\d", actual.Get("x-key"))
+	assert.Equal(t, "11", actual.Get(hdrContentLength))
+	assert.Equal(t, f.Body, actual.Body)
+}
+
+func TestReadFrame(t *testing.T) {
+	assert := assert.New(t)
+
+	r := bufio.NewReader(strings.NewReader("\r\nSEND\r\ndestination:foo\r\nk:1\r\nk:2\r\n\r\nbar\x00\n"))
+
+	f, err := readFrame(r, 0)
+	assert.NoError(err)
+	assert.Nil(f)
+
+	f, err = readFrame(r, 0)
+	require.NoError(t, err)
+	assert.Equal("foo", f.Get(hdrDestination))
+	assert.Equal("1", f.Get("k"))
+	assert.Equal([]byte("bar"), f.Body)
+
+	_, err = readFrame(bufio.NewReader(strings.NewReader("SEND\nk:\\t\n\n\x00")), 0)
+	assert.Equal(ErrMalformedFrame, err)
+
+	_, err = readFrame(bufio.NewReader(strings.NewReader("SEND\n\n"+strings.Repeat("x", 64)+"\x00")), 32)
+	assert.Equal(ErrFrameTooLarge, err)
+}
+
+func TestConnect(t *testing.T) {
+	assert := assert.New(t)
+
+	_, _, addr := newTestServer(t, &Options{
+		Authenticate: func(login, passcode string) (string, bool) {
+			return login, login == "alice" && passcode == "secret"
+		},
+	})
+
+	_, f := dial(t, addr, hdrLogin, "alice", hdrPasscode, "wrong")
+	assert.Equal(ERROR, f.Command)
+
+	_, f = dial(t, addr, hdrLogin, "alice", hdrPasscode, "secret", hdrHeartBeat, "0,1000")
+	assert.Equal(CONNECTED, f.Command)
+	assert.Equal("1.2", f.Get(hdrVersion))
+	assert.Equal("10000,10000", f.Get(hdrHeartBeat))
+	assert.NotEmpty(f.Get(hdrSession))
+
+	nc, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer nc.Close()
+	c := &testClient{t: t, c: nc, r: bufio.NewReader(nc)}
+	c.send(newFrame(CONNECT, hdrAcceptVersion, "1.0"))
+	f = c.recv()
+	assert.Equal(ERROR, f.Command)
+	assert.Equal("1.2", f.Get(hdrVersion))
+}
+
+func TestSendSubscribe(t *testing.T) {
+	assert := assert.New(t)
+
+	mb, _, addr := newTestServer(t, nil)
+
+	sub, _ := dial(t, addr)
+	sub.sendWithReceipt(newFrame(SUBSCRIBE, hdrID, "0", hdrDestination, "/sensors/+"))
+
+	pub, _ := dial(t, addr)
+	send := newFrame(SEND, hdrDestination, "/sensors/kitchen", hdrContentType, "text/plain", "x-unit", "C")
+	send.Body = []byte("21")
+	pub.sendWithReceipt(send)
+
+	f := sub.recv()
+	assert.Equal(MESSAGE, f.Command)
+	assert.Equal("0", f.Get(hdrSubscription))
+	assert.Equal("/sensors/kitchen", f.Get(hdrDestination))
+	assert.Equal("sensors/kitchen:0", f.Get(hdrMessageID))
+	assert.Equal("text/plain", f.Get(hdrContentType))
+	assert.Equal("C", f.Get("x-unit"))
+	assert.Equal([]byte("21"), f.Body)
+
+	// Messages sent over STOMP can be pulled over HTTP
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/sensors/kitchen", nil)
+	mb.ServeHTTP(w, r)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `"x-unit":"C"`)
+
+	// Messages published over HTTP are delivered over STOMP
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("PUT", "/sensors/garage", bytes.NewBufferString("12"))
+	mb.ServeHTTP(w, r)
+
+	f = sub.recv()
+	assert.Equal("/sensors/garage", f.Get(hdrDestination))
+	assert.Equal([]byte("12"), f.Body)
+
+	sub.sendWithReceipt(newFrame(UNSUBSCRIBE, hdrID, "0"))
+	sub.send(newFrame(UNSUBSCRIBE, hdrID, "0"))
+	assert.Equal(ERROR, sub.recv().Command)
+}
+
+func TestAckNack(t *testing.T) {
+	assert := assert.New(t)
+
+	mb, _, addr := newTestServer(t, &Options{MaxPending: 2})
+
+	c, _ := dial(t, addr)
+	c.sendWithReceipt(newFrame(SUBSCRIBE, hdrID, "0", hdrDestination, "jobs", hdrAck, AckClient))
+
+	topic := mb.NewTopic("jobs")
+	for _, payload := range []string{"a", "b", "c"} {
+		mb.Put(mb.NewMessage(topic, []byte(payload)))
+	}
+
+	a := c.recv()
+	b := c.recv()
+	assert.Equal([]byte("a"), a.Body)
+	assert.Equal([]byte("b"), b.Body)
+
+	// Delivery of c waits for acknowledgement of a and b, cumulatively
+	c.sendWithReceipt(newFrame(ACK, hdrID, b.Get(hdrAck)))
+
+	f := c.recv()
+	assert.Equal([]byte("c"), f.Body)
+
+	c.sendWithReceipt(newFrame(NACK, hdrID, f.Get(hdrAck)))
+
+	// Rejected messages stay on the queue once, they are not queued again
+	assert.Equal(3, queueLen(mb, "jobs"))
+
+	c.send(newFrame(ACK, hdrID, a.Get(hdrAck)))
+	assert.Equal(ERROR, c.recv().Command)
+}
+
+func TestUnacknowledgedNotRequeuedOnDisconnect(t *testing.T) {
+	mb, _, addr := newTestServer(t, nil)
+
+	c, _ := dial(t, addr)
+	c.sendWithReceipt(newFrame(SUBSCRIBE, hdrID, "0", hdrDestination, "jobs", hdrAck, AckClientIndividual))
+
+	mb.Put(mb.NewMessage(mb.NewTopic("jobs"), []byte("a")))
+
+	c.recv()
+	c.sendWithReceipt(newFrame(DISCONNECT))
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, 1, queueLen(mb, "jobs"))
+}
+
+// queueLen returns the number of messages on the queue of topic
+func queueLen(mb *msgbus.MessageBus, topic string) int {
+	for _, ts := range mb.Snapshot() {
+		if ts.Topic.Name == topic {
+			return len(ts.Messages)
+		}
+	}
+	return 0
+}
+
+func TestSendInvalid(t *testing.T) {
+	_, _, addr := newTestServer(t, nil)
+
+	c, _ := dial(t, addr)
+	c.send(newFrame(BEGIN, hdrTransaction, "tx1", hdrReceipt, "1"))
+
+	f := c.recv()
+	assert.Equal(t, ERROR, f.Command)
+	assert.Equal(t, "1", f.Get(hdrReceiptID))
+}
+
+func TestWebsocket(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := msgbus.New(nil)
+	s := NewServer(mb, nil)
+	mb.HandleSubprotocol(Subprotocol, s.ServeWebsocket)
+
+	ts := httptest.NewServer(mb)
+	defer ts.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{"v10.stomp", Subprotocol}}
+	ws, res, err := dialer.Dial(strings.Replace(ts.URL, "http", "ws", 1)+"/", nil)
+	require.NoError(t, err)
+	defer ws.Close()
+	assert.Equal(Subprotocol, res.Header.Get("Sec-Websocket-Protocol"))
+
+	c, f := connect(t, &wsTransport{Conn: ws})
+	assert.Equal(CONNECTED, f.Command)
+
+	c.sendWithReceipt(newFrame(SUBSCRIBE, hdrID, "sub-0", hdrDestination, "/foo"))
+
+	send := newFrame(SEND, hdrDestination, "/foo")
+	send.Body = []byte("bar")
+	c.send(send)
+
+	f = c.recv()
+	assert.Equal(MESSAGE, f.Command)
+	assert.Equal([]byte("bar"), f.Body)
+}
@@ -0,0 +1,551 @@
+// Package tcp implements a simple line protocol to a msgbus.MessageBus
+// over TCP for producers and consumers where the overhead of HTTP matters,
+// and for use with tools like nc.
+//
+// Commands are lines terminated by CRLF (or LF), their replies start with
+// "+" or "-" and are sent in order, so commands may be pipelined:
+//
+//	PUB <topic> <length>\r\n<payload>\r\n  +OK <id>
+//	PULL <topic>\r\n                       +MSG <topic> <id> <length>\r\n<payload>\r\n
+//	                                       +EMPTY
+//	SUB <topic|pattern>\r\n                +OK
+//	UNSUB <topic|pattern>\r\n              +OK
+//	AUTH <token>\r\n                       +OK
+//	AUTH <username> <password>\r\n         +OK
+//	PING\r\n                               +PONG
+//	QUIT\r\n                               +OK
+//
+// Errors are replied as "-ERR <message>". Messages of subscriptions are
+// pushed between replies as "MSG <topic> <id> <length>\r\n<payload>\r\n".
+// The CRLF after the payload of PUB is optional, empty lines are ignored.
+package tcp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prologic/msgbus"
+)
+
+const (
+	// MaxLineLength is the maximum length of a command line
+	MaxLineLength = 4096
+
+	// Time allowed to write to the peer.
+	writeWait = 10 * time.Second
+
+	// subscriberPrefix prefixes the bus subscriber id of a connection
+	subscriberPrefix = "tcp:"
+)
+
+var (
+	// ErrServerClosed is returned by Serve after Close is called
+	ErrServerClosed = errors.New("tcp: server closed")
+
+	// ErrLineTooLong is returned when reading a line longer than
+	// MaxLineLength
+	ErrLineTooLong = errors.New("tcp: line too long")
+
+	crlf = []byte("\r\n")
+)
+
+// Options ...
+type Options struct {
+	// Authenticate validates the credentials given with AUTH and returns
+	// the identity of the client, a single argument is passed as the
+	// password. If set clients must authenticate before any command other
+	// than AUTH, PING and QUIT.
+	Authenticate func(username, password string) (identity string, ok bool)
+}
+
+// Server is a line protocol server publishing to and subscribing from a bus
+type Server struct {
+	sync.Mutex
+
+	bus *msgbus.MessageBus
+
+	authenticate func(username, password string) (string, bool)
+
+	listeners map[net.Listener]bool
+	conns     map[*conn]bool
+	nextID    uint64
+	closed    bool
+}
+
+// NewServer ...
+func NewServer(bus *msgbus.MessageBus, options *Options) *Server {
+	s := &Server{
+		bus: bus,
+
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[*conn]bool),
+	}
+
+	if options != nil {
+		s.authenticate = options.Authenticate
+	}
+
+	return s
+}
+
+// ListenAndServe listens on the TCP address addr and serves clients
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts and serves clients on l until Close is called
+func (s *Server) Serve(l net.Listener) error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = true
+	s.Unlock()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.Lock()
+			closed := s.closed
+			delete(s.listeners, l)
+			s.Unlock()
+
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s.Lock()
+		s.nextID++
+		c := newConn(s, nc, s.nextID)
+		s.conns[c] = true
+		s.Unlock()
+
+		go func() {
+			c.serve()
+
+			s.Lock()
+			delete(s.conns, c)
+			s.Unlock()
+		}()
+	}
+}
+
+// Close stops all listeners and closes all connections
+func (s *Server) Close() error {
+	s.Lock()
+	s.closed = true
+	listeners := s.listeners
+	conns := s.conns
+	s.listeners = make(map[net.Listener]bool)
+	s.conns = make(map[*conn]bool)
+	s.Unlock()
+
+	for l := range listeners {
+		l.Close()
+	}
+	for c := range conns {
+		c.close()
+	}
+
+	return nil
+}
+
+// conn is a client connection
+type conn struct {
+	sync.Mutex
+
+	server  *Server
+	netConn net.Conn
+	r       *bufio.Reader
+	ctx     context.Context
+	id      string
+
+	authenticated bool
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	subs map[string]chan msgbus.Message
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newConn(s *Server, nc net.Conn, id uint64) *conn {
+	return &conn{
+		server:  s,
+		netConn: nc,
+		r:       bufio.NewReader(nc),
+		w:       bufio.NewWriter(nc),
+		ctx:     msgbus.WithRemoteAddr(context.Background(), nc.RemoteAddr().String()),
+		id:      subscriberPrefix + strconv.FormatUint(id, 10),
+
+		authenticated: s.authenticate == nil,
+
+		subs: make(map[string]chan msgbus.Message),
+		done: make(chan struct{}),
+	}
+}
+
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.netConn.Close()
+	})
+}
+
+// reply writes a reply, replies are buffered and flushed once no further
+// pipelined commands are buffered
+func (c *conn) reply(format string, args ...interface{}) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.netConn.SetWriteDeadline(time.Now().Add(writeWait))
+	fmt.Fprintf(c.w, format, args...)
+	_, err := c.w.Write(crlf)
+	return err
+}
+
+// writeMessage writes message prefixed with prefix, e.g: "MSG" or "+MSG"
+func (c *conn) writeMessage(prefix string, message msgbus.Message, flush bool) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.netConn.SetWriteDeadline(time.Now().Add(writeWait))
+	fmt.Fprintf(c.w, "%s %s %d %d\r\n", prefix, message.Topic.Name, message.ID, len(message.Payload))
+	c.w.Write(message.Payload)
+	c.w.Write(crlf)
+
+	if flush {
+		return c.w.Flush()
+	}
+	return nil
+}
+
+func (c *conn) flush() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.netConn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.w.Flush()
+}
+
+func (c *conn) serve() {
+	defer func() {
+		c.unsubscribeAll()
+		c.close()
+	}()
+
+	log.Debugf("[tcp] client %s connected from %s", c.id, c.netConn.RemoteAddr())
+
+	for {
+		if c.r.Buffered() == 0 {
+			if err := c.flush(); err != nil {
+				return
+			}
+		}
+
+		line, err := readLine(c.r)
+		if err != nil {
+			if err == ErrLineTooLong {
+				c.reply("-ERR line too long")
+				c.flush()
+			}
+			if err != io.EOF {
+				log.Debugf("[tcp] error reading from %s: %s", c.id, err)
+			}
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		quit, err := c.handle(strings.ToUpper(fields[0]), fields[1:])
+		if err != nil {
+			// Replies could not be written or the stream is out of sync
+			log.Debugf("[tcp] error handling %s from %s: %s", fields[0], c.id, err)
+			c.flush()
+			return
+		}
+		if quit {
+			c.flush()
+			return
+		}
+	}
+}
+
+// handle handles a command and returns true if the client quit, errors
+// are fatal to the connection
+func (c *conn) handle(command string, args []string) (bool, error) {
+	if !c.authenticated {
+		switch command {
+		case "AUTH", "PING", "QUIT":
+		case "PUB":
+			// The payload can't be told apart from commands, we can't recover
+			c.reply("-ERR authentication required")
+			return false, errors.New("unauthenticated PUB")
+		default:
+			return false, c.reply("-ERR authentication required")
+		}
+	}
+
+	switch command {
+	case "PUB":
+		return false, c.handlePub(args)
+	case "PULL":
+		if len(args) != 1 {
+			return false, c.reply("-ERR usage: PULL <topic>")
+		}
+		return false, c.handlePull(args[0])
+	case "SUB":
+		if len(args) != 1 {
+			return false, c.reply("-ERR usage: SUB <topic>")
+		}
+		return false, c.handleSub(args[0])
+	case "UNSUB":
+		if len(args) != 1 {
+			return false, c.reply("-ERR usage: UNSUB <topic>")
+		}
+		return false, c.handleUnsub(args[0])
+	case "AUTH":
+		return false, c.handleAuth(args)
+	case "PING":
+		return false, c.reply("+PONG")
+	case "QUIT":
+		return true, c.reply("+OK")
+	default:
+		return false, c.reply("-ERR unknown command %q", command)
+	}
+}
+
+func (c *conn) handlePub(args []string) error {
+	if len(args) != 2 {
+		// The length of the payload is unknown, we can't recover
+		c.reply("-ERR usage: PUB <topic> <length>")
+		return errors.New("invalid PUB command")
+	}
+
+	topic := args[0]
+	length, err := strconv.Atoi(args[1])
+	if err != nil || length < 0 {
+		c.reply("-ERR invalid length %q", args[1])
+		return errors.New("invalid PUB length")
+	}
+
+	bus := c.server.bus
+	if max := bus.TopicOptions(topic).MaxPayloadSize; length > max {
+		bus.Audit(c.ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditPublish, Result: msgbus.AuditRejected,
+			Topic: topic, Size: length, Detail: "payload exceeds max-payload-size",
+		})
+		if _, err := c.r.Discard(length); err != nil {
+			return err
+		}
+		return c.reply("-ERR payload exceeds max-payload-size")
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+
+	if msgbus.IsPattern(topic) {
+		return c.reply("-ERR invalid topic %q", topic)
+	}
+
+	message, _, err := bus.PutMessage(c.ctx, msgbus.Publishing{Topic: topic, Payload: payload})
+	if err != nil {
+		bus.Audit(c.ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditPublish, Result: msgbus.AuditRejected,
+			Topic: topic, Size: length, Detail: err.Error(),
+		})
+		return c.reply("-ERR %s", err)
+	}
+	bus.Audit(c.ctx, msgbus.AuditEvent{
+		Action: msgbus.AuditPublish, Result: msgbus.AuditOK,
+	}.WithMessage(message))
+
+	return c.reply("+OK %d", message.ID)
+}
+
+func (c *conn) handlePull(topic string) error {
+	bus := c.server.bus
+
+	message, ok := bus.Get(bus.NewTopic(topic))
+	if !ok {
+		bus.Audit(c.ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditPull, Result: msgbus.AuditEmpty, Topic: topic,
+		})
+		return c.reply("+EMPTY")
+	}
+
+	bus.Audit(c.ctx, msgbus.AuditEvent{
+		Action: msgbus.AuditPull, Result: msgbus.AuditOK,
+	}.WithMessage(message))
+
+	return c.writeMessage("+MSG", message, false)
+}
+
+func (c *conn) handleSub(topic string) error {
+	if !msgbus.ValidPattern(topic) {
+		return c.reply("-ERR invalid topic %q", topic)
+	}
+
+	c.Lock()
+	_, ok := c.subs[topic]
+	if !ok {
+		var ch chan msgbus.Message
+		if msgbus.IsPattern(topic) {
+			ch = c.server.bus.SubscribePattern(c.id, topic)
+		} else {
+			ch = c.server.bus.Subscribe(c.id, topic)
+		}
+		c.subs[topic] = ch
+		go c.forward(ch)
+	}
+	c.Unlock()
+
+	if !ok {
+		c.server.bus.Audit(c.ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditSubscribe, Result: msgbus.AuditOK, Topic: topic,
+		})
+	}
+
+	return c.reply("+OK")
+}
+
+func (c *conn) handleUnsub(topic string) error {
+	c.Lock()
+	_, ok := c.subs[topic]
+	if ok {
+		c.unsubscribe(topic)
+	}
+	c.Unlock()
+
+	if ok {
+		c.server.bus.Audit(c.ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditUnsubscribe, Result: msgbus.AuditOK, Topic: topic,
+		})
+	}
+
+	return c.reply("+OK")
+}
+
+// unsubscribe removes the subscription to topic from the bus, the caller
+// must hold the connection lock
+func (c *conn) unsubscribe(topic string) {
+	delete(c.subs, topic)
+
+	if msgbus.IsPattern(topic) {
+		c.server.bus.UnsubscribePattern(c.id, topic)
+	} else {
+		c.server.bus.Unsubscribe(c.id, topic)
+	}
+}
+
+func (c *conn) unsubscribeAll() {
+	c.Lock()
+	topics := make([]string, 0, len(c.subs))
+	for topic := range c.subs {
+		c.unsubscribe(topic)
+		topics = append(topics, topic)
+	}
+	c.Unlock()
+
+	for _, topic := range topics {
+		c.server.bus.Audit(c.ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditUnsubscribe, Result: msgbus.AuditOK, Topic: topic,
+		})
+	}
+}
+
+func (c *conn) handleAuth(args []string) error {
+	var username, password string
+	switch len(args) {
+	case 1:
+		password = args[0]
+	case 2:
+		username, password = args[0], args[1]
+	default:
+		return c.reply("-ERR usage: AUTH [<username>] <password>")
+	}
+
+	if c.server.authenticate == nil {
+		return c.reply("+OK")
+	}
+
+	identity, ok := c.server.authenticate(username, password)
+	if !ok {
+		c.server.bus.Audit(c.ctx, msgbus.AuditEvent{
+			Action: msgbus.AuditAuth,
+			Result: msgbus.AuditDenied,
+			Detail: "tcp auth",
+		})
+		return c.reply("-ERR invalid credentials")
+	}
+
+	c.Lock()
+	c.authenticated = true
+	c.ctx = msgbus.WithIdentity(c.ctx, identity)
+	c.Unlock()
+
+	return c.reply("+OK")
+}
+
+// forward pushes messages of a subscription until the connection is closed
+// or the subscription removed
+func (c *conn) forward(ch chan msgbus.Message) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case message, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := c.writeMessage("MSG", message, true); err != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+// readLine reads a line terminated by LF or CRLF of at most MaxLineLength
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > MaxLineLength {
+			return "", ErrLineTooLong
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/prologic/msgbus"
+)
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newTestServer(t *testing.T, options *Options) (*msgbus.MessageBus, string) {
+	mb := msgbus.New(nil)
+	s := NewServer(mb, options)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	return mb, l.Addr().String()
+}
+
+func dial(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *testClient) send(s string) {
+	_, err := io.WriteString(c.conn, s)
+	require.NoError(c.t, err)
+}
+
+func (c *testClient) line() string {
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := readLine(c.r)
+	require.NoError(c.t, err)
+	return line
+}
+
+func (c *testClient) payload(n int) string {
+	buf := make([]byte, n+2)
+	_, err := io.ReadFull(c.r, buf)
+	require.NoError(c.t, err)
+	return string(buf[:n])
+}
+
+func TestPubPull(t *testing.T) {
+	assert := assert.New(t)
+
+	mb, addr := newTestServer(t, nil)
+
+	c := dial(t, addr)
+
+	// Commands are pipelined, the CRLF after payloads is optional
+	c.send("PUB foo 5\r\nhello\r\nPUB foo 12\nhello\r\nworld\npull foo\r\nPULL foo\r\nPULL foo\r\nPING\r\n")
+
+	assert.Equal("+OK 0", c.line())
+	assert.Equal("+OK 1", c.line())
+	assert.Equal("+MSG foo 0 5", c.line())
+	assert.Equal("hello", c.payload(5))
+	assert.Equal("+MSG foo 1 12", c.line())
+	assert.Equal("hello\r\nworld", c.payload(12))
+	assert.Equal("+EMPTY", c.line())
+	assert.Equal("+PONG", c.line())
+
+	c.send("PUB bar 3\r\nbaz")
+	assert.Equal("+OK 0", c.line())
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/bar", nil)
+	mb.ServeHTTP(w, r)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `"payload":"YmF6"`)
+
+	c.send("FOO\r\nPULL\r\nQUIT\r\n")
+	assert.Equal(`-ERR unknown command "FOO"`, c.line())
+	assert.Equal("-ERR usage: PULL <topic>", c.line())
+	assert.Equal("+OK", c.line())
+
+	_, err := c.r.ReadByte()
+	assert.Equal(io.EOF, err)
+}
+
+func TestPubTooLarge(t *testing.T) {
+	mb := msgbus.New(&msgbus.Options{MaxPayloadSize: 4})
+	s := NewServer(mb, nil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l)
+	defer s.Close()
+
+	c := dial(t, l.Addr().String())
+	c.send("PUB foo 5\r\nhello\r\nPUB foo 4\r\nhell\r\n")
+
+	assert.Equal(t, "-ERR payload exceeds max-payload-size", c.line())
+	assert.Equal(t, "+OK 0", c.line())
+}
+
+func TestPubCompacted(t *testing.T) {
+	mb := msgbus.New(&msgbus.Options{
+		MaxPayloadSize: msgbus.DefaultMaxPayloadSize,
+		Topics:         map[string]msgbus.TopicOptions{"devices": {Compacted: true}},
+	})
+	s := NewServer(mb, nil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l)
+	defer s.Close()
+
+	c := dial(t, l.Addr().String())
+	c.send("PUB devices 2\r\non\r\nPING\r\n")
+
+	assert.Equal(t, "-ERR compacted topics require a key", c.line())
+	assert.Equal(t, "+PONG", c.line())
+}
+
+func TestSub(t *testing.T) {
+	assert := assert.New(t)
+
+	mb, addr := newTestServer(t, nil)
+
+	sub := dial(t, addr)
+	sub.send("SUB sensors/+\r\n")
+	assert.Equal("+OK", sub.line())
+
+	pub := dial(t, addr)
+	pub.send("PUB sensors/kitchen 2\r\n21\r\n")
+	assert.Equal("+OK 0", pub.line())
+
+	assert.Equal("MSG sensors/kitchen 0 2", sub.line())
+	assert.Equal("21", sub.payload(2))
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("PUT", "/sensors/garage", bytes.NewBufferString("12"))
+	mb.ServeHTTP(w, r)
+
+	assert.Equal("MSG sensors/garage 0 2", sub.line())
+	assert.Equal("12", sub.payload(2))
+
+	sub.send("UNSUB sensors/+\r\nPING\r\n")
+	assert.Equal("+OK", sub.line())
+	assert.Equal("+PONG", sub.line())
+}
+
+func TestAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	_, addr := newTestServer(t, &Options{
+		Authenticate: func(username, password string) (string, bool) {
+			return "ci", username == "" && password == "s3cr3t"
+		},
+	})
+
+	c := dial(t, addr)
+	c.send("PULL foo\r\nAUTH wrong\r\nAUTH s3cr3t\r\nPULL foo\r\n")
+	assert.Equal("-ERR authentication required", c.line())
+	assert.Equal("-ERR invalid credentials", c.line())
+	assert.Equal("+OK", c.line())
+	assert.Equal("+EMPTY", c.line())
+
+	c = dial(t, addr)
+	c.send("PUB foo 3\r\nbar\r\n")
+	assert.Equal("-ERR authentication required", c.line())
+	_, err := c.r.ReadByte()
+	assert.Equal(io.EOF, err)
+}
@@ -0,0 +1,94 @@
+package msgbus
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of spans created by the bus
+const tracerName = "github.com/prologic/msgbus"
+
+// propagator propagates W3C trace context (traceparent and tracestate)
+// in HTTP and message headers.
+var propagator = propagation.TraceContext{}
+
+// ExtractContext returns a copy of ctx with the trace context propagated
+// in the headers of message, if any.
+func ExtractContext(ctx context.Context, message *Message) context.Context {
+	if len(message.Headers) == 0 {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier(message.Headers))
+}
+
+// InjectContext stores the trace context of ctx in the headers of message.
+// The headers are copied first as they may be shared with other copies of
+// the message.
+func InjectContext(ctx context.Context, message *Message) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+
+	headers := make(map[string]string, len(message.Headers)+2)
+	for k, v := range message.Headers {
+		headers[k] = v
+	}
+	propagator.Inject(ctx, propagation.MapCarrier(headers))
+
+	message.Headers = headers
+}
+
+// messageAttributes returns the span attributes describing message
+func messageAttributes(message Message) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("messaging.system", "msgbus"),
+		attribute.String("messaging.destination.name", message.Topic.Name),
+		attribute.String("messaging.message.id", fmt.Sprintf("%d", message.ID)),
+		attribute.Int("messaging.message.body.size", len(message.Payload)),
+	}
+}
+
+// traceDelivery records the time message spent queued and starts a
+// delivery span over the given transport ("websocket" or "pull"). The
+// returned message carries the context of the delivery span so consumers
+// can continue the trace, the caller must end the span.
+func (mb *MessageBus) traceDelivery(ctx context.Context, message Message, transport string, links ...trace.Link) (Message, trace.Span) {
+	parent := ExtractContext(ctx, &message)
+	attrs := messageAttributes(message)
+
+	if !message.Created.IsZero() {
+		_, wait := mb.tracer.Start(
+			parent, "msgbus.queue",
+			trace.WithTimestamp(message.Created),
+			trace.WithAttributes(attrs...),
+		)
+		wait.End(trace.WithTimestamp(time.Now()))
+	}
+
+	ctx, span := mb.tracer.Start(
+		parent, "msgbus.deliver",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attrs...),
+		trace.WithAttributes(attribute.String("msgbus.transport", transport)),
+		trace.WithLinks(links...),
+	)
+
+	InjectContext(ctx, &message)
+
+	return message, span
+}
+
+// endSpan ends span recording err, if any
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
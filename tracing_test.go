@@ -0,0 +1,131 @@
+package msgbus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func newTracedBus() (*MessageBus, *tracetest.SpanRecorder) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	return New(&Options{
+		MaxPayloadSize: DefaultMaxPayloadSize,
+		TracerProvider: tp,
+	}), sr
+}
+
+func spanNames(sr *tracetest.SpanRecorder) []string {
+	var names []string
+	for _, span := range sr.Ended() {
+		names = append(names, span.Name())
+	}
+	return names
+}
+
+func TestInjectExtractContext(t *testing.T) {
+	assert := assert.New(t)
+
+	msg := Message{Headers: map[string]string{"traceparent": testTraceparent}}
+	ctx := ExtractContext(context.Background(), &msg)
+	sc := trace.SpanContextFromContext(ctx)
+	assert.True(sc.IsValid())
+	assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID().String())
+
+	headers := msg.Headers
+	copied := Message{Headers: headers}
+	InjectContext(ctx, &copied)
+	assert.Equal(testTraceparent, copied.Headers["traceparent"])
+
+	empty := Message{}
+	InjectContext(context.Background(), &empty)
+	assert.Nil(empty.Headers)
+}
+
+func TestTracingPutPull(t *testing.T) {
+	assert := assert.New(t)
+
+	mb, sr := newTracedBus()
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("PUT", "/hello", bytes.NewBufferString("hello world"))
+	r.Header.Set("traceparent", testTraceparent)
+	mb.ServeHTTP(w, r)
+	assert.Equal(http.StatusAccepted, w.Code)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/hello", nil)
+	mb.ServeHTTP(w, r)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Header().Get("traceparent"), "4bf92f3577b34da6a3ce929d0e0e4736")
+
+	var msg *Message
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &msg))
+	assert.Contains(msg.Headers["traceparent"], "4bf92f3577b34da6a3ce929d0e0e4736")
+
+	assert.Equal([]string{"msgbus.put", "msgbus.queue", "msgbus.deliver"}, spanNames(sr))
+	for _, span := range sr.Ended() {
+		assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String())
+	}
+
+	put, deliver := sr.Ended()[0], sr.Ended()[2]
+	assert.Equal(trace.SpanKindProducer, put.SpanKind())
+	assert.Equal(put.SpanContext().SpanID(), deliver.Parent().SpanID())
+	assert.Contains(msg.Headers["traceparent"], deliver.SpanContext().SpanID().String())
+}
+
+func TestTracingSubscriber(t *testing.T) {
+	assert := assert.New(t)
+
+	mb, sr := newTracedBus()
+
+	s := httptest.NewServer(mb)
+	defer s.Close()
+
+	u := fmt.Sprintf("ws%s/hello", strings.TrimPrefix(s.URL, "http"))
+	ws, _, err := websocket.DefaultDialer.Dial(u, nil)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	topic := mb.NewTopic("hello")
+
+	// wait for the subscription to be registered
+	for {
+		mb.RLock()
+		ls, ok := mb.listeners[topic]
+		mb.RUnlock()
+		if ok && ls.Length() > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	mb.Put(Message{
+		Topic:   topic,
+		Payload: []byte("hello world"),
+		Headers: map[string]string{"traceparent": testTraceparent},
+	})
+
+	var msg *Message
+	require.NoError(t, ws.ReadJSON(&msg))
+
+	ctx := ExtractContext(context.Background(), msg)
+	sc := trace.SpanContextFromContext(ctx)
+	assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID().String())
+	assert.Contains(spanNames(sr), "msgbus.put")
+}
@@ -0,0 +1,77 @@
+package msgbus
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// TransactionPath is the path of transactions publishing messages to
+// several topics atomically, whose messages each name their topic
+const TransactionPath = "/_transaction"
+
+// TransactionError is returned when a transaction is aborted because one of
+// its messages cannot be published, none of its messages are then published
+type TransactionError struct {
+	// Index is the index of the message in the transaction
+	Index int
+	Err   error
+}
+
+func (e *TransactionError) Error() string {
+	return fmt.Sprintf("transaction aborted: message %d: %s", e.Index, e.Err)
+}
+
+// Unwrap returns the reason the message cannot be published
+func (e *TransactionError) Unwrap() error {
+	return e.Err
+}
+
+// PutTransaction puts messages on the bus atomically: either all messages
+// are put and published or, if any message cannot be published, none are
+// and a *TransactionError is returned. The messages are put holding the bus
+// lock like PutBatch, so no other publish is seen in between and the
+// messages of each topic are assigned contiguous sequences. Messages whose
+// idempotency key was already published are not put again, so a retried
+// transaction is not published twice.
+func (mb *MessageBus) PutTransaction(ctx context.Context, messages []Publishing) ([]BatchResult, error) {
+	mb.Lock()
+	defer mb.Unlock()
+
+	for i, m := range messages {
+		if err := mb.validate(m); err != nil {
+			return nil, &TransactionError{Index: i, Err: err}
+		}
+	}
+
+	results := make([]BatchResult, len(messages))
+	for i, m := range messages {
+		results[i] = mb.putBatchMessage(ctx, m)
+	}
+	return results, nil
+}
+
+// serveTransaction publishes the messages of a transaction to the topics
+// named by the messages, all of them or none
+func (mb *MessageBus) serveTransaction(w http.ResponseWriter, r *http.Request) {
+	ctx := WithRemoteAddr(r.Context(), r.RemoteAddr)
+
+	messages, err := mb.ReadBatch(r.Body, "")
+	if err != nil {
+		mb.Audit(ctx, AuditEvent{Action: AuditPublish, Result: AuditRejected, Detail: err.Error()})
+		http.Error(w, err.Error(), BatchStatus(err))
+		return
+	}
+
+	results, err := mb.PutTransaction(propagator.Extract(ctx, propagation.HeaderCarrier(r.Header)), messages)
+	if err != nil {
+		mb.Audit(ctx, AuditEvent{Action: AuditPublish, Result: AuditRejected, Detail: err.Error()})
+		http.Error(w, err.Error(), BatchStatus(err))
+		return
+	}
+	mb.AuditBatch(ctx, messages, results)
+
+	WriteBatchResults(w, results)
+}
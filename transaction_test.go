@@ -0,0 +1,99 @@
+package msgbus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPutTransaction(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := New(&Options{
+		BufferLength:   DefaultBufferLength,
+		MaxQueueSize:   DefaultMaxQueueSize,
+		MaxPayloadSize: 4,
+	})
+	orders := mb.Subscribe("a", "orders.created")
+	defer mb.Unsubscribe("a", "orders.created")
+
+	// A transaction with a message that cannot be published puts none
+	_, err := mb.PutTransaction(context.Background(), []Publishing{
+		{Topic: "orders.created", Payload: []byte("1")},
+		{Topic: "audit.orders", Payload: []byte("toolarge")},
+	})
+	var txErr *TransactionError
+	if assert.ErrorAs(err, &txErr) {
+		assert.Equal(1, txErr.Index)
+	}
+	_, ok := mb.Get(mb.NewTopic("orders.created"))
+	assert.False(ok)
+	assert.Empty(orders)
+
+	tx := []Publishing{
+		{Topic: "orders.created", Payload: []byte("1"), IdempotencyKey: "a"},
+		{Topic: "audit.orders", Payload: []byte("1"), IdempotencyKey: "b"},
+		{Topic: "orders.created", Payload: []byte("2"), IdempotencyKey: "c"},
+	}
+	results, err := mb.PutTransaction(context.Background(), tx)
+	require.NoError(t, err)
+	if assert.Len(results, 3) {
+		assert.Equal(uint64(0), results[0].ID)
+		assert.Equal(1, results[0].Delivered)
+		assert.Equal(uint64(0), results[1].ID)
+		assert.Equal(uint64(1), results[2].ID)
+	}
+	assert.Equal("1", string((<-orders).Payload))
+	assert.Equal("2", string((<-orders).Payload))
+
+	// A retried transaction is not published twice
+	results, err = mb.PutTransaction(context.Background(), tx)
+	require.NoError(t, err)
+	for _, result := range results {
+		assert.True(result.Duplicate)
+	}
+	assert.Empty(orders)
+
+	_, ok = mb.Get(mb.NewTopic("audit.orders"))
+	assert.True(ok)
+	_, ok = mb.Get(mb.NewTopic("audit.orders"))
+	assert.False(ok)
+}
+
+func TestServeHTTPTransaction(t *testing.T) {
+	assert := assert.New(t)
+
+	mb := New(nil)
+
+	transaction := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", TransactionPath, bytes.NewBufferString(body))
+		mb.ServeHTTP(w, r)
+		return w
+	}
+
+	w := transaction(`[{"topic": "foo", "payload": "YQ=="}, {"topic": "bar", "payload": "Yg=="}]`)
+	assert.Equal(http.StatusAccepted, w.Code)
+	var results []BatchResult
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &results))
+	if assert.Len(results, 2) {
+		assert.Equal("foo", results[0].Topic)
+		assert.Equal("bar", results[1].Topic)
+	}
+
+	w = transaction(`[{"topic": "foo", "payload": "Yw=="}, {"payload": "ZA=="}]`)
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Contains(w.Body.String(), "message 1: topic required")
+
+	message, ok := mb.Get(mb.NewTopic("foo"))
+	assert.True(ok)
+	assert.Equal("a", string(message.Payload))
+	_, ok = mb.Get(mb.NewTopic("foo"))
+	assert.False(ok)
+}
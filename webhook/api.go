@@ -0,0 +1,98 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/prologic/msgbus"
+)
+
+// ServeHTTP serves the API managing subscriptions, paths are relative to
+// where the Manager is mounted:
+//
+//	GET    /             lists subscriptions
+//	POST   /             adds the subscription in the JSON body
+//	GET    /<id>         returns a subscription
+//	DELETE /<id>         removes a subscription
+//	POST   /<id>/enable  resumes delivery of a disabled subscription
+//
+// Secrets are never returned.
+func (m *Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := msgbus.WithRemoteAddr(r.Context(), r.RemoteAddr)
+	path := strings.Trim(r.URL.Path, "/")
+
+	switch {
+	case path == "" && r.Method == "GET":
+		subs := m.List()
+		for i := range subs {
+			subs[i].Secret = ""
+		}
+		writeJSON(w, http.StatusOK, subs)
+	case path == "" && r.Method == "POST":
+		var sub Subscription
+		if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+			http.Error(w, "invalid subscription: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		sub, err := m.Add(sub)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.audit(ctx, "add subscription "+sub.ID+" of "+sub.Topic+" to "+sub.URL)
+
+		sub.Secret = ""
+		writeJSON(w, http.StatusCreated, sub)
+	case strings.HasSuffix(path, "/enable") && r.Method == "POST":
+		id := strings.TrimSuffix(path, "/enable")
+		sub, err := m.Enable(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		m.audit(ctx, "enable subscription "+id)
+
+		sub.Secret = ""
+		writeJSON(w, http.StatusOK, sub)
+	case !strings.Contains(path, "/") && r.Method == "GET":
+		sub, ok := m.Get(path)
+		if !ok {
+			http.Error(w, ErrNotFound.Error(), http.StatusNotFound)
+			return
+		}
+
+		sub.Secret = ""
+		writeJSON(w, http.StatusOK, sub)
+	case !strings.Contains(path, "/") && r.Method == "DELETE":
+		if err := m.Remove(path); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		m.audit(ctx, "remove subscription "+path)
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Not Found", http.StatusNotFound)
+	}
+}
+
+func (m *Manager) audit(ctx context.Context, detail string) {
+	m.bus.Audit(ctx, msgbus.AuditEvent{
+		Action: msgbus.AuditAdmin, Result: msgbus.AuditOK, Detail: "webhook: " + detail,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
@@ -0,0 +1,643 @@
+// Package webhook implements push subscriptions delivering the messages of
+// a topic of a msgbus.MessageBus to a URL.
+//
+// Every message is POSTed to the URL of the subscription with the payload
+// as body, along with the headers of the message, the headers of the
+// subscription and:
+//
+//	X-Msgbus-Topic:      the topic of the message
+//	X-Msgbus-Message-Id: the id of the message
+//	X-Msgbus-Delivery:   a unique id of the delivery, the same for retries
+//	X-Msgbus-Signature:  sha256=<hex HMAC-SHA256 of the body> if the
+//	                     subscription has a secret
+//
+// A delivery succeeds with any 2xx response. Failed deliveries are retried
+// with exponential backoff, except on client errors other than 408 and
+// 429. A subscription is disabled once deliveries of several consecutive
+// messages failed and must be enabled again to resume.
+//
+// Messages are queued per subscription while they are delivered, once the
+// queue of a subscription is full newly published messages are dropped,
+// logged and counted by the Dropped field of the subscription and the
+// webhook_dropped metric.
+//
+// Subscriptions are held in memory only, those added with the API are
+// lost when the Manager is closed and must be added again.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jpillora/backoff"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prologic/msgbus"
+)
+
+const (
+	// DefaultMaxAttempts is the default number of attempts to deliver a
+	// message
+	DefaultMaxAttempts = 5
+
+	// DefaultMaxFailures is the default number of consecutive messages
+	// that failed to be delivered before a subscription is disabled
+	DefaultMaxFailures = 10
+
+	// DefaultMaxConcurrency is the default number of concurrent deliveries
+	// of a subscription, messages are delivered in order when it is 1
+	DefaultMaxConcurrency = 1
+
+	// DefaultMaxQueueLength is the default number of messages queued for
+	// delivery by a subscription before messages are dropped
+	DefaultMaxQueueLength = 1000
+
+	// DefaultMinBackoff is the default delay before the first retry
+	DefaultMinBackoff = time.Second
+
+	// DefaultMaxBackoff is the default maximum delay between retries
+	DefaultMaxBackoff = time.Minute
+
+	// DefaultTimeout is the default timeout of a delivery
+	DefaultTimeout = 30 * time.Second
+
+	// subscriberPrefix prefixes the bus subscriber id of a subscription
+	subscriberPrefix = "webhook:"
+)
+
+// Delivery headers
+const (
+	HeaderTopic     = "X-Msgbus-Topic"
+	HeaderMessageID = "X-Msgbus-Message-Id"
+	HeaderDelivery  = "X-Msgbus-Delivery"
+	HeaderSignature = "X-Msgbus-Signature"
+)
+
+var (
+	// ErrNotFound is returned for unknown subscriptions
+	ErrNotFound = errors.New("webhook: subscription not found")
+
+	// ErrClosed is returned when adding subscriptions to a closed Manager
+	ErrClosed = errors.New("webhook: manager closed")
+)
+
+// Subscription is a push subscription to a topic, or to topics matching a
+// pattern, delivering messages to a URL
+type Subscription struct {
+	ID      string            `json:"id"`
+	Topic   string            `json:"topic"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Secret signs deliveries with HMAC-SHA256 if set
+	Secret string `json:"secret,omitempty"`
+
+	// MaxConcurrency limits the concurrent deliveries to the URL, zero
+	// uses the default of the Manager
+	MaxConcurrency int `json:"max_concurrency,omitempty"`
+
+	Created time.Time `json:"created"`
+
+	// Disabled is true once delivery failed persistently
+	Disabled bool `json:"disabled"`
+
+	// Failures counts consecutive messages that failed to be delivered
+	Failures int `json:"failures"`
+
+	// LastError is the error of the last failed delivery, if any
+	LastError string `json:"last_error,omitempty"`
+
+	// Dropped counts messages dropped because the queue was full
+	Dropped int `json:"dropped"`
+}
+
+// Validate returns an error if the subscription is invalid
+func (s Subscription) Validate() error {
+	if s.Topic == "" || !msgbus.ValidPattern(s.Topic) {
+		return fmt.Errorf("invalid topic %q", s.Topic)
+	}
+
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q", s.URL)
+	}
+
+	if s.MaxConcurrency < 0 {
+		return fmt.Errorf("invalid max concurrency %d", s.MaxConcurrency)
+	}
+
+	return nil
+}
+
+// Options ...
+type Options struct {
+	// Client is used to deliver messages, defaults to a client with a
+	// timeout of DefaultTimeout
+	Client *http.Client
+
+	// MaxAttempts is the number of attempts to deliver a message
+	MaxAttempts int
+
+	// MaxFailures is the number of consecutive messages that failed to be
+	// delivered before a subscription is disabled
+	MaxFailures int
+
+	// MaxConcurrency is the default number of concurrent deliveries of a
+	// subscription
+	MaxConcurrency int
+
+	// MaxQueueLength is the number of messages queued for delivery by a
+	// subscription before messages are dropped
+	MaxQueueLength int
+
+	// MinBackoff and MaxBackoff bound the exponential delay between
+	// attempts
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// subscription is the state of an active subscription
+type subscription struct {
+	Subscription
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	queue  chan msgbus.Message
+	wg     sync.WaitGroup
+}
+
+// Manager manages push subscriptions of a bus
+type Manager struct {
+	sync.Mutex
+
+	bus    *msgbus.MessageBus
+	client *http.Client
+
+	maxAttempts    int
+	maxFailures    int
+	maxConcurrency int
+	maxQueueLength int
+	minBackoff     time.Duration
+	maxBackoff     time.Duration
+
+	subscriptions map[string]*subscription
+	closed        bool
+}
+
+// NewManager ...
+func NewManager(bus *msgbus.MessageBus, options *Options) *Manager {
+	m := &Manager{
+		bus:    bus,
+		client: &http.Client{Timeout: DefaultTimeout},
+
+		maxAttempts:    DefaultMaxAttempts,
+		maxFailures:    DefaultMaxFailures,
+		maxConcurrency: DefaultMaxConcurrency,
+		maxQueueLength: DefaultMaxQueueLength,
+		minBackoff:     DefaultMinBackoff,
+		maxBackoff:     DefaultMaxBackoff,
+
+		subscriptions: make(map[string]*subscription),
+	}
+
+	if options != nil {
+		if options.Client != nil {
+			m.client = options.Client
+		}
+		if options.MaxAttempts > 0 {
+			m.maxAttempts = options.MaxAttempts
+		}
+		if options.MaxFailures > 0 {
+			m.maxFailures = options.MaxFailures
+		}
+		if options.MaxConcurrency > 0 {
+			m.maxConcurrency = options.MaxConcurrency
+		}
+		if options.MaxQueueLength > 0 {
+			m.maxQueueLength = options.MaxQueueLength
+		}
+		if options.MinBackoff > 0 {
+			m.minBackoff = options.MinBackoff
+		}
+		if options.MaxBackoff > 0 {
+			m.maxBackoff = options.MaxBackoff
+		}
+	}
+
+	if metrics := bus.Metrics(); metrics != nil {
+		metrics.NewCounterVec(
+			"webhook", "deliveries",
+			"Number of webhook delivery attempts by result",
+			[]string{"result"},
+		)
+		metrics.NewGaugeFunc(
+			"webhook", "subscriptions",
+			"Number of webhook subscriptions",
+			func() float64 {
+				m.Lock()
+				defer m.Unlock()
+				return float64(len(m.subscriptions))
+			},
+		)
+		metrics.NewGaugeFunc(
+			"webhook", "queued",
+			"Number of messages queued for webhook delivery",
+			func() float64 {
+				m.Lock()
+				defer m.Unlock()
+				n := 0
+				for _, s := range m.subscriptions {
+					n += len(s.queue)
+				}
+				return float64(n)
+			},
+		)
+		metrics.NewCounter(
+			"webhook", "dropped",
+			"Number of messages dropped because a webhook queue was full",
+		)
+	}
+
+	return m
+}
+
+// Add registers a subscription and starts delivering messages published
+// from now on, an id is generated if none is given. The subscription as
+// added is returned.
+func (m *Manager) Add(sub Subscription) (Subscription, error) {
+	if err := sub.Validate(); err != nil {
+		return Subscription{}, err
+	}
+
+	if sub.ID == "" {
+		sub.ID = newID()
+	}
+	sub.Created = time.Now()
+	sub.Failures = 0
+	sub.LastError = ""
+
+	m.Lock()
+	defer m.Unlock()
+
+	if m.closed {
+		return Subscription{}, ErrClosed
+	}
+	if _, ok := m.subscriptions[sub.ID]; ok {
+		return Subscription{}, fmt.Errorf("subscription %s already exists", sub.ID)
+	}
+
+	s := &subscription{Subscription: sub}
+	m.subscriptions[sub.ID] = s
+	if !s.Disabled {
+		m.start(s)
+	}
+
+	log.Infof("[webhook] added subscription %s of %s to %s", sub.ID, sub.Topic, sub.URL)
+
+	return s.Subscription, nil
+}
+
+// Remove stops and removes a subscription, waiting for deliveries in
+// progress to be cancelled
+func (m *Manager) Remove(id string) error {
+	m.Lock()
+	s, ok := m.subscriptions[id]
+	if ok {
+		delete(m.subscriptions, id)
+		m.stop(s)
+	}
+	m.Unlock()
+
+	if !ok {
+		return ErrNotFound
+	}
+
+	s.wg.Wait()
+	log.Infof("[webhook] removed subscription %s", id)
+
+	return nil
+}
+
+// Enable resumes delivery of a disabled subscription
+func (m *Manager) Enable(id string) (Subscription, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	s, ok := m.subscriptions[id]
+	if !ok {
+		return Subscription{}, ErrNotFound
+	}
+
+	if s.Disabled {
+		s.Disabled = false
+		s.Failures = 0
+		m.start(s)
+		log.Infof("[webhook] enabled subscription %s", id)
+	}
+
+	return s.Subscription, nil
+}
+
+// Get returns a subscription
+func (m *Manager) Get(id string) (Subscription, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	s, ok := m.subscriptions[id]
+	if !ok {
+		return Subscription{}, false
+	}
+	return s.Subscription, true
+}
+
+// List returns all subscriptions ordered by creation
+func (m *Manager) List() []Subscription {
+	m.Lock()
+	defer m.Unlock()
+
+	subs := make([]Subscription, 0, len(m.subscriptions))
+	for _, s := range m.subscriptions {
+		subs = append(subs, s.Subscription)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Created.Before(subs[j].Created) })
+
+	return subs
+}
+
+// Close stops all subscriptions and waits for deliveries in progress to be
+// cancelled
+func (m *Manager) Close() error {
+	m.Lock()
+	m.closed = true
+	subs := m.subscriptions
+	m.subscriptions = make(map[string]*subscription)
+	for _, s := range subs {
+		m.stop(s)
+	}
+	m.Unlock()
+
+	for _, s := range subs {
+		s.wg.Wait()
+	}
+
+	return nil
+}
+
+// start subscribes s to the bus and starts queueing its messages for its
+// workers, the caller must hold the lock
+func (m *Manager) start(s *subscription) {
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.queue = make(chan msgbus.Message, m.maxQueueLength)
+
+	var ch chan msgbus.Message
+	if msgbus.IsPattern(s.Topic) {
+		ch = m.bus.SubscribePattern(subscriberPrefix+s.ID, s.Topic)
+	} else {
+		ch = m.bus.Subscribe(subscriberPrefix+s.ID, s.Topic)
+	}
+
+	n := s.MaxConcurrency
+	if n == 0 {
+		n = m.maxConcurrency
+	}
+	s.wg.Add(1)
+	go m.enqueue(s.ctx, s, ch, s.queue)
+	for i := 0; i < n; i++ {
+		s.wg.Add(1)
+		go m.worker(s.ctx, s, s.queue)
+	}
+}
+
+// stop cancels deliveries of s and unsubscribes it from the bus, the
+// caller must hold the lock
+func (m *Manager) stop(s *subscription) {
+	if s.cancel == nil {
+		return
+	}
+	s.cancel()
+	s.cancel = nil
+
+	if msgbus.IsPattern(s.Topic) {
+		m.bus.UnsubscribePattern(subscriberPrefix+s.ID, s.Topic)
+	} else {
+		m.bus.Unsubscribe(subscriberPrefix+s.ID, s.Topic)
+	}
+}
+
+// enqueue moves the messages of s from its bus subscriber channel to its
+// queue as they are published, so the bus does not drop them while
+// deliveries are retried. Messages are dropped once the queue is full.
+func (m *Manager) enqueue(ctx context.Context, s *subscription, ch, queue chan msgbus.Message) {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message, ok := <-ch:
+			if !ok {
+				return
+			}
+			select {
+			case queue <- message:
+			default:
+				m.dropped(s, message)
+			}
+		}
+	}
+}
+
+func (m *Manager) worker(ctx context.Context, s *subscription, queue chan msgbus.Message) {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message := <-queue:
+			m.deliver(ctx, s, message)
+		}
+	}
+}
+
+// deliver delivers message retrying with backoff until it succeeds, the
+// attempts are exhausted or the subscription is stopped
+func (m *Manager) deliver(ctx context.Context, s *subscription, message msgbus.Message) {
+	b := &backoff.Backoff{
+		Min:    m.minBackoff,
+		Max:    m.maxBackoff,
+		Factor: 2,
+		Jitter: true,
+	}
+
+	delivery := fmt.Sprintf("%s:%s:%d", s.ID, message.Topic.Name, message.ID)
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = m.post(ctx, s, delivery, message)
+		if err == nil {
+			m.observe("ok")
+			m.succeeded(s)
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Warnf(
+			"[webhook] error delivering %s to %s (attempt %d/%d): %s",
+			delivery, s.URL, attempt, m.maxAttempts, err,
+		)
+
+		if permanent(err) || attempt >= m.maxAttempts {
+			break
+		}
+
+		m.observe("retry")
+
+		select {
+		case <-time.After(b.Duration()):
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	m.observe("failed")
+	m.failed(s, err)
+}
+
+// post makes a single delivery attempt of message
+func (m *Manager) post(ctx context.Context, s *subscription, delivery string, message msgbus.Message) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", s.URL, bytes.NewReader(message.Payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/octet-stream")
+	for k, v := range message.Headers {
+		req.Header.Set(k, v)
+	}
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+
+	req.Header.Set(HeaderTopic, message.Topic.Name)
+	req.Header.Set(HeaderMessageID, strconv.FormatUint(message.ID, 10))
+	req.Header.Set(HeaderDelivery, delivery)
+	if s.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign(s.Secret, message.Payload))
+	}
+
+	res, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 4096))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &StatusError{StatusCode: res.StatusCode}
+	}
+
+	return nil
+}
+
+func (m *Manager) observe(result string) {
+	if metrics := m.bus.Metrics(); metrics != nil {
+		metrics.CounterVec("webhook", "deliveries").WithLabelValues(result).Inc()
+	}
+}
+
+// dropped records a message dropped because the queue of s was full
+func (m *Manager) dropped(s *subscription, message msgbus.Message) {
+	m.Lock()
+	s.Dropped++
+	m.Unlock()
+
+	log.Warnf(
+		"[webhook] queue of subscription %s full, dropped message %d of %s",
+		s.ID, message.ID, message.Topic.Name,
+	)
+
+	if metrics := m.bus.Metrics(); metrics != nil {
+		metrics.Counter("webhook", "dropped").Inc()
+	}
+}
+
+func (m *Manager) succeeded(s *subscription) {
+	m.Lock()
+	defer m.Unlock()
+
+	s.Failures = 0
+}
+
+// failed records a message that failed to be delivered and disables the
+// subscription if delivery failed persistently
+func (m *Manager) failed(s *subscription, err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	s.Failures++
+	s.LastError = err.Error()
+
+	if s.Failures >= m.maxFailures && !s.Disabled {
+		s.Disabled = true
+		m.stop(s)
+		log.Errorf(
+			"[webhook] disabled subscription %s to %s after %d consecutive failures: %s",
+			s.ID, s.URL, s.Failures, err,
+		)
+	}
+}
+
+// StatusError is the error of a delivery answered with a non-2xx status
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// permanent returns true if retrying a delivery that failed with err is
+// pointless, i.e: the target rejected it with a client error
+func permanent(err error) bool {
+	var se *StatusError
+	if !errors.As(err, &se) {
+		return false
+	}
+	switch se.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return se.StatusCode >= 400 && se.StatusCode < 500
+}
+
+// Sign returns the value of the signature header of a delivery of payload
+// signed with secret
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// newID returns a random subscription id
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,286 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/prologic/msgbus"
+)
+
+func newTestManager(t *testing.T, options *Options) (*msgbus.MessageBus, *Manager) {
+	if options == nil {
+		options = &Options{}
+	}
+	options.MinBackoff = time.Millisecond
+	options.MaxBackoff = 5 * time.Millisecond
+
+	mb := msgbus.New(nil)
+	m := NewManager(mb, options)
+	t.Cleanup(func() { m.Close() })
+
+	return mb, m
+}
+
+func publish(mb *msgbus.MessageBus, topic, payload string) {
+	mb.Put(mb.NewMessage(mb.NewTopic(topic), []byte(payload)))
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for condition")
+}
+
+func TestDeliver(t *testing.T) {
+	assert := assert.New(t)
+
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- r
+		bodies <- body
+	}))
+	defer ts.Close()
+
+	mb, m := newTestManager(t, nil)
+
+	_, err := m.Add(Subscription{
+		Topic:   "sensors/+",
+		URL:     ts.URL + "/hook",
+		Headers: map[string]string{"X-Api-Key": "abc"},
+		Secret:  "secret",
+	})
+	require.NoError(t, err)
+
+	publish(mb, "sensors/kitchen", "21")
+
+	r := <-requests
+	body := <-bodies
+	assert.Equal("POST", r.Method)
+	assert.Equal("/hook", r.URL.Path)
+	assert.Equal([]byte("21"), body)
+	assert.Equal("abc", r.Header.Get("X-Api-Key"))
+	assert.Equal("sensors/kitchen", r.Header.Get(HeaderTopic))
+	assert.Equal("0", r.Header.Get(HeaderMessageID))
+	assert.NotEmpty(r.Header.Get(HeaderDelivery))
+	assert.Equal(Sign("secret", []byte("21")), r.Header.Get(HeaderSignature))
+}
+
+func TestRetry(t *testing.T) {
+	var attempts int32
+	delivered := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		delivered <- r.Header.Get(HeaderDelivery)
+	}))
+	defer ts.Close()
+
+	mb, m := newTestManager(t, nil)
+
+	sub, err := m.Add(Subscription{Topic: "foo", URL: ts.URL})
+	require.NoError(t, err)
+
+	publish(mb, "foo", "bar")
+
+	assert.Equal(t, sub.ID+":foo:0", <-delivered)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+
+	sub, _ = m.Get(sub.ID)
+	assert.Equal(t, 0, sub.Failures)
+	assert.False(t, sub.Disabled)
+}
+
+func TestDisableAfterFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	mb, m := newTestManager(t, &Options{MaxFailures: 2})
+
+	sub, err := m.Add(Subscription{Topic: "foo", URL: ts.URL})
+	require.NoError(t, err)
+
+	publish(mb, "foo", "a")
+	publish(mb, "foo", "b")
+
+	waitFor(t, func() bool {
+		sub, _ = m.Get(sub.ID)
+		return sub.Disabled
+	})
+	assert.Equal(2, sub.Failures)
+	assert.Contains(sub.LastError, "400")
+
+	// Client errors are not retried
+	assert.Equal(int32(2), atomic.LoadInt32(&attempts))
+
+	// Disabled subscriptions receive no further messages
+	publish(mb, "foo", "c")
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(int32(2), atomic.LoadInt32(&attempts))
+
+	sub, err = m.Enable(sub.ID)
+	require.NoError(t, err)
+	assert.False(sub.Disabled)
+
+	publish(mb, "foo", "d")
+	waitFor(t, func() bool { return atomic.LoadInt32(&attempts) == 3 })
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		active  int
+		maximum int
+	)
+	release := make(chan struct{})
+	done := make(chan struct{}, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		if active > maximum {
+			maximum = active
+		}
+		mu.Unlock()
+
+		<-release
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+		done <- struct{}{}
+	}))
+	defer ts.Close()
+
+	mb, m := newTestManager(t, nil)
+
+	_, err := m.Add(Subscription{Topic: "foo", URL: ts.URL, MaxConcurrency: 2})
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		publish(mb, "foo", "x")
+	}
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return active == 2
+	})
+	close(release)
+	for i := 0; i < 5; i++ {
+		<-done
+	}
+
+	assert.Equal(t, 2, maximum)
+}
+
+func TestQueueOverflow(t *testing.T) {
+	assert := assert.New(t)
+
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	var delivered int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		atomic.AddInt32(&delivered, 1)
+	}))
+	defer ts.Close()
+
+	mb, m := newTestManager(t, &Options{MaxQueueLength: 2})
+
+	sub, err := m.Add(Subscription{Topic: "foo", URL: ts.URL})
+	require.NoError(t, err)
+
+	publish(mb, "foo", "0")
+	<-started
+
+	// The first message is being delivered, two more are queued and the
+	// rest are dropped
+	for i := 1; i < 6; i++ {
+		publish(mb, "foo", "x")
+	}
+	waitFor(t, func() bool {
+		sub, _ := m.Get(sub.ID)
+		return sub.Dropped == 3
+	})
+
+	close(release)
+	waitFor(t, func() bool { return atomic.LoadInt32(&delivered) == 3 })
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(int32(3), atomic.LoadInt32(&delivered))
+	sub, _ = m.Get(sub.ID)
+	assert.Equal(3, sub.Dropped)
+}
+
+func TestAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	_, m := newTestManager(t, nil)
+
+	ts := httptest.NewServer(http.StripPrefix("/_webhooks", m))
+	defer ts.Close()
+
+	body := `{"topic": "foo", "url": "http://localhost:1/hook", "secret": "s3cret"}`
+	res, err := http.Post(ts.URL+"/_webhooks/", "application/json", bytes.NewBufferString(body))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(http.StatusCreated, res.StatusCode)
+
+	var sub Subscription
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&sub))
+	assert.NotEmpty(sub.ID)
+	assert.Equal("foo", sub.Topic)
+	assert.Empty(sub.Secret)
+
+	actual, ok := m.Get(sub.ID)
+	require.True(t, ok)
+	assert.Equal("s3cret", actual.Secret)
+
+	res, err = http.Get(ts.URL + "/_webhooks/")
+	require.NoError(t, err)
+	var subs []Subscription
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&subs))
+	res.Body.Close()
+	require.Len(t, subs, 1)
+	assert.Equal(sub.ID, subs[0].ID)
+
+	res, err = http.Post(ts.URL+"/_webhooks/", "application/json", bytes.NewBufferString(`{"topic": "foo", "url": "ftp://x"}`))
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(http.StatusBadRequest, res.StatusCode)
+
+	req, _ := http.NewRequest("DELETE", ts.URL+"/_webhooks/"+sub.ID, nil)
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(http.StatusNoContent, res.StatusCode)
+
+	res, err = http.Get(ts.URL + "/_webhooks/" + sub.ID)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(http.StatusNotFound, res.StatusCode)
+}